@@ -0,0 +1,485 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/yiGmMk/pz-infra-new/logging"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+	"gorm.io/plugin/dbresolver"
+)
+
+const (
+	AUDIT_TABLE = "audit_records"
+
+	AUDIT_ACTION_CREATE = "create"
+	AUDIT_ACTION_UPDATE = "update"
+	AUDIT_ACTION_DELETE = "delete"
+
+	// the value of changed fields tagged by audit:"redact"
+	AUDIT_REDACTED = "***"
+
+	DEFAULT_AUDIT_MAX_ROWS     = 1000
+	DEFAULT_AUDIT_SINK_BUFFER  = 1000
+	auditBeforeRowsInstanceKey = "audit:before_rows"
+)
+
+// Auditable is implemented by the models whose changes are audited, e.g.
+// func (User) AuditEntityType() string { return "user" }
+// Fields tagged by audit:"-" are not recorded, and the values of fields tagged by audit:"redact" are hidden.
+type Auditable interface {
+	AuditEntityType() string
+}
+
+// AuditRecord is a change of an entity
+type AuditRecord struct {
+	ID         int64     `gorm:"column:id;primaryKey" json:"id"`
+	EntityType string    `gorm:"column:entity_type;size:64;index:idx_audit_entity,priority:1" json:"entity_type"`
+	EntityID   string    `gorm:"column:entity_id;size:128;index:idx_audit_entity,priority:2" json:"entity_id"`
+	Action     string    `gorm:"column:action;size:16" json:"action"`
+	Actor      string    `gorm:"column:actor;size:128" json:"actor"`
+	RequestID  string    `gorm:"column:request_id;size:64" json:"request_id"`
+	Changes    string    `gorm:"column:changes;type:text" json:"changes"` // JSON of map[string]AuditChange
+	CreatedAt  time.Time `gorm:"column:created_at" json:"created_at"`
+}
+
+func (AuditRecord) TableName() string {
+	return AUDIT_TABLE
+}
+
+// AuditChange is the change of a field, Old is nil on create and New is nil on delete
+type AuditChange struct {
+	Old interface{} `json:"old"`
+	New interface{} `json:"new"`
+}
+
+// Diff returns the changes of the record by column
+func (r *AuditRecord) Diff() (map[string]AuditChange, error) {
+	changes := map[string]AuditChange{}
+	if r.Changes == "" {
+		return changes, nil
+	}
+	err := json.Unmarshal([]byte(r.Changes), &changes)
+	return changes, err
+}
+
+type auditActorKey struct{}
+type auditRequestIDKey struct{}
+
+// WithAuditActor returns a context with the actor recorded in the audit records of the changes made with it
+func WithAuditActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, auditActorKey{}, actor)
+}
+
+// WithAuditRequestID returns a context with the request id recorded in the audit records
+func WithAuditRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, auditRequestIDKey{}, requestID)
+}
+
+func auditActor(ctx context.Context) string {
+	actor, _ := ctx.Value(auditActorKey{}).(string)
+	return actor
+}
+
+func auditRequestID(ctx context.Context) string {
+	if requestID, ok := ctx.Value(auditRequestIDKey{}).(string); ok {
+		return requestID
+	}
+	// the request id of the logging middleware
+	requestID, _ := RequestIDFromContext(ctx)
+	return requestID
+}
+
+// AuditSink writes the audit records, db is the DB of the change, so the records can be saved in its transaction
+type AuditSink interface {
+	Write(db *gorm.DB, records []*AuditRecord) error
+}
+
+// TableAuditSink saves the records to the audit table in the transaction of the change if any
+type TableAuditSink struct{}
+
+func (TableAuditSink) Write(db *gorm.DB, records []*AuditRecord) error {
+	return db.Session(&gorm.Session{NewDB: true, SkipHooks: true}).Create(records).Error
+}
+
+// LogAuditSink writes the records to the logger
+type LogAuditSink struct{}
+
+func (LogAuditSink) Write(db *gorm.DB, records []*AuditRecord) error {
+	for _, record := range records {
+		Log.Info("Audit", With("entity", record.EntityType), With("id", record.EntityID), With("action", record.Action),
+			With("actor", record.Actor), With("requestId", record.RequestID), With("changes", record.Changes))
+	}
+	return nil
+}
+
+// AsyncAuditSink writes the records by Sink in the background after the transaction of WithTx is committed,
+// records are dropped if the buffer is full so the changes are never blocked.
+type AsyncAuditSink struct {
+	sink    AuditSink
+	dbName  string
+	records chan []*AuditRecord
+	wg      sync.WaitGroup
+	lock    sync.Mutex
+	closed  bool
+}
+
+// NewAsyncAuditSink returns an AsyncAuditSink writing by sink with the database of dbName,
+// buffer is the number of pending writes, DEFAULT_AUDIT_SINK_BUFFER if 0
+func NewAsyncAuditSink(sink AuditSink, dbName string, buffer int) *AsyncAuditSink {
+	if buffer <= 0 {
+		buffer = DEFAULT_AUDIT_SINK_BUFFER
+	}
+	s := &AsyncAuditSink{sink: sink, dbName: dbName, records: make(chan []*AuditRecord, buffer)}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for records := range s.records {
+			if err := s.sink.Write(GetDB(dbName), records); err != nil {
+				Log.Error("Failed to write audit records", With("count", len(records)), WithError(err))
+			}
+		}
+	}()
+	return s
+}
+
+func (s *AsyncAuditSink) Write(db *gorm.DB, records []*AuditRecord) error {
+	AfterCommit(db.Statement.Context, func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if s.closed {
+			Log.Warn("Audit records dropped, the sink is closed", With("count", len(records)))
+			return
+		}
+		select {
+		case s.records <- records:
+		default:
+			Log.Warn("Audit records dropped, the sink is full", With("count", len(records)))
+		}
+	}, s.dbName)
+	return nil
+}
+
+// Close writes the pending records and stops the sink, the records committed after it are dropped
+func (s *AsyncAuditSink) Close() {
+	s.lock.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.records)
+	}
+	s.lock.Unlock()
+	s.wg.Wait()
+}
+
+// AuditOption is used to set up the audit plugin
+type AuditOption struct {
+	Sink          AuditSink                        // TableAuditSink if nil
+	ActorFunc     func(ctx context.Context) string // reads the actor of WithAuditActor if nil
+	RequestIDFunc func(ctx context.Context) string // reads the request id of WithAuditRequestID or logging.WithRequestID if nil
+	MaxRows       int                              // max rows of an update or delete audited, DEFAULT_AUDIT_MAX_ROWS if 0
+	Strict        bool                             // fail the change if failed to write the records, they are logged only otherwise
+}
+
+// AuditPlugin is a gorm plugin recording the changes of Auditable models by gorm,
+// changes by raw SQL are not recorded. Register it by DBOption.Plugins.
+type AuditPlugin struct {
+	option AuditOption
+}
+
+// NewAuditPlugin returns an AuditPlugin
+func NewAuditPlugin(option *AuditOption) *AuditPlugin {
+	p := &AuditPlugin{}
+	if option != nil {
+		p.option = *option
+	}
+	if p.option.Sink == nil {
+		p.option.Sink = TableAuditSink{}
+	}
+	if p.option.ActorFunc == nil {
+		p.option.ActorFunc = auditActor
+	}
+	if p.option.RequestIDFunc == nil {
+		p.option.RequestIDFunc = auditRequestID
+	}
+	if p.option.MaxRows <= 0 {
+		p.option.MaxRows = DEFAULT_AUDIT_MAX_ROWS
+	}
+	return p
+}
+
+func (p *AuditPlugin) Name() string {
+	return "audit"
+}
+
+func (p *AuditPlugin) Initialize(db *gorm.DB) error {
+	callback := db.Callback()
+	if err := callback.Create().After("gorm:create").Register("audit:after_create", p.afterCreate); err != nil {
+		return err
+	}
+	if err := callback.Update().Before("gorm:update").Register("audit:before_update", p.loadBefore); err != nil {
+		return err
+	}
+	if err := callback.Update().After("gorm:update").Register("audit:after_update", p.afterUpdate); err != nil {
+		return err
+	}
+	if err := callback.Delete().Before("gorm:delete").Register("audit:before_delete", p.loadBefore); err != nil {
+		return err
+	}
+	return callback.Delete().After("gorm:delete").Register("audit:after_delete", p.afterDelete)
+}
+
+func auditEntityType(db *gorm.DB) (string, bool) {
+	if db.Statement.Schema == nil {
+		return "", false
+	}
+	auditable, ok := reflect.New(db.Statement.Schema.ModelType).Interface().(Auditable)
+	if !ok {
+		return "", false
+	}
+	return auditable.AuditEntityType(), true
+}
+
+func (p *AuditPlugin) afterCreate(db *gorm.DB) {
+	entityType, ok := auditEntityType(db)
+	if !ok || db.Error != nil {
+		return
+	}
+	var records []*AuditRecord
+	eachRow(db.Statement.ReflectValue, func(row reflect.Value) {
+		if changes := diffRows(db.Statement.Schema, reflect.Value{}, row); len(changes) > 0 {
+			records = append(records, p.newRecord(db, entityType, AUDIT_ACTION_CREATE, entityID(db.Statement.Schema, row), changes))
+		}
+	})
+	p.write(db, records)
+}
+
+// loadBefore loads the rows to be changed, by the primary keys of the model or the conditions
+func (p *AuditPlugin) loadBefore(db *gorm.DB) {
+	if _, ok := auditEntityType(db); !ok || db.Error != nil {
+		return
+	}
+	s := db.Statement.Schema
+	if s.PrioritizedPrimaryField == nil {
+		return
+	}
+	query := p.rowsQuery(db)
+	var ids []interface{}
+	eachRow(db.Statement.ReflectValue, func(row reflect.Value) {
+		if id, zero := s.PrioritizedPrimaryField.ValueOf(row); !zero {
+			ids = append(ids, id)
+		}
+	})
+	if len(ids) > 0 {
+		query = query.Where(clause.IN{Column: clause.Column{Table: clause.CurrentTable, Name: s.PrioritizedPrimaryField.DBName}, Values: ids})
+	}
+	if where, ok := db.Statement.Clauses["WHERE"]; ok {
+		query = query.Clauses(where.Expression)
+	} else if len(ids) == 0 {
+		return
+	}
+	rows := reflect.New(reflect.SliceOf(s.ModelType))
+	// one more row is loaded to know if the limit is hit
+	if err := query.Limit(p.option.MaxRows + 1).Find(rows.Interface()).Error; err != nil {
+		Log.Error("Failed to load rows for audit", With("table", s.Table), WithError(err))
+		return
+	}
+	loaded := rows.Elem()
+	if loaded.Len() > p.option.MaxRows {
+		Log.Warn("Change exceeds the max rows of audit, only the first rows are audited",
+			With("table", s.Table), With("maxRows", p.option.MaxRows))
+		loaded = loaded.Slice(0, p.option.MaxRows)
+	}
+	db.InstanceSet(auditBeforeRowsInstanceKey, loaded)
+}
+
+// rowsQuery returns a query of the model in the connection of db, i.e. in its transaction if any,
+// it reads the primary so the changes of the transaction are seen
+func (p *AuditPlugin) rowsQuery(db *gorm.DB) *gorm.DB {
+	return db.Session(&gorm.Session{NewDB: true, SkipHooks: true}).Clauses(dbresolver.Write).Model(reflect.New(db.Statement.Schema.ModelType).Interface())
+}
+
+func (p *AuditPlugin) beforeRows(db *gorm.DB) (reflect.Value, bool) {
+	value, ok := db.InstanceGet(auditBeforeRowsInstanceKey)
+	if !ok {
+		return reflect.Value{}, false
+	}
+	rows := value.(reflect.Value)
+	return rows, rows.Len() > 0
+}
+
+func (p *AuditPlugin) afterUpdate(db *gorm.DB) {
+	entityType, ok := auditEntityType(db)
+	if !ok || db.Error != nil {
+		return
+	}
+	before, ok := p.beforeRows(db)
+	if !ok {
+		return
+	}
+	s := db.Statement.Schema
+	ids := make([]interface{}, 0, before.Len())
+	for i := 0; i < before.Len(); i++ {
+		id, _ := s.PrioritizedPrimaryField.ValueOf(before.Index(i))
+		ids = append(ids, id)
+	}
+	// the rows are read again so values set by expressions or the database are recorded
+	after := reflect.New(before.Type())
+	if err := p.rowsQuery(db).Unscoped().Where(clause.IN{Column: clause.Column{Table: clause.CurrentTable, Name: s.PrioritizedPrimaryField.DBName}, Values: ids}).
+		Find(after.Interface()).Error; err != nil {
+		Log.Error("Failed to load rows for audit", With("table", s.Table), WithError(err))
+		return
+	}
+	afterByID := make(map[string]reflect.Value, after.Elem().Len())
+	for i := 0; i < after.Elem().Len(); i++ {
+		row := after.Elem().Index(i)
+		afterByID[entityID(s, row)] = row
+	}
+
+	var records []*AuditRecord
+	for i := 0; i < before.Len(); i++ {
+		id := entityID(s, before.Index(i))
+		row, ok := afterByID[id]
+		if !ok {
+			continue
+		}
+		if changes := diffRows(s, before.Index(i), row); len(changes) > 0 {
+			records = append(records, p.newRecord(db, entityType, AUDIT_ACTION_UPDATE, id, changes))
+		}
+	}
+	p.write(db, records)
+}
+
+func (p *AuditPlugin) afterDelete(db *gorm.DB) {
+	entityType, ok := auditEntityType(db)
+	if !ok || db.Error != nil {
+		return
+	}
+	before, ok := p.beforeRows(db)
+	if !ok {
+		return
+	}
+	s := db.Statement.Schema
+	var records []*AuditRecord
+	for i := 0; i < before.Len(); i++ {
+		row := before.Index(i)
+		if changes := diffRows(s, row, reflect.Value{}); len(changes) > 0 {
+			records = append(records, p.newRecord(db, entityType, AUDIT_ACTION_DELETE, entityID(s, row), changes))
+		}
+	}
+	p.write(db, records)
+}
+
+func (p *AuditPlugin) newRecord(db *gorm.DB, entityType, action, id string, changes map[string]AuditChange) *AuditRecord {
+	data, err := json.Marshal(changes)
+	if err != nil {
+		Log.Error("Failed to marshal audit changes", With("entity", entityType), With("id", id), WithError(err))
+	}
+	ctx := db.Statement.Context
+	return &AuditRecord{
+		EntityType: entityType,
+		EntityID:   id,
+		Action:     action,
+		Actor:      p.option.ActorFunc(ctx),
+		RequestID:  p.option.RequestIDFunc(ctx),
+		Changes:    string(data),
+		CreatedAt:  time.Now(),
+	}
+}
+
+func (p *AuditPlugin) write(db *gorm.DB, records []*AuditRecord) {
+	if len(records) == 0 {
+		return
+	}
+	if err := p.option.Sink.Write(db, records); err != nil {
+		Log.Error("Failed to write audit records", With("entity", records[0].EntityType), With("count", len(records)), WithError(err))
+		if p.option.Strict {
+			db.AddError(err)
+		}
+	}
+}
+
+// eachRow calls fn with each struct of value, a struct, a pointer or a slice of them
+func eachRow(value reflect.Value, fn func(row reflect.Value)) {
+	value = reflect.Indirect(value)
+	switch value.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < value.Len(); i++ {
+			if row := reflect.Indirect(value.Index(i)); row.Kind() == reflect.Struct {
+				fn(row)
+			}
+		}
+	case reflect.Struct:
+		fn(value)
+	}
+}
+
+// entityID returns the primary keys of row joined by ","
+func entityID(s *schema.Schema, row reflect.Value) string {
+	ids := make([]string, 0, len(s.PrimaryFields))
+	for _, field := range s.PrimaryFields {
+		value, _ := field.ValueOf(row)
+		ids = append(ids, fmt.Sprint(value))
+	}
+	return strings.Join(ids, ",")
+}
+
+// diffRows returns the changed columns from before to after, either of them is invalid on create or delete
+func diffRows(s *schema.Schema, before, after reflect.Value) map[string]AuditChange {
+	changes := map[string]AuditChange{}
+	for _, field := range s.Fields {
+		tag := field.Tag.Get("audit")
+		if field.DBName == "" || tag == "-" || field.AutoUpdateTime > 0 {
+			continue
+		}
+		var change AuditChange
+		if before.IsValid() {
+			change.Old = reflect.Indirect(field.ReflectValueOf(before)).Interface()
+		}
+		if after.IsValid() {
+			change.New = reflect.Indirect(field.ReflectValueOf(after)).Interface()
+		}
+		if before.IsValid() && after.IsValid() && auditValueEqual(change.Old, change.New) {
+			continue
+		}
+		if tag == "redact" {
+			if before.IsValid() {
+				change.Old = AUDIT_REDACTED
+			}
+			if after.IsValid() {
+				change.New = AUDIT_REDACTED
+			}
+		}
+		changes[field.DBName] = change
+	}
+	return changes
+}
+
+func auditValueEqual(a, b interface{}) bool {
+	if t, ok := a.(time.Time); ok {
+		if u, ok := b.(time.Time); ok {
+			return t.Equal(u)
+		}
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// FindAuditHistory returns the audit records of the entity with the primary key id saved by TableAuditSink, oldest first
+func FindAuditHistory(ctx context.Context, entity Auditable, id interface{}, name ...string) ([]*AuditRecord, error) {
+	var records []*AuditRecord
+	err := GetDBFromContext(ctx, name...).Where("entity_type = ? AND entity_id = ?", entity.AuditEntityType(), fmt.Sprint(id)).
+		Order("id").Find(&records).Error
+	return records, err
+}
+
+// AutoMigrateAudit creates the audit table of the database if not exists
+func AutoMigrateAudit(name ...string) error {
+	return GetDB(name...).AutoMigrate(&AuditRecord{})
+}
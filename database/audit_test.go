@@ -0,0 +1,179 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yiGmMk/pz-infra-new/logging"
+
+	"github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+type auditUser struct {
+	ID        int64
+	Name      string
+	Password  string `audit:"redact"`
+	Note      string `audit:"-"`
+	Version   int
+	UpdatedAt time.Time
+	DeletedAt gorm.DeletedAt
+}
+
+func (auditUser) AuditEntityType() string {
+	return "user"
+}
+
+type memoryAuditSink struct {
+	lock    sync.Mutex
+	records []*AuditRecord
+}
+
+func (s *memoryAuditSink) Write(db *gorm.DB, records []*AuditRecord) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.records = append(s.records, records...)
+	return nil
+}
+
+func openAuditDB(t *testing.T, dir, name string, plugin *AuditPlugin) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(dir, name+".db")), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&auditUser{}, &AuditRecord{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Use(plugin); err != nil {
+		t.Fatal(err)
+	}
+	SetNamedDB(name, db)
+	return db
+}
+
+func TestAuditPlugin(t *testing.T) {
+	logger, err := (&logging.LogrusProvider{}).New(&logging.LogrusOption{Out: ioutil.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logging.Log = logger
+
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db := openAuditDB(t, dir, "audit", NewAuditPlugin(nil))
+
+	ctx := WithAuditRequestID(WithAuditActor(context.Background(), "admin"), "req-1")
+	txOption := &TxOption{DBName: "audit"}
+
+	Convey("test changes are recorded", t, func() {
+		user := &auditUser{Name: "tom", Password: "secret", Note: "note"}
+		So(db.WithContext(ctx).Create(user).Error, ShouldBeNil)
+		So(db.WithContext(ctx).Model(user).Updates(map[string]interface{}{"name": "jerry", "password": "secret2", "note": "new"}).Error, ShouldBeNil)
+		So(db.WithContext(ctx).Model(&auditUser{}).Where("name = ?", "jerry").Update("version", gorm.Expr("version + 1")).Error, ShouldBeNil)
+		So(db.WithContext(ctx).Delete(user).Error, ShouldBeNil)
+
+		records, err := FindAuditHistory(ctx, auditUser{}, user.ID, "audit")
+		So(err, ShouldBeNil)
+		So(len(records), ShouldEqual, 4)
+		So(records[0].Action, ShouldEqual, AUDIT_ACTION_CREATE)
+		So(records[0].Actor, ShouldEqual, "admin")
+		So(records[0].RequestID, ShouldEqual, "req-1")
+		created, err := records[0].Diff()
+		So(err, ShouldBeNil)
+		So(created["name"].New, ShouldEqual, "tom")
+		So(created["password"].New, ShouldEqual, AUDIT_REDACTED)
+		_, ok := created["note"]
+		So(ok, ShouldBeFalse)
+
+		updated, err := records[1].Diff()
+		So(err, ShouldBeNil)
+		So(records[1].Action, ShouldEqual, AUDIT_ACTION_UPDATE)
+		So(updated, ShouldResemble, map[string]AuditChange{
+			"name":     {Old: "tom", New: "jerry"},
+			"password": {Old: AUDIT_REDACTED, New: AUDIT_REDACTED},
+		})
+
+		// the values of expressions are read from the database
+		updated, err = records[2].Diff()
+		So(err, ShouldBeNil)
+		So(updated["version"], ShouldResemble, AuditChange{Old: float64(0), New: float64(1)})
+
+		So(records[3].Action, ShouldEqual, AUDIT_ACTION_DELETE)
+		deleted, err := records[3].Diff()
+		So(err, ShouldBeNil)
+		So(deleted["name"], ShouldResemble, AuditChange{Old: "jerry", New: nil})
+	})
+
+	Convey("test records are rolled back with the transaction", t, func() {
+		user := &auditUser{Name: "spike"}
+		So(WithTx(ctx, func(ctx context.Context, tx *gorm.DB) error {
+			if err := tx.Create(user).Error; err != nil {
+				return err
+			}
+			return errors.New("rollback")
+		}, txOption), ShouldNotBeNil)
+		records, err := FindAuditHistory(ctx, auditUser{}, user.ID, "audit")
+		So(err, ShouldBeNil)
+		So(len(records), ShouldEqual, 0)
+	})
+
+	Convey("test async sink writes after commit", t, func() {
+		memory := &memoryAuditSink{}
+		sink := NewAsyncAuditSink(memory, "audit_async", 10)
+		asyncDB := openAuditDB(t, dir, "audit_async", NewAuditPlugin(&AuditOption{Sink: sink}))
+		asyncOption := &TxOption{DBName: "audit_async"}
+
+		So(WithTx(ctx, func(ctx context.Context, tx *gorm.DB) error {
+			return tx.Create(&auditUser{Name: "a"}).Error
+		}, asyncOption), ShouldBeNil)
+		So(WithTx(ctx, func(ctx context.Context, tx *gorm.DB) error {
+			if err := tx.Create(&auditUser{Name: "b"}).Error; err != nil {
+				return err
+			}
+			return errors.New("rollback")
+		}, asyncOption), ShouldNotBeNil)
+		So(asyncDB.Create(&auditUser{Name: "c"}).Error, ShouldBeNil)
+		sink.Close()
+		So(func() {
+			So(asyncDB.Create(&auditUser{Name: "d"}).Error, ShouldBeNil)
+			sink.Close()
+		}, ShouldNotPanic)
+
+		So(len(memory.records), ShouldEqual, 2)
+		var count int64
+		So(asyncDB.Model(&AuditRecord{}).Count(&count).Error, ShouldBeNil)
+		So(count, ShouldEqual, 0)
+	})
+
+	Convey("test changes over the max rows are audited in part with a warning", t, func() {
+		var out bytes.Buffer
+		logging.Log, _ = (&logging.LogrusProvider{}).New(&logging.LogrusOption{Out: &out, Level: logrus.WarnLevel})
+		defer func() { logging.Log = logger }()
+		memory := &memoryAuditSink{}
+		limitedDB := openAuditDB(t, dir, "audit_limited", NewAuditPlugin(&AuditOption{Sink: memory, MaxRows: 2}))
+		for _, name := range []string{"a", "b", "c"} {
+			So(limitedDB.Create(&auditUser{Name: name, Note: "bulk"}).Error, ShouldBeNil)
+		}
+		memory.records = nil
+
+		So(limitedDB.Model(&auditUser{}).Where("note = ?", "bulk").Update("name", "x").Error, ShouldBeNil)
+		So(len(memory.records), ShouldEqual, 2)
+		So(out.String(), ShouldContainSubstring, "exceeds the max rows of audit")
+
+		out.Reset()
+		So(limitedDB.Model(&auditUser{}).Where("name = ?", "a").Update("name", "y").Error, ShouldBeNil)
+		So(out.String(), ShouldNotContainSubstring, "exceeds the max rows of audit")
+	})
+}
@@ -0,0 +1,182 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+
+	. "github.com/yiGmMk/pz-infra-new/logging"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	DEFAULT_BULK_BATCH_SIZE = 500
+	DEFAULT_BULK_WORKERS    = 4
+)
+
+// BulkOption is used to set how BulkInsert writes models
+type BulkOption struct {
+	DBName    string // name of the registered database, the default database if empty
+	BatchSize int    // models of each INSERT statement, DEFAULT_BULK_BATCH_SIZE if 0
+	Workers   int    // batches written concurrently, DEFAULT_BULK_WORKERS if 0
+	// Upsert updates the existing rows on duplicate key, i.e. INSERT ... ON DUPLICATE KEY UPDATE
+	Upsert bool
+	// UpdateColumns are the columns updated on duplicate key, all columns if empty
+	UpdateColumns []string
+	// ConflictColumns are the unique columns to detect duplicates, only needed by databases other than mysql
+	ConflictColumns []string
+	// InTransaction writes all batches one by one in a transaction,
+	// it stops at the first failed batch and nothing is written.
+	InTransaction bool
+}
+
+func (o *BulkOption) withDefaults() *BulkOption {
+	opt := BulkOption{}
+	if o != nil {
+		opt = *o
+	}
+	if opt.BatchSize <= 0 {
+		opt.BatchSize = DEFAULT_BULK_BATCH_SIZE
+	}
+	if opt.Workers <= 0 {
+		opt.Workers = DEFAULT_BULK_WORKERS
+	}
+	return &opt
+}
+
+func (o *BulkOption) onConflict() clause.OnConflict {
+	onConflict := clause.OnConflict{}
+	for _, column := range o.ConflictColumns {
+		onConflict.Columns = append(onConflict.Columns, clause.Column{Name: column})
+	}
+	if len(o.UpdateColumns) > 0 {
+		onConflict.DoUpdates = clause.AssignmentColumns(o.UpdateColumns)
+	} else {
+		onConflict.UpdateAll = true
+	}
+	return onConflict
+}
+
+// BatchError is the error of a failed batch
+type BatchError struct {
+	Batch  int // index of the batch
+	Offset int // index of the first model of the batch in the slice
+	Size   int // models in the batch
+	Err    error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("database: batch %d of models [%d, %d) failed: %s", e.Batch, e.Offset, e.Offset+e.Size, e.Err.Error())
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// BulkError is returned by BulkInsert if any batch failed, errors are ordered by batch
+type BulkError struct {
+	Errors []*BatchError
+}
+
+func (e *BulkError) Error() string {
+	return fmt.Sprintf("database: %d batches failed, the first: %s", len(e.Errors), e.Errors[0].Error())
+}
+
+func (e *BulkError) Unwrap() error {
+	return e.Errors[0]
+}
+
+// BulkInsert inserts a slice of models in batches, see BulkInsertContext
+func BulkInsert(models interface{}, option *BulkOption) error {
+	return BulkInsertContext(context.Background(), models, option)
+}
+
+// BulkInsertContext inserts a slice of models in batches with CreateInBatches, each batch is atomic.
+// Batches are written by a bounded pool of workers unless in a transaction,
+// and a *BulkError with the errors of all failed batches is returned.
+// If ctx carries a transaction of WithTx, the batches are written in it.
+func BulkInsertContext(ctx context.Context, models interface{}, option *BulkOption) error {
+	list := reflect.Indirect(reflect.ValueOf(models))
+	if list.Kind() != reflect.Slice {
+		return fmt.Errorf("database: bulk insert expects a slice, got %T", models)
+	}
+	if list.Len() == 0 {
+		return nil
+	}
+	opt := option.withDefaults()
+
+	if opt.InTransaction {
+		return WithTx(ctx, func(ctx context.Context, tx *gorm.DB) error {
+			for batch := 0; batch*opt.BatchSize < list.Len(); batch++ {
+				if err := writeBatch(ctx, list, opt, batch); err != nil {
+					return &BulkError{Errors: []*BatchError{err}}
+				}
+			}
+			return nil
+		}, &TxOption{DBName: opt.DBName})
+	}
+	workers := opt.Workers
+	if _, ok := TxFromContext(ctx, opt.DBName); ok {
+		// a transaction is bound to one connection, it can't be shared by workers
+		workers = 1
+	}
+	return writeBatches(ctx, list, opt, workers)
+}
+
+// writeBatches writes list in batches by a pool of workers
+func writeBatches(ctx context.Context, list reflect.Value, opt *BulkOption, workers int) error {
+	batches := (list.Len() + opt.BatchSize - 1) / opt.BatchSize
+	if workers > batches {
+		workers = batches
+	}
+
+	var lock sync.Mutex
+	var errs []*BatchError
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range jobs {
+				if err := writeBatch(ctx, list, opt, batch); err != nil {
+					lock.Lock()
+					errs = append(errs, err)
+					lock.Unlock()
+				}
+			}
+		}()
+	}
+	for batch := 0; batch < batches; batch++ {
+		jobs <- batch
+	}
+	close(jobs)
+	wg.Wait()
+
+	if len(errs) == 0 {
+		return nil
+	}
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Batch < errs[j].Batch })
+	return &BulkError{Errors: errs}
+}
+
+func writeBatch(ctx context.Context, list reflect.Value, opt *BulkOption, batch int) *BatchError {
+	offset := batch * opt.BatchSize
+	end := offset + opt.BatchSize
+	if end > list.Len() {
+		end = list.Len()
+	}
+	db := GetDBFromContext(ctx, opt.DBName)
+	if opt.Upsert {
+		db = db.Clauses(opt.onConflict())
+	}
+	if err := db.CreateInBatches(list.Slice(offset, end).Interface(), opt.BatchSize).Error; err != nil {
+		Log.Error("Failed to insert batch", With("batch", batch), With("offset", offset), WithError(err))
+		return &BatchError{Batch: batch, Offset: offset, Size: end - offset, Err: err}
+	}
+	return nil
+}
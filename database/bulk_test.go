@@ -0,0 +1,154 @@
+package database_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/yiGmMk/pz-infra-new/database"
+	"github.com/yiGmMk/pz-infra-new/tests/base"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"gorm.io/gorm"
+)
+
+type bulkUser struct {
+	ID    int64  `gorm:"primaryKey"`
+	Email string `gorm:"uniqueIndex"`
+	Name  string
+	Age   int
+}
+
+func newBulkUsers(from, n int) []*bulkUser {
+	users := make([]*bulkUser, n)
+	for i := range users {
+		id := from + i
+		users[i] = &bulkUser{ID: int64(id), Email: fmt.Sprintf("user%d@test.com", id), Name: fmt.Sprintf("user%d", id), Age: 20}
+	}
+	return users
+}
+
+func TestBulkInsert(t *testing.T) {
+	ctx := context.Background()
+
+	Convey("test bulk insert", t, func() {
+		db, err := base.InitSQLiteDB("bulk")
+		So(err, ShouldBeNil)
+		// the connections of a shared cache sqlite database lock each other's tables, write one at a time
+		sqlDB, _ := db.DB()
+		sqlDB.SetMaxOpenConns(1)
+		So(db.AutoMigrate(&bulkUser{}), ShouldBeNil)
+		var statements int32
+		db.Callback().Create().After("gorm:create").Register("test:count", func(*gorm.DB) {
+			atomic.AddInt32(&statements, 1)
+		})
+		count := func() int64 {
+			var n int64
+			db.Model(&bulkUser{}).Count(&n)
+			return n
+		}
+
+		Convey("models are written in batches", func() {
+			err := database.BulkInsertContext(ctx, newBulkUsers(1, 10), &database.BulkOption{DBName: "bulk", BatchSize: 3, Workers: 2})
+			So(err, ShouldBeNil)
+			So(count(), ShouldEqual, 10)
+			So(atomic.LoadInt32(&statements), ShouldEqual, 4)
+
+			So(database.BulkInsertContext(ctx, []*bulkUser{}, &database.BulkOption{DBName: "bulk"}), ShouldBeNil)
+			So(database.BulkInsertContext(ctx, &bulkUser{}, &database.BulkOption{DBName: "bulk"}), ShouldNotBeNil)
+		})
+
+		Convey("errors of the failed batches are returned", func() {
+			So(db.Create(&bulkUser{ID: 100, Email: "dup@test.com"}).Error, ShouldBeNil)
+			users := newBulkUsers(1, 8)
+			users[1].Email = "dup@test.com"
+			users[7].Email = "dup@test.com"
+			err := database.BulkInsertContext(ctx, users, &database.BulkOption{DBName: "bulk", BatchSize: 3})
+
+			var bulkErr *database.BulkError
+			So(errors.As(err, &bulkErr), ShouldBeTrue)
+			So(len(bulkErr.Errors), ShouldEqual, 2)
+			So(*bulkErr.Errors[0], ShouldResemble, database.BatchError{Batch: 0, Offset: 0, Size: 3, Err: bulkErr.Errors[0].Err})
+			So(*bulkErr.Errors[1], ShouldResemble, database.BatchError{Batch: 2, Offset: 6, Size: 2, Err: bulkErr.Errors[1].Err})
+			var batchErr *database.BatchError
+			So(errors.As(err, &batchErr), ShouldBeTrue)
+			So(batchErr.Batch, ShouldEqual, 0)
+			// each batch is atomic, only the batch 1 is written
+			So(count(), ShouldEqual, 1+3)
+		})
+
+		Convey("nothing is written if a batch fails in transaction", func() {
+			users := newBulkUsers(1, 8)
+			users[7].Email = users[0].Email
+			err := database.BulkInsertContext(ctx, users, &database.BulkOption{DBName: "bulk", BatchSize: 3, InTransaction: true})
+
+			var bulkErr *database.BulkError
+			So(errors.As(err, &bulkErr), ShouldBeTrue)
+			So(len(bulkErr.Errors), ShouldEqual, 1)
+			So(bulkErr.Errors[0].Batch, ShouldEqual, 2)
+			So(count(), ShouldEqual, 0)
+		})
+
+		Convey("batches join the transaction of ctx", func() {
+			err := database.WithTx(ctx, func(ctx context.Context, tx *gorm.DB) error {
+				if err := database.BulkInsertContext(ctx, newBulkUsers(1, 5), &database.BulkOption{DBName: "bulk", BatchSize: 2}); err != nil {
+					return err
+				}
+				return errors.New("rollback")
+			}, &database.TxOption{DBName: "bulk"})
+			So(err, ShouldNotBeNil)
+			So(count(), ShouldEqual, 0)
+		})
+
+		Convey("upsert updates the columns of the existing rows", func() {
+			So(database.BulkInsertContext(ctx, newBulkUsers(1, 3), &database.BulkOption{DBName: "bulk"}), ShouldBeNil)
+			users := newBulkUsers(2, 3)
+			for _, user := range users {
+				user.Name = "updated"
+				user.Age = 30
+			}
+			err := database.BulkInsertContext(ctx, users, &database.BulkOption{
+				DBName:          "bulk",
+				Upsert:          true,
+				UpdateColumns:   []string{"name"},
+				ConflictColumns: []string{"id"},
+			})
+			So(err, ShouldBeNil)
+
+			var saved []bulkUser
+			So(db.Order("id").Find(&saved).Error, ShouldBeNil)
+			So(len(saved), ShouldEqual, 4)
+			So(saved[0].Name, ShouldEqual, "user1")
+			So(saved[1].Name, ShouldEqual, "updated")
+			So(saved[1].Age, ShouldEqual, 20)
+			So(saved[3].Name, ShouldEqual, "updated")
+			So(saved[3].Age, ShouldEqual, 30)
+
+			Convey("all columns are updated if UpdateColumns is empty", func() {
+				err := database.BulkInsertContext(ctx, users, &database.BulkOption{DBName: "bulk", Upsert: true, ConflictColumns: []string{"id"}})
+				So(err, ShouldBeNil)
+				var user bulkUser
+				So(db.First(&user, 2).Error, ShouldBeNil)
+				So(user.Age, ShouldEqual, 30)
+			})
+		})
+
+		Convey("BatchSaveModels upserts all columns if not isCreate", func() {
+			db, err := base.InitSQLiteDB("")
+			So(err, ShouldBeNil)
+			So(db.AutoMigrate(&bulkUser{}), ShouldBeNil)
+			So(database.BatchSaveModels(newBulkUsers(1, 3), true), ShouldBeNil)
+			users := newBulkUsers(3, 2)
+			users[0].Age = 30
+			So(database.BatchSaveModels(users, false), ShouldBeNil)
+
+			var saved []bulkUser
+			So(db.Order("id").Find(&saved).Error, ShouldBeNil)
+			So(len(saved), ShouldEqual, 4)
+			So(saved[2].Age, ShouldEqual, 30)
+			So(database.BatchSaveModels(&bulkUser{}, true), ShouldNotBeNil)
+		})
+	})
+}
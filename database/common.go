@@ -1,11 +1,10 @@
 package database
 
 import (
-	"reflect"
-
 	. "github.com/yiGmMk/pz-infra-new/logging"
 )
 
+// Deprecated: BatchSaveModels uses BulkInsert now.
 func SaveModelWithChan(t interface{}, isCreate bool, ch chan error) error {
 	db := GetDB()
 	if isCreate {
@@ -29,38 +28,12 @@ func EmptyResponseChannel(ch chan error) {
 	ch <- nil
 }
 
+// BatchSaveModels inserts a slice of models in batches, or upserts them if not isCreate,
+// see BulkInsert for more options. Unlike the versions before, which always inserted and ignored
+// non-slice arguments, the existing rows are updated with all columns if not isCreate,
+// i.e. INSERT ... ON DUPLICATE KEY UPDATE, and an error is returned if t is not a slice.
 func BatchSaveModels(t interface{}, isCreate bool) error {
-	switch reflect.TypeOf(t).Kind() {
-	case reflect.Slice:
-		list := reflect.ValueOf(t)
-
-		Log.Info("BatchSaveModels, len:", With("len", list.Len()))
-		i := 0
-		maxProcess := 10
-		ch := make(chan error, maxProcess)
-		for {
-			for j := 0; j < maxProcess; j++ {
-				if i+j >= list.Len() {
-					go EmptyResponseChannel(ch)
-				} else {
-					go SaveModelWithChan(list.Index(i+j).Interface(), true, ch)
-				}
-			}
-
-			for j := 0; j < maxProcess; j++ {
-				err := <-ch
-				if err != nil {
-					return err
-				}
-			}
-
-			i += maxProcess
-			if i >= list.Len() {
-				break
-			}
-		}
-	}
-	return nil
+	return BulkInsert(t, &BulkOption{Upsert: !isCreate})
 }
 
 func ExecSql(sql string, args ...interface{}) error {
@@ -2,11 +2,11 @@ package database
 
 import (
 	"context"
+	"database/sql"
 	"errors"
+	"fmt"
 	"time"
 
-	"github.com/sirupsen/logrus"
-	"github.com/yiGmMk/pz-infra-new/log"
 	"github.com/yiGmMk/pz-infra-new/logging"
 
 	_ "github.com/go-sql-driver/mysql"
@@ -14,10 +14,11 @@ import (
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
 	"gorm.io/gorm/utils"
+	"gorm.io/plugin/dbresolver"
 )
 
 var (
-	globalDB                 *gorm.DB
+	globalDB                 *gorm.DB // the default database
 	ErrRecordNotFound        = gorm.ErrRecordNotFound
 	ErrInvalidTransaction    = gorm.ErrInvalidTransaction
 	ErrNotImplemented        = gorm.ErrNotImplemented
@@ -35,93 +36,178 @@ var (
 
 // gorm V2 日志输出需要实现logger.Interface接口
 type GormLogger struct {
-	logger        logging.Logger // logrus封装,日志记录
-	SlowThreshold time.Duration  // 慢查询阈值,用于慢查询日志记录
-	SourceField   string         //
+	logger           logging.Logger  // logrus封装,日志记录
+	SlowThreshold    time.Duration   // 慢查询阈值,用于慢查询日志记录
+	SourceField      string          //
+	LogLevel         logger.LogLevel // Silent不输出日志,Error只输出错误,Warn输出错误和慢查询,Info输出所有语句
+	ExplainThreshold time.Duration   // 超过该耗时的SELECT执行EXPLAIN并记录到慢查询,0时不执行
+	explainDB        *gorm.DB
 }
 
-func (l *GormLogger) LogMode(logger.LogLevel) logger.Interface {
+func (l *GormLogger) LogMode(level logger.LogLevel) logger.Interface {
 	newlogger := *l
+	newlogger.LogLevel = level
 	return &newlogger
 }
 
 func (l *GormLogger) Info(ctx context.Context, msg string, data ...interface{}) {
-	l.logger.WithContext(ctx).Infof(msg, data...)
+	if l.LogLevel >= logger.Info {
+		l.logger.WithContext(ctx).Info(fmt.Sprintf(msg, data...))
+	}
 }
 
 func (l *GormLogger) Warn(ctx context.Context, msg string, data ...interface{}) {
-	l.logger.WithContext(ctx).Warnf(msg, data...)
+	if l.LogLevel >= logger.Warn {
+		l.logger.WithContext(ctx).Warn(fmt.Sprintf(msg, data...))
+	}
 }
 
 func (l *GormLogger) Error(ctx context.Context, msg string, data ...interface{}) {
-	l.logger.WithContext(ctx).Errorf(msg, data...)
+	if l.LogLevel >= logger.Error {
+		l.logger.WithContext(ctx).Error(fmt.Sprintf(msg, data...))
+	}
 }
 
+// Trace records the metrics of each statement whatever the level is, see GetSQLStats and GetSlowQueries
 func (l *GormLogger) Trace(ctx context.Context, begin time.Time, fc func() (string, int64), err error) {
 	elapsed := time.Since(begin)
-	sql, _ := fc()
-	fields := logrus.Fields{}
-	if l.SourceField != "" {
-		fields[l.SourceField] = utils.FileWithLineNum()
-	}
-	if err != nil && !(errors.Is(err, gorm.ErrRecordNotFound)) {
-		fields[logrus.ErrorKey] = err
-		l.logger.WithContext(ctx).WithFields(fields).Errorf("%s [%s]", sql, elapsed)
-		return
+	sql, rows := fc()
+	failed := err != nil && !errors.Is(err, gorm.ErrRecordNotFound)
+	slow := l.SlowThreshold != 0 && elapsed > l.SlowThreshold
+	fingerprint := FingerprintSQL(sql)
+	slowest := sqlMetricsRegistry.observe(fingerprint, elapsed, rows, failed, slow, sql)
+	if slowest && l.explainDB != nil && l.ExplainThreshold != 0 && elapsed > l.ExplainThreshold {
+		captureExplain(ctx, l.explainDB, fingerprint, sql)
 	}
 
-	if l.SlowThreshold != 0 && elapsed > l.SlowThreshold {
-		l.logger.WithContext(ctx).WithFields(fields).Warnf("%s [%s]", sql, elapsed)
+	if l.LogLevel <= logger.Silent {
 		return
 	}
+	var fields []logging.Field
+	if l.SourceField != "" {
+		fields = append(fields, logging.With(l.SourceField, utils.FileWithLineNum()))
+	}
+	message := fmt.Sprintf("%s [%s]", sql, elapsed)
+	switch {
+	case failed && l.LogLevel >= logger.Error:
+		l.logger.WithContext(ctx).Error(message, append(fields, logging.WithError(err))...)
+	case slow && l.LogLevel >= logger.Warn:
+		l.logger.WithContext(ctx).Warn(message, fields...)
+	case !failed && !slow && l.LogLevel >= logger.Info:
+		l.logger.WithContext(ctx).Debug(message, fields...)
+	}
+}
 
-	l.logger.WithContext(ctx).WithFields(fields).Debugf("%s [%s]", sql, elapsed)
+// setExplainDB sets the database running the EXPLAIN of slow queries, and records the SQL and the values of its queries
+func (l *GormLogger) setExplainDB(db *gorm.DB) error {
+	if err := registerExplainCallbacks(db); err != nil {
+		return err
+	}
+	l.explainDB = db
+	return nil
 }
 
-func InitDB(connectString string, infraLogger logging.Logger) error {
-	var gormlog logger.Interface
-	if infraLogger != nil {
-		gormlog = &GormLogger{
-			SlowThreshold: 200 * time.Millisecond,
-			logger:        infraLogger,
-		}
-	} else {
-		gormlog = logger.Default
+func newGormLogger(infraLogger logging.Logger, option *DBOption) logger.Interface {
+	if infraLogger == nil {
+		return logger.Default
+	}
+	slowThreshold := option.SlowThreshold
+	if slowThreshold == 0 {
+		slowThreshold = DEFAULT_SLOW_THRESHOLD
 	}
+	return &GormLogger{
+		SlowThreshold:    slowThreshold,
+		ExplainThreshold: option.ExplainThreshold,
+		LogLevel:         logger.Info,
+		logger:           infraLogger,
+	}
+}
 
+// openDB opens the primary of connectString with its pool configured by option,
+// reads are routed to replicas if any, the pools of replicas are returned
+func openDB(connectString string, replicas []string, option *DBOption, infraLogger logging.Logger) (*gorm.DB, []*sql.DB, error) {
 	gormDB, err := gorm.Open(mysql.Open(connectString), &gorm.Config{
 		SkipDefaultTransaction: true,
-		Logger:                 gormlog,
+		Logger:                 newGormLogger(infraLogger, option),
 	})
 	if err != nil {
-		log.Errorf("init db error with url %s failed: %s", connectString, err.Error())
-		panic(err)
+		return nil, nil, err
 	}
-	gormDB.Logger.LogMode(logger.Info)
-	SetDB(gormDB)
-	return err
+	if gormLogger, ok := gormDB.Logger.(*GormLogger); ok && option.ExplainThreshold != 0 {
+		if err := gormLogger.setExplainDB(gormDB); err != nil {
+			return nil, nil, err
+		}
+	}
+	sqlDB, err := gormDB.DB()
+	if err != nil {
+		return nil, nil, err
+	}
+	option.configurePool(sqlDB)
+
+	var replicaPools []*sql.DB
+	if len(replicas) > 0 {
+		dialectors := make([]gorm.Dialector, 0, len(replicas))
+		for _, replica := range replicas {
+			dialectors = append(dialectors, mysql.Open(replica))
+		}
+		resolver := dbresolver.Register(dbresolver.Config{Replicas: dialectors})
+		// callbacks are called for the pools of the primary and replicas when the resolver is initialized
+		resolver.Call(func(connPool gorm.ConnPool) error {
+			if pool, ok := connPool.(*sql.DB); ok && pool != sqlDB {
+				option.configurePool(pool)
+				replicaPools = append(replicaPools, pool)
+			}
+			return nil
+		})
+		if err := gormDB.Use(resolver); err != nil {
+			sqlDB.Close()
+			return nil, nil, err
+		}
+	}
+	for _, plugin := range option.Plugins {
+		if err := gormDB.Use(plugin); err != nil {
+			closePools(gormDB, replicaPools)
+			return nil, nil, err
+		}
+	}
+	return gormDB, replicaPools, nil
+}
+
+// InitDB opens the default database with DefaultDBOption
+func InitDB(connectString string, infraLogger logging.Logger) error {
+	return InitDBWithOption(connectString, DefaultDBOption(), infraLogger)
+}
+
+// InitDBWithOption opens the default database with the pool and retries set by option
+func InitDBWithOption(connectString string, option *DBOption, infraLogger logging.Logger) error {
+	return RegisterDB(&DBConfig{Name: DEFAULT_DB_NAME, Source: connectString, Option: option}, infraLogger)
 }
 
+// LogMode sets the log level of all registered databases
 func LogMode(level logger.LogLevel) {
-	if globalDB != nil {
-		globalDB.Logger.LogMode(level)
+	dbsLock.Lock()
+	defer dbsLock.Unlock()
+	for _, db := range dbs {
+		db.Logger = db.Logger.LogMode(level)
 	}
 }
 
-// 通过 NewDB 选项创建一个不带之前条件的新 DB,不受上一条执行语句携带的Statement影响
+// 通过 NewDB 选项创建一个不带之前条件的新 DB,不受上一条执行语句携带的Statement影响,
+// 可指定已注册的数据库名称,如 GetDB("orders"),不指定时返回默认数据库
 // 参考: https://gorm.io/zh_CN/docs/session.html#NewDB
-func GetDB() *gorm.DB {
-	return globalDB.Session(&gorm.Session{
+func GetDB(name ...string) *gorm.DB {
+	return mustGetDB(name...).Session(&gorm.Session{
 		NewDB: true,
 	})
 }
 
 // 通过指定session获取不带之前条件的新 DB,在session中可指定一些条件,
 // 参考: https://gorm.io/zh_CN/docs/session.html#NewDB
-func GetDBWithSession(session *gorm.Session) *gorm.DB {
-	return globalDB.Session(session)
+func GetDBWithSession(session *gorm.Session, name ...string) *gorm.DB {
+	return mustGetDB(name...).Session(session)
 }
 
+// SetDB sets the default database
 func SetDB(db *gorm.DB) {
-	globalDB = db
+	SetNamedDB(DEFAULT_DB_NAME, db)
 }
@@ -38,6 +38,8 @@ func RollbackIfError(isNewTran bool, tran *gorm.DB, err error) error {
 
 type TransactionFunc func(db *gorm.DB) error
 
+// TransactionRun runs method in the transaction of dbs or a new one,
+// nested calls share the transaction without savepoints, use WithTx for savepoints and hooks.
 func TransactionRun(method TransactionFunc, dbs ...*gorm.DB) error {
 	tx, isNew := GetTransactionDatabases(dbs)
 	err := method(tx)
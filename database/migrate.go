@@ -0,0 +1,362 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	. "github.com/yiGmMk/pz-infra-new/logging"
+
+	"gorm.io/gorm"
+)
+
+const (
+	DEFAULT_MIGRATION_TABLE        = "schema_migrations"
+	DEFAULT_MIGRATION_LOCK_TIMEOUT = 60 * time.Second
+)
+
+// MigrationFunc changes the schema or data in the transaction of a migration
+type MigrationFunc func(tx *gorm.DB) error
+
+// Migration is a version of the schema, it's applied by UpSQL then Up, and reverted by DownSQL then Down
+type Migration struct {
+	Version int64
+	Name    string
+	UpSQL   string
+	DownSQL string
+	Up      MigrationFunc
+	Down    MigrationFunc
+}
+
+// MigrationRecord is a row of the migration table
+type MigrationRecord struct {
+	Version   int64     `gorm:"column:version;primaryKey;autoIncrement:false"`
+	Name      string    `gorm:"column:name;size:255"`
+	AppliedAt time.Time `gorm:"column:applied_at"`
+}
+
+// MigrationStatus tells if a migration is applied
+type MigrationStatus struct {
+	Version   int64
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+	Missing   bool // applied but not found in the registered migrations
+}
+
+var (
+	registeredMigrations     []*Migration
+	registeredMigrationsLock sync.Mutex
+)
+
+// RegisterMigration registers a Go migration for all Migrators, call it in init()
+func RegisterMigration(version int64, name string, up, down MigrationFunc) {
+	registeredMigrationsLock.Lock()
+	defer registeredMigrationsLock.Unlock()
+	registeredMigrations = append(registeredMigrations, &Migration{Version: version, Name: name, Up: up, Down: down})
+}
+
+// MigratorOption is used to set up a Migrator
+type MigratorOption struct {
+	Table       string        // table of applied versions, DEFAULT_MIGRATION_TABLE if empty
+	Dir         string        // directory of the SQL files, no SQL file is read if empty
+	DryRun      bool          // print the plan to Out instead of changing the database
+	Out         io.Writer     // where dry run plans are printed, ioutil.Discard if nil
+	LockTimeout time.Duration // DEFAULT_MIGRATION_LOCK_TIMEOUT if 0
+}
+
+// Migrator applies and reverts migrations, the migrations are read from SQL files named
+// <version>_<name>.up.sql and <version>_<name>.down.sql in Dir, and from RegisterMigration.
+type Migrator struct {
+	db         *gorm.DB
+	option     MigratorOption
+	migrations []*Migration // ordered by version
+}
+
+var migrationFileRegexp = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+// NewMigrator returns a Migrator of db with the SQL files in option.Dir and the registered Go migrations
+func NewMigrator(db *gorm.DB, option *MigratorOption) (*Migrator, error) {
+	m := &Migrator{db: db}
+	if option != nil {
+		m.option = *option
+	}
+	if m.option.Table == "" {
+		m.option.Table = DEFAULT_MIGRATION_TABLE
+	}
+	if m.option.Out == nil {
+		m.option.Out = ioutil.Discard
+	}
+	if m.option.LockTimeout <= 0 {
+		m.option.LockTimeout = DEFAULT_MIGRATION_LOCK_TIMEOUT
+	}
+
+	byVersion := make(map[int64]*Migration)
+	if m.option.Dir != "" {
+		if err := loadMigrationFiles(m.option.Dir, byVersion); err != nil {
+			return nil, err
+		}
+	}
+	registeredMigrationsLock.Lock()
+	registered := append([]*Migration{}, registeredMigrations...)
+	registeredMigrationsLock.Unlock()
+	for _, migration := range registered {
+		if err := mergeMigration(byVersion, migration); err != nil {
+			return nil, err
+		}
+	}
+	for _, migration := range byVersion {
+		m.migrations = append(m.migrations, migration)
+	}
+	sort.Slice(m.migrations, func(i, j int) bool { return m.migrations[i].Version < m.migrations[j].Version })
+	return m, nil
+}
+
+func loadMigrationFiles(dir string, byVersion map[int64]*Migration) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		matches := migrationFileRegexp.FindStringSubmatch(file.Name())
+		if file.IsDir() || matches == nil {
+			continue
+		}
+		version, err := strconv.ParseInt(matches[1], 10, 64)
+		if err != nil {
+			return err
+		}
+		content, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return err
+		}
+		migration := &Migration{Version: version, Name: matches[2]}
+		if matches[3] == "up" {
+			migration.UpSQL = string(content)
+		} else {
+			migration.DownSQL = string(content)
+		}
+		if err := mergeMigration(byVersion, migration); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeMigration merges the parts of a migration of the same version and name
+func mergeMigration(byVersion map[int64]*Migration, migration *Migration) error {
+	existing, ok := byVersion[migration.Version]
+	if !ok {
+		copied := *migration
+		byVersion[migration.Version] = &copied
+		return nil
+	}
+	if existing.Name != migration.Name {
+		return fmt.Errorf("database: migration version %d is used by %s and %s", migration.Version, existing.Name, migration.Name)
+	}
+	if (existing.UpSQL != "" && migration.UpSQL != "") || (existing.DownSQL != "" && migration.DownSQL != "") ||
+		(existing.Up != nil && migration.Up != nil) || (existing.Down != nil && migration.Down != nil) {
+		return fmt.Errorf("database: migration %d_%s is defined twice", migration.Version, migration.Name)
+	}
+	if migration.UpSQL != "" {
+		existing.UpSQL = migration.UpSQL
+	}
+	if migration.DownSQL != "" {
+		existing.DownSQL = migration.DownSQL
+	}
+	if migration.Up != nil {
+		existing.Up = migration.Up
+	}
+	if migration.Down != nil {
+		existing.Down = migration.Down
+	}
+	return nil
+}
+
+// Migrations returns the migrations ordered by version
+func (m *Migrator) Migrations() []*Migration {
+	return m.migrations
+}
+
+func (m *Migrator) table() *gorm.DB {
+	return m.db.Session(&gorm.Session{NewDB: true}).Table(m.option.Table)
+}
+
+// appliedRecords returns the records of applied migrations by version,
+// the migration table is created if not exists and create
+func (m *Migrator) appliedRecords(create bool) (map[int64]*MigrationRecord, error) {
+	if !m.db.Migrator().HasTable(m.option.Table) {
+		if !create {
+			return map[int64]*MigrationRecord{}, nil
+		}
+		if err := m.table().AutoMigrate(&MigrationRecord{}); err != nil {
+			return nil, err
+		}
+	}
+	var records []*MigrationRecord
+	if err := m.table().Order("version").Find(&records).Error; err != nil {
+		return nil, err
+	}
+	applied := make(map[int64]*MigrationRecord, len(records))
+	for _, record := range records {
+		applied[record.Version] = record
+	}
+	return applied, nil
+}
+
+// Status returns the status of all migrations, including applied versions not found any more
+func (m *Migrator) Status() ([]*MigrationStatus, error) {
+	applied, err := m.appliedRecords(false)
+	if err != nil {
+		return nil, err
+	}
+	var statuses []*MigrationStatus
+	for _, migration := range m.migrations {
+		status := &MigrationStatus{Version: migration.Version, Name: migration.Name}
+		if record, ok := applied[migration.Version]; ok {
+			status.Applied = true
+			status.AppliedAt = record.AppliedAt
+			delete(applied, migration.Version)
+		}
+		statuses = append(statuses, status)
+	}
+	for _, record := range applied {
+		statuses = append(statuses, &MigrationStatus{Version: record.Version, Name: record.Name, Applied: true, AppliedAt: record.AppliedAt, Missing: true})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+	return statuses, nil
+}
+
+// Up applies the pending migrations up to version target, all if target is 0,
+// and returns the applied migrations
+func (m *Migrator) Up(target int64) ([]*Migration, error) {
+	var done []*Migration
+	err := m.withLock(func() error {
+		applied, err := m.appliedRecords(!m.option.DryRun)
+		if err != nil {
+			return err
+		}
+		for _, migration := range m.migrations {
+			if target > 0 && migration.Version > target {
+				break
+			}
+			if _, ok := applied[migration.Version]; ok {
+				continue
+			}
+			if err := m.apply(migration, true); err != nil {
+				return err
+			}
+			done = append(done, migration)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Down reverts the latest steps applied migrations and returns the reverted migrations
+func (m *Migrator) Down(steps int) ([]*Migration, error) {
+	var done []*Migration
+	err := m.withLock(func() error {
+		applied, err := m.appliedRecords(!m.option.DryRun)
+		if err != nil {
+			return err
+		}
+		for i := len(m.migrations) - 1; i >= 0 && len(done) < steps; i-- {
+			migration := m.migrations[i]
+			if _, ok := applied[migration.Version]; !ok {
+				continue
+			}
+			if err := m.apply(migration, false); err != nil {
+				return err
+			}
+			done = append(done, migration)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// apply runs a migration up or down in a transaction with its record.
+// Note DDL statements of mysql are committed implicitly and can't be rolled back.
+func (m *Migrator) apply(migration *Migration, up bool) error {
+	direction, script, fn := "down", migration.DownSQL, migration.Down
+	if up {
+		direction, script, fn = "up", migration.UpSQL, migration.Up
+	}
+	statements := SplitSQLStatements(script)
+	if m.option.DryRun {
+		fmt.Fprintf(m.option.Out, "-- %s %d_%s\n", direction, migration.Version, migration.Name)
+		for _, statement := range statements {
+			fmt.Fprintf(m.option.Out, "%s;\n", statement)
+		}
+		if fn != nil {
+			fmt.Fprintf(m.option.Out, "-- go migration func\n")
+		}
+		return nil
+	}
+
+	Log.Info("Apply migration", With("version", migration.Version), With("name", migration.Name), With("direction", direction))
+	err := m.db.Session(&gorm.Session{NewDB: true}).Transaction(func(tx *gorm.DB) error {
+		for _, statement := range statements {
+			if err := tx.Exec(statement).Error; err != nil {
+				return err
+			}
+		}
+		if fn != nil {
+			if err := fn(tx); err != nil {
+				return err
+			}
+		}
+		if up {
+			return tx.Table(m.option.Table).Create(&MigrationRecord{Version: migration.Version, Name: migration.Name, AppliedAt: time.Now()}).Error
+		}
+		return tx.Table(m.option.Table).Where("version = ?", migration.Version).Delete(&MigrationRecord{}).Error
+	})
+	if err != nil {
+		Log.Error("Failed to apply migration", With("version", migration.Version), With("name", migration.Name), With("direction", direction), WithError(err))
+		return fmt.Errorf("database: migration %d_%s %s: %w", migration.Version, migration.Name, direction, err)
+	}
+	return nil
+}
+
+// withLock runs fn holding a lock so only one instance migrates the database,
+// mysql GET_LOCK is used, other databases are not locked.
+func (m *Migrator) withLock(fn func() error) error {
+	if m.db.Dialector.Name() != "mysql" {
+		return fn()
+	}
+	sqlDB, err := m.db.DB()
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	// the lock is held by the session of the connection, so keep the connection until released
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	lockName := "migrate_" + m.option.Table
+	var locked sql.NullInt64
+	if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", lockName, int(m.option.LockTimeout/time.Second)).Scan(&locked); err != nil {
+		return err
+	}
+	if locked.Int64 != 1 {
+		return fmt.Errorf("database: failed to lock %s, another instance is migrating", lockName)
+	}
+	defer func() {
+		if _, err := conn.ExecContext(ctx, "SELECT RELEASE_LOCK(?)", lockName); err != nil {
+			Log.Error("Failed to release migration lock", WithError(err))
+		}
+	}()
+	return fn()
+}
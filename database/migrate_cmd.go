@@ -0,0 +1,165 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/astaxie/beego"
+	mysqlDriver "github.com/go-sql-driver/mysql"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+)
+
+const migrateUsage = `usage: migrate [flags] command [arg]
+
+commands:
+  create          create the database of the dsn, drop it first if -drop
+  up [version]    apply pending migrations up to version, all if omitted
+  down [steps]    revert the latest steps applied migrations, 1 if omitted
+  status          print the status of migrations
+
+flags:
+`
+
+// RunMigrateCommand runs the migration command line, services with Go migrations
+// registered by RegisterMigration can call it in their own main to migrate.
+func RunMigrateCommand(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	flags.SetOutput(out)
+	conf := flags.String("conf", "", "app config file in ini, the dsn is read from its db key")
+	dsn := flags.String("dsn", "", "mysql dsn, e.g. user:pass@tcp(localhost:3306)/db?parseTime=True")
+	dir := flags.String("dir", "migrations", "directory of <version>_<name>.up.sql and .down.sql files")
+	table := flags.String("table", DEFAULT_MIGRATION_TABLE, "table of applied versions")
+	dryRun := flags.Bool("dry-run", false, "print the SQL to run instead of running it")
+	drop := flags.Bool("drop", false, "drop the database before create")
+	flags.Usage = func() {
+		fmt.Fprint(out, migrateUsage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *dsn == "" && *conf != "" {
+		if err := beego.LoadAppConfig("ini", *conf); err != nil {
+			return err
+		}
+		*dsn = beego.AppConfig.String("db")
+	}
+	if *dsn == "" || flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("database: dsn and command are required")
+	}
+
+	command := flags.Arg(0)
+	if command == "create" {
+		return createDatabase(*dsn, *drop, *dryRun, out)
+	}
+
+	db, err := gorm.Open(mysql.Open(*dsn), &gorm.Config{})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	}()
+	migrator, err := NewMigrator(db, &MigratorOption{Table: *table, Dir: *dir, DryRun: *dryRun, Out: out})
+	if err != nil {
+		return err
+	}
+
+	switch command {
+	case "up":
+		var target int64
+		if flags.NArg() > 1 {
+			if target, err = strconv.ParseInt(flags.Arg(1), 10, 64); err != nil {
+				return err
+			}
+		}
+		migrations, err := migrator.Up(target)
+		printMigrations(out, "applied", migrations, *dryRun)
+		return err
+	case "down":
+		steps := 1
+		if flags.NArg() > 1 {
+			if steps, err = strconv.Atoi(flags.Arg(1)); err != nil {
+				return err
+			}
+		}
+		migrations, err := migrator.Down(steps)
+		printMigrations(out, "reverted", migrations, *dryRun)
+		return err
+	case "status":
+		statuses, err := migrator.Status()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tSTATUS\tAPPLIED AT")
+		for _, status := range statuses {
+			state, appliedAt := "pending", ""
+			if status.Applied {
+				state, appliedAt = "applied", status.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			if status.Missing {
+				state = "missing"
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", status.Version, status.Name, state, appliedAt)
+		}
+		return w.Flush()
+	}
+	flags.Usage()
+	return fmt.Errorf("database: unknown migrate command %s", command)
+}
+
+func printMigrations(out io.Writer, action string, migrations []*Migration, dryRun bool) {
+	if dryRun {
+		return
+	}
+	for _, migration := range migrations {
+		fmt.Fprintf(out, "%s %d_%s\n", action, migration.Version, migration.Name)
+	}
+}
+
+// createDatabase creates the database of dsn with utf8mb4, drops it first if drop
+func createDatabase(dsn string, drop, dryRun bool, out io.Writer) error {
+	config, err := mysqlDriver.ParseDSN(dsn)
+	if err != nil {
+		return err
+	}
+	name := config.DBName
+	if name == "" {
+		return errors.New("database: no database in dsn")
+	}
+	var statements []string
+	if drop {
+		statements = append(statements, fmt.Sprintf("DROP DATABASE IF EXISTS `%s`", name))
+	}
+	statements = append(statements, fmt.Sprintf("CREATE DATABASE IF NOT EXISTS `%s` DEFAULT CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci", name))
+	if dryRun {
+		for _, statement := range statements {
+			fmt.Fprintf(out, "%s;\n", statement)
+		}
+		return nil
+	}
+
+	config.DBName = ""
+	db, err := sql.Open("mysql", config.FormatDSN())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(out, "created database %s\n", name)
+	return nil
+}
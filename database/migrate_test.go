@@ -0,0 +1,104 @@
+package database
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/yiGmMk/pz-infra-new/logging"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestMigrator(t *testing.T) {
+	logger, err := (&logging.LogrusProvider{}).New(&logging.LogrusOption{Out: ioutil.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logging.Log = logger
+
+	dir, err := ioutil.TempDir("", "migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"1_create_user.up.sql":    "CREATE TABLE user (id INTEGER PRIMARY KEY, name TEXT);\nCREATE INDEX idx_user_name ON user (name);",
+		"1_create_user.down.sql":  "DROP TABLE user;",
+		"3_create_order.up.sql":   "CREATE TABLE `order` (id INTEGER PRIMARY KEY, remark TEXT DEFAULT 'a;b');",
+		"3_create_order.down.sql": "DROP TABLE `order`;",
+		"README.md":               "not a migration",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	RegisterMigration(2, "seed_user", func(tx *gorm.DB) error {
+		return tx.Exec("INSERT INTO user (id, name) VALUES (1, 'admin')").Error
+	}, func(tx *gorm.DB) error {
+		return tx.Exec("DELETE FROM user WHERE id = 1").Error
+	})
+	defer func() { registeredMigrations = nil }()
+
+	Convey("test migrator", t, func() {
+		db, err := gorm.Open(sqlite.Open(filepath.Join(dir, "test.db")), &gorm.Config{})
+		So(err, ShouldBeNil)
+		defer os.Remove(filepath.Join(dir, "test.db"))
+
+		out := &bytes.Buffer{}
+		dryRun, err := NewMigrator(db, &MigratorOption{Dir: dir, DryRun: true, Out: out})
+		So(err, ShouldBeNil)
+		So(len(dryRun.Migrations()), ShouldEqual, 3)
+		_, err = dryRun.Up(0)
+		So(err, ShouldBeNil)
+		So(out.String(), ShouldContainSubstring, "-- up 1_create_user\nCREATE TABLE user")
+		So(out.String(), ShouldContainSubstring, "-- up 2_seed_user\n-- go migration func")
+		So(db.Migrator().HasTable(DEFAULT_MIGRATION_TABLE), ShouldBeFalse)
+
+		migrator, err := NewMigrator(db, &MigratorOption{Dir: dir})
+		So(err, ShouldBeNil)
+		applied, err := migrator.Up(2)
+		So(err, ShouldBeNil)
+		So(len(applied), ShouldEqual, 2)
+		var count int64
+		db.Table("user").Count(&count)
+		So(count, ShouldEqual, 1)
+
+		applied, err = migrator.Up(0)
+		So(err, ShouldBeNil)
+		So(len(applied), ShouldEqual, 1)
+		So(applied[0].Name, ShouldEqual, "create_order")
+
+		statuses, err := migrator.Status()
+		So(err, ShouldBeNil)
+		So(len(statuses), ShouldEqual, 3)
+		for _, status := range statuses {
+			So(status.Applied, ShouldBeTrue)
+		}
+
+		reverted, err := migrator.Down(2)
+		So(err, ShouldBeNil)
+		So(len(reverted), ShouldEqual, 2)
+		So(reverted[0].Version, ShouldEqual, 3)
+		So(db.Migrator().HasTable("order"), ShouldBeFalse)
+		db.Table("user").Count(&count)
+		So(count, ShouldEqual, 0)
+
+		statuses, err = migrator.Status()
+		So(err, ShouldBeNil)
+		So(statuses[0].Applied, ShouldBeTrue)
+		So(statuses[1].Applied, ShouldBeFalse)
+	})
+
+	Convey("test duplicated migration version", t, func() {
+		RegisterMigration(1, "other", nil, nil)
+		defer func() { registeredMigrations = registeredMigrations[:1] }()
+		_, err := NewMigrator(nil, &MigratorOption{Dir: dir})
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,154 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/yiGmMk/pz-infra-new/log"
+	"github.com/yiGmMk/pz-infra-new/logging"
+
+	"github.com/astaxie/beego"
+	"gorm.io/gorm"
+	"gorm.io/plugin/dbresolver"
+)
+
+const DEFAULT_DB_NAME = "default"
+
+var (
+	dbs          = make(map[string]*gorm.DB)
+	replicaPools = make(map[string][]*sql.DB)
+	statsStops   = make(map[string]chan struct{})
+	dbsLock      sync.RWMutex
+)
+
+// DBConfig describes a database and its read replicas
+type DBConfig struct {
+	Name     string    // DEFAULT_DB_NAME if empty
+	Source   string    // connect string of the primary, writes and transactions go to it
+	Replicas []string  // connect strings of the read replicas, reads are routed to them randomly
+	Option   *DBOption // DefaultDBOption() if nil
+}
+
+// RegisterDB opens the database of config and registers it by name
+func RegisterDB(config *DBConfig, infraLogger logging.Logger) error {
+	name := config.Name
+	if name == "" {
+		name = DEFAULT_DB_NAME
+	}
+	option := config.Option
+	if option == nil {
+		option = DefaultDBOption()
+	}
+	db, replicas, err := openDBWithRetry(config.Source, config.Replicas, option, infraLogger)
+	if err != nil {
+		log.Errorf("init db %s failed: %s", name, err.Error())
+		return err
+	}
+	setDB(name, db, replicas)
+	if option.StatsInterval > 0 {
+		stop := make(chan struct{})
+		dbsLock.Lock()
+		statsStops[name] = stop
+		dbsLock.Unlock()
+		startStatsExporter(name, option, stop)
+	}
+	return nil
+}
+
+// InitDBsFromConfig registers the default database of "db" and "dbReplicas",
+// and the databases listed in "dbNames" of "<name>::db" and "<name>::dbReplicas",
+// the replicas are separated by ";". The pool is set by the keys read by getDBOption.
+func InitDBsFromConfig(infraLogger logging.Logger) error {
+	configs := []*DBConfig{{
+		Name:     DEFAULT_DB_NAME,
+		Source:   beego.AppConfig.String("db"),
+		Replicas: beego.AppConfig.Strings("dbReplicas"),
+		Option:   getDBOption(""),
+	}}
+	for _, name := range beego.AppConfig.Strings("dbNames") {
+		configs = append(configs, &DBConfig{
+			Name:     name,
+			Source:   beego.AppConfig.String(name + "::db"),
+			Replicas: beego.AppConfig.Strings(name + "::dbReplicas"),
+			Option:   getDBOption(name + "::"),
+		})
+	}
+	for _, config := range configs {
+		if config.Source == "" {
+			continue
+		}
+		if err := RegisterDB(config, infraLogger); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetNamedDB registers db by name, it replaces the db registered before
+func SetNamedDB(name string, db *gorm.DB) {
+	setDB(name, db, nil)
+}
+
+func setDB(name string, db *gorm.DB, replicas []*sql.DB) {
+	dbsLock.Lock()
+	defer dbsLock.Unlock()
+	if stop, ok := statsStops[name]; ok {
+		close(stop)
+		delete(statsStops, name)
+	}
+	dbs[name] = db
+	replicaPools[name] = replicas
+	if name == DEFAULT_DB_NAME {
+		globalDB = db
+	}
+}
+
+func getReplicaPools(name string) []*sql.DB {
+	dbsLock.RLock()
+	defer dbsLock.RUnlock()
+	return replicaPools[name]
+}
+
+// LookupDB returns the database registered by name
+func LookupDB(name string) (*gorm.DB, error) {
+	dbsLock.RLock()
+	defer dbsLock.RUnlock()
+	db, ok := dbs[name]
+	if !ok {
+		return nil, fmt.Errorf("database: db %s is not registered", name)
+	}
+	return db, nil
+}
+
+// DBNames returns the names of registered databases
+func DBNames() []string {
+	dbsLock.RLock()
+	defer dbsLock.RUnlock()
+	names := make([]string, 0, len(dbs))
+	for name := range dbs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// mustGetDB returns the database of name or the default database, panics if not registered
+func mustGetDB(name ...string) *gorm.DB {
+	db, err := LookupDB(dbName(name...))
+	if err != nil {
+		panic(err)
+	}
+	return db
+}
+
+// UsePrimary routes the queries of db to the primary, use it to read data just written
+func UsePrimary(db *gorm.DB) *gorm.DB {
+	return db.Clauses(dbresolver.Write)
+}
+
+// GetPrimaryDB is GetDB with all queries routed to the primary
+func GetPrimaryDB(name ...string) *gorm.DB {
+	return UsePrimary(GetDB(name...))
+}
@@ -0,0 +1,354 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	. "github.com/yiGmMk/pz-infra-new/logging"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	OUTBOX_TABLE = "outbox_events"
+
+	OUTBOX_STATUS_PENDING   = 0
+	OUTBOX_STATUS_PUBLISHED = 1
+	OUTBOX_STATUS_FAILED    = 2 // attempts are used up, see RetryFailedOutboxEvents
+
+	DEFAULT_OUTBOX_BATCH_SIZE        = 100
+	DEFAULT_OUTBOX_POLL_INTERVAL     = time.Second
+	DEFAULT_OUTBOX_MAX_ATTEMPTS      = 10
+	DEFAULT_OUTBOX_RETRY_BACKOFF     = time.Second
+	DEFAULT_OUTBOX_MAX_RETRY_BACKOFF = 10 * time.Minute
+	DEFAULT_OUTBOX_RETAIN_PUBLISHED  = 7 * 24 * time.Hour
+	DEFAULT_OUTBOX_CLEANUP_INTERVAL  = time.Hour
+)
+
+// OutboxEvent is an event saved in the transaction of the data change and published later by OutboxRelay
+type OutboxEvent struct {
+	ID            int64      `gorm:"column:id;primaryKey"`
+	Topic         string     `gorm:"column:topic;size:255;not null"`
+	Key           string     `gorm:"column:event_key;size:255"` // events of a key are published in order unless retried
+	Payload       string     `gorm:"column:payload;type:text"`
+	Status        int        `gorm:"column:status;not null;index:idx_outbox_status_next_attempt,priority:1"`
+	Attempts      int        `gorm:"column:attempts;not null"`
+	LastError     string     `gorm:"column:last_error;size:1024"`
+	NextAttemptAt time.Time  `gorm:"column:next_attempt_at;index:idx_outbox_status_next_attempt,priority:2"`
+	CreatedAt     time.Time  `gorm:"column:created_at"`
+	PublishedAt   *time.Time `gorm:"column:published_at"`
+}
+
+func (OutboxEvent) TableName() string {
+	return OUTBOX_TABLE
+}
+
+// AutoMigrateOutbox creates the outbox table of the database if not exists
+func AutoMigrateOutbox(name ...string) error {
+	return GetDB(name...).AutoMigrate(&OutboxEvent{})
+}
+
+var (
+	outboxSignals     = map[string]chan struct{}{}
+	outboxSignalsLock sync.Mutex
+)
+
+// outboxSignal returns the channel waking up a relay of the database when an event is committed to it,
+// so it's published before the next poll
+func outboxSignal(name string) chan struct{} {
+	outboxSignalsLock.Lock()
+	defer outboxSignalsLock.Unlock()
+	signal, ok := outboxSignals[name]
+	if !ok {
+		signal = make(chan struct{}, 1)
+		outboxSignals[name] = signal
+	}
+	return signal
+}
+
+// PublishOutbox saves an event with the payload marshaled to JSON in the transaction of ctx,
+// so the event is published if and only if the transaction is committed.
+// It's saved at once if ctx carries no transaction of WithTx.
+func PublishOutbox(ctx context.Context, topic, key string, payload interface{}, name ...string) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return SaveOutboxEvent(ctx, &OutboxEvent{Topic: topic, Key: key, Payload: string(data)}, name...)
+}
+
+// SaveOutboxEvent saves event in the transaction of ctx, see PublishOutbox
+func SaveOutboxEvent(ctx context.Context, event *OutboxEvent, name ...string) error {
+	event.Status = OUTBOX_STATUS_PENDING
+	if event.NextAttemptAt.IsZero() {
+		event.NextAttemptAt = time.Now()
+	}
+	if err := GetDBFromContext(ctx, name...).Create(event).Error; err != nil {
+		Log.Error("Failed to save outbox event", With("topic", event.Topic), With("key", event.Key), WithError(err))
+		return err
+	}
+	signal := outboxSignal(dbName(name...))
+	AfterCommit(ctx, func() {
+		select {
+		case signal <- struct{}{}:
+		default:
+		}
+	}, name...)
+	return nil
+}
+
+// RetryFailedOutboxEvents resets the failed events of topics, or all topics if empty, to be published again
+func RetryFailedOutboxEvents(ctx context.Context, topics []string, name ...string) (int64, error) {
+	db := GetDBFromContext(ctx, name...).Model(&OutboxEvent{}).Where("status = ?", OUTBOX_STATUS_FAILED)
+	if len(topics) > 0 {
+		db = db.Where("topic IN ?", topics)
+	}
+	result := db.Updates(map[string]interface{}{"status": OUTBOX_STATUS_PENDING, "attempts": 0, "next_attempt_at": time.Now()})
+	return result.RowsAffected, result.Error
+}
+
+// Publisher publishes the events of the outbox to a message broker
+type Publisher interface {
+	Publish(ctx context.Context, event *OutboxEvent) error
+}
+
+// PublisherFunc is a function Publisher
+type PublisherFunc func(ctx context.Context, event *OutboxEvent) error
+
+func (f PublisherFunc) Publish(ctx context.Context, event *OutboxEvent) error {
+	return f(ctx, event)
+}
+
+// LogPublisher writes the events to the logger, for development and tests.
+// See redisstream.Publisher for redis streams.
+type LogPublisher struct{}
+
+func (LogPublisher) Publish(ctx context.Context, event *OutboxEvent) error {
+	Log.Info("Outbox event", With("id", event.ID), With("topic", event.Topic), With("key", event.Key), With("payload", event.Payload))
+	return nil
+}
+
+// OutboxRelayOption is used to set how OutboxRelay publishes events
+type OutboxRelayOption struct {
+	DBName          string        // name of the registered database, the default database if empty
+	BatchSize       int           // events claimed in a transaction, DEFAULT_OUTBOX_BATCH_SIZE if 0
+	PollInterval    time.Duration // DEFAULT_OUTBOX_POLL_INTERVAL if 0
+	MaxAttempts     int           // the event is failed after, DEFAULT_OUTBOX_MAX_ATTEMPTS if 0
+	RetryBackoff    time.Duration // delay before the first retry, doubled on each retry, DEFAULT_OUTBOX_RETRY_BACKOFF if 0
+	MaxRetryBackoff time.Duration // DEFAULT_OUTBOX_MAX_RETRY_BACKOFF if 0
+	RetainPublished time.Duration // published events are deleted after, DEFAULT_OUTBOX_RETAIN_PUBLISHED if 0
+	CleanupInterval time.Duration // DEFAULT_OUTBOX_CLEANUP_INTERVAL if 0
+}
+
+func (o *OutboxRelayOption) withDefaults() OutboxRelayOption {
+	opt := OutboxRelayOption{}
+	if o != nil {
+		opt = *o
+	}
+	if opt.BatchSize <= 0 {
+		opt.BatchSize = DEFAULT_OUTBOX_BATCH_SIZE
+	}
+	if opt.PollInterval <= 0 {
+		opt.PollInterval = DEFAULT_OUTBOX_POLL_INTERVAL
+	}
+	if opt.MaxAttempts <= 0 {
+		opt.MaxAttempts = DEFAULT_OUTBOX_MAX_ATTEMPTS
+	}
+	if opt.RetryBackoff <= 0 {
+		opt.RetryBackoff = DEFAULT_OUTBOX_RETRY_BACKOFF
+	}
+	if opt.MaxRetryBackoff <= 0 {
+		opt.MaxRetryBackoff = DEFAULT_OUTBOX_MAX_RETRY_BACKOFF
+	}
+	if opt.RetainPublished <= 0 {
+		opt.RetainPublished = DEFAULT_OUTBOX_RETAIN_PUBLISHED
+	}
+	if opt.CleanupInterval <= 0 {
+		opt.CleanupInterval = DEFAULT_OUTBOX_CLEANUP_INTERVAL
+	}
+	return opt
+}
+
+// backoff returns the delay before the next attempt after attempts failed
+func (o *OutboxRelayOption) backoff(attempts int) time.Duration {
+	delay := o.RetryBackoff
+	for i := 1; i < attempts && delay < o.MaxRetryBackoff; i++ {
+		delay *= 2
+	}
+	if delay > o.MaxRetryBackoff {
+		delay = o.MaxRetryBackoff
+	}
+	return delay
+}
+
+// OutboxRelay claims the pending events and publishes them. Events are published at least once,
+// a consumer should be idempotent by the event id. Relays of several instances can run together,
+// on mysql the events are claimed by SELECT ... FOR UPDATE SKIP LOCKED so they don't block each other.
+type OutboxRelay struct {
+	publisher Publisher
+	option    OutboxRelayOption
+	lock      sync.Mutex
+	stop      chan struct{} // nil until Start
+	stopOnce  sync.Once
+	wg        sync.WaitGroup
+}
+
+// NewOutboxRelay returns a relay publishing events by publisher
+func NewOutboxRelay(publisher Publisher, option *OutboxRelayOption) *OutboxRelay {
+	return &OutboxRelay{publisher: publisher, option: option.withDefaults()}
+}
+
+// Start publishes the events in the background until Stop, it's started once only
+func (r *OutboxRelay) Start() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.stop != nil {
+		return
+	}
+	r.stop = make(chan struct{})
+	signal := outboxSignal(dbName(r.option.DBName))
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			<-r.stop
+			cancel()
+		}()
+
+		poll := time.NewTicker(r.option.PollInterval)
+		defer poll.Stop()
+		cleanup := time.NewTicker(r.option.CleanupInterval)
+		defer cleanup.Stop()
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-cleanup.C:
+				r.Cleanup(ctx)
+			case <-poll.C:
+				r.drain(ctx)
+			case <-signal:
+				r.drain(ctx)
+			}
+		}
+	}()
+}
+
+// Stop stops the relay and waits for the claimed events, it does nothing if the relay is not started
+func (r *OutboxRelay) Stop() {
+	r.lock.Lock()
+	stop := r.stop
+	r.lock.Unlock()
+	if stop == nil {
+		return
+	}
+	r.stopOnce.Do(func() { close(stop) })
+	r.wg.Wait()
+}
+
+// drain publishes until less than a batch is published
+func (r *OutboxRelay) drain(ctx context.Context) {
+	for ctx.Err() == nil {
+		published, err := r.RunOnce(ctx)
+		if err != nil || published < r.option.BatchSize {
+			return
+		}
+	}
+}
+
+// RunOnce claims a batch of due events and publishes them, it returns the number of published events
+func (r *OutboxRelay) RunOnce(ctx context.Context) (int, error) {
+	published := 0
+	// the claimed rows are locked until the results are saved, so other relays skip them
+	err := WithTx(ctx, func(ctx context.Context, tx *gorm.DB) error {
+		query := tx.Where("status = ? AND next_attempt_at <= ?", OUTBOX_STATUS_PENDING, time.Now()).
+			Order("id").Limit(r.option.BatchSize)
+		if tx.Dialector.Name() == "mysql" {
+			query = query.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"})
+		}
+		var events []*OutboxEvent
+		if err := query.Find(&events).Error; err != nil {
+			return err
+		}
+		failedKeys := make(map[string]bool)
+		for _, event := range events {
+			if event.Key != "" && failedKeys[event.Key] {
+				// keep the events of the key after the failed one in order
+				continue
+			}
+			if err := r.publish(ctx, tx, event); err != nil {
+				return err
+			}
+			if event.Status == OUTBOX_STATUS_PUBLISHED {
+				published++
+			} else if event.Key != "" {
+				failedKeys[event.Key] = true
+			}
+		}
+		return nil
+	}, &TxOption{DBName: r.option.DBName})
+	if err != nil {
+		Log.Error("Failed to relay outbox events", WithError(err))
+	}
+	return published, err
+}
+
+// publish publishes an event and saves the result, the error of saving is returned
+func (r *OutboxRelay) publish(ctx context.Context, tx *gorm.DB, event *OutboxEvent) error {
+	updates := map[string]interface{}{}
+	if err := r.publisher.Publish(ctx, event); err != nil {
+		event.Attempts++
+		lastError := err.Error()
+		if len(lastError) > 1024 {
+			lastError = lastError[:1024]
+		}
+		updates["attempts"] = event.Attempts
+		updates["last_error"] = lastError
+		if event.Attempts >= r.option.MaxAttempts {
+			event.Status = OUTBOX_STATUS_FAILED
+			Log.Error("Outbox event failed", With("id", event.ID), With("topic", event.Topic), With("attempts", event.Attempts), WithError(err))
+		} else {
+			updates["next_attempt_at"] = time.Now().Add(r.option.backoff(event.Attempts))
+			Log.Warn("Failed to publish outbox event", With("id", event.ID), With("topic", event.Topic), With("attempts", event.Attempts), WithError(err))
+		}
+	} else {
+		now := time.Now()
+		event.Status, event.PublishedAt = OUTBOX_STATUS_PUBLISHED, &now
+		updates["published_at"] = now
+	}
+	updates["status"] = event.Status
+	return tx.Model(event).Updates(updates).Error
+}
+
+// Cleanup deletes the events published before RetainPublished, in batches so the table is not locked long
+func (r *OutboxRelay) Cleanup(ctx context.Context) (int64, error) {
+	var deleted int64
+	before := time.Now().Add(-r.option.RetainPublished)
+	for ctx.Err() == nil {
+		var ids []int64
+		db := GetDB(r.option.DBName).WithContext(ctx)
+		if err := db.Model(&OutboxEvent{}).Where("status = ? AND published_at < ?", OUTBOX_STATUS_PUBLISHED, before).
+			Order("id").Limit(r.option.BatchSize).Pluck("id", &ids).Error; err != nil {
+			Log.Error("Failed to cleanup outbox events", WithError(err))
+			return deleted, err
+		}
+		if len(ids) == 0 {
+			break
+		}
+		result := db.Where("id IN ?", ids).Delete(&OutboxEvent{})
+		if result.Error != nil {
+			Log.Error("Failed to cleanup outbox events", WithError(result.Error))
+			return deleted, result.Error
+		}
+		deleted += result.RowsAffected
+		if len(ids) < r.option.BatchSize {
+			break
+		}
+	}
+	return deleted, ctx.Err()
+}
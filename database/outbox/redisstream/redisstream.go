@@ -0,0 +1,28 @@
+package redisstream
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/yiGmMk/pz-infra-new/database"
+	"github.com/yiGmMk/pz-infra-new/redisUtil"
+)
+
+// Publisher is a database.Publisher appending the outbox events to the redis stream StreamPrefix + topic.
+// It lives out of database and redisUtil, so neither of them depends on the other.
+type Publisher struct {
+	StreamPrefix string
+	MaxLen       int64 // the stream is trimmed to about MaxLen entries, not trimmed if 0
+}
+
+func (p *Publisher) Publish(ctx context.Context, event *database.OutboxEvent) error {
+	_, err := redisUtil.XAdd(p.StreamPrefix+event.Topic, p.MaxLen,
+		"id", strconv.FormatInt(event.ID, 10),
+		"topic", event.Topic,
+		"key", event.Key,
+		"payload", event.Payload,
+		"created_at", event.CreatedAt.Format(time.RFC3339Nano),
+	)
+	return err
+}
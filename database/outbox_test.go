@@ -0,0 +1,142 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yiGmMk/pz-infra-new/logging"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestOutbox(t *testing.T) {
+	logger, err := (&logging.LogrusProvider{}).New(&logging.LogrusOption{Out: ioutil.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logging.Log = logger
+
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := gorm.Open(sqlite.Open(filepath.Join(dir, "test.db")), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetNamedDB("outbox", db)
+	if err := AutoMigrateOutbox("outbox"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	txOption := &TxOption{DBName: "outbox"}
+	var lock sync.Mutex
+	var published []string
+	failing := map[string]bool{}
+	publisher := PublisherFunc(func(ctx context.Context, event *OutboxEvent) error {
+		lock.Lock()
+		defer lock.Unlock()
+		if failing[event.Payload] {
+			return errors.New("broker is down")
+		}
+		published = append(published, event.Payload)
+		return nil
+	})
+	relay := NewOutboxRelay(publisher, &OutboxRelayOption{DBName: "outbox", MaxAttempts: 2, RetryBackoff: time.Millisecond, RetainPublished: time.Nanosecond})
+
+	Convey("test events are saved only if committed", t, func() {
+		So(WithTx(ctx, func(ctx context.Context, tx *gorm.DB) error {
+			So(PublishOutbox(ctx, "order", "1", map[string]int{"id": 1}, "outbox"), ShouldBeNil)
+			return errors.New("rollback")
+		}, txOption), ShouldNotBeNil)
+		So(WithTx(ctx, func(ctx context.Context, tx *gorm.DB) error {
+			return PublishOutbox(ctx, "order", "2", map[string]int{"id": 2}, "outbox")
+		}, txOption), ShouldBeNil)
+
+		count, err := relay.RunOnce(ctx)
+		So(err, ShouldBeNil)
+		So(count, ShouldEqual, 1)
+		So(published, ShouldResemble, []string{`{"id":2}`})
+	})
+
+	Convey("test failed events are retried in order of key", t, func() {
+		published = nil
+		failing["a"] = true
+		for _, payload := range []string{"a", "b"} {
+			So(SaveOutboxEvent(ctx, &OutboxEvent{Topic: "order", Key: "3", Payload: payload}, "outbox"), ShouldBeNil)
+		}
+		So(SaveOutboxEvent(ctx, &OutboxEvent{Topic: "order", Key: "4", Payload: "c"}, "outbox"), ShouldBeNil)
+
+		count, err := relay.RunOnce(ctx)
+		So(err, ShouldBeNil)
+		So(count, ShouldEqual, 1)
+		So(published, ShouldResemble, []string{"c"})
+		var first OutboxEvent
+		So(db.Where("payload = ?", "a").Take(&first).Error, ShouldBeNil)
+		So(first.Attempts, ShouldEqual, 1)
+		So(first.LastError, ShouldEqual, "broker is down")
+
+		time.Sleep(5 * time.Millisecond)
+		_, err = relay.RunOnce(ctx)
+		So(err, ShouldBeNil)
+		So(db.Where("payload = ?", "a").Take(&first).Error, ShouldBeNil)
+		So(first.Status, ShouldEqual, OUTBOX_STATUS_FAILED)
+
+		// the next event of the key is published once the failed one is given up
+		_, err = relay.RunOnce(ctx)
+		So(err, ShouldBeNil)
+		So(published, ShouldResemble, []string{"c", "b"})
+
+		failing["a"] = false
+		retried, err := RetryFailedOutboxEvents(ctx, []string{"order"}, "outbox")
+		So(err, ShouldBeNil)
+		So(retried, ShouldEqual, 1)
+		_, err = relay.RunOnce(ctx)
+		So(err, ShouldBeNil)
+		So(published, ShouldResemble, []string{"c", "b", "a"})
+	})
+
+	Convey("test cleanup published events", t, func() {
+		deleted, err := relay.Cleanup(ctx)
+		So(err, ShouldBeNil)
+		So(deleted, ShouldEqual, 4)
+		var count int64
+		So(db.Model(&OutboxEvent{}).Count(&count).Error, ShouldBeNil)
+		So(count, ShouldEqual, 0)
+	})
+
+	Convey("test relay is woken up by committed events", t, func() {
+		published = nil
+		relay := NewOutboxRelay(publisher, &OutboxRelayOption{DBName: "outbox", PollInterval: time.Hour})
+		relay.Start()
+		So(WithTx(ctx, func(ctx context.Context, tx *gorm.DB) error {
+			return PublishOutbox(ctx, "order", "5", "d", "outbox")
+		}, txOption), ShouldBeNil)
+		for i := 0; i < 100; i++ {
+			lock.Lock()
+			done := len(published) > 0
+			lock.Unlock()
+			if done {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		relay.Stop()
+		So(published, ShouldResemble, []string{`"d"`})
+		// relays of other databases are not woken up
+		So(len(outboxSignal("other")), ShouldEqual, 0)
+
+		So(relay.Stop, ShouldNotPanic)
+		So(NewOutboxRelay(publisher, nil).Stop, ShouldNotPanic)
+	})
+}
@@ -0,0 +1,278 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+const (
+	DEFAULT_PAGE_SIZE = 20
+	MAX_PAGE_SIZE     = 1000
+)
+
+// Scope adds conditions to the queries of pagination, e.g.
+// func(db *gorm.DB) *gorm.DB { return db.Where("status = ?", status) }
+type Scope func(db *gorm.DB) *gorm.DB
+
+// PageRequest is a request of offset pagination
+type PageRequest struct {
+	Page      int    // starting from 1, the first page if 0
+	PageSize  int    // DEFAULT_PAGE_SIZE if 0, MAX_PAGE_SIZE at most
+	OrderBy   string // column to sort by, the primary key if empty
+	Desc      bool
+	WithTotal bool // count the total rows, it's slow on big tables
+}
+
+// Page is the result of offset pagination
+type Page struct {
+	Page     int   `json:"page"`
+	PageSize int   `json:"page_size"`
+	HasMore  bool  `json:"has_more"`
+	Total    int64 `json:"total"` // -1 if not counted
+}
+
+// CursorRequest is a request of keyset pagination, which is stable and fast for deep pages
+type CursorRequest struct {
+	Cursor    string // NextCursor of the previous page, the first page if empty
+	Limit     int    // DEFAULT_PAGE_SIZE if 0, MAX_PAGE_SIZE at most
+	OrderBy   string // non null column to sort by, ties are sorted by the primary key, the primary key if empty
+	Desc      bool
+	WithTotal bool // count the total rows, it's slow on big tables
+}
+
+// CursorPage is the result of keyset pagination
+type CursorPage struct {
+	NextCursor string `json:"next_cursor"` // empty if no more
+	HasMore    bool   `json:"has_more"`
+	Total      int64  `json:"total"` // -1 if not counted
+}
+
+// cursor is the position after the last row of a page, the request is kept so it can't be mixed up
+type cursor struct {
+	OrderBy string        `json:"o"`
+	Desc    bool          `json:"d,omitempty"`
+	Values  []cursorValue `json:"v"`
+}
+
+// cursorValue keeps the type of time values, which are compared as strings by some databases
+type cursorValue struct {
+	Time  *time.Time  `json:"t,omitempty"`
+	Value interface{} `json:"v,omitempty"`
+}
+
+func (c *cursor) encode() (string, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeCursor(s string) (*cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	// numbers are kept as json.Number so big ids are not rounded
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	c := &cursor{}
+	if err := decoder.Decode(c); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+func (v cursorValue) value() interface{} {
+	if v.Time != nil {
+		return *v.Time
+	}
+	if number, ok := v.Value.(json.Number); ok {
+		return number.String()
+	}
+	return v.Value
+}
+
+func pageSize(size int) int {
+	if size <= 0 {
+		return DEFAULT_PAGE_SIZE
+	}
+	if size > MAX_PAGE_SIZE {
+		return MAX_PAGE_SIZE
+	}
+	return size
+}
+
+// orderFields returns the fields to sort by, orderBy and the primary key to break ties
+func orderFields(s *schema.Schema, orderBy string) ([]*schema.Field, error) {
+	primary := s.PrioritizedPrimaryField
+	if primary == nil {
+		return nil, ErrInvalidQuery
+	}
+	if orderBy == "" {
+		return []*schema.Field{primary}, nil
+	}
+	field := s.LookUpField(orderBy)
+	if field == nil || field.DBName == "" {
+		return nil, ErrInvalidQuery
+	}
+	if field == primary {
+		return []*schema.Field{primary}, nil
+	}
+	return []*schema.Field{field, primary}, nil
+}
+
+func orderBy(db *gorm.DB, fields []*schema.Field, desc bool) *gorm.DB {
+	for _, field := range fields {
+		db = db.Order(clause.OrderByColumn{Column: clause.Column{Table: clause.CurrentTable, Name: field.DBName}, Desc: desc})
+	}
+	return db
+}
+
+func (r *Repository) count(ctx context.Context, scopes []Scope) (int64, error) {
+	var total int64
+	if err := r.DB(ctx).Scopes(toGormScopes(scopes)...).Count(&total).Error; err != nil {
+		return 0, r.mapError("count", err)
+	}
+	return total, nil
+}
+
+func toGormScopes(scopes []Scope) []func(*gorm.DB) *gorm.DB {
+	funcs := make([]func(*gorm.DB) *gorm.DB, 0, len(scopes))
+	for _, scope := range scopes {
+		funcs = append(funcs, scope)
+	}
+	return funcs
+}
+
+// FindPage finds a page of the models matching scopes into dest, a pointer to a slice
+func (r *Repository) FindPage(ctx context.Context, dest interface{}, req *PageRequest, scopes ...Scope) (*Page, error) {
+	if req == nil {
+		req = &PageRequest{}
+	}
+	s, err := r.schema()
+	if err != nil {
+		return nil, r.mapError("find page", err)
+	}
+	fields, err := orderFields(s, req.OrderBy)
+	if err != nil {
+		return nil, err
+	}
+	page := &Page{Page: req.Page, PageSize: pageSize(req.PageSize), Total: -1}
+	if page.Page <= 0 {
+		page.Page = 1
+	}
+	if req.WithTotal {
+		if page.Total, err = r.count(ctx, scopes); err != nil {
+			return nil, err
+		}
+	}
+
+	// one more row is read to tell if there are more pages
+	db := orderBy(r.DB(ctx).Scopes(toGormScopes(scopes)...), fields, req.Desc).
+		Offset((page.Page - 1) * page.PageSize).Limit(page.PageSize + 1)
+	if err := db.Find(dest).Error; err != nil {
+		return nil, r.mapError("find page", err)
+	}
+	page.HasMore = truncate(dest, page.PageSize)
+	return page, nil
+}
+
+// FindByCursor finds the models after the cursor matching scopes into dest, a pointer to a slice
+func (r *Repository) FindByCursor(ctx context.Context, dest interface{}, req *CursorRequest, scopes ...Scope) (*CursorPage, error) {
+	if req == nil {
+		req = &CursorRequest{}
+	}
+	s, err := r.schema()
+	if err != nil {
+		return nil, r.mapError("find by cursor", err)
+	}
+	fields, err := orderFields(s, req.OrderBy)
+	if err != nil {
+		return nil, err
+	}
+	limit := pageSize(req.Limit)
+	page := &CursorPage{Total: -1}
+	if req.WithTotal {
+		if page.Total, err = r.count(ctx, scopes); err != nil {
+			return nil, err
+		}
+	}
+
+	db := r.DB(ctx).Scopes(toGormScopes(scopes)...)
+	if req.Cursor != "" {
+		c, err := decodeCursor(req.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		if c.OrderBy != fields[0].DBName || c.Desc != req.Desc || len(c.Values) != len(fields) {
+			return nil, ErrInvalidCursor
+		}
+		db = db.Where(afterCursor(fields, c.Values, req.Desc))
+	}
+	if err := orderBy(db, fields, req.Desc).Limit(limit + 1).Find(dest).Error; err != nil {
+		return nil, r.mapError("find by cursor", err)
+	}
+	page.HasMore = truncate(dest, limit)
+	if !page.HasMore {
+		return page, nil
+	}
+
+	rows := reflect.Indirect(reflect.ValueOf(dest))
+	last := reflect.Indirect(rows.Index(rows.Len() - 1))
+	next := &cursor{OrderBy: fields[0].DBName, Desc: req.Desc}
+	for _, field := range fields {
+		value := reflect.Indirect(field.ReflectValueOf(last)).Interface()
+		if t, ok := value.(time.Time); ok {
+			next.Values = append(next.Values, cursorValue{Time: &t})
+		} else {
+			next.Values = append(next.Values, cursorValue{Value: value})
+		}
+	}
+	if page.NextCursor, err = next.encode(); err != nil {
+		return nil, r.mapError("find by cursor", err)
+	}
+	return page, nil
+}
+
+// afterCursor returns the condition of the rows after values in the order of fields, e.g.
+// (a > 1) OR (a = 1 AND id > 2) when sorted by a and id
+func afterCursor(fields []*schema.Field, values []cursorValue, desc bool) clause.Expression {
+	var or []clause.Expression
+	for i := range fields {
+		var and []clause.Expression
+		for j := 0; j < i; j++ {
+			and = append(and, clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: fields[j].DBName}, Value: values[j].value()})
+		}
+		column := clause.Column{Table: clause.CurrentTable, Name: fields[i].DBName}
+		if desc {
+			and = append(and, clause.Lt{Column: column, Value: values[i].value()})
+		} else {
+			and = append(and, clause.Gt{Column: column, Value: values[i].value()})
+		}
+		or = append(or, clause.And(and...))
+	}
+	if len(or) == 1 {
+		// a single OR condition would be joined to the other conditions by OR
+		return or[0]
+	}
+	return clause.Or(or...)
+}
+
+// truncate cuts the slice of dest to size and returns if it was longer
+func truncate(dest interface{}, size int) bool {
+	rows := reflect.ValueOf(dest).Elem()
+	if rows.Len() <= size {
+		return false
+	}
+	rows.Set(rows.Slice(0, size))
+	return true
+}
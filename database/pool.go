@@ -0,0 +1,267 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/yiGmMk/pz-infra-new/log"
+	"github.com/yiGmMk/pz-infra-new/logging"
+
+	"github.com/astaxie/beego"
+	"gorm.io/gorm"
+)
+
+const (
+	DEFAULT_MAX_OPEN_CONNS       = 100
+	DEFAULT_MAX_IDLE_CONNS       = 10
+	DEFAULT_CONN_MAX_LIFETIME    = time.Hour
+	DEFAULT_RETRY_BACKOFF        = time.Second
+	DEFAULT_MAX_RETRY_BACKOFF    = 30 * time.Second
+	DEFAULT_PING_TIMEOUT         = 5 * time.Second
+	DEFAULT_HEALTH_CHECK_TIMEOUT = 5 * time.Second
+	DEFAULT_SLOW_THRESHOLD       = 200 * time.Millisecond
+)
+
+// DBOption is used to set the connection pool of a database and how to connect it
+type DBOption struct {
+	MaxOpenConns    int            // max open connections of each pool, unlimited if negative
+	MaxIdleConns    int            // max idle connections of each pool, no idle connection is kept if negative
+	ConnMaxLifetime time.Duration  // connections are closed after it, never if negative
+	ConnMaxIdleTime time.Duration  // idle connections are closed after it, never if 0
+	ConnectRetries  int            // times to retry if failed to connect on start
+	RetryBackoff    time.Duration  // delay before the first retry, doubled on each retry, DEFAULT_RETRY_BACKOFF if 0
+	MaxRetryBackoff time.Duration  // max delay between retries, DEFAULT_MAX_RETRY_BACKOFF if 0
+	PingOnStart     bool           // ping the primary and replicas before the database is registered
+	PingTimeout     time.Duration  // DEFAULT_PING_TIMEOUT if 0
+	StatsInterval   time.Duration  // export the pool stats periodically, not exported if 0
+	StatsExporter   func(*DBStats) // logs the stats if nil
+	SlowThreshold   time.Duration  // statements slower than it are logged as warnings, DEFAULT_SLOW_THRESHOLD if 0
+	// SELECT statements slower than it are explained in the background and the plan is kept
+	// in the slow queries, statements are not explained if 0
+	ExplainThreshold time.Duration
+	Plugins          []gorm.Plugin // gorm plugins used by the database, e.g. NewAuditPlugin
+}
+
+// DefaultDBOption returns the option used by InitDB
+func DefaultDBOption() *DBOption {
+	return &DBOption{
+		MaxOpenConns:    DEFAULT_MAX_OPEN_CONNS,
+		MaxIdleConns:    DEFAULT_MAX_IDLE_CONNS,
+		ConnMaxLifetime: DEFAULT_CONN_MAX_LIFETIME,
+	}
+}
+
+// getDBOption reads DBOption from app config with keys prefixed by prefix, durations are in seconds unless the key ends with Ms
+func getDBOption(prefix string) *DBOption {
+	seconds := func(key string, def time.Duration) time.Duration {
+		return time.Duration(beego.AppConfig.DefaultInt(prefix+key, int(def/time.Second))) * time.Second
+	}
+	milliseconds := func(key string, def time.Duration) time.Duration {
+		return time.Duration(beego.AppConfig.DefaultInt(prefix+key, int(def/time.Millisecond))) * time.Millisecond
+	}
+	return &DBOption{
+		MaxOpenConns:     beego.AppConfig.DefaultInt(prefix+"dbMaxOpenConns", DEFAULT_MAX_OPEN_CONNS),
+		MaxIdleConns:     beego.AppConfig.DefaultInt(prefix+"dbMaxIdleConns", DEFAULT_MAX_IDLE_CONNS),
+		ConnMaxLifetime:  seconds("dbConnMaxLifetime", DEFAULT_CONN_MAX_LIFETIME),
+		ConnMaxIdleTime:  seconds("dbConnMaxIdleTime", 0),
+		ConnectRetries:   beego.AppConfig.DefaultInt(prefix+"dbConnectRetries", 0),
+		PingOnStart:      beego.AppConfig.DefaultBool(prefix+"dbPingOnStart", false),
+		StatsInterval:    seconds("dbStatsInterval", 0),
+		SlowThreshold:    milliseconds("dbSlowThresholdMs", DEFAULT_SLOW_THRESHOLD),
+		ExplainThreshold: milliseconds("dbExplainThresholdMs", 0),
+	}
+}
+
+// configurePool applies the pool sizing and lifetimes of the option to sqlDB
+func (o *DBOption) configurePool(sqlDB *sql.DB) {
+	if o.MaxOpenConns != 0 {
+		sqlDB.SetMaxOpenConns(o.MaxOpenConns)
+	}
+	if o.MaxIdleConns != 0 {
+		sqlDB.SetMaxIdleConns(o.MaxIdleConns)
+	}
+	if o.ConnMaxLifetime != 0 {
+		sqlDB.SetConnMaxLifetime(o.ConnMaxLifetime)
+	}
+	if o.ConnMaxIdleTime > 0 {
+		sqlDB.SetConnMaxIdleTime(o.ConnMaxIdleTime)
+	}
+}
+
+// backoff returns the delay before the retry of attempt, starting from 1
+func (o *DBOption) backoff(attempt int) time.Duration {
+	delay := o.RetryBackoff
+	if delay <= 0 {
+		delay = DEFAULT_RETRY_BACKOFF
+	}
+	max := o.MaxRetryBackoff
+	if max <= 0 {
+		max = DEFAULT_MAX_RETRY_BACKOFF
+	}
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// openDBWithRetry opens the database, retries with backoff if failed to open or ping
+func openDBWithRetry(connectString string, replicas []string, option *DBOption, infraLogger logging.Logger) (*gorm.DB, []*sql.DB, error) {
+	for attempt := 0; ; attempt++ {
+		gormDB, replicaPools, err := openDB(connectString, replicas, option, infraLogger)
+		if err == nil && option.PingOnStart {
+			if err = pingPools(gormDB, replicaPools, option.PingTimeout); err != nil {
+				closePools(gormDB, replicaPools)
+			}
+		}
+		if err == nil {
+			return gormDB, replicaPools, nil
+		}
+		if attempt >= option.ConnectRetries {
+			return nil, nil, err
+		}
+		delay := option.backoff(attempt + 1)
+		log.Warnf("connect db failed: %s, retry %d in %s", err.Error(), attempt+1, delay)
+		time.Sleep(delay)
+	}
+}
+
+func pingPools(gormDB *gorm.DB, replicas []*sql.DB, timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = DEFAULT_PING_TIMEOUT
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	sqlDB, err := gormDB.DB()
+	if err != nil {
+		return err
+	}
+	if err := sqlDB.PingContext(ctx); err != nil {
+		return err
+	}
+	for _, replica := range replicas {
+		if err := replica.PingContext(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func closePools(gormDB *gorm.DB, replicas []*sql.DB) {
+	if sqlDB, err := gormDB.DB(); err == nil {
+		sqlDB.Close()
+	}
+	for _, replica := range replicas {
+		replica.Close()
+	}
+}
+
+// DBStats is the pool stats of a database
+type DBStats struct {
+	Name     string
+	Primary  sql.DBStats
+	Replicas []sql.DBStats
+}
+
+// GetDBStats returns the pool stats of the database of name, the default database if name is empty
+func GetDBStats(name string) (*DBStats, error) {
+	if name == "" {
+		name = DEFAULT_DB_NAME
+	}
+	db, err := LookupDB(name)
+	if err != nil {
+		return nil, err
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+	stats := &DBStats{Name: name, Primary: sqlDB.Stats()}
+	for _, replica := range getReplicaPools(name) {
+		stats.Replicas = append(stats.Replicas, replica.Stats())
+	}
+	return stats, nil
+}
+
+func logDBStats(stats *DBStats) {
+	fields := []logging.Field{
+		logging.With("db", stats.Name),
+		logging.With("openConnections", stats.Primary.OpenConnections),
+		logging.With("inUse", stats.Primary.InUse),
+		logging.With("idle", stats.Primary.Idle),
+		logging.With("waitCount", stats.Primary.WaitCount),
+		logging.With("waitDuration", stats.Primary.WaitDuration.String()),
+	}
+	for i, replica := range stats.Replicas {
+		fields = append(fields, logging.With(fmt.Sprintf("replica%dOpenConnections", i), replica.OpenConnections),
+			logging.With(fmt.Sprintf("replica%dInUse", i), replica.InUse))
+	}
+	logging.Log.Info("DB pool stats", fields...)
+}
+
+// startStatsExporter exports the pool stats of the database of name until stop is closed
+func startStatsExporter(name string, option *DBOption, stop chan struct{}) {
+	exporter := option.StatsExporter
+	if exporter == nil {
+		exporter = logDBStats
+	}
+	ticker := time.NewTicker(option.StatsInterval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				stats, err := GetDBStats(name)
+				if err != nil {
+					logging.Log.Error("Failed to get db stats", logging.With("db", name), logging.WithError(err))
+					continue
+				}
+				exporter(stats)
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// HealthCheck pings the primary and replicas of all registered databases,
+// it returns the first error instead of panic
+func HealthCheck(ctx context.Context) error {
+	for _, name := range DBNames() {
+		if err := HealthCheckDB(ctx, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HealthCheckDB pings the primary and replicas of the database of name,
+// DEFAULT_HEALTH_CHECK_TIMEOUT is used if ctx has no deadline
+func HealthCheckDB(ctx context.Context, name string) error {
+	db, err := LookupDB(name)
+	if err != nil {
+		return err
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DEFAULT_HEALTH_CHECK_TIMEOUT)
+		defer cancel()
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		return fmt.Errorf("database: db %s: %w", name, err)
+	}
+	if err := sqlDB.PingContext(ctx); err != nil {
+		return fmt.Errorf("database: db %s primary: %w", name, err)
+	}
+	for i, replica := range getReplicaPools(name) {
+		if err := replica.PingContext(ctx); err != nil {
+			return fmt.Errorf("database: db %s replica %d: %w", name, i, err)
+		}
+	}
+	return nil
+}
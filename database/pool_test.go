@@ -0,0 +1,35 @@
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDBOption(t *testing.T) {
+	Convey("test retry backoff", t, func() {
+		option := &DBOption{RetryBackoff: time.Second, MaxRetryBackoff: 5 * time.Second}
+		So(option.backoff(1), ShouldEqual, time.Second)
+		So(option.backoff(2), ShouldEqual, 2*time.Second)
+		So(option.backoff(3), ShouldEqual, 4*time.Second)
+		So(option.backoff(4), ShouldEqual, 5*time.Second)
+		So((&DBOption{}).backoff(1), ShouldEqual, DEFAULT_RETRY_BACKOFF)
+	})
+
+	Convey("test connect failure returns error after retries", t, func() {
+		start := time.Now()
+		err := RegisterDB(&DBConfig{
+			Name:   "unreachable",
+			Source: "root:pass@tcp(127.0.0.1:1)/test?timeout=100ms",
+			Option: &DBOption{ConnectRetries: 2, RetryBackoff: 10 * time.Millisecond},
+		}, nil)
+		So(err, ShouldNotBeNil)
+		So(time.Since(start), ShouldBeGreaterThanOrEqualTo, 30*time.Millisecond)
+
+		_, err = LookupDB("unreachable")
+		So(err, ShouldNotBeNil)
+		So(HealthCheckDB(context.Background(), "unreachable"), ShouldNotBeNil)
+	})
+}
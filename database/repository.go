@@ -0,0 +1,243 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+
+	. "github.com/yiGmMk/pz-infra-new/errorUtil"
+	. "github.com/yiGmMk/pz-infra-new/logging"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+const DEFAULT_VERSION_COLUMN = "version"
+
+var (
+	ErrModelNotFound   = NewHErrorCustom(ERROR_CODE_NOT_FOUND)
+	ErrVersionConflict = NewHErrorCustom(ERROR_CODE_DB_VERSION_CONFLICT)
+	ErrInvalidCursor   = NewHErrorCustom(ERROR_CODE_DB_INVALID_CURSOR)
+	ErrInvalidQuery    = NewHErrorCustom(ERROR_CODE_PARAMETER_FORMAT_INVALID)
+	ErrDatabase        = NewHErrorCustom(ERROR_CODE_DB_ERROR)
+
+	errNoSoftDelete = errors.New("database: model has no gorm.DeletedAt field for soft delete")
+
+	deletedAtType = reflect.TypeOf(gorm.DeletedAt{})
+)
+
+// RepositoryOption is used to set up a Repository
+type RepositoryOption struct {
+	DBName        string // name of the registered database, the default database if empty
+	VersionColumn string // column of the optimistic lock, DEFAULT_VERSION_COLUMN if empty
+}
+
+// Repository implements the common queries of a model. Rows soft deleted by a gorm.DeletedAt
+// field are filtered out unless Unscoped. The transaction of WithTx in ctx is used if any,
+// and errors are mapped to HError: ErrModelNotFound, ErrVersionConflict, ErrInvalidCursor,
+// ErrInvalidQuery or ErrDatabase, the original error is logged.
+type Repository struct {
+	model    interface{}
+	option   RepositoryOption
+	unscoped bool
+}
+
+// NewRepository returns a Repository of model, a pointer to the model struct, e.g. &User{}
+func NewRepository(model interface{}, option *RepositoryOption) *Repository {
+	r := &Repository{model: model}
+	if option != nil {
+		r.option = *option
+	}
+	if r.option.VersionColumn == "" {
+		r.option.VersionColumn = DEFAULT_VERSION_COLUMN
+	}
+	return r
+}
+
+// Unscoped returns a Repository including the soft deleted rows
+func (r *Repository) Unscoped() *Repository {
+	unscoped := *r
+	unscoped.unscoped = true
+	return &unscoped
+}
+
+// DB returns the DB of the model in ctx for the queries not covered by the repository
+func (r *Repository) DB(ctx context.Context) *gorm.DB {
+	db := GetDBFromContext(ctx, r.option.DBName).Model(r.model)
+	if r.unscoped {
+		db = db.Unscoped()
+	}
+	return db
+}
+
+func (r *Repository) schema() (*schema.Schema, error) {
+	stmt := &gorm.Statement{DB: GetDB(r.option.DBName)}
+	if err := stmt.Parse(r.model); err != nil {
+		return nil, err
+	}
+	return stmt.Schema, nil
+}
+
+// mapError maps err to HError and logs the errors of the database
+func (r *Repository) mapError(action string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrModelNotFound
+	}
+	var hErr *HError
+	if errors.As(err, &hErr) {
+		return err
+	}
+	Log.Error("Repository failed to "+action, With("model", fmt.Sprintf("%T", r.model)), WithError(err))
+	return ErrDatabase
+}
+
+// Create inserts model
+func (r *Repository) Create(ctx context.Context, model interface{}) error {
+	return r.mapError("create", r.DB(ctx).Create(model).Error)
+}
+
+// FindByID finds the model by primary key into dest, id is always bound as a value
+func (r *Repository) FindByID(ctx context.Context, dest interface{}, id interface{}) error {
+	s, err := r.schema()
+	if err != nil {
+		return r.mapError("find by id", err)
+	}
+	if s.PrioritizedPrimaryField == nil {
+		return ErrInvalidQuery
+	}
+	// Take(dest, id) would take a string id as raw SQL
+	condition := clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: s.PrioritizedPrimaryField.DBName}, Value: id}
+	return r.mapError("find by id", r.DB(ctx).Where(condition).Take(dest).Error)
+}
+
+// FindWhere finds the models matching the conditions into dest, a pointer to a slice,
+// e.g. FindWhere(ctx, &users, "age > ?", 18)
+func (r *Repository) FindWhere(ctx context.Context, dest interface{}, query interface{}, args ...interface{}) error {
+	return r.mapError("find", r.DB(ctx).Where(query, args...).Find(dest).Error)
+}
+
+// Exists checks if any model matches the conditions
+func (r *Repository) Exists(ctx context.Context, query interface{}, args ...interface{}) (bool, error) {
+	var found []int
+	if err := r.DB(ctx).Select("1").Where(query, args...).Limit(1).Find(&found).Error; err != nil {
+		return false, r.mapError("check exists", err)
+	}
+	return len(found) > 0, nil
+}
+
+// Update saves columns of model, all but the primary key and created_at if no column is given.
+// If the model has the version column, the row is updated only if its version is not changed,
+// ErrVersionConflict is returned otherwise, and the version of model is increased on success.
+func (r *Repository) Update(ctx context.Context, model interface{}, columns ...string) error {
+	s, err := r.schema()
+	if err != nil {
+		return r.mapError("update", err)
+	}
+	value := reflect.Indirect(reflect.ValueOf(model))
+	selected := make(map[string]bool, len(columns))
+	for _, column := range columns {
+		if s.LookUpField(column) == nil {
+			return ErrInvalidQuery
+		}
+		selected[s.LookUpField(column).DBName] = true
+	}
+	versionField := s.LookUpField(r.option.VersionColumn)
+
+	updates := map[string]interface{}{}
+	for _, field := range s.Fields {
+		// updated_at is set by gorm, soft delete is only changed by SoftDelete
+		if field.DBName == "" || field.PrimaryKey || !field.Updatable || field.AutoCreateTime > 0 || field.AutoUpdateTime > 0 ||
+			field == versionField || field.FieldType == deletedAtType {
+			continue
+		}
+		if len(selected) > 0 && !selected[field.DBName] {
+			continue
+		}
+		updates[field.DBName] = field.ReflectValueOf(value).Interface()
+	}
+
+	db := r.DB(ctx).Model(model)
+	var version int64
+	if versionField != nil {
+		if version, err = intValue(versionField.ReflectValueOf(value)); err != nil {
+			return r.mapError("update", err)
+		}
+		db = db.Where(clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: versionField.DBName}, Value: version})
+		updates[versionField.DBName] = gorm.Expr(db.Statement.Quote(versionField.DBName) + " + 1")
+	}
+	result := db.Updates(updates)
+	if result.Error != nil {
+		return r.mapError("update", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		// nothing changed if the row is deleted or updated by others
+		if versionField == nil {
+			return nil
+		}
+		exists, err := r.existsByPrimaryKey(ctx, s, value)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrModelNotFound
+		}
+		return ErrVersionConflict
+	}
+	if versionField != nil {
+		if err := versionField.Set(value, version+1); err != nil {
+			return r.mapError("update", err)
+		}
+	}
+	return nil
+}
+
+func (r *Repository) existsByPrimaryKey(ctx context.Context, s *schema.Schema, value reflect.Value) (bool, error) {
+	if s.PrioritizedPrimaryField == nil {
+		return false, ErrInvalidQuery
+	}
+	id, _ := s.PrioritizedPrimaryField.ValueOf(value)
+	return r.Exists(ctx, clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: s.PrioritizedPrimaryField.DBName}, Value: id})
+}
+
+// SoftDelete marks model deleted by its gorm.DeletedAt field, ErrModelNotFound is returned
+// if it's not found or already deleted
+func (r *Repository) SoftDelete(ctx context.Context, model interface{}) error {
+	s, err := r.schema()
+	if err != nil {
+		return r.mapError("soft delete", err)
+	}
+	softDelete := false
+	for _, field := range s.Fields {
+		if field.FieldType == deletedAtType {
+			softDelete = true
+		}
+	}
+	if !softDelete {
+		return r.mapError("soft delete", errNoSoftDelete)
+	}
+	// the soft delete is not unscoped, or the row is deleted permanently
+	result := GetDBFromContext(ctx, r.option.DBName).Delete(model)
+	if result.Error != nil {
+		return r.mapError("soft delete", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrModelNotFound
+	}
+	return nil
+}
+
+// intValue returns the value of an integer field, e.g. the version
+func intValue(value reflect.Value) (int64, error) {
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return value.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(value.Uint()), nil
+	}
+	return 0, fmt.Errorf("database: %s is not an integer", value.Type())
+}
@@ -0,0 +1,217 @@
+package database
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/yiGmMk/pz-infra-new/logging"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+type repoUser struct {
+	ID        int64
+	Name      string
+	Score     int
+	Version   int
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	DeletedAt gorm.DeletedAt
+}
+
+func TestRepository(t *testing.T) {
+	logger, err := (&logging.LogrusProvider{}).New(&logging.LogrusOption{Out: ioutil.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logging.Log = logger
+
+	dir, err := ioutil.TempDir("", "repository")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := gorm.Open(sqlite.Open(filepath.Join(dir, "test.db")), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&repoUser{}); err != nil {
+		t.Fatal(err)
+	}
+	SetNamedDB("repository", db)
+
+	ctx := context.Background()
+	repo := NewRepository(&repoUser{}, &RepositoryOption{DBName: "repository"})
+	for i := 1; i <= 10; i++ {
+		if err := repo.Create(ctx, &repoUser{Name: "user", Score: i % 3}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	Convey("test find and exists", t, func() {
+		user := &repoUser{}
+		So(repo.FindByID(ctx, user, 3), ShouldBeNil)
+		So(user.Score, ShouldEqual, 0)
+		So(repo.FindByID(ctx, &repoUser{}, 100), ShouldEqual, ErrModelNotFound)
+
+		var users []*repoUser
+		So(repo.FindWhere(ctx, &users, "score = ?", 1), ShouldBeNil)
+		So(len(users), ShouldEqual, 4)
+
+		exists, err := repo.Exists(ctx, "score = ?", 2)
+		So(err, ShouldBeNil)
+		So(exists, ShouldBeTrue)
+		exists, err = repo.Exists(ctx, "score = ?", 5)
+		So(err, ShouldBeNil)
+		So(exists, ShouldBeFalse)
+	})
+
+	Convey("test update with optimistic lock", t, func() {
+		first, second := &repoUser{}, &repoUser{}
+		So(repo.FindByID(ctx, first, 1), ShouldBeNil)
+		So(repo.FindByID(ctx, second, 1), ShouldBeNil)
+
+		first.Name = "first"
+		So(repo.Update(ctx, first), ShouldBeNil)
+		So(first.Version, ShouldEqual, 1)
+		second.Name = "second"
+		So(repo.Update(ctx, second), ShouldEqual, ErrVersionConflict)
+
+		So(repo.FindByID(ctx, second, 1), ShouldBeNil)
+		So(second.Name, ShouldEqual, "first")
+		second.Name, second.Score = "second", 100
+		So(repo.Update(ctx, second, "score"), ShouldBeNil)
+		So(repo.FindByID(ctx, second, 1), ShouldBeNil)
+		So(second.Name, ShouldEqual, "first")
+		So(second.Score, ShouldEqual, 100)
+		So(second.Version, ShouldEqual, 2)
+
+		So(repo.Update(ctx, &repoUser{ID: 100}), ShouldEqual, ErrModelNotFound)
+		So(repo.Update(ctx, second, "unknown"), ShouldEqual, ErrInvalidQuery)
+	})
+
+	Convey("test soft delete", t, func() {
+		So(repo.SoftDelete(ctx, &repoUser{ID: 10}), ShouldBeNil)
+		So(repo.FindByID(ctx, &repoUser{}, 10), ShouldEqual, ErrModelNotFound)
+		So(repo.SoftDelete(ctx, &repoUser{ID: 10}), ShouldEqual, ErrModelNotFound)
+		So(repo.Unscoped().FindByID(ctx, &repoUser{}, 10), ShouldBeNil)
+	})
+
+	Convey("test offset pagination", t, func() {
+		var users []*repoUser
+		page, err := repo.FindPage(ctx, &users, &PageRequest{Page: 3, PageSize: 4, WithTotal: true})
+		So(err, ShouldBeNil)
+		So(page.Total, ShouldEqual, 9)
+		So(page.HasMore, ShouldBeFalse)
+		So(len(users), ShouldEqual, 1)
+		So(users[0].ID, ShouldEqual, 9)
+
+		users = nil
+		page, err = repo.FindPage(ctx, &users, &PageRequest{PageSize: 2, OrderBy: "score", Desc: true},
+			func(db *gorm.DB) *gorm.DB { return db.Where("score < ?", 100) })
+		So(err, ShouldBeNil)
+		So(page.Total, ShouldEqual, -1)
+		So(page.HasMore, ShouldBeTrue)
+		So(len(users), ShouldEqual, 2)
+		So(users[0].ID, ShouldEqual, 8)
+
+		_, err = repo.FindPage(ctx, &users, &PageRequest{OrderBy: "name; drop table"})
+		So(err, ShouldEqual, ErrInvalidQuery)
+	})
+
+	Convey("test cursor pagination", t, func() {
+		var ids []int64
+		req := &CursorRequest{Limit: 2, OrderBy: "score", WithTotal: true}
+		for {
+			var users []repoUser
+			page, err := repo.FindByCursor(ctx, &users, req, func(db *gorm.DB) *gorm.DB { return db.Where("score < ?", 100) })
+			So(err, ShouldBeNil)
+			So(page.Total, ShouldEqual, 8)
+			for _, user := range users {
+				ids = append(ids, user.ID)
+			}
+			if !page.HasMore {
+				So(page.NextCursor, ShouldBeEmpty)
+				break
+			}
+			req.Cursor = page.NextCursor
+		}
+		So(ids, ShouldResemble, []int64{3, 6, 9, 4, 7, 2, 5, 8})
+
+		_, err := repo.FindByCursor(ctx, &[]repoUser{}, &CursorRequest{Cursor: "not a cursor"})
+		So(err, ShouldEqual, ErrInvalidCursor)
+		_, err = repo.FindByCursor(ctx, &[]repoUser{}, &CursorRequest{Cursor: req.Cursor, OrderBy: "name"})
+		So(err, ShouldEqual, ErrInvalidCursor)
+	})
+
+	Convey("test cursor pagination by time desc", t, func() {
+		var ids []int64
+		req := &CursorRequest{Limit: 4, OrderBy: "created_at", Desc: true}
+		for {
+			var users []repoUser
+			page, err := repo.FindByCursor(ctx, &users, req)
+			So(err, ShouldBeNil)
+			for _, user := range users {
+				ids = append(ids, user.ID)
+			}
+			if !page.HasMore {
+				break
+			}
+			req.Cursor = page.NextCursor
+		}
+		So(ids, ShouldResemble, []int64{9, 8, 7, 6, 5, 4, 3, 2, 1})
+	})
+}
+
+type repoCode struct {
+	Code string `gorm:"primaryKey"`
+	Name string
+}
+
+func TestRepositoryStringID(t *testing.T) {
+	logger, err := (&logging.LogrusProvider{}).New(&logging.LogrusOption{Out: ioutil.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logging.Log = logger
+
+	dir, err := ioutil.TempDir("", "repository")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := gorm.Open(sqlite.Open(filepath.Join(dir, "test.db")), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&repoCode{}); err != nil {
+		t.Fatal(err)
+	}
+	SetNamedDB("repository_code", db)
+
+	ctx := context.Background()
+	repo := NewRepository(&repoCode{}, &RepositoryOption{DBName: "repository_code"})
+	for _, code := range []string{"a", "b"} {
+		if err := repo.Create(ctx, &repoCode{Code: code, Name: "code " + code}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	Convey("test find by string id", t, func() {
+		code := &repoCode{}
+		So(repo.FindByID(ctx, code, "b"), ShouldBeNil)
+		So(code.Name, ShouldEqual, "code b")
+
+		Convey("SQL in the id is bound as a value", func() {
+			for _, id := range []string{"1 OR 1=1", "code <> ''", "'a' OR 1=1 --"} {
+				So(repo.FindByID(ctx, &repoCode{}, id), ShouldEqual, ErrModelNotFound)
+			}
+		})
+	})
+}
@@ -0,0 +1,397 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/yiGmMk/pz-infra-new/logging"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+const (
+	DEFAULT_SLOW_QUERY_TOP_N     = 50
+	DEFAULT_MAX_SQL_FINGERPRINTS = 1000
+	DEFAULT_EXPLAIN_TIMEOUT      = 5 * time.Second
+	// statements of new fingerprints are counted here once DEFAULT_MAX_SQL_FINGERPRINTS is reached
+	OTHER_SQL_FINGERPRINT = "<other>"
+)
+
+// SQLStats is a snapshot of the metrics of the statements of a fingerprint
+type SQLStats struct {
+	Fingerprint      string          `json:"fingerprint"`
+	Count            int64           `json:"count"`
+	Errors           int64           `json:"errors"`
+	Rows             int64           `json:"rows"`
+	TotalLatency     time.Duration   `json:"total_latency"`
+	MaxLatency       time.Duration   `json:"max_latency"`
+	LatencyHistogram []int64         `json:"latency_histogram"`
+	HistogramEdges   []time.Duration `json:"histogram_edges"`
+}
+
+// AvgLatency returns the average latency of the statements
+func (s SQLStats) AvgLatency() time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.TotalLatency / time.Duration(s.Count)
+}
+
+// SlowQuery is the slowest statement of a fingerprint over the slow threshold
+type SlowQuery struct {
+	Fingerprint string        `json:"fingerprint"`
+	SQL         string        `json:"sql"`
+	Latency     time.Duration `json:"latency"`
+	Rows        int64         `json:"rows"`
+	Time        time.Time     `json:"time"`
+	Count       int64         `json:"count"`             // times the fingerprint was over the slow threshold
+	Explain     string        `json:"explain,omitempty"` // the plan of SQL if captured
+}
+
+// latency histogram buckets upper bounds, the last bucket counts everything above
+var sqlHistogramEdges = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	20 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	2 * time.Second,
+}
+
+type sqlMetrics struct {
+	lock  sync.Mutex
+	stats map[string]*SQLStats
+	slow  map[string]*SlowQuery
+	topN  int
+}
+
+var sqlMetricsRegistry = newSQLMetrics(DEFAULT_SLOW_QUERY_TOP_N)
+
+func newSQLMetrics(topN int) *sqlMetrics {
+	return &sqlMetrics{
+		stats: make(map[string]*SQLStats),
+		slow:  make(map[string]*SlowQuery),
+		topN:  topN,
+	}
+}
+
+// observe records a statement and returns if it's the slowest of its fingerprint in the slow queries
+func (m *sqlMetrics) observe(fingerprint string, latency time.Duration, rows int64, failed, slow bool, sql string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	stats, ok := m.stats[fingerprint]
+	if !ok {
+		if len(m.stats) >= DEFAULT_MAX_SQL_FINGERPRINTS {
+			fingerprint = OTHER_SQL_FINGERPRINT
+			stats = m.stats[fingerprint]
+		}
+		if stats == nil {
+			stats = &SQLStats{Fingerprint: fingerprint, LatencyHistogram: make([]int64, len(sqlHistogramEdges)+1)}
+			m.stats[fingerprint] = stats
+		}
+	}
+	stats.Count++
+	if failed {
+		stats.Errors++
+	}
+	if rows > 0 {
+		stats.Rows += rows
+	}
+	stats.TotalLatency += latency
+	if latency > stats.MaxLatency {
+		stats.MaxLatency = latency
+	}
+	bucket := len(sqlHistogramEdges)
+	for i, edge := range sqlHistogramEdges {
+		if latency <= edge {
+			bucket = i
+			break
+		}
+	}
+	stats.LatencyHistogram[bucket]++
+
+	if !slow || m.topN <= 0 {
+		return false
+	}
+	query, ok := m.slow[fingerprint]
+	if ok {
+		query.Count++
+		if latency <= query.Latency {
+			return false
+		}
+		query.SQL, query.Latency, query.Rows, query.Time, query.Explain = sql, latency, rows, time.Now(), ""
+		return true
+	}
+	if len(m.slow) >= m.topN {
+		// evict the fastest one, or drop the query if it's the fastest
+		var fastest *SlowQuery
+		for _, q := range m.slow {
+			if fastest == nil || q.Latency < fastest.Latency {
+				fastest = q
+			}
+		}
+		if fastest.Latency >= latency {
+			return false
+		}
+		delete(m.slow, fastest.Fingerprint)
+	}
+	m.slow[fingerprint] = &SlowQuery{Fingerprint: fingerprint, SQL: sql, Latency: latency, Rows: rows, Time: time.Now(), Count: 1}
+	return true
+}
+
+// setExplain sets the plan of the slow query if it's still the slowest one of its fingerprint
+func (m *sqlMetrics) setExplain(fingerprint, sql, explain string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if query, ok := m.slow[fingerprint]; ok && query.SQL == sql {
+		query.Explain = explain
+	}
+}
+
+// GetSQLStats returns the metrics of all statement fingerprints, ordered by total latency desc
+func GetSQLStats() []SQLStats {
+	sqlMetricsRegistry.lock.Lock()
+	defer sqlMetricsRegistry.lock.Unlock()
+	list := make([]SQLStats, 0, len(sqlMetricsRegistry.stats))
+	for _, stats := range sqlMetricsRegistry.stats {
+		s := *stats
+		s.LatencyHistogram = append([]int64{}, stats.LatencyHistogram...)
+		s.HistogramEdges = append([]time.Duration{}, sqlHistogramEdges...)
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].TotalLatency > list[j].TotalLatency })
+	return list
+}
+
+// GetSlowQueries returns the top N slow queries, one per fingerprint, ordered by latency desc
+func GetSlowQueries() []SlowQuery {
+	sqlMetricsRegistry.lock.Lock()
+	defer sqlMetricsRegistry.lock.Unlock()
+	list := make([]SlowQuery, 0, len(sqlMetricsRegistry.slow))
+	for _, query := range sqlMetricsRegistry.slow {
+		list = append(list, *query)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Latency > list[j].Latency })
+	return list
+}
+
+// SetSlowQueryTopN sets how many fingerprints are kept in the slow queries, the slowest are kept
+func SetSlowQueryTopN(n int) {
+	sqlMetricsRegistry.lock.Lock()
+	defer sqlMetricsRegistry.lock.Unlock()
+	sqlMetricsRegistry.topN = n
+	for len(sqlMetricsRegistry.slow) > n && len(sqlMetricsRegistry.slow) > 0 {
+		var fastest *SlowQuery
+		for _, q := range sqlMetricsRegistry.slow {
+			if fastest == nil || q.Latency < fastest.Latency {
+				fastest = q
+			}
+		}
+		delete(sqlMetricsRegistry.slow, fastest.Fingerprint)
+	}
+}
+
+// ResetSQLStats clears the statement metrics and slow queries collected so far
+func ResetSQLStats() {
+	sqlMetricsRegistry.lock.Lock()
+	defer sqlMetricsRegistry.lock.Unlock()
+	sqlMetricsRegistry.stats = make(map[string]*SQLStats)
+	sqlMetricsRegistry.slow = make(map[string]*SlowQuery)
+}
+
+// DumpSlowQueries writes the slow queries to w, e.g. from a debug handler
+func DumpSlowQueries(w io.Writer) error {
+	for i, query := range GetSlowQueries() {
+		if _, err := fmt.Fprintf(w, "#%d %s latency=%s rows=%d count=%d at=%s\n%s\n",
+			i+1, query.Fingerprint, query.Latency, query.Rows, query.Count, query.Time.Format(time.RFC3339), query.SQL); err != nil {
+			return err
+		}
+		if query.Explain != "" {
+			if _, err := fmt.Fprintf(w, "explain:\n%s", query.Explain); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintln(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var (
+	sqlInListRegexp = regexp.MustCompile(`(?i)\bIN\s*\(\s*\?(\s*,\s*\?)*\s*\)`)
+	sqlTuplesRegexp = regexp.MustCompile(`\(\s*\?(\s*,\s*\?)*\s*\)(\s*,\s*\(\s*\?(\s*,\s*\?)*\s*\))+`)
+)
+
+// FingerprintSQL normalizes a statement so statements differing only in values share a fingerprint,
+// literals are replaced by ?, IN lists and multi-row VALUES are collapsed and spaces are squeezed.
+func FingerprintSQL(sql string) string {
+	var b strings.Builder
+	space := false
+	for i := 0; i < len(sql); i++ {
+		c := sql[i]
+		switch {
+		case c == '\'' || c == '"':
+			// skip the quoted string, backslashes and doubled quotes are escapes
+			for i++; i < len(sql); i++ {
+				if sql[i] == '\\' {
+					i++
+				} else if sql[i] == c {
+					if i+1 < len(sql) && sql[i+1] == c {
+						i++
+						continue
+					}
+					break
+				}
+			}
+			c = '?'
+		case c == '`':
+			// identifiers are kept as they are
+			end := len(sql) - 1
+			if n := strings.IndexByte(sql[i+1:], '`'); n >= 0 {
+				end = i + 1 + n
+			}
+			if space {
+				b.WriteByte(' ')
+				space = false
+			}
+			b.WriteString(sql[i : end+1])
+			i = end
+			continue
+		case c >= '0' && c <= '9' && (i == 0 || !isIdentByte(sql[i-1])):
+			for i+1 < len(sql) && (isIdentByte(sql[i+1]) || sql[i+1] == '.') {
+				i++
+			}
+			c = '?'
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			space = b.Len() > 0
+			continue
+		}
+		if space {
+			b.WriteByte(' ')
+			space = false
+		}
+		b.WriteByte(c)
+	}
+	fingerprint := sqlInListRegexp.ReplaceAllString(b.String(), "IN (?)")
+	return sqlTuplesRegexp.ReplaceAllStringFunc(fingerprint, func(tuples string) string {
+		return tuples[:strings.IndexByte(tuples, ')')+1]
+	})
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || c == '$' || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// explainRunning limits the EXPLAIN statements running at the same time
+var explainRunning = make(chan struct{}, 1)
+
+type explainArgsKey struct{}
+
+// explainArgs is the SQL and the values of a query, recorded in the context of its statement for Trace,
+// the SQL logged has the values substituted and must not be run again
+type explainArgs struct {
+	statement *gorm.Statement
+	sql       string
+	vars      []interface{}
+}
+
+// registerExplainCallbacks records the SQL and the values of the queries after they run
+func registerExplainCallbacks(db *gorm.DB) error {
+	callback := db.Callback()
+	if err := callback.Query().After("gorm:query").Register("sqlmetrics:explain", recordExplainArgs); err != nil {
+		return err
+	}
+	return callback.Row().After("gorm:row").Register("sqlmetrics:explain", recordExplainArgs)
+}
+
+func recordExplainArgs(db *gorm.DB) {
+	stmt := db.Statement
+	if db.Error != nil || stmt.SQL.Len() == 0 || stmt.Context == nil {
+		return
+	}
+	args := &explainArgs{statement: stmt, sql: stmt.SQL.String(), vars: append([]interface{}(nil), stmt.Vars...)}
+	// a statement run again updates its args instead of nesting the contexts
+	if current, ok := stmt.Context.Value(explainArgsKey{}).(*explainArgs); ok && current.statement == stmt {
+		*current = *args
+		return
+	}
+	stmt.Context = context.WithValue(stmt.Context, explainArgsKey{}, args)
+}
+
+// captureExplain runs EXPLAIN of a slow SELECT in the background and keeps the plan in its slow query,
+// it's skipped if another EXPLAIN is running so slow queries don't pile up more load on the database.
+// The SQL and the values recorded by registerExplainCallbacks are used, the values are bound again,
+// and the query is not explained if they are missing or don't match statement, the SQL logged.
+func captureExplain(ctx context.Context, db *gorm.DB, fingerprint, statement string) {
+	var args *explainArgs
+	if ctx != nil {
+		args, _ = ctx.Value(explainArgsKey{}).(*explainArgs)
+	}
+	if args == nil || len(args.sql) < 6 || !strings.EqualFold(args.sql[:6], "select") ||
+		db.Dialector.Explain(args.sql, args.vars...) != statement {
+		return
+	}
+	select {
+	case explainRunning <- struct{}{}:
+	default:
+		return
+	}
+	go func() {
+		defer func() { <-explainRunning }()
+		ctx, cancel := context.WithTimeout(context.Background(), DEFAULT_EXPLAIN_TIMEOUT)
+		defer cancel()
+		// a silent logger keeps the EXPLAIN out of the logs and metrics
+		rows, err := db.Session(&gorm.Session{NewDB: true, Logger: logger.Discard, Context: ctx}).Raw("EXPLAIN "+args.sql, args.vars...).Rows()
+		if err != nil {
+			Log.Warn("Failed to explain slow query", With("sql", statement), WithError(err))
+			return
+		}
+		defer rows.Close()
+		explain, err := formatExplainRows(rows)
+		if err != nil {
+			Log.Warn("Failed to explain slow query", With("sql", statement), WithError(err))
+			return
+		}
+		sqlMetricsRegistry.setExplain(fingerprint, statement, explain)
+	}()
+}
+
+// formatExplainRows formats each row of the plan as a line of column=value
+func formatExplainRows(rows *sql.Rows) (string, error) {
+	columns, err := rows.Columns()
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	values := make([]sql.NullString, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return "", err
+		}
+		for i, column := range columns {
+			if i > 0 {
+				b.WriteByte(' ')
+			}
+			value := "NULL"
+			if values[i].Valid {
+				value = values[i].String
+			}
+			fmt.Fprintf(&b, "%s=%s", column, value)
+		}
+		b.WriteByte('\n')
+	}
+	return b.String(), rows.Err()
+}
@@ -0,0 +1,133 @@
+package database
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/yiGmMk/pz-infra-new/logging"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestFingerprintSQL(t *testing.T) {
+	Convey("test literals are replaced", t, func() {
+		So(FingerprintSQL("SELECT * FROM `user`  WHERE id = 12 AND name = 'a''b\\'c'\n AND score > 1.5"),
+			ShouldEqual, "SELECT * FROM `user` WHERE id = ? AND name = ? AND score > ?")
+		So(FingerprintSQL(`SELECT * FROM t1 WHERE c2 = "x"`), ShouldEqual, "SELECT * FROM t1 WHERE c2 = ?")
+	})
+
+	Convey("test lists are collapsed", t, func() {
+		So(FingerprintSQL("SELECT * FROM user WHERE id IN (1, 2,3)"), ShouldEqual, FingerprintSQL("SELECT * FROM user WHERE id in (4)"))
+		So(FingerprintSQL("INSERT INTO user (id,name) VALUES (1,'a'),(2,'b'), (3, 'c')"),
+			ShouldEqual, "INSERT INTO user (id,name) VALUES (?,?)")
+	})
+}
+
+func TestGormLogger(t *testing.T) {
+	out := &bytes.Buffer{}
+	infraLogger, err := (&logging.LogrusProvider{}).New(&logging.LogrusOption{Out: out, Level: logrus.DebugLevel, Formatter: &logrus.TextFormatter{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logging.Log = infraLogger
+
+	dir, err := ioutil.TempDir("", "sqlmetrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	gormLogger := newGormLogger(infraLogger, &DBOption{SlowThreshold: time.Nanosecond, ExplainThreshold: time.Nanosecond}).(*GormLogger)
+	db, err := gorm.Open(sqlite.Open(filepath.Join(dir, "test.db")), &gorm.Config{Logger: gormLogger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gormLogger.setExplainDB(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec("CREATE TABLE user (id INTEGER PRIMARY KEY, name TEXT)").Error; err != nil {
+		t.Fatal(err)
+	}
+
+	Convey("test metrics and slow queries", t, func() {
+		ResetSQLStats()
+		for i := 1; i <= 3; i++ {
+			So(db.Exec("INSERT INTO user (id, name) VALUES (?, ?)", i, "name").Error, ShouldBeNil)
+		}
+		var names []string
+		So(db.Raw("SELECT name FROM user WHERE id IN (?)", []int{1, 2}).Scan(&names).Error, ShouldBeNil)
+		So(db.Exec("INSERT INTO user (id, name) VALUES (?, ?)", 1, "dup").Error, ShouldNotBeNil)
+
+		stats := map[string]SQLStats{}
+		for _, s := range GetSQLStats() {
+			stats[s.Fingerprint] = s
+		}
+		insert := stats["INSERT INTO user (id, name) VALUES (?, ?)"]
+		So(insert.Count, ShouldEqual, 4)
+		So(insert.Errors, ShouldEqual, 1)
+		So(insert.Rows, ShouldEqual, 3)
+		So(len(insert.LatencyHistogram), ShouldEqual, len(insert.HistogramEdges)+1)
+		So(stats["SELECT name FROM user WHERE id IN (?)"].Rows, ShouldEqual, 2)
+
+		So(len(GetSlowQueries()), ShouldEqual, 2)
+		So(out.String(), ShouldContainSubstring, "level=warning")
+		So(out.String(), ShouldContainSubstring, "level=error")
+
+		// the plan of the SELECT is captured in the background
+		var explain string
+		for i := 0; i < 100 && explain == ""; i++ {
+			for _, query := range GetSlowQueries() {
+				if query.Fingerprint == "SELECT name FROM user WHERE id IN (?)" {
+					explain = query.Explain
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		So(explain, ShouldNotBeEmpty)
+
+		// the values are bound to the EXPLAIN instead of the SQL logged, which breaks on the quote in sqlite
+		So(db.Raw("SELECT name FROM user WHERE name = ?", `a"b`).Scan(&names).Error, ShouldBeNil)
+		explain = ""
+		for i := 0; i < 100 && explain == ""; i++ {
+			for _, query := range GetSlowQueries() {
+				if query.Fingerprint == "SELECT name FROM user WHERE name = ?" {
+					explain = query.Explain
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		So(explain, ShouldNotBeEmpty)
+
+		dump := &bytes.Buffer{}
+		So(DumpSlowQueries(dump), ShouldBeNil)
+		So(dump.String(), ShouldContainSubstring, "#1 ")
+		So(dump.String(), ShouldContainSubstring, "explain:\n")
+
+		SetSlowQueryTopN(1)
+		defer SetSlowQueryTopN(DEFAULT_SLOW_QUERY_TOP_N)
+		So(len(GetSlowQueries()), ShouldEqual, 1)
+	})
+
+	Convey("test log levels are honoured", t, func() {
+		ResetSQLStats()
+		out.Reset()
+		silent := db.Session(&gorm.Session{Logger: gormLogger.LogMode(logger.Silent)})
+		So(silent.Exec("INSERT INTO user (id, name) VALUES (?, ?)", 1, "dup").Error, ShouldNotBeNil)
+		So(out.Len(), ShouldEqual, 0)
+		So(GetSQLStats()[0].Errors, ShouldEqual, 1)
+
+		errorOnly := db.Session(&gorm.Session{Logger: gormLogger.LogMode(logger.Error)})
+		So(errorOnly.Exec("DELETE FROM user WHERE id = ?", 3).Error, ShouldBeNil)
+		So(out.Len(), ShouldEqual, 0)
+		So(errorOnly.Exec("INSERT INTO user (id, name) VALUES (?, ?)", 1, "dup").Error, ShouldNotBeNil)
+		So(out.String(), ShouldContainSubstring, "level=error")
+	})
+}
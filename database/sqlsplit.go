@@ -0,0 +1,120 @@
+package database
+
+import (
+	"strings"
+)
+
+const DEFAULT_SQL_DELIMITER = ";"
+
+// SplitSQLStatements splits a SQL script into statements by ";",
+// delimiters in quoted strings, quoted identifiers and comments are not separators.
+// Comments are kept in the statement they belong to and empty statements are dropped.
+// DELIMITER lines of mysql scripts change the delimiter, e.g. for procedures and triggers.
+func SplitSQLStatements(script string) []string {
+	var statements []string
+	var current strings.Builder
+	var quote byte // the quote the scanner is in, 0 if not quoted
+	delimiter := DEFAULT_SQL_DELIMITER
+
+	flush := func() {
+		statement := strings.TrimSpace(current.String())
+		current.Reset()
+		if statement != "" && !isCommentOnly(statement) {
+			statements = append(statements, statement)
+		}
+	}
+
+	for i := 0; i < len(script); i++ {
+		c := script[i]
+		if quote != 0 {
+			current.WriteByte(c)
+			if c == '\\' && quote != '`' && i+1 < len(script) {
+				i++
+				current.WriteByte(script[i])
+			} else if c == quote {
+				if i+1 < len(script) && script[i+1] == quote {
+					// doubled quote is an escaped quote
+					i++
+					current.WriteByte(script[i])
+				} else {
+					quote = 0
+				}
+			}
+			continue
+		}
+
+		// DELIMITER is a client command, it is only valid at the beginning of a statement
+		if (i == 0 || script[i-1] == '\n' || script[i-1] == '\r') && isCommentOnly(current.String()) {
+			if newDelimiter, end, ok := parseDelimiterCommand(script, i); ok {
+				delimiter = newDelimiter
+				current.Reset()
+				i = end
+				continue
+			}
+		}
+
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+			current.WriteByte(c)
+		case c == '#' || isDashComment(script[i:]):
+			end := strings.IndexAny(script[i:], "\r\n")
+			if end < 0 {
+				end = len(script) - i
+			}
+			current.WriteString(script[i : i+end])
+			i += end - 1
+		case c == '/' && strings.HasPrefix(script[i:], "/*"):
+			end := strings.Index(script[i+2:], "*/")
+			if end < 0 {
+				end = len(script) - i - 2
+			} else {
+				end += 2
+			}
+			current.WriteString(script[i : i+2+end])
+			i += 1 + end
+		case strings.HasPrefix(script[i:], delimiter):
+			flush()
+			i += len(delimiter) - 1
+		default:
+			current.WriteByte(c)
+		}
+	}
+	flush()
+	return statements
+}
+
+// isDashComment checks if s starts with a "--" comment, which is followed by a space, a line end or nothing
+func isDashComment(s string) bool {
+	if !strings.HasPrefix(s, "--") {
+		return false
+	}
+	return len(s) == 2 || s[2] == ' ' || s[2] == '\t' || s[2] == '\r' || s[2] == '\n'
+}
+
+// isCommentOnly checks if the statement contains nothing but line comments
+func isCommentOnly(statement string) bool {
+	lines := strings.FieldsFunc(statement, func(c rune) bool { return c == '\n' || c == '\r' })
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line != "" && !isDashComment(line) && !strings.HasPrefix(line, "#") {
+			return false
+		}
+	}
+	return true
+}
+
+// parseDelimiterCommand parses "DELIMITER xx" at start, returns the delimiter and the end of the line
+func parseDelimiterCommand(script string, start int) (string, int, bool) {
+	end := strings.IndexAny(script[start:], "\r\n")
+	if end < 0 {
+		end = len(script)
+	} else {
+		end += start
+	}
+	fields := strings.Fields(script[start:end])
+	if len(fields) != 2 || !strings.EqualFold(fields[0], "DELIMITER") {
+		return "", 0, false
+	}
+	return fields[1], end, true
+}
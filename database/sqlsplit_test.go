@@ -0,0 +1,58 @@
+package database
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSplitSQLStatements(t *testing.T) {
+	Convey("test split sql statements", t, func() {
+		script := `
+-- create table; with comment
+CREATE TABLE t (id INT, name VARCHAR(32) COMMENT 'a;b');
+# comment only;
+INSERT INTO t VALUES (1, 'it''s;'), (2, "x\";y");
+/* block; comment */ INSERT INTO ` + "`t;`" + ` VALUES (3, '');
+;;
+UPDATE t SET name = 'z' WHERE id = 1`
+		statements := SplitSQLStatements(script)
+		So(len(statements), ShouldEqual, 4)
+		So(statements[0], ShouldEqual, "-- create table; with comment\nCREATE TABLE t (id INT, name VARCHAR(32) COMMENT 'a;b')")
+		So(statements[1], ShouldEqual, "# comment only;\nINSERT INTO t VALUES (1, 'it''s;'), (2, \"x\\\";y\")")
+		So(statements[2], ShouldEqual, "/* block; comment */ INSERT INTO `t;` VALUES (3, '')")
+		So(statements[3], ShouldEqual, "UPDATE t SET name = 'z' WHERE id = 1")
+		So(SplitSQLStatements("-- nothing\n"), ShouldBeEmpty)
+	})
+
+	Convey("test delimiter command", t, func() {
+		script := `-- trigger
+DELIMITER $$
+CREATE TRIGGER tr BEFORE INSERT ON t FOR EACH ROW BEGIN
+  SET NEW.a = 1;
+  SET NEW.b = 'x$$';
+END$$
+DELIMITER ;
+select 1;
+select 'DELIMITER $$';`
+		So(SplitSQLStatements(script), ShouldResemble, []string{
+			"CREATE TRIGGER tr BEFORE INSERT ON t FOR EACH ROW BEGIN\n  SET NEW.a = 1;\n  SET NEW.b = 'x$$';\nEND",
+			"select 1",
+			"select 'DELIMITER $$'",
+		})
+		So(SplitSQLStatements("select 1;\n\nselect 2;;  \n"), ShouldResemble, []string{"select 1", "select 2"})
+		So(SplitSQLStatements(""), ShouldBeNil)
+	})
+
+	Convey("test line ends of CRLF and CR", t, func() {
+		script := "--\r\n-- create table\r\nCREATE TABLE t (id INT);\r\n--\r\nINSERT INTO t VALUES (1);\r\n"
+		So(SplitSQLStatements(script), ShouldResemble, []string{
+			"--\r\n-- create table\r\nCREATE TABLE t (id INT)",
+			"--\r\nINSERT INTO t VALUES (1)",
+		})
+		So(SplitSQLStatements("-- comment\rSELECT 1;\rDELIMITER $$\rSELECT 2$$"), ShouldResemble, []string{
+			"-- comment\rSELECT 1",
+			"SELECT 2",
+		})
+	})
+}
@@ -0,0 +1,179 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	. "github.com/yiGmMk/pz-infra-new/errorUtil"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+var (
+	ErrTenantMissing  = NewHErrorCustom(ERROR_CODE_TENANT_MISSING)
+	ErrTenantMismatch = NewHErrorCustom(ERROR_CODE_TENANT_MISMATCH)
+)
+
+type tenantKey struct{}
+type skipTenantKey struct{}
+
+// WithTenant returns a context of the tenant, e.g. the department id,
+// the queries of tenant models with it are scoped to the tenant
+func WithTenant(ctx context.Context, tenantID interface{}) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenantID)
+}
+
+// TenantFromContext returns the tenant of WithTenant
+func TenantFromContext(ctx context.Context) (interface{}, bool) {
+	tenantID := ctx.Value(tenantKey{})
+	return tenantID, tenantID != nil
+}
+
+// WithoutTenantScope returns a context whose queries are not scoped to a tenant, for admin queries across tenants.
+// Use it explicitly and carefully.
+func WithoutTenantScope(ctx context.Context) context.Context {
+	return context.WithValue(ctx, skipTenantKey{}, true)
+}
+
+func tenantScopeSkipped(ctx context.Context) bool {
+	skip, _ := ctx.Value(skipTenantKey{}).(bool)
+	return skip
+}
+
+// TenantOption is used to set up the tenant plugin
+type TenantOption struct {
+	// TenantFunc reads the tenant of ctx, TenantFromContext if nil
+	TenantFunc func(ctx context.Context) (interface{}, bool)
+}
+
+// TenantPlugin is a gorm plugin scoping the tenant models to the tenant of the context. A tenant model has
+// a field tagged by tenant, e.g. DepartmentId int64 `tenant:"true"`. Queries (including Row, Rows and Scan),
+// updates and deletes of them are filtered by the tenant column, and the column is set on create.
+// ErrTenantMissing is returned if the context carries no tenant nor WithoutTenantScope. Raw SQL is not scoped.
+// Register it by DBOption.Plugins.
+type TenantPlugin struct {
+	option TenantOption
+}
+
+// NewTenantPlugin returns a TenantPlugin
+func NewTenantPlugin(option *TenantOption) *TenantPlugin {
+	p := &TenantPlugin{}
+	if option != nil {
+		p.option = *option
+	}
+	if p.option.TenantFunc == nil {
+		p.option.TenantFunc = TenantFromContext
+	}
+	return p
+}
+
+func (p *TenantPlugin) Name() string {
+	return "tenant"
+}
+
+func (p *TenantPlugin) Initialize(db *gorm.DB) error {
+	callback := db.Callback()
+	if err := callback.Create().Before("gorm:create").Register("tenant:create", p.setTenant); err != nil {
+		return err
+	}
+	if err := callback.Query().Before("gorm:query").Register("tenant:query", p.scopeQuery); err != nil {
+		return err
+	}
+	// Row, Rows and Scan are run by the row callbacks
+	if err := callback.Row().Before("gorm:row").Register("tenant:row", p.scopeQuery); err != nil {
+		return err
+	}
+	if err := callback.Update().Before("gorm:update").Register("tenant:update", p.scopeWrite); err != nil {
+		return err
+	}
+	return callback.Delete().Before("gorm:delete").Register("tenant:delete", p.scopeWrite)
+}
+
+// tenantField returns the field tagged by tenant of the model
+func tenantField(s *schema.Schema) *schema.Field {
+	if s == nil {
+		return nil
+	}
+	for _, field := range s.Fields {
+		if _, ok := field.Tag.Lookup("tenant"); ok && field.DBName != "" {
+			return field
+		}
+	}
+	return nil
+}
+
+// tenant returns the tenant field of the model and the tenant of the context,
+// the field is nil if the model is not a tenant model or the scope is skipped
+func (p *TenantPlugin) tenant(db *gorm.DB) (*schema.Field, interface{}) {
+	field := tenantField(db.Statement.Schema)
+	// the SQL of Raw is built already
+	if field == nil || db.Error != nil || db.Statement.SQL.Len() > 0 || tenantScopeSkipped(db.Statement.Context) {
+		return nil, nil
+	}
+	tenantID, ok := p.option.TenantFunc(db.Statement.Context)
+	if !ok {
+		db.AddError(ErrTenantMissing)
+		return nil, nil
+	}
+	return field, tenantID
+}
+
+func (p *TenantPlugin) setTenant(db *gorm.DB) {
+	field, tenantID := p.tenant(db)
+	if field == nil {
+		return
+	}
+	eachRow(db.Statement.ReflectValue, func(row reflect.Value) {
+		if value, zero := field.ValueOf(row); !zero {
+			if fmt.Sprint(value) != fmt.Sprint(tenantID) {
+				db.AddError(ErrTenantMismatch)
+			}
+			return
+		}
+		if err := field.Set(row, tenantID); err != nil {
+			db.AddError(err)
+		}
+	})
+}
+
+func (p *TenantPlugin) scopeQuery(db *gorm.DB) {
+	if field, tenantID := p.tenant(db); field != nil {
+		addTenantCondition(db, field, tenantID)
+	}
+}
+
+func (p *TenantPlugin) scopeWrite(db *gorm.DB) {
+	field, tenantID := p.tenant(db)
+	if field == nil {
+		return
+	}
+	if _, ok := db.Statement.Clauses["WHERE"]; !ok && !db.AllowGlobalUpdate && !hasPrimaryKeyValue(db) {
+		// leave it to gorm to reject the update or delete without conditions,
+		// the tenant condition must not turn it into an update of the whole tenant
+		return
+	}
+	addTenantCondition(db, field, tenantID)
+}
+
+func addTenantCondition(db *gorm.DB, field *schema.Field, tenantID interface{}) {
+	db.Statement.AddClause(clause.Where{Exprs: []clause.Expression{
+		clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: field.DBName}, Value: tenantID},
+	}})
+}
+
+// hasPrimaryKeyValue checks if the model has a non zero primary key, which is used as the condition by gorm
+func hasPrimaryKeyValue(db *gorm.DB) bool {
+	s := db.Statement.Schema
+	found := false
+	eachRow(db.Statement.ReflectValue, func(row reflect.Value) {
+		for _, field := range s.PrimaryFields {
+			if _, zero := field.ValueOf(row); !zero {
+				found = true
+			}
+		}
+	})
+	return found
+}
@@ -0,0 +1,111 @@
+package database
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+type tenantOrder struct {
+	ID           int64
+	DepartmentID int64 `tenant:"true"`
+	Amount       int
+}
+
+func TestTenantPlugin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tenant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := gorm.Open(sqlite.Open(filepath.Join(dir, "test.db")), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&tenantOrder{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Use(NewTenantPlugin(nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	tenant1 := WithTenant(context.Background(), int64(1))
+	tenant2 := WithTenant(context.Background(), int64(2))
+	admin := WithoutTenantScope(context.Background())
+
+	Convey("test tenant is set on create", t, func() {
+		So(db.WithContext(tenant1).Create(&[]*tenantOrder{{Amount: 10}, {Amount: 20}}).Error, ShouldBeNil)
+		order := &tenantOrder{Amount: 30}
+		So(db.WithContext(tenant2).Create(order).Error, ShouldBeNil)
+		So(order.DepartmentID, ShouldEqual, 2)
+
+		So(db.WithContext(tenant2).Create(&tenantOrder{DepartmentID: 1}).Error, ShouldEqual, ErrTenantMismatch)
+		So(db.Create(&tenantOrder{Amount: 40}).Error, ShouldEqual, ErrTenantMissing)
+	})
+
+	Convey("test queries are scoped to the tenant", t, func() {
+		var orders []tenantOrder
+		So(db.WithContext(tenant1).Where("amount > ?", 0).Find(&orders).Error, ShouldBeNil)
+		So(len(orders), ShouldEqual, 2)
+		var count int64
+		So(db.WithContext(tenant2).Model(&tenantOrder{}).Count(&count).Error, ShouldBeNil)
+		So(count, ShouldEqual, 1)
+		So(db.WithContext(tenant2).First(&tenantOrder{}, orders[0].ID).Error, ShouldEqual, gorm.ErrRecordNotFound)
+		So(db.Find(&orders).Error, ShouldEqual, ErrTenantMissing)
+
+		So(db.WithContext(admin).Model(&tenantOrder{}).Count(&count).Error, ShouldBeNil)
+		So(count, ShouldEqual, 3)
+	})
+
+	Convey("test updates and deletes are scoped to the tenant", t, func() {
+		result := db.WithContext(tenant2).Model(&tenantOrder{}).Where("amount > ?", 0).Update("amount", 100)
+		So(result.Error, ShouldBeNil)
+		So(result.RowsAffected, ShouldEqual, 1)
+		result = db.WithContext(tenant2).Delete(&tenantOrder{ID: 1})
+		So(result.Error, ShouldBeNil)
+		So(result.RowsAffected, ShouldEqual, 0)
+
+		// updates without conditions are still rejected
+		So(db.WithContext(tenant1).Model(&tenantOrder{}).Update("amount", 0).Error, ShouldEqual, gorm.ErrMissingWhereClause)
+
+		result = db.WithContext(tenant1).Where("amount = ?", 10).Delete(&tenantOrder{})
+		So(result.Error, ShouldBeNil)
+		So(result.RowsAffected, ShouldEqual, 1)
+	})
+
+	Convey("test row queries are scoped to the tenant", t, func() {
+		var amounts []int
+		So(db.WithContext(tenant2).Model(&tenantOrder{}).Pluck("amount", &amounts).Error, ShouldBeNil)
+		So(amounts, ShouldResemble, []int{100})
+
+		var total struct{ Total int }
+		So(db.WithContext(tenant1).Model(&tenantOrder{}).Select("sum(amount) as total").Scan(&total).Error, ShouldBeNil)
+		So(total.Total, ShouldEqual, 20)
+		// gorm adds the error of Rows to Scan again
+		So(db.Model(&tenantOrder{}).Select("sum(amount) as total").Scan(&total).Error.Error(), ShouldContainSubstring, ErrTenantMissing.Error())
+
+		rows, err := db.WithContext(tenant2).Model(&tenantOrder{}).Select("department_id").Rows()
+		So(err, ShouldBeNil)
+		var departments []int64
+		for rows.Next() {
+			var department int64
+			So(rows.Scan(&department), ShouldBeNil)
+			departments = append(departments, department)
+		}
+		rows.Close()
+		So(departments, ShouldResemble, []int64{2})
+		_, err = db.Model(&tenantOrder{}).Rows()
+		So(err, ShouldEqual, ErrTenantMissing)
+
+		// raw SQL is not scoped
+		var count int64
+		So(db.Raw("SELECT count(*) FROM tenant_orders").Scan(&count).Error, ShouldBeNil)
+		So(count, ShouldEqual, 2)
+	})
+}
@@ -0,0 +1,165 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+
+	. "github.com/yiGmMk/pz-infra-new/logging"
+
+	"gorm.io/gorm"
+)
+
+// TxOption is used to set how WithTx begins a transaction
+type TxOption struct {
+	DBName    string             // name of the registered database, the default database if empty
+	Isolation sql.IsolationLevel // isolation level of the transaction, the database default if 0
+	ReadOnly  bool
+}
+
+// TxFunc is called by WithTx with the context carrying the transaction
+type TxFunc func(ctx context.Context, tx *gorm.DB) error
+
+// txContextKey is the context key of the transaction of a database
+type txContextKey struct {
+	name string
+}
+
+// txScope is a transaction or a savepoint nested in it
+type txScope struct {
+	tx          *gorm.DB
+	depth       int // 0 for the transaction, n for the nth nested savepoint
+	lock        sync.Mutex
+	afterCommit []func()
+}
+
+// WithTx runs fn in a transaction, which is committed if fn returns nil and rolled back otherwise.
+// If ctx already carries a transaction of the same database, fn joins it in a savepoint,
+// so an error of fn only rolls back what fn did, and the isolation level of opts is ignored.
+// Use the ctx passed to fn in nested calls to propagate the transaction.
+func WithTx(ctx context.Context, fn TxFunc, opts ...*TxOption) error {
+	opt := &TxOption{}
+	if len(opts) > 0 && opts[0] != nil {
+		opt = opts[0]
+	}
+	name := opt.DBName
+	if name == "" {
+		name = DEFAULT_DB_NAME
+	}
+	key := txContextKey{name: name}
+	if parent, ok := ctx.Value(key).(*txScope); ok {
+		return parent.nested(ctx, key, fn)
+	}
+
+	var txOptions *sql.TxOptions
+	if opt.Isolation != sql.LevelDefault || opt.ReadOnly {
+		txOptions = &sql.TxOptions{Isolation: opt.Isolation, ReadOnly: opt.ReadOnly}
+	}
+	tx := GetDB(name).WithContext(ctx).Begin(txOptions)
+	if tx.Error != nil {
+		Log.Error("Failed to begin transaction", With("db", name), WithError(tx.Error))
+		return tx.Error
+	}
+	// the transaction carries the context too, so gorm callbacks can see it, e.g. to call AfterCommit
+	scope := &txScope{}
+	txCtx := context.WithValue(ctx, key, scope)
+	scope.tx = tx.WithContext(txCtx)
+
+	committed := false
+	defer func() {
+		if !committed {
+			if err := tx.Rollback().Error; err != nil && err != sql.ErrTxDone {
+				Log.Error("Failed to rollback transaction", With("db", name), WithError(err))
+			}
+		}
+	}()
+	if err := fn(txCtx, scope.tx); err != nil {
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	committed = true
+	scope.runAfterCommit()
+	return nil
+}
+
+// nested runs fn in a savepoint of the transaction
+func (s *txScope) nested(ctx context.Context, key txContextKey, fn TxFunc) error {
+	child := &txScope{depth: s.depth + 1}
+	childCtx := context.WithValue(ctx, key, child)
+	child.tx = s.tx.WithContext(childCtx)
+	savepoint := fmt.Sprintf("sp_%d", child.depth)
+	// use a new session so errors of savepoints are not kept by the transaction
+	if err := s.tx.Session(&gorm.Session{}).SavePoint(savepoint).Error; err != nil {
+		return err
+	}
+	if err := fn(childCtx, child.tx); err != nil {
+		if rbErr := s.tx.Session(&gorm.Session{}).RollbackTo(savepoint).Error; rbErr != nil {
+			Log.Error("Failed to rollback to savepoint", With("savepoint", savepoint), WithError(rbErr))
+		}
+		return err
+	}
+	if err := s.tx.Session(&gorm.Session{}).Exec("RELEASE SAVEPOINT " + savepoint).Error; err != nil {
+		return err
+	}
+	// hooks of the savepoint run only if the transaction is committed
+	s.lock.Lock()
+	s.afterCommit = append(s.afterCommit, child.afterCommit...)
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *txScope) runAfterCommit() {
+	for _, hook := range s.afterCommit {
+		runHook(hook)
+	}
+}
+
+func runHook(hook func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			Log.Error("After commit hook panic", With("panic", r))
+		}
+	}()
+	hook()
+}
+
+// AfterCommit registers hook to run after the transaction in ctx is committed,
+// e.g. publish an event only if the data is saved. The hook is dropped if the transaction
+// or the savepoint registering it is rolled back, and it runs at once if ctx carries no transaction.
+func AfterCommit(ctx context.Context, hook func(), name ...string) {
+	scope, ok := ctx.Value(txContextKey{name: dbName(name...)}).(*txScope)
+	if !ok {
+		runHook(hook)
+		return
+	}
+	scope.lock.Lock()
+	defer scope.lock.Unlock()
+	scope.afterCommit = append(scope.afterCommit, hook)
+}
+
+// TxFromContext returns the transaction of the database in ctx
+func TxFromContext(ctx context.Context, name ...string) (*gorm.DB, bool) {
+	scope, ok := ctx.Value(txContextKey{name: dbName(name...)}).(*txScope)
+	if !ok {
+		return nil, false
+	}
+	return scope.tx, true
+}
+
+// GetDBFromContext returns the transaction of the database in ctx, or a new DB with ctx if not in a transaction
+func GetDBFromContext(ctx context.Context, name ...string) *gorm.DB {
+	if tx, ok := TxFromContext(ctx, name...); ok {
+		return tx
+	}
+	return GetDB(name...).WithContext(ctx)
+}
+
+func dbName(name ...string) string {
+	if len(name) > 0 && name[0] != "" {
+		return name[0]
+	}
+	return DEFAULT_DB_NAME
+}
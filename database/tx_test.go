@@ -0,0 +1,167 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/yiGmMk/pz-infra-new/logging"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+type txItem struct {
+	ID   int64 `gorm:"primaryKey"`
+	Name string
+}
+
+func TestWithTx(t *testing.T) {
+	logger, err := (&logging.LogrusProvider{}).New(&logging.LogrusOption{Out: ioutil.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logging.Log = logger
+
+	dir, err := ioutil.TempDir("", "tx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := gorm.Open(sqlite.Open(filepath.Join(dir, "test.db")), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&txItem{}); err != nil {
+		t.Fatal(err)
+	}
+	// savepoints are executed as raw SQL
+	var lock sync.Mutex
+	var savepoints []string
+	db.Callback().Raw().After("gorm:raw").Register("test:savepoints", func(db *gorm.DB) {
+		if sql := db.Statement.SQL.String(); strings.Contains(sql, "SAVEPOINT") {
+			lock.Lock()
+			savepoints = append(savepoints, sql)
+			lock.Unlock()
+		}
+	})
+	SetNamedDB("tx", db)
+
+	ctx := context.Background()
+	option := &TxOption{DBName: "tx"}
+	names := func() []string {
+		var names []string
+		GetDB("tx").Model(&txItem{}).Order("id").Pluck("name", &names)
+		return names
+	}
+
+	Convey("test transactions", t, func() {
+		So(GetDB("tx").Where("1 = 1").Delete(&txItem{}).Error, ShouldBeNil)
+		savepoints = nil
+
+		Convey("committed if fn returns nil", func() {
+			So(WithTx(ctx, func(ctx context.Context, tx *gorm.DB) error {
+				_, ok := TxFromContext(ctx, "tx")
+				So(ok, ShouldBeTrue)
+				return GetDBFromContext(ctx, "tx").Create(&txItem{Name: "a"}).Error
+			}, option), ShouldBeNil)
+			So(names(), ShouldResemble, []string{"a"})
+		})
+
+		Convey("rolled back if fn returns an error", func() {
+			err := WithTx(ctx, func(ctx context.Context, tx *gorm.DB) error {
+				tx.Create(&txItem{Name: "a"})
+				return errors.New("failed")
+			}, option)
+			So(err, ShouldNotBeNil)
+			So(names(), ShouldBeEmpty)
+		})
+
+		Convey("a nested savepoint rolls back only what it did", func() {
+			So(WithTx(ctx, func(ctx context.Context, tx *gorm.DB) error {
+				tx.Create(&txItem{Name: "outer"})
+				So(WithTx(ctx, func(ctx context.Context, tx *gorm.DB) error {
+					tx.Create(&txItem{Name: "inner"})
+					So(WithTx(ctx, func(ctx context.Context, tx *gorm.DB) error {
+						tx.Create(&txItem{Name: "innermost"})
+						return errors.New("failed")
+					}, option), ShouldNotBeNil)
+					return nil
+				}, option), ShouldBeNil)
+				return WithTx(ctx, func(ctx context.Context, tx *gorm.DB) error {
+					tx.Create(&txItem{Name: "failed"})
+					return errors.New("failed")
+				}, option)
+			}, option), ShouldNotBeNil)
+			So(names(), ShouldBeEmpty)
+
+			savepoints = nil
+			So(WithTx(ctx, func(ctx context.Context, tx *gorm.DB) error {
+				tx.Create(&txItem{Name: "outer"})
+				So(WithTx(ctx, func(ctx context.Context, tx *gorm.DB) error {
+					tx.Create(&txItem{Name: "inner"})
+					return WithTx(ctx, func(ctx context.Context, tx *gorm.DB) error {
+						tx.Create(&txItem{Name: "innermost"})
+						return errors.New("failed")
+					}, option)
+				}, option), ShouldNotBeNil)
+				return nil
+			}, option), ShouldBeNil)
+			So(names(), ShouldResemble, []string{"outer"})
+			So(savepoints, ShouldResemble, []string{
+				"SAVEPOINT sp_1",
+				"SAVEPOINT sp_2",
+				"ROLLBACK TO SAVEPOINT sp_2",
+				"ROLLBACK TO SAVEPOINT sp_1",
+			})
+		})
+
+		Convey("after commit hooks run in order once committed", func() {
+			var called []string
+			So(WithTx(ctx, func(ctx context.Context, tx *gorm.DB) error {
+				AfterCommit(ctx, func() { called = append(called, "first") }, "tx")
+				So(WithTx(ctx, func(ctx context.Context, tx *gorm.DB) error {
+					AfterCommit(ctx, func() { called = append(called, "nested") }, "tx")
+					return nil
+				}, option), ShouldBeNil)
+				AfterCommit(ctx, func() { panic("hook panic") }, "tx")
+				AfterCommit(ctx, func() { called = append(called, "last") }, "tx")
+				So(called, ShouldBeEmpty)
+				return nil
+			}, option), ShouldBeNil)
+			So(called, ShouldResemble, []string{"first", "nested", "last"})
+		})
+
+		Convey("after commit hooks are dropped on rollback", func() {
+			var called []string
+			So(WithTx(ctx, func(ctx context.Context, tx *gorm.DB) error {
+				AfterCommit(ctx, func() { called = append(called, "outer") }, "tx")
+				So(WithTx(ctx, func(ctx context.Context, tx *gorm.DB) error {
+					AfterCommit(ctx, func() { called = append(called, "rolled back savepoint") }, "tx")
+					return errors.New("failed")
+				}, option), ShouldNotBeNil)
+				return nil
+			}, option), ShouldBeNil)
+			So(called, ShouldResemble, []string{"outer"})
+
+			called = nil
+			So(WithTx(ctx, func(ctx context.Context, tx *gorm.DB) error {
+				AfterCommit(ctx, func() { called = append(called, "rolled back") }, "tx")
+				return errors.New("failed")
+			}, option), ShouldNotBeNil)
+			So(called, ShouldBeEmpty)
+		})
+
+		Convey("after commit hooks run at once without a transaction", func() {
+			called := false
+			AfterCommit(ctx, func() { called = true }, "tx")
+			So(called, ShouldBeTrue)
+		})
+	})
+}
@@ -21,10 +21,18 @@ const (
 	ERROR_CODE_MOBILE_IS_INVALID        = 1006
 	ERROR_CODE_REQUEST_SMS_OVERLOAD     = 1007
 	ERROR_CODE_CAPTCHA_TOKEN_ERROR      = 1008
+	ERROR_CODE_ACCESS_TOKEN_REVOKED     = 1009
+	ERROR_CODE_REFRESH_TOKEN_ERROR      = 1010
+	ERROR_CODE_REFRESH_TOKEN_REUSED     = 1011
 	ERROR_CODE_REDIS_KEY_NULL           = 1015
 	ERROR_CODE_REDIS_VALUE_NULL_PTR     = 1016
 	ERROR_CODE_REDIS_VALUE_NULL         = 1017
 	ERROR_CODE_REDIS_KEY_NOT_EXIST      = 1018
+	ERROR_CODE_DB_VERSION_CONFLICT      = 1020
+	ERROR_CODE_DB_INVALID_CURSOR        = 1021
+	ERROR_CODE_DB_ERROR                 = 1022
+	ERROR_CODE_TENANT_MISSING           = 1023
+	ERROR_CODE_TENANT_MISMATCH          = 1024
 
 	ERROR_CODE_ALIOSS_CONFIG_IS_EMPTY          = 1200
 	ERROR_CODE_UPLOAD_FILE_CONTENT_IS_EMPTY    = 1201
@@ -76,10 +84,18 @@ var ErrorCodeMessageMap = map[int]string{
 	ERROR_CODE_MOBILE_IS_INVALID:        "手机号码无效",
 	ERROR_CODE_REQUEST_SMS_OVERLOAD:     "申请验证码超出次数",
 	ERROR_CODE_CAPTCHA_TOKEN_ERROR:      "验证码token错误",
+	ERROR_CODE_ACCESS_TOKEN_REVOKED:     "access token已注销",
+	ERROR_CODE_REFRESH_TOKEN_ERROR:      "refresh token错误或失效",
+	ERROR_CODE_REFRESH_TOKEN_REUSED:     "refresh token重复使用",
 	ERROR_CODE_REDIS_KEY_NULL:           "redis: key值为空",
 	ERROR_CODE_REDIS_VALUE_NULL_PTR:     "redis: value值为空指针",
 	ERROR_CODE_REDIS_VALUE_NULL:         "redis: value值为空",
 	ERROR_CODE_REDIS_KEY_NOT_EXIST:      "redis: key不存在或过期",
+	ERROR_CODE_DB_VERSION_CONFLICT:      "数据已被修改,请刷新后重试",
+	ERROR_CODE_DB_INVALID_CURSOR:        "分页游标无效",
+	ERROR_CODE_DB_ERROR:                 "数据库错误",
+	ERROR_CODE_TENANT_MISSING:           "缺少租户信息",
+	ERROR_CODE_TENANT_MISMATCH:          "租户不匹配",
 
 	ERROR_CODE_ALIOSS_CONFIG_IS_EMPTY:          "阿里oss配置为空",
 	ERROR_CODE_UPLOAD_FILE_CONTENT_IS_EMPTY:    "上传文件内容为空",
@@ -28,7 +28,7 @@ require (
 	github.com/stretchr/testify v1.6.1
 	github.com/stvp/tempredis v0.0.0-20181119212430-b82af8480203
 	github.com/tealeg/xlsx v1.0.5
-	github.com/tinylib/msgp v1.1.4 // indirect
+	github.com/tinylib/msgp v1.1.4
 	github.com/twpayne/go-polyline v1.0.1
 	github.com/ziutek/mymysql v1.5.4
 	golang.org/x/crypto v0.0.0-20201012173705-84dcc777aaee // indirect
@@ -36,6 +36,9 @@ require (
 	gopkg.in/gomail.v2 v2.0.0-20160411212932-81ebce5c23df // indirect
 	gopkg.in/natefinch/lumberjack.v2 v2.0.0
 	gopkg.in/olivere/elastic.v5 v5.0.86
+	gopkg.in/yaml.v2 v2.2.8
 	gorm.io/driver/mysql v1.0.3
+	gorm.io/driver/sqlite v1.1.4
 	gorm.io/gorm v1.20.11
+	gorm.io/plugin/dbresolver v1.1.0
 )
@@ -0,0 +1,143 @@
+package lockUtil
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	. "github.com/yiGmMk/pz-infra-new/logging"
+	"github.com/yiGmMk/pz-infra-new/redisUtil"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// SCAN_COUNT is the COUNT hint of the SCAN of the lock names
+const SCAN_COUNT = 1000
+
+// ErrEmptyLockPrefix is returned for an empty prefix, which would match every key of redis
+var ErrEmptyLockPrefix = errors.New("lockUtil: lock prefix is empty")
+
+// LockInfo describes a lock which is currently held.
+type LockInfo struct {
+	Name   string        `json:"name"`
+	TTL    time.Duration `json:"ttl"`
+	Holder *LockHolder   `json:"holder"` // nil if the holder is released after listed
+}
+
+// ListLocks returns all held locks whose name starts with prefix.
+// Only the locks with holders, i.e. acquired by lockUtil, are listed, prefix must not be empty.
+func ListLocks(prefix string) ([]LockInfo, error) {
+	conn := redisUtil.GetPool().Get()
+	defer conn.Close()
+
+	names, err := getLockNames(conn, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	locks := make([]LockInfo, 0, len(names))
+	for _, name := range names {
+		ttl, err := redis.Int64(conn.Do("PTTL", name))
+		if err != nil {
+			Log.Error("lockUtil: failed to get lock ttl", With("lock", name), WithError(err))
+			return nil, err
+		}
+		if ttl == -2 { // released after listed
+			continue
+		}
+		info := LockInfo{Name: name, TTL: time.Duration(ttl) * time.Millisecond}
+		info.Holder, err = getLockHolder(conn, name)
+		if err != nil {
+			Log.Warn("lockUtil: invalid lock holder", With("lock", name), WithError(err))
+		}
+		locks = append(locks, info)
+	}
+	return locks, nil
+}
+
+// ForceReleaseLocks deletes all locks whose name starts with prefix regardless of who holds them,
+// returns the number of released locks. As ListLocks, only the locks with holders are deleted,
+// so other keys of the prefix are kept, and prefix must not be empty.
+func ForceReleaseLocks(prefix string) (int, error) {
+	conn := redisUtil.GetPool().Get()
+	defer conn.Close()
+
+	names, err := getLockNames(conn, prefix)
+	if err != nil {
+		return 0, err
+	}
+
+	released := 0
+	for _, name := range names {
+		holder, _ := getLockHolder(conn, name)
+		n, err := redis.Int(conn.Do("DEL", name, getHolderKey(name)))
+		if err != nil {
+			Log.Error("lockUtil: failed to force release lock", With("lock", name), WithError(err))
+			return released, err
+		}
+		if n > 0 {
+			released++
+			metrics.forceReleased(name, holder)
+		}
+	}
+	return released, nil
+}
+
+// getLockNames scans the holder keys of the locks whose name starts with prefix and returns the names,
+// keys without holders are not locks of lockUtil
+func getLockNames(conn redis.Conn, prefix string) ([]string, error) {
+	if prefix == "" {
+		return nil, ErrEmptyLockPrefix
+	}
+	pattern := escapePattern(prefix) + "*" + HOLDER_KEY_SUFFIX
+	seen := map[string]bool{}
+	var names []string
+	cursor := 0
+	for {
+		values, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", SCAN_COUNT))
+		if err == nil {
+			cursor, err = redis.Int(values[0], nil)
+		}
+		var keys []string
+		if err == nil {
+			keys, err = redis.Strings(values[1], nil)
+		}
+		if err != nil {
+			Log.Error("lockUtil: failed to list locks", With("prefix", prefix), WithError(err))
+			return nil, err
+		}
+		// keys may be returned more than once by SCAN
+		for _, key := range keys {
+			if name := strings.TrimSuffix(key, HOLDER_KEY_SUFFIX); !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+		if cursor == 0 {
+			return names, nil
+		}
+	}
+}
+
+// escapePattern escapes the glob characters of redis patterns in s
+func escapePattern(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(`*?[]\`, c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func getLockHolder(conn redis.Conn, name string) (*LockHolder, error) {
+	s, err := redis.String(conn.Do("GET", getHolderKey(name)))
+	if err != nil {
+		if err == redis.ErrNil {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return decodeLockHolder(s)
+}
@@ -0,0 +1,19 @@
+package lockUtil
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLockNames(t *testing.T) {
+	Convey("test empty prefix is rejected", t, func() {
+		_, err := getLockNames(nil, "")
+		So(err, ShouldEqual, ErrEmptyLockPrefix)
+	})
+
+	Convey("test glob characters of prefix are escaped", t, func() {
+		So(escapePattern("order:"), ShouldEqual, "order:")
+		So(escapePattern(`a*b?[c]\`), ShouldEqual, `a\*b\?\[c\]\\`)
+	})
+}
@@ -0,0 +1,79 @@
+package lockUtil
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+// HOLDER_KEY_SUFFIX is appended to a lock name to build the companion key
+// which stores who is holding the lock.
+const HOLDER_KEY_SUFFIX = ":holder"
+
+// LockHolder describes the process which holds a lock.
+type LockHolder struct {
+	Hostname   string    `json:"hostname"`
+	Pid        int       `json:"pid"`
+	AcquiredAt time.Time `json:"acquired_at"`
+	Caller     string    `json:"caller"`
+	Value      string    `json:"value"`
+}
+
+var hostname = func() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return name
+}()
+
+func getHolderKey(name string) string {
+	return name + HOLDER_KEY_SUFFIX
+}
+
+// newLockHolder records the current process as the holder of a lock,
+// skip is the number of stack frames to ascend to find the caller.
+func newLockHolder(value string, skip int) *LockHolder {
+	return &LockHolder{
+		Hostname:   hostname,
+		Pid:        os.Getpid(),
+		AcquiredAt: time.Now(),
+		Caller:     getCaller(skip + 1),
+		Value:      value,
+	}
+}
+
+func (h *LockHolder) encode() string {
+	bs, err := json.Marshal(h)
+	if err != nil {
+		return ""
+	}
+	return string(bs)
+}
+
+func decodeLockHolder(s string) (*LockHolder, error) {
+	if s == "" {
+		return nil, nil
+	}
+	holder := &LockHolder{}
+	if err := json.Unmarshal([]byte(s), holder); err != nil {
+		return nil, err
+	}
+	return holder, nil
+}
+
+func getCaller(skip int) string {
+	pc, file, line, ok := runtime.Caller(skip + 1)
+	if !ok {
+		return "unknown"
+	}
+	_, fileName := filepath.Split(file)
+	funcName := "unknown"
+	if fn := runtime.FuncForPC(pc); fn != nil {
+		funcName = filepath.Base(fn.Name())
+	}
+	return fmt.Sprintf("%s:%d:%s", fileName, line, funcName)
+}
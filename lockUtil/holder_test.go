@@ -0,0 +1,50 @@
+package lockUtil
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLockHolder(t *testing.T) {
+	Convey("test lock holder", t, func() {
+		Convey("holder key", func() {
+			So(getHolderKey("order:1"), ShouldEqual, "order:1"+HOLDER_KEY_SUFFIX)
+		})
+
+		Convey("new holder records the caller", func() {
+			holder := newLockHolder("value", 0)
+			So(holder.Hostname, ShouldEqual, hostname)
+			So(holder.Pid, ShouldEqual, os.Getpid())
+			So(holder.Value, ShouldEqual, "value")
+			So(time.Since(holder.AcquiredAt), ShouldBeLessThan, time.Second)
+			So(strings.HasPrefix(holder.Caller, "holder_test.go:"), ShouldBeTrue)
+		})
+
+		Convey("encode and decode", func() {
+			holder := &LockHolder{
+				Hostname:   "host",
+				Pid:        42,
+				AcquiredAt: time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC),
+				Caller:     "a.go:1:pkg.F",
+				Value:      "value",
+			}
+			decoded, err := decodeLockHolder(holder.encode())
+			So(err, ShouldBeNil)
+			So(decoded.AcquiredAt.Equal(holder.AcquiredAt), ShouldBeTrue)
+			decoded.AcquiredAt = holder.AcquiredAt
+			So(decoded, ShouldResemble, holder)
+		})
+
+		Convey("decode empty and invalid", func() {
+			holder, err := decodeLockHolder("")
+			So(err, ShouldBeNil)
+			So(holder, ShouldBeNil)
+			_, err = decodeLockHolder("not json")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,145 @@
+package lockUtil
+
+import (
+	"sync"
+	"time"
+
+	. "github.com/yiGmMk/pz-infra-new/logging"
+)
+
+// LockStats is a snapshot of the lock metrics collected in this process.
+type LockStats struct {
+	Acquired       int64           `json:"acquired"`
+	Failed         int64           `json:"failed"`
+	Released       int64           `json:"released"`
+	ForceReleased  int64           `json:"force_released"`
+	TotalWait      time.Duration   `json:"total_wait"`
+	MaxWait        time.Duration   `json:"max_wait"`
+	TotalHold      time.Duration   `json:"total_hold"`
+	MaxHold        time.Duration   `json:"max_hold"`
+	WaitHistogram  []int64         `json:"wait_histogram"`
+	HoldHistogram  []int64         `json:"hold_histogram"`
+	HistogramEdges []time.Duration `json:"histogram_edges"`
+}
+
+// AvgWait returns the average time spent to acquire a lock successfully.
+func (s LockStats) AvgWait() time.Duration {
+	if s.Acquired == 0 {
+		return 0
+	}
+	return s.TotalWait / time.Duration(s.Acquired)
+}
+
+// AvgHold returns the average time a lock was held before released.
+func (s LockStats) AvgHold() time.Duration {
+	if s.Released == 0 {
+		return 0
+	}
+	return s.TotalHold / time.Duration(s.Released)
+}
+
+// histogram buckets upper bounds, the last bucket counts everything above
+var histogramEdges = []time.Duration{
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+	10 * time.Second,
+}
+
+type lockMetrics struct {
+	lock  sync.Mutex
+	stats LockStats
+}
+
+var metrics = newLockMetrics()
+
+func newLockMetrics() *lockMetrics {
+	return &lockMetrics{
+		stats: LockStats{
+			WaitHistogram: make([]int64, len(histogramEdges)+1),
+			HoldHistogram: make([]int64, len(histogramEdges)+1),
+		},
+	}
+}
+
+func observe(histogram []int64, d time.Duration) {
+	for i, edge := range histogramEdges {
+		if d <= edge {
+			histogram[i]++
+			return
+		}
+	}
+	histogram[len(histogramEdges)]++
+}
+
+func (m *lockMetrics) acquired(name string, wait time.Duration) {
+	m.lock.Lock()
+	m.stats.Acquired++
+	m.stats.TotalWait += wait
+	if wait > m.stats.MaxWait {
+		m.stats.MaxWait = wait
+	}
+	observe(m.stats.WaitHistogram, wait)
+	m.lock.Unlock()
+	Log.Debug("lock acquired", With("lock", name), With("wait", wait.String()))
+}
+
+func (m *lockMetrics) failed(name string, wait time.Duration, err error) {
+	m.lock.Lock()
+	m.stats.Failed++
+	m.lock.Unlock()
+	Log.Warn("failed to acquire lock", With("lock", name), With("wait", wait.String()), WithError(err))
+}
+
+func (m *lockMetrics) released(name string, hold time.Duration) {
+	m.lock.Lock()
+	m.stats.Released++
+	m.stats.TotalHold += hold
+	if hold > m.stats.MaxHold {
+		m.stats.MaxHold = hold
+	}
+	observe(m.stats.HoldHistogram, hold)
+	m.lock.Unlock()
+	Log.Debug("lock released", With("lock", name), With("hold", hold.String()))
+}
+
+func (m *lockMetrics) forceReleased(name string, holder *LockHolder) {
+	m.lock.Lock()
+	m.stats.ForceReleased++
+	m.lock.Unlock()
+	Log.Warn("lock force released", With("lock", name), With("holder", holder))
+}
+
+// GetLockStats returns a snapshot of the lock metrics of this process.
+func GetLockStats() LockStats {
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+	stats := metrics.stats
+	stats.WaitHistogram = append([]int64{}, metrics.stats.WaitHistogram...)
+	stats.HoldHistogram = append([]int64{}, metrics.stats.HoldHistogram...)
+	stats.HistogramEdges = append([]time.Duration{}, histogramEdges...)
+	return stats
+}
+
+// ResetLockStats clears all lock metrics collected so far.
+func ResetLockStats() {
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+	metrics.stats = newLockMetrics().stats
+}
+
+// LogLockStats writes the current lock metrics to the logger.
+func LogLockStats() {
+	stats := GetLockStats()
+	Log.Info("lock stats",
+		With("acquired", stats.Acquired),
+		With("failed", stats.Failed),
+		With("released", stats.Released),
+		With("forceReleased", stats.ForceReleased),
+		With("avgWait", stats.AvgWait().String()),
+		With("maxWait", stats.MaxWait.String()),
+		With("avgHold", stats.AvgHold().String()),
+		With("maxHold", stats.MaxHold.String()),
+	)
+}
@@ -0,0 +1,70 @@
+package lockUtil
+
+import (
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	. "github.com/yiGmMk/pz-infra-new/logging"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func initTestLogger() {
+	if Log == nil {
+		Log, _ = (&LogrusProvider{}).New(&LogrusOption{Out: ioutil.Discard})
+	}
+}
+
+func TestLockMetrics(t *testing.T) {
+	initTestLogger()
+	Convey("test lock metrics", t, func() {
+		ResetLockStats()
+		Reset(ResetLockStats)
+
+		Convey("empty stats", func() {
+			stats := GetLockStats()
+			So(stats.Acquired, ShouldEqual, 0)
+			So(stats.AvgWait(), ShouldEqual, 0)
+			So(stats.AvgHold(), ShouldEqual, 0)
+			So(stats.HistogramEdges, ShouldResemble, histogramEdges)
+			So(len(stats.WaitHistogram), ShouldEqual, len(histogramEdges)+1)
+		})
+
+		Convey("acquired, failed and released", func() {
+			metrics.acquired("a", 5*time.Millisecond)
+			metrics.acquired("a", 15*time.Millisecond)
+			metrics.failed("a", time.Second, errors.New("failed"))
+			metrics.released("a", 2*time.Second)
+			metrics.released("a", time.Minute)
+			metrics.forceReleased("a", nil)
+
+			stats := GetLockStats()
+			So(stats.Acquired, ShouldEqual, 2)
+			So(stats.Failed, ShouldEqual, 1)
+			So(stats.Released, ShouldEqual, 2)
+			So(stats.ForceReleased, ShouldEqual, 1)
+			So(stats.MaxWait, ShouldEqual, 15*time.Millisecond)
+			So(stats.AvgWait(), ShouldEqual, 10*time.Millisecond)
+			So(stats.MaxHold, ShouldEqual, time.Minute)
+			So(stats.AvgHold(), ShouldEqual, 31*time.Second)
+			So(stats.WaitHistogram, ShouldResemble, []int64{0, 1, 1, 0, 0, 0})
+			So(stats.HoldHistogram, ShouldResemble, []int64{0, 0, 0, 0, 1, 1})
+		})
+
+		Convey("snapshot is a copy", func() {
+			metrics.acquired("a", time.Millisecond)
+			stats := GetLockStats()
+			stats.WaitHistogram[0] = 100
+			So(GetLockStats().WaitHistogram[0], ShouldEqual, 1)
+		})
+
+		Convey("histogram edges are inclusive", func() {
+			histogram := make([]int64, len(histogramEdges)+1)
+			observe(histogram, time.Millisecond)
+			observe(histogram, 10*time.Second+1)
+			So(histogram, ShouldResemble, []int64{1, 0, 0, 0, 0, 1})
+		})
+	})
+}
@@ -12,17 +12,31 @@ import (
 )
 
 func GetLockerAndLock(name string, expiry ...time.Duration) (redsync.Locker, error) {
-	mutex, err := redsync.NewMutexWithPool(name, []*redis.Pool{redisUtil.GetPool()})
-	if err != nil {
-		log.Error(err)
-		return nil, err
+	c := &lockConfig{
+		Name:   name,
+		Quorum: 1,
+		nodes:  []*redis.Pool{redisUtil.GetPool()},
 	}
 	if len(expiry) > 0 {
-		mutex.Expiry = expiry[0]
+		c.Expiry = expiry[0]
 	}
-	if err := mutex.Lock(); err != nil {
+	if err := acquireLock(c, 1); err != nil {
 		log.Error(err)
 		return nil, err
 	}
-	return mutex, nil
+	return &observedLocker{c}, nil
+}
+
+// observedLocker is a redsync.Locker recording holder metadata and hold duration,
+// the holder is set and deleted with the lock by the value checked scripts of redlock
+type observedLocker struct {
+	config *lockConfig
+}
+
+func (l *observedLocker) Lock() error {
+	return acquireLock(l.config, 1)
+}
+
+func (l *observedLocker) Unlock() {
+	ReleaseLock(l.config)
 }
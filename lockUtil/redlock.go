@@ -42,6 +42,8 @@ type lockConfig struct {
 	value string // value is used in order to release the lock in a safe way
 	until time.Time
 
+	acquiredAt time.Time // used to measure how long the lock is held
+
 	nodes []*redis.Pool
 }
 
@@ -65,6 +67,11 @@ func NewLockConfig(name, value string) *lockConfig {
 }
 
 func AcquireLock(c *lockConfig) error {
+	return acquireLock(c, 1)
+}
+
+// acquireLock acquires the lock of c, skip is the number of stack frames to the caller recorded in the holder
+func acquireLock(c *lockConfig, skip int) error {
 	var value string
 	if c.value == "" {
 		b := make([]byte, 16)
@@ -87,8 +94,11 @@ func AcquireLock(c *lockConfig) error {
 		retries = DefaultTries
 	}
 
+	begin := time.Now()
 	for i := 0; i < retries; i++ {
 		n := 0
+		// built for each attempt, so AcquiredAt is the time of the attempt which succeeds
+		holder := newLockHolder(value, skip+1).encode()
 		start := time.Now()
 		for _, node := range c.nodes {
 			if node == nil {
@@ -96,7 +106,7 @@ func AcquireLock(c *lockConfig) error {
 			}
 
 			conn := node.Get()
-			reply, err := redis.String(conn.Do("set", c.Name, value, "nx", "px", int(expiry/time.Millisecond)))
+			reply, err := redis.String(acquireScript.Do(conn, c.Name, getHolderKey(c.Name), value, int(expiry/time.Millisecond), holder))
 			conn.Close()
 			if err != nil {
 				continue
@@ -116,6 +126,8 @@ func AcquireLock(c *lockConfig) error {
 		if n >= c.Quorum && time.Now().Before(until) {
 			c.value = value
 			c.until = until
+			c.acquiredAt = time.Now()
+			metrics.acquired(c.Name, c.acquiredAt.Sub(begin))
 			return nil
 		}
 
@@ -128,6 +140,7 @@ func AcquireLock(c *lockConfig) error {
 		time.Sleep(delay)
 	}
 
+	metrics.failed(c.Name, time.Since(begin), ErrFailed)
 	return ErrFailed
 }
 
@@ -150,7 +163,7 @@ func TouchLock(c *lockConfig) bool {
 		}
 
 		conn := node.Get()
-		reply, err := touchScript.Do(conn, c.Name, value, reset)
+		reply, err := touchScript.Do(conn, c.Name, getHolderKey(c.Name), value, reset)
 		conn.Close()
 		if err != nil {
 			continue
@@ -172,8 +185,10 @@ func ReleaseLock(c *lockConfig) bool {
 		panic("redsync: unlock of unlocked mutex")
 	}
 
+	acquiredAt := c.acquiredAt
 	c.value = ""
 	c.until = time.Unix(0, 0)
+	c.acquiredAt = time.Time{}
 
 	n := 0
 	for _, node := range c.nodes {
@@ -182,7 +197,7 @@ func ReleaseLock(c *lockConfig) bool {
 		}
 
 		conn := node.Get()
-		status, err := delScript.Do(conn, c.Name, value)
+		status, err := delScript.Do(conn, c.Name, getHolderKey(c.Name), value)
 		conn.Close()
 		if err != nil {
 			continue
@@ -193,20 +208,31 @@ func ReleaseLock(c *lockConfig) bool {
 		n++
 	}
 	if n >= c.Quorum {
+		metrics.released(c.Name, time.Since(acquiredAt))
 		return true
 	}
 	return false
 }
 
-var delScript = redis.NewScript(1, `
+var acquireScript = redis.NewScript(2, `
+if redis.call("set", KEYS[1], ARGV[1], "nx", "px", ARGV[2]) then
+	redis.call("set", KEYS[2], ARGV[3], "px", ARGV[2])
+	return "OK"
+else
+	return false
+end`)
+
+var delScript = redis.NewScript(2, `
 if redis.call("get", KEYS[1]) == ARGV[1] then
+	redis.call("del", KEYS[2])
 	return redis.call("del", KEYS[1])
 else
 	return 0
 end`)
 
-var touchScript = redis.NewScript(1, `
+var touchScript = redis.NewScript(2, `
 if redis.call("get", KEYS[1]) == ARGV[1] then
+	redis.call("pexpire", KEYS[2], ARGV[2])
 	return redis.call("set", KEYS[1], ARGV[1], "xx", "px", ARGV[2])
 else
 	return "ERR"
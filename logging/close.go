@@ -0,0 +1,62 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/yiGmMk/pz-infra-new/logging/hooks/async"
+	"github.com/yiGmMk/pz-infra-new/logging/hooks/rolling"
+)
+
+var (
+	closers     []io.Closer // the hooks of the last InitLoggerWithConfig
+	closersLock sync.Mutex
+)
+
+// replaceClosers sets the hooks to close by Close and returns the hooks of the previous init
+func replaceClosers(hookClosers []io.Closer) []io.Closer {
+	closersLock.Lock()
+	defer closersLock.Unlock()
+	previous := closers
+	closers = hookClosers
+	return previous
+}
+
+// Close flushes the async hooks and closes the hooks and the log files of InitLoggerWithConfig,
+// call it before exiting, e.g. defer logging.Close() in main. Entries logged after it are written synchronously.
+func Close() error {
+	closeErr := closeHooks(replaceClosers(nil))
+	if err := rolling.Close(); err != nil && closeErr == nil {
+		closeErr = err
+	}
+	return closeErr
+}
+
+// closeHooks closes the hooks in reverse order, so an async hook is flushed before the hook wrapped by it is closed
+func closeHooks(hookClosers []io.Closer) error {
+	var closeErr error
+	for i := len(hookClosers) - 1; i >= 0; i-- {
+		if hook, ok := hookClosers[i].(*async.Hook); ok && hook.Dropped() > 0 {
+			fmt.Fprintf(os.Stderr, "logging: %d entries dropped as the buffer is full\n", hook.Dropped())
+		}
+		if err := hookClosers[i].Close(); err != nil && closeErr == nil {
+			closeErr = err
+		}
+	}
+	return closeErr
+}
+
+// DroppedEntries returns the number of the entries dropped by the async hooks as their buffers are full
+func DroppedEntries() uint64 {
+	closersLock.Lock()
+	defer closersLock.Unlock()
+	var dropped uint64
+	for _, closer := range closers {
+		if hook, ok := closer.(*async.Hook); ok {
+			dropped += hook.Dropped()
+		}
+	}
+	return dropped
+}
@@ -0,0 +1,362 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/yiGmMk/pz-infra-new/config"
+	"github.com/yiGmMk/pz-infra-new/logging/formatter"
+	"github.com/yiGmMk/pz-infra-new/logging/hooks/async"
+	"github.com/yiGmMk/pz-infra-new/logging/hooks/fluentd"
+	"github.com/yiGmMk/pz-infra-new/logging/hooks/rolling"
+
+	"github.com/sirupsen/logrus"
+)
+
+// types of the outputs
+const (
+	LOG_OUTPUT_STDERR = "stderr"
+	LOG_OUTPUT_STDOUT = "stdout"
+	LOG_OUTPUT_FILE   = "file"
+)
+
+const DEFAULT_LOG_LEVEL = "info"
+
+// LoggingConfig describes the logger of InitLoggerWithConfig
+type LoggingConfig struct {
+	Component string         `json:"component"`
+	Level     string         `json:"level"`   // default level of the outputs, DEFAULT_LOG_LEVEL if empty
+	Format    string         `json:"format"`  // default format of the outputs, see formatter.New
+	Outputs   []OutputConfig `json:"outputs"` // stderr if empty
+	Fluentd   FluentdConfig  `json:"fluentd"`
+	Async     AsyncConfig    `json:"async"` // of the file outputs and fluentd
+}
+
+// OutputConfig describes where the log lines go
+type OutputConfig struct {
+	Type     string         `json:"type"`  // LOG_OUTPUT_STDERR, LOG_OUTPUT_STDOUT or LOG_OUTPUT_FILE
+	Path     string         `json:"path"`  // path of the file
+	Level    string         `json:"level"` // the least severe level written, LoggingConfig.Level if empty
+	Format   string         `json:"format"`
+	Rotation RotationConfig `json:"rotation"`
+}
+
+// RotationConfig is the rotation of a file output, the defaults of rolling are used for zero values
+type RotationConfig struct {
+	MaxSize    int  `json:"maxSize"`    // megabytes
+	MaxBackups int  `json:"maxBackups"` // rotated files to retain
+	MaxAge     int  `json:"maxAge"`     // days to retain the rotated files
+	Compress   bool `json:"compress"`   // gzip the rotated files
+	LocalTime  bool `json:"localTime"`
+}
+
+// AsyncConfig describes the async hooks, see async.Hook. Call Close before exiting to flush them.
+type AsyncConfig struct {
+	Enabled    bool   `json:"enabled"`
+	BufferSize int    `json:"bufferSize"` // async.DEFAULT_BUFFER_SIZE if 0
+	BatchSize  int    `json:"batchSize"`  // async.DEFAULT_BATCH_SIZE if 0
+	Policy     string `json:"policy"`     // policy when the buffer is full, block, dropNewest or dropOldest
+}
+
+// FluentdConfig describes the fluentd hook
+type FluentdConfig struct {
+	Enabled   bool   `json:"enabled"`
+	Host      string `json:"host"`
+	Port      int    `json:"port"`
+	Level     string `json:"level"`     // LoggingConfig.Level if empty
+	TagPrefix string `json:"tagPrefix"` // fluentd.FLUENTD_TAG_PREFIX if empty
+}
+
+// LoadLoggingConfig reads the config under key, e.g. of yaml
+//
+//	logger:
+//	  level: info
+//	  format: json
+//	  outputs:
+//	  - type: file
+//	    path: ./log/error.log
+//	    level: error
+//	    rotation:
+//	      maxSize: 100
+//	      compress: true
+func LoadLoggingConfig(configer config.Configer, key string) (*LoggingConfig, error) {
+	c := &LoggingConfig{}
+	if !configer.IsSet(key) {
+		return c, nil
+	}
+	// the keys of some providers are lower cased, which are matched by encoding/json too
+	data, err := json.Marshal(stringKeys(configer.Get(key)))
+	if err != nil {
+		return nil, fmt.Errorf("logging: invalid config %s: %v", key, err)
+	}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("logging: invalid config %s: %v", key, err)
+	}
+	return c, c.Validate()
+}
+
+// stringKeys converts the map[interface{}]interface{} of yaml to map[string]interface{} for encoding/json
+func stringKeys(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			m[fmt.Sprint(k)] = stringKeys(item)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			m[k] = stringKeys(item)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, item := range v {
+			s[i] = stringKeys(item)
+		}
+		return s
+	}
+	return value
+}
+
+// Validate checks the levels, formats and outputs of the config
+func (c *LoggingConfig) Validate() error {
+	var errs []string
+	check := func(err error) {
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	check(validateLevel(c.Level))
+	check(validateFormat(c.Format))
+	for i, output := range c.Outputs {
+		check(validateLevel(output.Level))
+		check(validateFormat(output.Format))
+		switch output.Type {
+		case LOG_OUTPUT_STDERR, LOG_OUTPUT_STDOUT:
+		case LOG_OUTPUT_FILE:
+			if output.Path == "" {
+				errs = append(errs, fmt.Sprintf("path of output %d is empty", i))
+			}
+			r := output.Rotation
+			if r.MaxSize < 0 || r.MaxBackups < 0 || r.MaxAge < 0 {
+				errs = append(errs, fmt.Sprintf("rotation of output %d is negative", i))
+			}
+		default:
+			errs = append(errs, fmt.Sprintf("unknown type %q of output %d", output.Type, i))
+		}
+	}
+	if c.Async.BufferSize < 0 || c.Async.BatchSize < 0 {
+		errs = append(errs, "buffer or batch size of async is negative")
+	}
+	if !async.ValidPolicy(async.Policy(c.Async.Policy)) {
+		errs = append(errs, fmt.Sprintf("unknown policy %q of async", c.Async.Policy))
+	}
+	if c.Fluentd.Enabled {
+		check(validateLevel(c.Fluentd.Level))
+		if c.Fluentd.Host == "" || c.Fluentd.Port <= 0 {
+			errs = append(errs, "host or port of fluentd is missing")
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("logging: invalid config: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func validateLevel(level string) error {
+	if level == "" {
+		return nil
+	}
+	_, err := logrus.ParseLevel(level)
+	return err
+}
+
+func validateFormat(format string) error {
+	if format == "" {
+		return nil
+	}
+	_, err := formatter.New(format)
+	return err
+}
+
+// levels returns the levels written by an output, all levels if the output follows AppLevel
+func (c *LoggingConfig) levels(level string) []logrus.Level {
+	if level == "" {
+		return logrus.AllLevels
+	}
+	return levelsFrom(c.level(level))
+}
+
+// level returns the level of an output, the default level of the config if empty
+func (c *LoggingConfig) level(level string) logrus.Level {
+	if level == "" {
+		level = c.Level
+	}
+	if level == "" {
+		level = DEFAULT_LOG_LEVEL
+	}
+	l, _ := logrus.ParseLevel(level)
+	return l
+}
+
+var (
+	initLogger *logrus.Logger // the logger of the last InitLoggerWithConfig, attached to AppLevel
+	initLock   sync.Mutex
+)
+
+// InitLoggerWithConfig initializes Log by config, an error is returned if the config is invalid.
+// The level of the config is set to AppLevel, which can be changed at runtime, outputs without levels follow it,
+// and outputs with their own levels get their entries even if they are more verbose than AppLevel.
+// Failing to connect fluentd is printed to stderr only and the hook is skipped.
+func InitLoggerWithConfig(c *LoggingConfig) (Logger, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	initProvider()
+	outputs := c.Outputs
+	if len(outputs) == 0 {
+		outputs = []OutputConfig{{Type: LOG_OUTPUT_STDERR}}
+	}
+
+	var hooks []logrus.Hook
+	var hookClosers []io.Closer // closed by Close or the next init
+	outputLevel := logrus.PanicLevel
+	// add appends the hook of an output, the outputs without their own levels follow AppLevel
+	add := func(hook logrus.Hook, level string) {
+		if closer, ok := hook.(io.Closer); ok {
+			hookClosers = append(hookClosers, closer)
+		}
+		if level == "" {
+			hook = FollowLevel(hook)
+		} else {
+			outputLevel = maxLevel(outputLevel, c.level(level))
+		}
+		hooks = append(hooks, hook)
+	}
+	for _, output := range outputs {
+		levels := c.levels(output.Level)
+		format := output.Format
+		if format == "" {
+			format = c.Format
+		}
+		f, _ := formatter.New(format)
+		switch output.Type {
+		case LOG_OUTPUT_FILE:
+			r := output.Rotation
+			add(c.async(rolling.NewWithOption(&rolling.Option{
+				Path:       output.Path,
+				MaxSize:    r.MaxSize,
+				MaxBackups: r.MaxBackups,
+				MaxAge:     r.MaxAge,
+				Compress:   r.Compress,
+				LocalTime:  r.LocalTime,
+			}).SetFormatter(f).SetLevels(levels)), output.Level)
+		default:
+			var out io.Writer = os.Stderr
+			if output.Type == LOG_OUTPUT_STDOUT {
+				out = os.Stdout
+			}
+			// the text of logrus is kept for the console if the format is not set
+			if format == "" {
+				f = new(logrus.TextFormatter)
+			}
+			add(&writerHook{levels: levels, out: out, formatter: f}, output.Level)
+		}
+	}
+	if c.Fluentd.Enabled {
+		hook, err := fluentd.NewForComponent(c.Fluentd.Host, c.Fluentd.Port, c.Fluentd.TagPrefix, c.Component)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "logging: failed to connect fluentd [%s] \n", err)
+		} else {
+			hookClosers = append(hookClosers, hook)
+			add(c.async(hook.SetLevels(c.levels(c.Fluentd.Level))), c.Fluentd.Level)
+		}
+	}
+
+	// all outputs are hooks, so each of them can have its own level
+	AppLevel.SetLevel(c.level(""))
+	logger, err := GetLogger(Logrus, &LogrusOption{
+		Hooks:       hooks,
+		Component:   c.Component,
+		Out:         ioutil.Discard,
+		Formatter:   discardFormatter{},
+		AtomicLevel: AppLevel,
+		OutputLevel: outputLevel,
+	})
+	if err != nil {
+		closeHooks(hookClosers)
+		return nil, err
+	}
+	// the logger of the previous init stops following AppLevel
+	initLock.Lock()
+	if initLogger != nil {
+		AppLevel.detach(initLogger)
+	}
+	if l, ok := logger.(*logrusLogger); ok {
+		initLogger = l.Logrus
+	}
+	initLock.Unlock()
+	Log = logger
+	// the hooks of the previous init are not used any more, the entries left in their buffers are flushed
+	if err := closeHooks(replaceClosers(hookClosers)); err != nil {
+		fmt.Fprintf(os.Stderr, "logging: failed to close the previous hooks [%s] \n", err)
+	}
+	return logger, nil
+}
+
+// async wraps hook by an async hook if enabled
+func (c *LoggingConfig) async(hook logrus.Hook) logrus.Hook {
+	if !c.Async.Enabled {
+		return hook
+	}
+	return async.New(hook, &async.Option{
+		BufferSize: c.Async.BufferSize,
+		BatchSize:  c.Async.BatchSize,
+		Policy:     async.Policy(c.Async.Policy),
+	})
+}
+
+// levelsFrom returns the levels as severe as level or more
+func levelsFrom(level logrus.Level) []logrus.Level {
+	var levels []logrus.Level
+	for _, l := range logrus.AllLevels {
+		if l <= level {
+			levels = append(levels, l)
+		}
+	}
+	return levels
+}
+
+// writerHook writes the log lines to a console
+type writerHook struct {
+	levels    []logrus.Level
+	out       io.Writer
+	formatter logrus.Formatter
+}
+
+func (h *writerHook) Levels() []logrus.Level {
+	return h.levels
+}
+
+func (h *writerHook) Fire(entry *logrus.Entry) error {
+	serialized, err := h.formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+	_, err = h.out.Write(serialized)
+	return err
+}
+
+// discardFormatter skips formatting the entries written to ioutil.Discard
+type discardFormatter struct{}
+
+func (discardFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	return nil, nil
+}
@@ -0,0 +1,224 @@
+package logging
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/yiGmMk/pz-infra-new/config"
+
+	"github.com/astaxie/beego"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLoggingConfig(t *testing.T) {
+	Convey("test load config", t, func() {
+		configer, err := (&config.ViperProvider{}).New(&config.ViperOption{ConfigFile: "testdata/logging.yaml"})
+		So(err, ShouldBeNil)
+		c, err := LoadLoggingConfig(configer, "logger")
+		So(err, ShouldBeNil)
+		So(c.Component, ShouldEqual, "api")
+		So(c.Format, ShouldEqual, "json")
+		So(c.Outputs, ShouldResemble, []OutputConfig{
+			{Type: LOG_OUTPUT_STDERR, Level: "warn", Format: "logfmt"},
+			{Type: LOG_OUTPUT_FILE, Path: "./log/error.log", Level: "error", Rotation: RotationConfig{MaxSize: 50, MaxBackups: 7, Compress: true}},
+		})
+
+		c, err = LoadLoggingConfig(configer, "missing")
+		So(err, ShouldBeNil)
+		So(c, ShouldResemble, &LoggingConfig{})
+	})
+
+	Convey("test validate config", t, func() {
+		c := &LoggingConfig{
+			Level:  "verbose",
+			Format: "xml",
+			Outputs: []OutputConfig{
+				{Type: LOG_OUTPUT_FILE},
+				{Type: "kafka"},
+				{Type: LOG_OUTPUT_FILE, Path: "a.log", Rotation: RotationConfig{MaxAge: -1}},
+			},
+			Fluentd: FluentdConfig{Enabled: true},
+		}
+		err := c.Validate()
+		So(err, ShouldNotBeNil)
+		for _, message := range []string{"verbose", "xml", "path of output 0", `"kafka"`, "rotation of output 2", "fluentd"} {
+			So(err.Error(), ShouldContainSubstring, message)
+		}
+		_, err = InitLoggerWithConfig(c)
+		So(err, ShouldNotBeNil)
+		So((&LoggingConfig{}).Validate(), ShouldBeNil)
+	})
+
+	Convey("test outputs have their own levels", t, func() {
+		dir, err := ioutil.TempDir("", "logging")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		oldLog := Log
+		defer func() { Log = oldLog }()
+
+		commonPath := filepath.Join(dir, "common.log")
+		errorPath := filepath.Join(dir, "error.log")
+		logger, err := InitLoggerWithConfig(&LoggingConfig{
+			Component: "api",
+			Level:     "debug",
+			Format:    "json",
+			Outputs: []OutputConfig{
+				{Type: LOG_OUTPUT_FILE, Path: commonPath},
+				{Type: LOG_OUTPUT_FILE, Path: errorPath, Level: "error"},
+			},
+		})
+		So(err, ShouldBeNil)
+		So(Log, ShouldEqual, logger)
+		logger.Debug("debug")
+		logger.Error("error")
+
+		data, err := ioutil.ReadFile(commonPath)
+		So(err, ShouldBeNil)
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		So(len(lines), ShouldEqual, 2)
+		line := map[string]interface{}{}
+		So(json.Unmarshal([]byte(lines[0]), &line), ShouldBeNil)
+		So(line["msg"], ShouldEqual, "debug")
+		So(line["component"], ShouldEqual, "api")
+
+		data, err = ioutil.ReadFile(errorPath)
+		So(err, ShouldBeNil)
+		lines = strings.Split(strings.TrimSpace(string(data)), "\n")
+		So(len(lines), ShouldEqual, 1)
+		So(lines[0], ShouldContainSubstring, `"msg":"error"`)
+	})
+
+	Convey("test outputs more verbose than the level", t, func() {
+		dir, err := ioutil.TempDir("", "logging")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		oldLog := Log
+		defer func() { Log = oldLog }()
+
+		debugPath := filepath.Join(dir, "debug.log")
+		commonPath := filepath.Join(dir, "common.log")
+		logger, err := InitLoggerWithConfig(&LoggingConfig{
+			Level:  "info",
+			Format: "json",
+			Outputs: []OutputConfig{
+				{Type: LOG_OUTPUT_FILE, Path: debugPath, Level: "debug"},
+				{Type: LOG_OUTPUT_FILE, Path: commonPath},
+			},
+		})
+		So(err, ShouldBeNil)
+		logger.Debug("debug")
+		logger.Info("info")
+
+		data, err := ioutil.ReadFile(debugPath)
+		So(err, ShouldBeNil)
+		So(strings.Count(string(data), "\n"), ShouldEqual, 2)
+		So(string(data), ShouldContainSubstring, `"msg":"debug"`)
+		data, err = ioutil.ReadFile(commonPath)
+		So(err, ShouldBeNil)
+		So(strings.Count(string(data), "\n"), ShouldEqual, 1)
+		So(string(data), ShouldContainSubstring, `"msg":"info"`)
+
+		// the outputs without levels still follow AppLevel
+		So(SetLevel("debug"), ShouldBeNil)
+		defer SetLevel("info")
+		logger.Debug("debug")
+		data, err = ioutil.ReadFile(commonPath)
+		So(err, ShouldBeNil)
+		So(strings.Count(string(data), "\n"), ShouldEqual, 2)
+	})
+
+	Convey("test loggers of the previous inits are detached", t, func() {
+		oldLog := Log
+		defer func() { Log = oldLog }()
+		c := &LoggingConfig{Outputs: []OutputConfig{{Type: LOG_OUTPUT_STDOUT, Level: "error"}}}
+		_, err := InitLoggerWithConfig(c)
+		So(err, ShouldBeNil)
+		attached := len(AppLevel.loggers)
+		for i := 0; i < 3; i++ {
+			_, err = InitLoggerWithConfig(c)
+			So(err, ShouldBeNil)
+		}
+		So(len(AppLevel.loggers), ShouldEqual, attached)
+	})
+
+	Convey("test async outputs are flushed by close", t, func() {
+		dir, err := ioutil.TempDir("", "logging")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		oldLog := Log
+		defer func() { Log = oldLog }()
+
+		path := filepath.Join(dir, "async.log")
+		logger, err := InitLoggerWithConfig(&LoggingConfig{
+			Outputs: []OutputConfig{{Type: LOG_OUTPUT_FILE, Path: path}},
+			Async:   AsyncConfig{Enabled: true, Policy: "dropOldest"},
+		})
+		So(err, ShouldBeNil)
+		for i := 0; i < 100; i++ {
+			logger.Info("async")
+		}
+		So(Close(), ShouldBeNil)
+		So(DroppedEntries(), ShouldEqual, 0)
+		data, err := ioutil.ReadFile(path)
+		So(err, ShouldBeNil)
+		So(strings.Count(string(data), "\n"), ShouldEqual, 100)
+
+		So((&LoggingConfig{Async: AsyncConfig{Policy: "dropAll"}}).Validate(), ShouldNotBeNil)
+	})
+
+	Convey("test hooks of the previous inits are closed", t, func() {
+		dir, err := ioutil.TempDir("", "logging")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		oldLog := Log
+		defer func() { Log = oldLog }()
+		defer Close()
+
+		path := filepath.Join(dir, "async.log")
+		c := &LoggingConfig{
+			Outputs: []OutputConfig{{Type: LOG_OUTPUT_FILE, Path: path}, {Type: LOG_OUTPUT_STDERR, Level: "error"}},
+			Async:   AsyncConfig{Enabled: true},
+		}
+		logger, err := InitLoggerWithConfig(c)
+		So(err, ShouldBeNil)
+		So(closers, ShouldHaveLength, 1)
+		previous := closers[0]
+		for i := 0; i < 10; i++ {
+			logger.Info("async")
+		}
+		for i := 0; i < 3; i++ {
+			_, err = InitLoggerWithConfig(c)
+			So(err, ShouldBeNil)
+		}
+		So(closers, ShouldHaveLength, 1)
+		So(closers[0] == previous, ShouldBeFalse)
+		// the buffer of the previous init is flushed by the next init
+		data, err := ioutil.ReadFile(path)
+		So(err, ShouldBeNil)
+		So(strings.Count(string(data), "\n"), ShouldEqual, 10)
+	})
+
+	Convey("test invalid app config falls back to the default config", t, func() {
+		dir, err := ioutil.TempDir("", "logging")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		oldLog, oldCommonLogPath, oldErrorLogPath := Log, defaultCommonLogPath, defaultErrorLogPath
+		defer func() { Log, defaultCommonLogPath, defaultErrorLogPath = oldLog, oldCommonLogPath, oldErrorLogPath }()
+		defaultCommonLogPath = filepath.Join(dir, "common.log")
+		defaultErrorLogPath = filepath.Join(dir, "error.log")
+		So(beego.AppConfig.Set(CONFIG_LOG_LEVEL, "verbose"), ShouldBeNil)
+		defer beego.AppConfig.Set(CONFIG_LOG_LEVEL, "")
+
+		var logger Logger
+		So(func() { logger = InitLogger("api") }, ShouldNotPanic)
+		So(Log, ShouldEqual, logger)
+		logger.Error("error")
+		data, err := ioutil.ReadFile(defaultErrorLogPath)
+		So(err, ShouldBeNil)
+		So(string(data), ShouldContainSubstring, "error")
+	})
+}
@@ -0,0 +1,69 @@
+package logging
+
+import (
+	"context"
+)
+
+// keys of the common fields carried by context
+const (
+	REQUEST_ID_KEY = "requestId"
+	USER_ID_KEY    = "userId"
+	TRACE_ID_KEY   = "traceId"
+	TENANT_ID_KEY  = "tenantId"
+)
+
+type contextFieldsKey struct{}
+
+// ContextWithFields returns a context carrying fields, which are added to every log line
+// of the loggers of Logger.WithContext(ctx). Fields of the same key override the earlier ones.
+func ContextWithFields(ctx context.Context, fields ...Field) context.Context {
+	if len(fields) == 0 {
+		return ctx
+	}
+	parent := FieldsFromContext(ctx)
+	merged := make([]Field, 0, len(parent)+len(fields))
+	merged = append(merged, parent...)
+	merged = append(merged, fields...)
+	return context.WithValue(ctx, contextFieldsKey{}, merged)
+}
+
+// FieldsFromContext returns the fields of ContextWithFields
+func FieldsFromContext(ctx context.Context) []Field {
+	if ctx == nil {
+		return nil
+	}
+	fields, _ := ctx.Value(contextFieldsKey{}).([]Field)
+	return fields
+}
+
+// WithRequestID returns a context carrying the request id as a log field
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return ContextWithFields(ctx, With(REQUEST_ID_KEY, requestID))
+}
+
+// RequestIDFromContext returns the request id of WithRequestID
+func RequestIDFromContext(ctx context.Context) (string, bool) {
+	fields := FieldsFromContext(ctx)
+	for i := len(fields) - 1; i >= 0; i-- {
+		if fields[i].Key() == REQUEST_ID_KEY {
+			requestID, ok := fields[i].Value().(string)
+			return requestID, ok
+		}
+	}
+	return "", false
+}
+
+// WithUserID returns a context carrying the user id as a log field
+func WithUserID(ctx context.Context, userID interface{}) context.Context {
+	return ContextWithFields(ctx, With(USER_ID_KEY, userID))
+}
+
+// WithTraceID returns a context carrying the trace id as a log field
+func WithTraceID(ctx context.Context, traceID string) context.Context {
+	return ContextWithFields(ctx, With(TRACE_ID_KEY, traceID))
+}
+
+// WithTenantID returns a context carrying the tenant id as a log field
+func WithTenantID(ctx context.Context, tenantID interface{}) context.Context {
+	return ContextWithFields(ctx, With(TENANT_ID_KEY, tenantID))
+}
@@ -0,0 +1,81 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func lastLine(buf *bytes.Buffer) map[string]interface{} {
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	line := map[string]interface{}{}
+	json.Unmarshal([]byte(lines[len(lines)-1]), &line)
+	return line
+}
+
+func TestContextLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger, err := (&LogrusProvider{}).New(&LogrusOption{Out: buf, Formatter: &logrus.JSONFormatter{}, Level: logrus.DebugLevel})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Convey("test fields of context are logged", t, func() {
+		ctx := WithUserID(WithRequestID(context.Background(), "req-1"), 7)
+		ctx = ContextWithFields(ctx, With(REQUEST_ID_KEY, "req-2"))
+		requestID, ok := RequestIDFromContext(ctx)
+		So(ok, ShouldBeTrue)
+		So(requestID, ShouldEqual, "req-2")
+
+		logger.WithContext(ctx).Info("hello", With("a", 1))
+		line := lastLine(buf)
+		So(line["msg"], ShouldEqual, "hello")
+		So(line[REQUEST_ID_KEY], ShouldEqual, "req-2")
+		So(line[USER_ID_KEY], ShouldEqual, 7)
+		So(line["a"], ShouldEqual, 1)
+		So(line["fileFunc"], ShouldStartWith, "context_test.go:")
+	})
+
+	Convey("test child loggers keep their fields", t, func() {
+		child := logger.With(With("a", 1))
+		child.With(With("b", 2)).Warn("child", With("a", 3))
+		line := lastLine(buf)
+		So(line["a"], ShouldEqual, 3)
+		So(line["b"], ShouldEqual, 2)
+
+		child.Debug("parent")
+		line = lastLine(buf)
+		So(line["a"], ShouldEqual, 1)
+		_, ok := line["b"]
+		So(ok, ShouldBeFalse)
+	})
+
+	Convey("test request id middleware", t, func() {
+		var requestID string
+		handler := RequestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestID, _ = RequestIDFromContext(r.Context())
+		}))
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set(REQUEST_ID_HEADER, "abc")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		So(requestID, ShouldEqual, "abc")
+		So(w.Header().Get(REQUEST_ID_HEADER), ShouldEqual, "abc")
+
+		r = httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set(REQUEST_ID_HEADER, "bad id\n")
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		So(requestID, ShouldNotEqual, "bad id\n")
+		So(len(requestID), ShouldEqual, 36)
+		So(w.Header().Get(REQUEST_ID_HEADER), ShouldEqual, requestID)
+	})
+}
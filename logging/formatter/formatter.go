@@ -0,0 +1,145 @@
+package formatter
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yiGmMk/pz-infra-new/logging/hooks"
+
+	"github.com/sirupsen/logrus"
+)
+
+// names of the formatters
+const (
+	TEXT   = "text"
+	JSON   = "json"
+	LOGFMT = "logfmt"
+)
+
+// keys of the fields printed before the others, stacktrace is printed last as it's long
+var (
+	leadingKeys  = []string{"component", "fileFunc"}
+	trailingKeys = []string{"stacktrace"}
+)
+
+// New returns the formatter of name, TEXT if name is empty. TEXT and LOGFMT print the fields in a deterministic
+// order, component and fileFunc first, the others sorted by key and stacktrace last; JSON prints one object
+// per line with sorted keys.
+func New(name string) (logrus.Formatter, error) {
+	switch strings.ToLower(name) {
+	case "", TEXT:
+		return &TextFormatter{}, nil
+	case JSON:
+		return &logrus.JSONFormatter{TimestampFormat: time.RFC3339Nano}, nil
+	case LOGFMT:
+		return &LogfmtFormatter{}, nil
+	}
+	return nil, fmt.Errorf("formatter: unknown formatter %s", name)
+}
+
+// TextFormatter formats an entry as `LEVEL[time] message  key=value ...`
+type TextFormatter struct {
+	TimestampFormat string // time.RFC3339 if empty
+}
+
+func (f *TextFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	b := &bytes.Buffer{}
+	levelString := strings.ToUpper(hooks.LevelString(entry.Level))
+	fmt.Fprintf(b, "%-5s[%s] %-44s ", levelString, entry.Time.Format(timestampFormat(f.TimestampFormat)), entry.Message)
+	for _, k := range SortedKeys(entry.Data) {
+		fmt.Fprintf(b, " %s=%+v", k, entry.Data[k])
+	}
+	b.WriteByte('\n')
+	return b.Bytes(), nil
+}
+
+// LogfmtFormatter formats an entry as `time=... level=... msg=... key=value ...`,
+// values are quoted if they contain spaces, quotes or `=`
+type LogfmtFormatter struct {
+	TimestampFormat string // time.RFC3339 if empty
+}
+
+func (f *LogfmtFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	b := &bytes.Buffer{}
+	writeLogfmt(b, logrus.FieldKeyTime, entry.Time.Format(timestampFormat(f.TimestampFormat)))
+	writeLogfmt(b, logrus.FieldKeyLevel, hooks.LevelString(entry.Level))
+	writeLogfmt(b, logrus.FieldKeyMsg, entry.Message)
+	for _, k := range SortedKeys(entry.Data) {
+		v := entry.Data[k]
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		writeLogfmt(b, k, fmt.Sprint(v))
+	}
+	b.WriteByte('\n')
+	return b.Bytes(), nil
+}
+
+func writeLogfmt(b *bytes.Buffer, key, value string) {
+	if b.Len() > 0 {
+		b.WriteByte(' ')
+	}
+	b.WriteString(key)
+	b.WriteByte('=')
+	if needsQuote(value) {
+		b.WriteString(strconv.Quote(value))
+	} else {
+		b.WriteString(value)
+	}
+}
+
+func needsQuote(value string) bool {
+	if value == "" {
+		return true
+	}
+	for _, c := range value {
+		if c <= ' ' || c == '=' || c == '"' || c == 0x7f {
+			return true
+		}
+	}
+	return false
+}
+
+func timestampFormat(format string) string {
+	if format == "" {
+		return time.RFC3339
+	}
+	return format
+}
+
+// SortedKeys returns the keys of data in the order of the formatters
+func SortedKeys(data logrus.Fields) []string {
+	keys := make([]string, 0, len(data))
+	for _, k := range leadingKeys {
+		if _, ok := data[k]; ok {
+			keys = append(keys, k)
+		}
+	}
+	others := make([]string, 0, len(data))
+	for k := range data {
+		if !contains(leadingKeys, k) && !contains(trailingKeys, k) {
+			others = append(others, k)
+		}
+	}
+	sort.Strings(others)
+	keys = append(keys, others...)
+	for _, k := range trailingKeys {
+		if _, ok := data[k]; ok {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+func contains(keys []string, key string) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
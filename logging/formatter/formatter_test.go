@@ -0,0 +1,67 @@
+package formatter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func testEntry() *logrus.Entry {
+	entry := logrus.NewEntry(logrus.New())
+	entry.Time = time.Date(2021, 1, 16, 8, 0, 0, 0, time.UTC)
+	entry.Level = logrus.WarnLevel
+	entry.Message = "order failed"
+	entry.Data = logrus.Fields{
+		"stacktrace": "goroutine 1",
+		"orderNo":    "a b",
+		"component":  "api",
+		"error":      errors.New("timeout"),
+		"fileFunc":   "order.go:10:Add",
+		"amount":     10,
+	}
+	return entry
+}
+
+func TestFormatters(t *testing.T) {
+	Convey("test text format", t, func() {
+		f, err := New("")
+		So(err, ShouldBeNil)
+		b, err := f.Format(testEntry())
+		So(err, ShouldBeNil)
+		So(string(b), ShouldEqual, fmt.Sprintf("WARN [2021-01-16T08:00:00Z] %-44s ", "order failed")+
+			" component=api fileFunc=order.go:10:Add amount=10 error=timeout orderNo=a b stacktrace=goroutine 1\n")
+	})
+
+	Convey("test logfmt format", t, func() {
+		f, err := New(LOGFMT)
+		So(err, ShouldBeNil)
+		b, err := f.Format(testEntry())
+		So(err, ShouldBeNil)
+		So(string(b), ShouldEqual, `time=2021-01-16T08:00:00Z level=warn msg="order failed" component=api `+
+			`fileFunc=order.go:10:Add amount=10 error=timeout orderNo="a b" stacktrace="goroutine 1"`+"\n")
+	})
+
+	Convey("test json format", t, func() {
+		f, err := New("JSON")
+		So(err, ShouldBeNil)
+		b, err := f.Format(testEntry())
+		So(err, ShouldBeNil)
+		line := map[string]interface{}{}
+		So(json.Unmarshal(b, &line), ShouldBeNil)
+		So(line["msg"], ShouldEqual, "order failed")
+		So(line["level"], ShouldEqual, "warning")
+		So(line["error"], ShouldEqual, "timeout")
+		So(line["fileFunc"], ShouldEqual, "order.go:10:Add")
+		So(line["stacktrace"], ShouldEqual, "goroutine 1")
+	})
+
+	Convey("test unknown format", t, func() {
+		_, err := New("xml")
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,219 @@
+package async
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DEFAULT_BUFFER_SIZE = 4096
+	DEFAULT_BATCH_SIZE  = 128
+)
+
+// Policy is what Fire does when the buffer is full
+type Policy string
+
+const (
+	POLICY_BLOCK       Policy = "block"      // wait for the buffer, nothing is lost but the loggers are slowed down
+	POLICY_DROP_NEWEST Policy = "dropNewest" // drop the entry fired
+	POLICY_DROP_OLDEST Policy = "dropOldest" // drop the oldest entry of the buffer
+)
+
+// BatchHook is a hook writing a batch of entries at once, e.g. by a single write of a file
+type BatchHook interface {
+	logrus.Hook
+	FireBatch(entries []*logrus.Entry) error
+}
+
+// Option is used to set up the async hook, the defaults are used for zero values
+type Option struct {
+	BufferSize int
+	BatchSize  int    // max entries written by the wrapped hook at once
+	Policy     Policy // POLICY_BLOCK if empty
+}
+
+// Hook fires the entries by the wrapped hook in a goroutine, so a slow hook doesn't block the loggers.
+// The entries are kept in a bounded buffer, the Policy of the option is applied when it's full.
+// Close flushes the buffer, the entries fired after it are written by the wrapped hook synchronously.
+// Fatal and panic entries are written synchronously after the buffer, as the process exits or panics then.
+type Hook struct {
+	hook     logrus.Hook
+	option   Option
+	lock     sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	drained  *sync.Cond      // the buffer is empty and no batch is being written
+	buffer   []*logrus.Entry // ring buffer of count entries from head
+	head     int
+	count    int
+	closed   bool
+	writing  bool // a batch taken from the buffer is being written
+	dropped  uint64
+	done     chan struct{}
+}
+
+// New returns a Hook wrapping hook and starts its writer goroutine
+func New(hook logrus.Hook, option *Option) *Hook {
+	h := &Hook{hook: hook, done: make(chan struct{})}
+	if option != nil {
+		h.option = *option
+	}
+	if h.option.BufferSize <= 0 {
+		h.option.BufferSize = DEFAULT_BUFFER_SIZE
+	}
+	if h.option.BatchSize <= 0 {
+		h.option.BatchSize = DEFAULT_BATCH_SIZE
+	}
+	if h.option.Policy == "" {
+		h.option.Policy = POLICY_BLOCK
+	}
+	h.buffer = make([]*logrus.Entry, h.option.BufferSize)
+	h.notEmpty = sync.NewCond(&h.lock)
+	h.notFull = sync.NewCond(&h.lock)
+	h.drained = sync.NewCond(&h.lock)
+	go h.run()
+	return h
+}
+
+// ValidPolicy checks if policy is one of the policies, empty for POLICY_BLOCK
+func ValidPolicy(policy Policy) bool {
+	switch policy {
+	case "", POLICY_BLOCK, POLICY_DROP_NEWEST, POLICY_DROP_OLDEST:
+		return true
+	}
+	return false
+}
+
+func (h *Hook) Levels() []logrus.Level {
+	return h.hook.Levels()
+}
+
+func (h *Hook) Fire(entry *logrus.Entry) error {
+	if entry.Level <= logrus.FatalLevel {
+		h.Flush()
+		return h.hook.Fire(entry)
+	}
+	e := copyEntry(entry)
+	h.lock.Lock()
+	for !h.closed && h.count == len(h.buffer) {
+		switch h.option.Policy {
+		case POLICY_DROP_NEWEST:
+			h.lock.Unlock()
+			atomic.AddUint64(&h.dropped, 1)
+			return nil
+		case POLICY_DROP_OLDEST:
+			h.pop()
+			atomic.AddUint64(&h.dropped, 1)
+		default:
+			h.notFull.Wait()
+		}
+	}
+	if h.closed {
+		h.lock.Unlock()
+		return h.hook.Fire(e)
+	}
+	h.buffer[(h.head+h.count)%len(h.buffer)] = e
+	h.count++
+	h.notEmpty.Signal()
+	h.lock.Unlock()
+	return nil
+}
+
+// Dropped returns the number of the entries dropped as the buffer is full
+func (h *Hook) Dropped() uint64 {
+	return atomic.LoadUint64(&h.dropped)
+}
+
+// Flush waits until the entries in the buffer are written
+func (h *Hook) Flush() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for h.count > 0 || h.writing {
+		h.drained.Wait()
+	}
+}
+
+// Close writes the entries in the buffer and stops the writer goroutine
+func (h *Hook) Close() error {
+	h.lock.Lock()
+	if !h.closed {
+		h.closed = true
+		h.notEmpty.Broadcast()
+		h.notFull.Broadcast()
+	}
+	h.lock.Unlock()
+	<-h.done
+	return nil
+}
+
+// pop removes the oldest entry of the buffer, the lock must be held
+func (h *Hook) pop() *logrus.Entry {
+	entry := h.buffer[h.head]
+	h.buffer[h.head] = nil
+	h.head = (h.head + 1) % len(h.buffer)
+	h.count--
+	return entry
+}
+
+func (h *Hook) run() {
+	defer close(h.done)
+	batch := make([]*logrus.Entry, 0, h.option.BatchSize)
+	for {
+		h.lock.Lock()
+		for h.count == 0 && !h.closed {
+			h.notEmpty.Wait()
+		}
+		if h.count == 0 {
+			h.lock.Unlock()
+			return
+		}
+		for h.count > 0 && len(batch) < h.option.BatchSize {
+			batch = append(batch, h.pop())
+		}
+		h.writing = true
+		h.notFull.Broadcast()
+		h.lock.Unlock()
+
+		h.fire(batch)
+		for i := range batch {
+			batch[i] = nil
+		}
+		batch = batch[:0]
+
+		h.lock.Lock()
+		h.writing = false
+		if h.count == 0 {
+			h.drained.Broadcast()
+		}
+		h.lock.Unlock()
+	}
+}
+
+func (h *Hook) fire(batch []*logrus.Entry) {
+	if batchHook, ok := h.hook.(BatchHook); ok {
+		if err := batchHook.FireBatch(batch); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to fire hook: %v\n", err)
+		}
+		return
+	}
+	for _, entry := range batch {
+		if err := h.hook.Fire(entry); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to fire hook: %v\n", err)
+		}
+	}
+}
+
+// copyEntry copies the entry fired, as it's written after the logger returns
+func copyEntry(entry *logrus.Entry) *logrus.Entry {
+	copied := *entry
+	copied.Data = make(logrus.Fields, len(entry.Data))
+	for k, v := range entry.Data {
+		copied.Data[k] = v
+	}
+	copied.Buffer = nil
+	return &copied
+}
@@ -0,0 +1,155 @@
+package async
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// slowHook records the messages, it's blocked until release is closed
+type slowHook struct {
+	release chan struct{}
+	lock    sync.Mutex
+	batches [][]string
+}
+
+func (h *slowHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *slowHook) Fire(entry *logrus.Entry) error {
+	return h.FireBatch([]*logrus.Entry{entry})
+}
+
+func (h *slowHook) FireBatch(entries []*logrus.Entry) error {
+	<-h.release
+	var messages []string
+	for _, entry := range entries {
+		messages = append(messages, entry.Message)
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.batches = append(h.batches, messages)
+	return nil
+}
+
+func (h *slowHook) messages() []string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	var messages []string
+	for _, batch := range h.batches {
+		messages = append(messages, batch...)
+	}
+	return messages
+}
+
+func fire(hook logrus.Hook, messages ...string) {
+	for _, message := range messages {
+		hook.Fire(&logrus.Entry{Level: logrus.InfoLevel, Message: message, Data: logrus.Fields{}})
+	}
+}
+
+// waitBlocked waits until the writer goroutine takes the first entry and is blocked by the slow hook
+func waitBlocked(h *Hook) {
+	for i := 0; i < 100; i++ {
+		h.lock.Lock()
+		count := h.count
+		h.lock.Unlock()
+		if count == 0 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestAsyncHook(t *testing.T) {
+	Convey("test entries are written in batches and flushed by close", t, func() {
+		slow := &slowHook{release: make(chan struct{})}
+		hook := New(slow, &Option{BufferSize: 10, BatchSize: 3})
+		fire(hook, "a")
+		waitBlocked(hook)
+		fire(hook, "b", "c", "d", "e")
+		close(slow.release)
+		So(hook.Close(), ShouldBeNil)
+		So(slow.messages(), ShouldResemble, []string{"a", "b", "c", "d", "e"})
+		So(slow.batches[0], ShouldResemble, []string{"a"})
+		So(slow.batches[1], ShouldResemble, []string{"b", "c", "d"})
+
+		// written synchronously after close
+		fire(hook, "f")
+		So(slow.messages(), ShouldResemble, []string{"a", "b", "c", "d", "e", "f"})
+	})
+
+	Convey("test fatal and panic entries are written after the buffer synchronously", t, func() {
+		slow := &slowHook{release: make(chan struct{})}
+		hook := New(slow, &Option{BufferSize: 10, BatchSize: 2})
+		fire(hook, "a")
+		waitBlocked(hook)
+		fire(hook, "b", "c", "d")
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			close(slow.release)
+		}()
+		So(hook.Fire(&logrus.Entry{Level: logrus.FatalLevel, Message: "fatal", Data: logrus.Fields{}}), ShouldBeNil)
+		So(slow.messages(), ShouldResemble, []string{"a", "b", "c", "d", "fatal"})
+		So(hook.Fire(&logrus.Entry{Level: logrus.PanicLevel, Message: "panic", Data: logrus.Fields{}}), ShouldBeNil)
+		So(slow.messages(), ShouldResemble, []string{"a", "b", "c", "d", "fatal", "panic"})
+		So(hook.Close(), ShouldBeNil)
+	})
+
+	Convey("test drop newest", t, func() {
+		slow := &slowHook{release: make(chan struct{})}
+		hook := New(slow, &Option{BufferSize: 2, Policy: POLICY_DROP_NEWEST})
+		fire(hook, "a")
+		waitBlocked(hook)
+		fire(hook, "b", "c", "d", "e")
+		So(hook.Dropped(), ShouldEqual, 2)
+		close(slow.release)
+		hook.Close()
+		So(slow.messages(), ShouldResemble, []string{"a", "b", "c"})
+	})
+
+	Convey("test drop oldest", t, func() {
+		slow := &slowHook{release: make(chan struct{})}
+		hook := New(slow, &Option{BufferSize: 2, Policy: POLICY_DROP_OLDEST})
+		fire(hook, "a")
+		waitBlocked(hook)
+		fire(hook, "b", "c", "d", "e")
+		So(hook.Dropped(), ShouldEqual, 2)
+		close(slow.release)
+		hook.Close()
+		So(slow.messages(), ShouldResemble, []string{"a", "d", "e"})
+	})
+
+	Convey("test block until the buffer has room", t, func() {
+		slow := &slowHook{release: make(chan struct{})}
+		hook := New(slow, &Option{BufferSize: 1})
+		fire(hook, "a")
+		waitBlocked(hook)
+		fire(hook, "b")
+		fired := make(chan struct{})
+		go func() {
+			fire(hook, "c")
+			close(fired)
+		}()
+		select {
+		case <-fired:
+			t.Fatal("fire is not blocked")
+		case <-time.After(20 * time.Millisecond):
+		}
+		close(slow.release)
+		<-fired
+		hook.Close()
+		So(hook.Dropped(), ShouldEqual, 0)
+		So(slow.messages(), ShouldResemble, []string{"a", "b", "c"})
+	})
+
+	Convey("test policies", t, func() {
+		So(ValidPolicy(""), ShouldBeTrue)
+		So(ValidPolicy(POLICY_DROP_OLDEST), ShouldBeTrue)
+		So(ValidPolicy("dropAll"), ShouldBeFalse)
+	})
+}
@@ -2,6 +2,7 @@ package fluentd
 
 import (
 	"fmt"
+	"os"
 
 	"github.com/astaxie/beego"
 	"github.com/sirupsen/logrus"
@@ -13,17 +14,27 @@ const (
 	FLUENTD_TAG_PREFIX  = "roav_backend."
 )
 
+// NewForComponent connects fluentd with the tag of the component, FLUENTD_TAG_PREFIX is used if tagPrefix is empty
+func NewForComponent(host string, port int, tagPrefix, componentName string) (*fluentdHook, error) {
+	if tagPrefix == "" {
+		tagPrefix = FLUENTD_TAG_PREFIX
+	}
+	return New(host, port, tagPrefix+componentName)
+}
+
+// BuildFluentdHook connects fluentd by the logger.fluentd.* config of beego, nil is returned if it fails.
+//
+// Deprecated: use LoggingConfig.Fluentd of the logging package, which is enabled by InitLogger if the host is set.
 func BuildFluentdHook(componentName string) logrus.Hook {
-	fluentdHost := beego.AppConfig.String(CONFIG_FLUENTD_HOST)
 	fluentdPort, err := beego.AppConfig.Int(CONFIG_FLUENTD_PORT)
 	if err != nil {
-		fmt.Errorf("Get fluentdPort error ", err)
+		fmt.Fprintf(os.Stderr, "logging: invalid fluentd port [%s] \n", err)
 		return nil
 	}
-	if fluentdHook, err := New(fluentdHost, fluentdPort, FLUENTD_TAG_PREFIX+componentName); err == nil {
-		return fluentdHook
-	} else {
-		fmt.Errorf("New fluentdHook error ", err)
+	hook, err := NewForComponent(beego.AppConfig.String(CONFIG_FLUENTD_HOST), fluentdPort, "", componentName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "logging: failed to connect fluentd [%s] \n", err)
 		return nil
 	}
+	return hook
 }
@@ -4,29 +4,49 @@ import (
 	"bytes"
 	"fmt"
 	"path/filepath"
-	"strings"
-	"time"
+	"sync"
 
 	"gopkg.in/natefinch/lumberjack.v2"
 
-	"github.com/yiGmMk/pz-infra-new/logging/hooks"
+	"github.com/yiGmMk/pz-infra-new/logging/formatter"
 
 	"github.com/sirupsen/logrus"
 )
 
+// default rotation of the log files
+const (
+	DEFAULT_MAX_SIZE    = 100 // megabytes
+	DEFAULT_MAX_BACKUPS = 3
+	DEFAULT_MAX_AGE     = 28 // days
+)
+
 type LevelPaths map[logrus.Level]string
 type levelFiles map[logrus.Level]*lumberjack.Logger
 type pathFiles map[string]*lumberjack.Logger
 
-var files = make(pathFiles)
+var (
+	files     = make(pathFiles)
+	filesLock sync.Mutex
+)
 
 // Hook to handle writing to rolling log files.
 type rollingHook struct {
-	levels []logrus.Level
-	path   string
-	file   *lumberjack.Logger
-	paths  LevelPaths
-	files  levelFiles
+	levels    []logrus.Level
+	path      string
+	file      *lumberjack.Logger
+	paths     LevelPaths
+	files     levelFiles
+	formatter logrus.Formatter
+}
+
+// Option is the rotation of a log file, the defaults are used for zero values
+type Option struct {
+	Path       string
+	MaxSize    int  // megabytes before the file is rotated
+	MaxBackups int  // rotated files to retain
+	MaxAge     int  // days to retain the rotated files
+	Compress   bool // gzip the rotated files
+	LocalTime  bool // name the rotated files by local time instead of UTC
 }
 
 func New(path string) *rollingHook {
@@ -34,72 +54,122 @@ func New(path string) *rollingHook {
 }
 
 func NewWithLevelPaths(path string, levelPaths LevelPaths) *rollingHook {
-	hook := &rollingHook{
-		levels: logrus.AllLevels,
-		file:   newRollingFile(path),
-	}
+	hook := NewWithOption(&Option{Path: path})
 	if len(levelPaths) > 0 {
 		hook.paths = levelPaths
 		hook.files = make(levelFiles)
 		for l, p := range levelPaths {
-			hook.files[l] = newRollingFile(p)
+			hook.files[l] = newRollingFile(&Option{Path: p})
 		}
 	}
 	return hook
 }
 
-func newRollingFile(path string) *lumberjack.Logger {
-	if path == "" {
+// NewWithOption returns a hook writing to the file of option.
+// The options of a file are set by the first hook of it.
+func NewWithOption(option *Option) *rollingHook {
+	return &rollingHook{
+		levels:    logrus.AllLevels,
+		path:      option.Path,
+		file:      newRollingFile(option),
+		formatter: &formatter.TextFormatter{},
+	}
+}
+
+func newRollingFile(option *Option) *lumberjack.Logger {
+	if option.Path == "" {
 		panic("rolling: log file path is empty")
 	}
-	abs, err := filepath.Abs(path)
+	abs, err := filepath.Abs(option.Path)
 	if err != nil {
 		panic(fmt.Errorf("rolling: can't get absolute path for log file: %v", err))
 	}
+	filesLock.Lock()
+	defer filesLock.Unlock()
 	file, ok := files[abs]
 	if ok {
 		return file
 	}
 	newFile := &lumberjack.Logger{
 		Filename:   abs,
-		MaxSize:    100, // megabytes
-		MaxBackups: 3,
-		MaxAge:     28, //days
+		MaxSize:    orDefault(option.MaxSize, DEFAULT_MAX_SIZE),
+		MaxBackups: orDefault(option.MaxBackups, DEFAULT_MAX_BACKUPS),
+		MaxAge:     orDefault(option.MaxAge, DEFAULT_MAX_AGE),
+		Compress:   option.Compress,
+		LocalTime:  option.LocalTime,
 	}
 	files[abs] = newFile
 	return newFile
 }
 
-func (hook *rollingHook) Fire(entry *logrus.Entry) error {
-	serialized := serialize(entry, time.RFC3339)
-	_, err := hook.file.Write(serialized)
-	if err != nil {
-		return fmt.Errorf("failed to write message: %v", err)
+func orDefault(value, defaultValue int) int {
+	if value == 0 {
+		return defaultValue
 	}
-	defer hook.file.Close()
+	return value
+}
 
-	f, ok := hook.files[entry.Level]
-	if ok {
-		_, err = f.Write(serialized)
+// SetLevels sets the levels written by the hook, all levels by default
+func (hook *rollingHook) SetLevels(levels []logrus.Level) *rollingHook {
+	hook.levels = levels
+	return hook
+}
+
+// SetFormatter sets the formatter of the log lines, formatter.TextFormatter by default
+func (hook *rollingHook) SetFormatter(formatter logrus.Formatter) *rollingHook {
+	hook.formatter = formatter
+	return hook
+}
+
+// Fire writes the entry, the files are kept open until Close
+func (hook *rollingHook) Fire(entry *logrus.Entry) error {
+	return hook.FireBatch([]*logrus.Entry{entry})
+}
+
+// FireBatch writes the entries by a single write of each file, see async.BatchHook
+func (hook *rollingHook) FireBatch(entries []*logrus.Entry) error {
+	all := &bytes.Buffer{}
+	var levelBuffers map[logrus.Level]*bytes.Buffer
+	for _, entry := range entries {
+		serialized, err := hook.formatter.Format(entry)
 		if err != nil {
+			return fmt.Errorf("failed to format message: %v", err)
+		}
+		all.Write(serialized)
+		if _, ok := hook.files[entry.Level]; ok {
+			if levelBuffers == nil {
+				levelBuffers = make(map[logrus.Level]*bytes.Buffer)
+			}
+			if levelBuffers[entry.Level] == nil {
+				levelBuffers[entry.Level] = &bytes.Buffer{}
+			}
+			levelBuffers[entry.Level].Write(serialized)
+		}
+	}
+	if _, err := hook.file.Write(all.Bytes()); err != nil {
+		return fmt.Errorf("failed to write message: %v", err)
+	}
+	for level, b := range levelBuffers {
+		if _, err := hook.files[level].Write(b.Bytes()); err != nil {
 			return fmt.Errorf("failed to write message: %v", err)
 		}
-		defer f.Close()
 	}
 	return nil
 }
 
-func (hook *rollingHook) Levels() []logrus.Level {
-	return hook.levels
+// Close closes all the log files, they are opened again if written
+func Close() error {
+	filesLock.Lock()
+	defer filesLock.Unlock()
+	var closeErr error
+	for _, file := range files {
+		if err := file.Close(); err != nil && closeErr == nil {
+			closeErr = err
+		}
+	}
+	return closeErr
 }
 
-func serialize(entry *logrus.Entry, timestampFormat string) []byte {
-	b := &bytes.Buffer{}
-	levelString := strings.ToUpper(hooks.LevelString(entry.Level))
-	fmt.Fprintf(b, "%-5s[%s] %-44s ", levelString, entry.Time.Format(timestampFormat), entry.Message)
-	for k, v := range entry.Data {
-		fmt.Fprintf(b, " %s=%+v", k, v)
-	}
-	b.WriteByte('\n')
-	return b.Bytes()
+func (hook *rollingHook) Levels() []logrus.Level {
+	return hook.levels
 }
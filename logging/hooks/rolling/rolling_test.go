@@ -0,0 +1,94 @@
+package rolling
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func entry(level logrus.Level, message string) *logrus.Entry {
+	return &logrus.Entry{Level: level, Message: message, Data: logrus.Fields{}}
+}
+
+// readLines returns the lines of the log file, nil if it doesn't exist
+func readLines(path string) []string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func TestRollingHook(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rolling")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer Close()
+
+	Convey("test entries are written in batches", t, func() {
+		path := filepath.Join(dir, "batch.log")
+		hook := New(path)
+		So(hook.FireBatch([]*logrus.Entry{entry(logrus.InfoLevel, "a"), entry(logrus.WarnLevel, "b")}), ShouldBeNil)
+		So(hook.Fire(entry(logrus.InfoLevel, "c")), ShouldBeNil)
+		So(hook.FireBatch(nil), ShouldBeNil)
+
+		lines := readLines(path)
+		So(lines, ShouldHaveLength, 3)
+		for i, message := range []string{"a", "b", "c"} {
+			So(lines[i], ShouldContainSubstring, message)
+		}
+	})
+
+	Convey("test entries of levels are written to their own files too", t, func() {
+		path := filepath.Join(dir, "common.log")
+		errorPath := filepath.Join(dir, "error.log")
+		warnPath := filepath.Join(dir, "warn.log")
+		hook := NewWithLevelPaths(path, LevelPaths{logrus.ErrorLevel: errorPath, logrus.WarnLevel: warnPath})
+		So(hook.FireBatch([]*logrus.Entry{
+			entry(logrus.InfoLevel, "info"),
+			entry(logrus.ErrorLevel, "error1"),
+			entry(logrus.WarnLevel, "warn"),
+			entry(logrus.ErrorLevel, "error2"),
+		}), ShouldBeNil)
+
+		So(readLines(path), ShouldHaveLength, 4)
+		errorLines := readLines(errorPath)
+		So(errorLines, ShouldHaveLength, 2)
+		So(errorLines[0], ShouldContainSubstring, "error1")
+		So(errorLines[1], ShouldContainSubstring, "error2")
+		warnLines := readLines(warnPath)
+		So(warnLines, ShouldHaveLength, 1)
+		So(warnLines[0], ShouldContainSubstring, "warn")
+	})
+
+	Convey("test hooks of a path share the file and its options", t, func() {
+		path := filepath.Join(dir, "shared.log")
+		first := NewWithOption(&Option{Path: path, MaxSize: 10})
+		second := NewWithOption(&Option{Path: path, MaxSize: 20})
+		So(second.file, ShouldEqual, first.file)
+		So(first.file.MaxSize, ShouldEqual, 10)
+		So(first.file.MaxBackups, ShouldEqual, DEFAULT_MAX_BACKUPS)
+		So(func() { New("") }, ShouldPanic)
+	})
+
+	Convey("test files are opened again after close", t, func() {
+		path := filepath.Join(dir, "reopen.log")
+		hook := New(path)
+		So(hook.Fire(entry(logrus.InfoLevel, "before")), ShouldBeNil)
+		So(Close(), ShouldBeNil)
+		// the file removed after close is created by the next write
+		So(os.Remove(path), ShouldBeNil)
+		So(hook.Fire(entry(logrus.InfoLevel, "after")), ShouldBeNil)
+
+		lines := readLines(path)
+		So(lines, ShouldHaveLength, 1)
+		So(lines[0], ShouldContainSubstring, "after")
+	})
+}
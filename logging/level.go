@@ -0,0 +1,416 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yiGmMk/pz-infra-new/config"
+
+	"github.com/sirupsen/logrus"
+)
+
+// AppLevel is the level of the loggers of InitLoggerWithConfig and InitLogger, see SetLevel
+var AppLevel = NewAtomicLevel(logrus.InfoLevel)
+
+// AtomicLevel is a level which can be changed at runtime, and overridden for a component or a package,
+// e.g. "redisUtil" or "github.com/yiGmMk/pz-infra-new/redisUtil"
+type AtomicLevel struct {
+	level     uint32
+	overrides atomic.Value // map[string]logrus.Level, copied on write
+	lock      sync.Mutex
+	timers    map[string]*time.Timer          // timers of the temporary levels, "" for the level
+	bases     map[string]*logrus.Level        // levels restored by the timers, nil to remove the override
+	loggers   map[*logrus.Logger]logrus.Level // attached loggers and their output levels
+}
+
+// NewAtomicLevel returns an AtomicLevel of level
+func NewAtomicLevel(level logrus.Level) *AtomicLevel {
+	a := &AtomicLevel{level: uint32(level), timers: make(map[string]*time.Timer), bases: make(map[string]*logrus.Level), loggers: make(map[*logrus.Logger]logrus.Level)}
+	a.overrides.Store(map[string]logrus.Level{})
+	return a
+}
+
+// Level returns the level without overrides
+func (a *AtomicLevel) Level() logrus.Level {
+	return logrus.Level(atomic.LoadUint32(&a.level))
+}
+
+// SetLevel sets the level, a temporary level of SetLevelFor is dropped
+func (a *AtomicLevel) SetLevel(level logrus.Level) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.stopTimer("")
+	a.setLevel(level)
+}
+
+// SetLevelFor sets the level for d, then the level of SetLevel is restored,
+// even if SetLevelFor is called again before
+func (a *AtomicLevel) SetLevelFor(level logrus.Level, d time.Duration) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	base := a.base("")
+	a.stopTimer("")
+	a.setLevel(level)
+	a.startTimer("", d, base, func() {
+		a.setLevel(*base)
+	})
+}
+
+// Overrides returns the levels overridden for components and packages
+func (a *AtomicLevel) Overrides() map[string]logrus.Level {
+	overrides := a.overrides.Load().(map[string]logrus.Level)
+	copied := make(map[string]logrus.Level, len(overrides))
+	for name, level := range overrides {
+		copied[name] = level
+	}
+	return copied
+}
+
+// SetOverride sets the level of a component or a package, a temporary level of SetOverrideFor is dropped
+func (a *AtomicLevel) SetOverride(name string, level logrus.Level) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.stopTimer(name)
+	a.setOverride(name, &level)
+}
+
+// SetOverrideFor sets the level of a component or a package for d, then the level of SetOverride is restored,
+// or the override is removed if there isn't one, even if SetOverrideFor is called again before
+func (a *AtomicLevel) SetOverrideFor(name string, level logrus.Level, d time.Duration) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	base := a.base(name)
+	a.stopTimer(name)
+	a.setOverride(name, &level)
+	a.startTimer(name, d, base, func() {
+		a.setOverride(name, base)
+	})
+}
+
+// RemoveOverride removes the level of a component or a package
+func (a *AtomicLevel) RemoveOverride(name string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.stopTimer(name)
+	a.setOverride(name, nil)
+}
+
+// enabled checks if level is logged by the component or the package of the caller,
+// skip is the number of frames to the caller as runtime.Caller of the caller of enabled
+func (a *AtomicLevel) enabled(level logrus.Level, component string, skip int) bool {
+	overrides := a.overrides.Load().(map[string]logrus.Level)
+	if len(overrides) > 0 {
+		pc, _, _, _ := runtime.Caller(skip + 1)
+		if l, ok := matchOverride(overrides, component, pc); ok {
+			return level <= l
+		}
+	}
+	return level <= a.Level()
+}
+
+// matchOverride returns the override of the package of pc, or of the component
+func matchOverride(overrides map[string]logrus.Level, component string, pc uintptr) (logrus.Level, bool) {
+	if fn := runtime.FuncForPC(pc); fn != nil {
+		pkg := packageName(fn.Name())
+		if l, ok := overrides[pkg]; ok {
+			return l, true
+		}
+		if l, ok := overrides[pkg[strings.LastIndex(pkg, "/")+1:]]; ok {
+			return l, true
+		}
+	}
+	l, ok := overrides[component]
+	return l, ok && component != ""
+}
+
+// packageName returns the package of a function name, e.g. github.com/a/b for github.com/a/b.(*T).F
+func packageName(funcName string) string {
+	slash := strings.LastIndex(funcName, "/")
+	if dot := strings.Index(funcName[slash+1:], "."); dot >= 0 {
+		return funcName[:slash+1+dot]
+	}
+	return funcName
+}
+
+func (a *AtomicLevel) setLevel(level logrus.Level) {
+	atomic.StoreUint32(&a.level, uint32(level))
+	a.syncLoggers()
+}
+
+func (a *AtomicLevel) setOverride(name string, level *logrus.Level) {
+	overrides := a.Overrides()
+	if level == nil {
+		delete(overrides, name)
+	} else {
+		overrides[name] = *level
+	}
+	a.overrides.Store(overrides)
+	a.syncLoggers()
+}
+
+// base returns the level set without a duration of name, "" for the level, nil if name isn't overridden
+func (a *AtomicLevel) base(name string) *logrus.Level {
+	if base, ok := a.bases[name]; ok {
+		return base
+	}
+	if name == "" {
+		level := a.Level()
+		return &level
+	}
+	if level, ok := a.overrides.Load().(map[string]logrus.Level)[name]; ok {
+		return &level
+	}
+	return nil
+}
+
+func (a *AtomicLevel) startTimer(name string, d time.Duration, base *logrus.Level, restore func()) {
+	var timer *time.Timer
+	timer = time.AfterFunc(d, func() {
+		a.lock.Lock()
+		defer a.lock.Unlock()
+		// the level is set again since
+		if a.timers[name] != timer {
+			return
+		}
+		delete(a.timers, name)
+		delete(a.bases, name)
+		restore()
+	})
+	a.timers[name] = timer
+	a.bases[name] = base
+}
+
+func (a *AtomicLevel) stopTimer(name string) {
+	if timer, ok := a.timers[name]; ok {
+		timer.Stop()
+		delete(a.timers, name)
+		delete(a.bases, name)
+	}
+}
+
+// attach makes the level of logger follow a, the most verbose of the level, the overrides and outputLevel,
+// so the entries are filtered by logrus before the overrides are checked
+func (a *AtomicLevel) attach(logger *logrus.Logger, outputLevel logrus.Level) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.loggers[logger] = outputLevel
+	logger.SetLevel(maxLevel(a.mostVerbose(), outputLevel))
+}
+
+// detach stops the level of logger following a
+func (a *AtomicLevel) detach(logger *logrus.Logger) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	delete(a.loggers, logger)
+}
+
+func (a *AtomicLevel) syncLoggers() {
+	level := a.mostVerbose()
+	for logger, outputLevel := range a.loggers {
+		logger.SetLevel(maxLevel(level, outputLevel))
+	}
+}
+
+// maxLevel returns the more verbose of the levels
+func maxLevel(a, b logrus.Level) logrus.Level {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func (a *AtomicLevel) mostVerbose() logrus.Level {
+	level := a.Level()
+	for _, l := range a.overrides.Load().(map[string]logrus.Level) {
+		if l > level {
+			level = l
+		}
+	}
+	return level
+}
+
+// SetLevel sets AppLevel, e.g. "debug"
+func SetLevel(level string) error {
+	l, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	AppLevel.SetLevel(l)
+	return nil
+}
+
+// SetLevelFor sets AppLevel for d, then the level before is restored
+func SetLevelFor(level string, d time.Duration) error {
+	l, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	AppLevel.SetLevelFor(l, d)
+	return nil
+}
+
+// SetPackageLevel overrides AppLevel for a component or a package, e.g. SetPackageLevel("redisUtil", "debug")
+func SetPackageLevel(name, level string) error {
+	l, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	AppLevel.SetOverride(name, l)
+	return nil
+}
+
+// SetPackageLevelFor overrides AppLevel for a component or a package for d
+func SetPackageLevelFor(name, level string, d time.Duration) error {
+	l, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	AppLevel.SetOverrideFor(name, l, d)
+	return nil
+}
+
+// ResetPackageLevel removes the override of a component or a package
+func ResetPackageLevel(name string) {
+	AppLevel.RemoveOverride(name)
+}
+
+// LevelStatus is the JSON of LevelHandler
+type LevelStatus struct {
+	Level     string            `json:"level"`
+	Overrides map[string]string `json:"overrides"`
+}
+
+// levelRequest is the body of the PUT requests of LevelHandler
+type levelRequest struct {
+	Level    string `json:"level"`
+	Package  string `json:"package"`  // component or package, the level of all if empty
+	Duration string `json:"duration"` // e.g. "10m", the level is restored after it if set
+}
+
+func levelStatus(a *AtomicLevel) *LevelStatus {
+	status := &LevelStatus{Level: a.Level().String(), Overrides: map[string]string{}}
+	for name, level := range a.Overrides() {
+		status.Overrides[name] = level.String()
+	}
+	return status
+}
+
+// LevelHandler is an admin endpoint of AppLevel. GET returns the LevelStatus,
+// PUT sets a level by a JSON body like {"level": "debug", "package": "redisUtil", "duration": "10m"},
+// and DELETE removes the override of the package of the query, e.g. ?package=redisUtil.
+// Protect it as other admin endpoints.
+func LevelHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodPost:
+			if err := applyLevelRequest(r); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		case http.MethodDelete:
+			name := r.URL.Query().Get("package")
+			if name == "" {
+				http.Error(w, "package is required", http.StatusBadRequest)
+				return
+			}
+			ResetPackageLevel(name)
+		default:
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(levelStatus(AppLevel))
+	})
+}
+
+func applyLevelRequest(r *http.Request) error {
+	req := &levelRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return fmt.Errorf("invalid body: %v", err)
+	}
+	level, err := logrus.ParseLevel(req.Level)
+	if err != nil {
+		return err
+	}
+	var d time.Duration
+	if req.Duration != "" {
+		if d, err = time.ParseDuration(req.Duration); err != nil || d <= 0 {
+			return fmt.Errorf("invalid duration %s", req.Duration)
+		}
+	}
+	Log.Info("Log level changed", With("level", req.Level), With("package", req.Package), With("duration", req.Duration))
+	switch {
+	case req.Package == "" && d == 0:
+		AppLevel.SetLevel(level)
+	case req.Package == "":
+		AppLevel.SetLevelFor(level, d)
+	case d == 0:
+		AppLevel.SetOverride(req.Package, level)
+	default:
+		AppLevel.SetOverrideFor(req.Package, level, d)
+	}
+	return nil
+}
+
+// WatchLevelConfig polls the level of levelKey and the overrides of packagesKey, a map of package to level,
+// of configer every interval and applies the changes to AppLevel, e.g. of a viper configer watching its file.
+// Invalid levels are logged and skipped. Call the returned function to stop watching.
+func WatchLevelConfig(configer config.Configer, levelKey, packagesKey string, interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	var once sync.Once
+	applied := map[string]string{}
+	apply := func() {
+		levels := map[string]string{}
+		if level := configer.String(levelKey); level != "" {
+			levels[""] = level
+		}
+		if packagesKey != "" {
+			for name, level := range configer.StringMap(packagesKey) {
+				levels[name] = level
+			}
+		}
+		for name := range applied {
+			if _, ok := levels[name]; !ok && name != "" {
+				ResetPackageLevel(name)
+			}
+		}
+		for name, level := range levels {
+			if applied[name] == level {
+				continue
+			}
+			var err error
+			if name == "" {
+				err = SetLevel(level)
+			} else {
+				err = SetPackageLevel(name, level)
+			}
+			if err != nil {
+				Log.Warn("Invalid log level of config", With("package", name), With("level", level), WithError(err))
+			}
+		}
+		applied = levels
+	}
+	apply()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				apply()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
@@ -0,0 +1,174 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yiGmMk/pz-infra-new/config"
+
+	"github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAtomicLevel(t *testing.T) {
+	buf := &bytes.Buffer{}
+	level := NewAtomicLevel(logrus.InfoLevel)
+	logger, err := (&LogrusProvider{}).New(&LogrusOption{Out: buf, Formatter: &logrus.JSONFormatter{}, Component: "api", AtomicLevel: level})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := func() int {
+		defer buf.Reset()
+		return strings.Count(buf.String(), "\n")
+	}
+
+	Convey("test level is changed at runtime", t, func() {
+		logger.Debug("debug")
+		So(lines(), ShouldEqual, 0)
+		level.SetLevel(logrus.DebugLevel)
+		logger.Debug("debug")
+		So(lines(), ShouldEqual, 1)
+		level.SetLevel(logrus.ErrorLevel)
+		logger.Warn("warn")
+		So(lines(), ShouldEqual, 0)
+		level.SetLevel(logrus.InfoLevel)
+	})
+
+	Convey("test overrides of packages and components", t, func() {
+		level.SetOverride("logging", logrus.DebugLevel)
+		logger.Debug("debug")
+		So(lines(), ShouldEqual, 1)
+		level.RemoveOverride("logging")
+
+		level.SetOverride("github.com/yiGmMk/pz-infra-new/logging", logrus.ErrorLevel)
+		level.SetOverride("api", logrus.DebugLevel)
+		logger.Info("info")
+		So(lines(), ShouldEqual, 0)
+		level.RemoveOverride("github.com/yiGmMk/pz-infra-new/logging")
+		logger.Debug("debug")
+		So(lines(), ShouldEqual, 1)
+		level.RemoveOverride("api")
+		So(level.Overrides(), ShouldBeEmpty)
+
+		So(packageName("github.com/a/b.(*T).F"), ShouldEqual, "github.com/a/b")
+		So(packageName("main.main"), ShouldEqual, "main")
+	})
+
+	Convey("test temporary levels are restored", t, func() {
+		level.SetLevelFor(logrus.DebugLevel, 20*time.Millisecond)
+		level.SetOverrideFor("redisUtil", logrus.TraceLevel, 20*time.Millisecond)
+		So(level.Level(), ShouldEqual, logrus.DebugLevel)
+		time.Sleep(100 * time.Millisecond)
+		So(level.Level(), ShouldEqual, logrus.InfoLevel)
+		So(level.Overrides(), ShouldBeEmpty)
+
+		// a level set since is kept
+		level.SetLevelFor(logrus.DebugLevel, 20*time.Millisecond)
+		level.SetLevel(logrus.WarnLevel)
+		time.Sleep(100 * time.Millisecond)
+		So(level.Level(), ShouldEqual, logrus.WarnLevel)
+
+		// nested temporary levels restore the level set without a duration
+		level.SetLevelFor(logrus.DebugLevel, 10*time.Minute)
+		level.SetLevelFor(logrus.TraceLevel, 20*time.Millisecond)
+		level.SetOverride("redisUtil", logrus.ErrorLevel)
+		level.SetOverrideFor("redisUtil", logrus.DebugLevel, 10*time.Minute)
+		level.SetOverrideFor("redisUtil", logrus.TraceLevel, 20*time.Millisecond)
+		level.SetOverrideFor("mongoUtil", logrus.DebugLevel, 10*time.Minute)
+		level.SetOverrideFor("mongoUtil", logrus.TraceLevel, 20*time.Millisecond)
+		So(level.Level(), ShouldEqual, logrus.TraceLevel)
+		time.Sleep(100 * time.Millisecond)
+		So(level.Level(), ShouldEqual, logrus.WarnLevel)
+		So(level.Overrides(), ShouldResemble, map[string]logrus.Level{"redisUtil": logrus.ErrorLevel})
+		level.RemoveOverride("redisUtil")
+		level.SetLevel(logrus.InfoLevel)
+	})
+}
+
+// levelConfiger is a Configer of the levels, safe to be changed while watched
+type levelConfiger struct {
+	config.Configer
+	lock     sync.Mutex
+	level    string
+	packages map[string]string
+}
+
+func (c *levelConfiger) String(key string) string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.level
+}
+
+func (c *levelConfiger) StringMap(key string) map[string]string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.packages
+}
+
+func (c *levelConfiger) set(level string, packages map[string]string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.level = level
+	c.packages = packages
+}
+
+func TestLevelHandler(t *testing.T) {
+	logger, err := (&LogrusProvider{}).New(&LogrusOption{Out: ioutil.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldLog := Log
+	Log = logger
+	defer func() { Log = oldLog }()
+	defer AppLevel.SetLevel(AppLevel.Level())
+	handler := LevelHandler()
+	serve := func(method, target, body string) (int, *LevelStatus) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		status := &LevelStatus{}
+		json.Unmarshal(w.Body.Bytes(), status)
+		return w.Code, status
+	}
+
+	Convey("test change levels by http", t, func() {
+		code, status := serve(http.MethodPut, "/", `{"level": "debug", "package": "redisUtil"}`)
+		So(code, ShouldEqual, http.StatusOK)
+		So(status.Overrides, ShouldResemble, map[string]string{"redisUtil": "debug"})
+
+		code, status = serve(http.MethodPut, "/", `{"level": "warning"}`)
+		So(code, ShouldEqual, http.StatusOK)
+		So(status.Level, ShouldEqual, "warning")
+
+		code, status = serve(http.MethodDelete, "/?package=redisUtil", "")
+		So(code, ShouldEqual, http.StatusOK)
+		So(status.Overrides, ShouldBeEmpty)
+
+		code, _ = serve(http.MethodPut, "/", `{"level": "verbose"}`)
+		So(code, ShouldEqual, http.StatusBadRequest)
+		code, _ = serve(http.MethodPut, "/", `{"level": "debug", "duration": "soon"}`)
+		So(code, ShouldEqual, http.StatusBadRequest)
+	})
+
+	Convey("test watch levels of config", t, func() {
+		configer := &levelConfiger{level: "info"}
+		stop := WatchLevelConfig(configer, "logger.level", "logger.packages", 10*time.Millisecond)
+		defer stop()
+		So(AppLevel.Level(), ShouldEqual, logrus.InfoLevel)
+
+		configer.set("error", map[string]string{"redisUtil": "debug"})
+		time.Sleep(100 * time.Millisecond)
+		So(AppLevel.Level(), ShouldEqual, logrus.ErrorLevel)
+		So(AppLevel.Overrides(), ShouldResemble, map[string]logrus.Level{"redisUtil": logrus.DebugLevel})
+
+		configer.set("error", nil)
+		time.Sleep(100 * time.Millisecond)
+		So(AppLevel.Overrides(), ShouldBeEmpty)
+	})
+}
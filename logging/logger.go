@@ -2,8 +2,6 @@ package logging
 
 import (
 	"context"
-
-	"github.com/sirupsen/logrus"
 )
 
 // Logger
@@ -20,7 +18,11 @@ type Logger interface {
 	// Get Print Method Logger
 	GetPrintLogger() PrintLogger
 
-	WithContext(ctx context.Context) *logrus.Entry
+	// WithContext returns a child Logger adding the fields of ContextWithFields(ctx), e.g. the request id,
+	// to every log line, hooks get ctx by the entry
+	WithContext(ctx context.Context) Logger
+	// With returns a child Logger adding fields to every log line
+	With(fields ...Field) Logger
 
 	// github.com/pkg/errors
 	// errors.New/WithStack/Wrap/Wrapf等可以方便地给错误带上堆栈信息,方便定位错误
@@ -7,7 +7,6 @@ import (
 	"sync"
 
 	"github.com/yiGmMk/pz-infra-new/logging/hooks/fluentd"
-	"github.com/yiGmMk/pz-infra-new/logging/hooks/rolling"
 
 	"github.com/astaxie/beego"
 	"github.com/sirupsen/logrus"
@@ -16,6 +15,21 @@ import (
 var defaultCommonLogPath = "./log/common.log"
 var defaultErrorLogPath = "./log/error.log"
 
+// keys of the beego config of AppLoggingConfig
+const (
+	CONFIG_COMMON_LOG_PATH = "logger.defaultCommonLogPath"
+	CONFIG_ERROR_LOG_PATH  = "logger.defaultErrorLogPath"
+	CONFIG_LOG_LEVEL       = "logger.level"
+	CONFIG_LOG_FORMAT      = "logger.format" // see formatter.New
+	CONFIG_LOG_MAX_SIZE    = "logger.maxSize"
+	CONFIG_LOG_MAX_BACKUPS = "logger.maxBackups"
+	CONFIG_LOG_MAX_AGE     = "logger.maxAge"
+	CONFIG_LOG_COMPRESS    = "logger.compress"
+	CONFIG_LOG_ASYNC       = "logger.async"
+	CONFIG_LOG_BUFFER_SIZE = "logger.asyncBufferSize"
+	CONFIG_LOG_POLICY      = "logger.asyncPolicy"
+)
+
 // Provider is the interface that must be implemented by a logger provider.
 type LogProvider interface {
 	// New returns a new logger.
@@ -65,43 +79,85 @@ func GetLogger(name string, option interface{}) (Logger, error) {
 	return provider.New(option)
 }
 
-// Initialize Logger.
+// InitLogger initializes Log by the beego config of AppLoggingConfig. If the config is invalid,
+// the error is printed to stderr and the default config is used, see defaultLoggingConfig.
 func InitLogger(componentName string) Logger {
-	initProvider()
-	var hooks []logrus.Hook
-	rollingHook := rolling.NewWithLevelPaths(defaultCommonLogPath, rolling.LevelPaths{
-		logrus.ErrorLevel: defaultErrorLogPath,
-	})
-	hooks = append(hooks, rollingHook)
-	if fluentdHook := fluentd.BuildFluentdHook(componentName); fluentdHook != nil {
-		hooks = append(hooks, fluentdHook)
+	c := AppLoggingConfig(componentName)
+	if err := c.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "logging: %s, the default config is used \n", err)
+		c = defaultLoggingConfig(componentName)
 	}
-	logLevel := logrus.InfoLevel
+	logger, err := InitLoggerWithConfig(c)
+	if err != nil {
+		// the default config is always valid
+		panic(fmt.Errorf("logging: failed to init logger: %v", err))
+	}
+	return logger
+}
+
+// defaultLoggingConfig returns the config of AppLoggingConfig without the optional keys,
+// the logs go to stderr, the default common log file and the default error log file
+func defaultLoggingConfig(componentName string) *LoggingConfig {
+	return &LoggingConfig{
+		Component: componentName,
+		Level:     defaultAppLevel(),
+		Outputs: []OutputConfig{
+			{Type: LOG_OUTPUT_STDERR},
+			{Type: LOG_OUTPUT_FILE, Path: defaultCommonLogPath},
+			{Type: LOG_OUTPUT_FILE, Path: defaultErrorLogPath, Level: logrus.ErrorLevel.String()},
+		},
+	}
+}
+
+// defaultAppLevel returns debug in dev mode and DEFAULT_LOG_LEVEL otherwise
+func defaultAppLevel() string {
 	if beego.BConfig.RunMode == "dev" {
-		logLevel = logrus.DebugLevel
+		return logrus.DebugLevel.String()
+	}
+	return DEFAULT_LOG_LEVEL
+}
+
+// AppLoggingConfig returns the config of the logger.* keys of beego. The logs go to stderr, the common log file
+// and the error log file, the level is debug in dev mode and info otherwise if not set,
+// and the fluentd hook is enabled if its host is set.
+func AppLoggingConfig(componentName string) *LoggingConfig {
+	commonLogPath := beego.AppConfig.DefaultString(CONFIG_COMMON_LOG_PATH, defaultCommonLogPath)
+	errorLogPath := beego.AppConfig.DefaultString(CONFIG_ERROR_LOG_PATH, defaultErrorLogPath)
+	level := beego.AppConfig.String(CONFIG_LOG_LEVEL)
+	if level == "" {
+		level = defaultAppLevel()
+	}
+	rotation := RotationConfig{
+		MaxSize:    beego.AppConfig.DefaultInt(CONFIG_LOG_MAX_SIZE, 0),
+		MaxBackups: beego.AppConfig.DefaultInt(CONFIG_LOG_MAX_BACKUPS, 0),
+		MaxAge:     beego.AppConfig.DefaultInt(CONFIG_LOG_MAX_AGE, 0),
+		Compress:   beego.AppConfig.DefaultBool(CONFIG_LOG_COMPRESS, false),
 	}
-	logger, err := GetLogger(Logrus, &LogrusOption{
-		Level:     logLevel,
-		Hooks:     hooks,
+	fluentdHost := beego.AppConfig.String(fluentd.CONFIG_FLUENTD_HOST)
+	return &LoggingConfig{
 		Component: componentName,
-		Out:       os.Stderr,
-		Formatter: new(logrus.TextFormatter),
-	})
-	if err != nil {
-		panic(fmt.Errorf("tests: failed to init logger: %v", err))
+		Level:     level,
+		Format:    beego.AppConfig.String(CONFIG_LOG_FORMAT),
+		Outputs: []OutputConfig{
+			{Type: LOG_OUTPUT_STDERR},
+			{Type: LOG_OUTPUT_FILE, Path: commonLogPath, Rotation: rotation},
+			{Type: LOG_OUTPUT_FILE, Path: errorLogPath, Level: logrus.ErrorLevel.String(), Rotation: rotation},
+		},
+		Fluentd: FluentdConfig{
+			Enabled: fluentdHost != "",
+			Host:    fluentdHost,
+			Port:    beego.AppConfig.DefaultInt(fluentd.CONFIG_FLUENTD_PORT, 0),
+		},
+		Async: AsyncConfig{
+			Enabled:    beego.AppConfig.DefaultBool(CONFIG_LOG_ASYNC, false),
+			BufferSize: beego.AppConfig.DefaultInt(CONFIG_LOG_BUFFER_SIZE, 0),
+			Policy:     beego.AppConfig.String(CONFIG_LOG_POLICY),
+		},
 	}
-	Log = logger
-	return logger
 }
 
 func initProvider() {
 	registerProviderOnce.Do(func() {
 		Register(Logrus, &LogrusProvider{})
 	})
-	if beego.AppConfig.String("logger.defaultCommonLogPath") != "" {
-		defaultCommonLogPath = beego.AppConfig.String("logger.defaultCommonLogPath")
-	}
-	if beego.AppConfig.String("logger.defaultCommonLogPath") != "" {
-		defaultErrorLogPath = beego.AppConfig.String("logger.defaultErrorLogPath")
-	}
 }
@@ -35,6 +35,11 @@ type logrusLogger struct {
 	Component  string
 	Logrus     *logrus.Logger
 	workingDir string
+	fields     []Field // fields of With and the context
+	ctx        context.Context
+	level      *AtomicLevel
+	// outputLevel is the most verbose level of the outputs with their own levels, see LogrusOption
+	outputLevel logrus.Level
 }
 
 // LogrusOption is used to set options for Logrus.
@@ -44,6 +49,11 @@ type LogrusOption struct {
 	Formatter logrus.Formatter
 	Level     logrus.Level
 	Component string
+	// AtomicLevel is the level changed at runtime, a new one of Level if nil
+	AtomicLevel *AtomicLevel
+	// OutputLevel is the most verbose level of the hooks with their own levels, entries above AtomicLevel
+	// but not above it are still logged for them, and skipped by the hooks following AtomicLevel, see FollowLevel
+	OutputLevel logrus.Level
 }
 
 var (
@@ -91,20 +101,29 @@ func setOption(option interface{}) (*LogrusOption, error) {
 	}
 	newOpt.Level = opt.Level
 	newOpt.Component = opt.Component
+	newOpt.AtomicLevel = opt.AtomicLevel
+	newOpt.OutputLevel = opt.OutputLevel
 	return newOpt, nil
 }
 
 func newLogrusLogger(option *LogrusOption) *logrusLogger {
-	return &logrusLogger{
+	level := option.AtomicLevel
+	if level == nil {
+		level = NewAtomicLevel(option.Level)
+	}
+	log := &logrusLogger{
 		Component: option.Component,
 		Logrus: &logrus.Logger{
 			Out:       option.Out,
 			Formatter: option.Formatter,
 			Hooks:     option.levelHooks(),
-			Level:     option.Level,
 		},
-		workingDir: getWorkingDir(),
+		workingDir:  getWorkingDir(),
+		level:       level,
+		outputLevel: option.OutputLevel,
 	}
+	level.attach(log.Logrus, option.OutputLevel)
+	return log
 }
 
 func getWorkingDir() string {
@@ -118,6 +137,9 @@ func getWorkingDir() string {
 
 func (log *logrusLogger) addFields(fields []Field, needStackTrace bool) logrus.Fields {
 	fs := logrus.Fields{}
+	for _, f := range log.fields {
+		fs[f.Key()] = f.Value()
+	}
 	for _, f := range fields {
 		fs[f.Key()] = f.Value()
 	}
@@ -158,34 +180,101 @@ func (log *logrusLogger) extractCallerInfo(skip int) (fullPath string, shortPath
 	return
 }
 
+// entry returns the entry of the logger with its context
+func (log *logrusLogger) entry() *logrus.Entry {
+	entry := logrus.NewEntry(log.Logrus)
+	if log.ctx != nil {
+		entry = entry.WithContext(log.ctx)
+	}
+	return entry
+}
+
+// belowLevelKey marks the context of the entries above the level of the logger,
+// which are only logged for the outputs with their own levels
+type belowLevelKey struct{}
+
+// entryOf returns the entry of level for the caller of the logging method, false if it's not logged
+func (log *logrusLogger) entryOf(level logrus.Level) (*logrus.Entry, bool) {
+	if log.level.enabled(level, log.Component, 2) {
+		return log.entry(), true
+	}
+	if level > log.outputLevel {
+		return nil, false
+	}
+	ctx := log.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return logrus.NewEntry(log.Logrus).WithContext(context.WithValue(ctx, belowLevelKey{}, true)), true
+}
+
+// FollowLevel wraps a hook following AtomicLevel of a logger with LogrusOption.OutputLevel,
+// it skips the entries above the level which are logged for the other hooks only
+func FollowLevel(hook logrus.Hook) logrus.Hook {
+	return levelFollower{hook}
+}
+
+type levelFollower struct {
+	logrus.Hook
+}
+
+func (h levelFollower) Fire(entry *logrus.Entry) error {
+	if entry.Context != nil && entry.Context.Value(belowLevelKey{}) != nil {
+		return nil
+	}
+	return h.Hook.Fire(entry)
+}
+
 func (log *logrusLogger) Debug(message string, fields ...Field) {
-	log.Logrus.WithFields(log.addFields(fields, false)).Debugln(message)
+	if entry, ok := log.entryOf(logrus.DebugLevel); ok {
+		entry.WithFields(log.addFields(fields, false)).Debugln(message)
+	}
 }
 
 func (log *logrusLogger) Info(message string, fields ...Field) {
-	log.Logrus.WithFields(log.addFields(fields, false)).Infoln(message)
+	if entry, ok := log.entryOf(logrus.InfoLevel); ok {
+		entry.WithFields(log.addFields(fields, false)).Infoln(message)
+	}
 }
 
 func (log *logrusLogger) Warn(message string, fields ...Field) {
-	log.Logrus.WithFields(log.addFields(fields, false)).Warnln(message)
+	if entry, ok := log.entryOf(logrus.WarnLevel); ok {
+		entry.WithFields(log.addFields(fields, false)).Warnln(message)
+	}
 }
 
 func (log *logrusLogger) Error(message string, fields ...Field) error {
-	log.Logrus.WithFields(log.addFields(fields, true)).Errorln(message)
+	if entry, ok := log.entryOf(logrus.ErrorLevel); ok {
+		entry.WithFields(log.addFields(fields, true)).Errorln(message)
+	}
 	return errors.New(message)
 }
 
 func (log *logrusLogger) Fatal(message string, fields ...Field) {
-	log.Logrus.WithFields(log.addFields(fields, true)).Fatalln(message)
+	log.entry().WithFields(log.addFields(fields, true)).Fatalln(message)
 
 }
 
 func (log *logrusLogger) Panic(message string, fields ...Field) {
-	log.Logrus.WithFields(log.addFields(fields, true)).Panicln(message)
+	log.entry().WithFields(log.addFields(fields, true)).Panicln(message)
 }
 
-func (log *logrusLogger) WithContext(ctx context.Context) *logrus.Entry {
-	return log.Logrus.WithContext(ctx)
+func (log *logrusLogger) WithContext(ctx context.Context) Logger {
+	child := log.with(FieldsFromContext(ctx))
+	child.ctx = ctx
+	return child
+}
+
+func (log *logrusLogger) With(fields ...Field) Logger {
+	return log.with(fields)
+}
+
+func (log *logrusLogger) with(fields []Field) *logrusLogger {
+	child := *log
+	child.fields = make([]Field, 0, len(log.fields)+len(fields))
+	child.fields = append(child.fields, log.fields...)
+	child.fields = append(child.fields, fields...)
+	return &child
 }
 
 func (log *logrusLogger) GetPrintLogger() PrintLogger {
@@ -194,7 +283,11 @@ func (log *logrusLogger) GetPrintLogger() PrintLogger {
 
 // 已携带堆栈信息的错误,使用fmt.Sprintf("%+v",err)得到完整的错误信息输出
 func (log *logrusLogger) LogErrorHasStackInfo(err error, args ...interface{}) {
-	log.Logrus.Errorln(fmt.Sprintf("%+v", err), args)
+	fs := logrus.Fields{}
+	for _, f := range log.fields {
+		fs[f.Key()] = f.Value()
+	}
+	log.entry().WithFields(fs).Errorln(fmt.Sprintf("%+v", err), args)
 }
 
 type printLogger struct {
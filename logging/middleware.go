@@ -0,0 +1,50 @@
+package logging
+
+import (
+	"net/http"
+
+	"github.com/astaxie/beego"
+	beegoContext "github.com/astaxie/beego/context"
+	"github.com/pborman/uuid"
+)
+
+const (
+	REQUEST_ID_HEADER     = "X-Request-ID"
+	MAX_REQUEST_ID_LENGTH = 128
+)
+
+// requestID returns the request id of the header, or a new one if it's missing or invalid
+func requestID(r *http.Request) string {
+	id := r.Header.Get(REQUEST_ID_HEADER)
+	if id == "" || len(id) > MAX_REQUEST_ID_LENGTH {
+		return uuid.New()
+	}
+	// don't let clients break the log lines
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return uuid.New()
+		}
+	}
+	return id
+}
+
+// RequestIDMiddleware propagates the X-Request-ID header of the request, or generates one,
+// into the context of the request and the response header.
+// Use Log.WithContext(r.Context()) in handlers to log with it.
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := requestID(r)
+		w.Header().Set(REQUEST_ID_HEADER, id)
+		next.ServeHTTP(w, r.WithContext(WithRequestID(r.Context(), id)))
+	})
+}
+
+// BeegoRequestIDFilter is RequestIDMiddleware of beego, it should be inserted at beego.BeforeRouter.
+// Use Log.WithContext(ctx.Request.Context()) in controllers to log with it.
+func BeegoRequestIDFilter() beego.FilterFunc {
+	return func(ctx *beegoContext.Context) {
+		id := requestID(ctx.Request)
+		ctx.Output.Header(REQUEST_ID_HEADER, id)
+		ctx.Request = ctx.Request.WithContext(WithRequestID(ctx.Request.Context(), id))
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"reflect"
+	"strings"
 
 	"github.com/yiGmMk/pz-infra-new/encryptUtil"
 	. "github.com/yiGmMk/pz-infra-new/errorUtil"
@@ -549,3 +550,97 @@ func LpushString(key, value string) error {
 	}
 	return nil
 }
+
+// GetHashStringMap returns all fields and values of the hash key
+func GetHashStringMap(key string) (map[string]string, error) {
+	if len(key) == 0 {
+		return nil, errKeyIsBlank
+	}
+
+	conn := getPool().Get()
+	defer conn.Close()
+	m, err := redis.StringMap(conn.Do("HGETALL", key))
+	if err != nil {
+		Log.Error("redis: HGETALL Error ", With("key", key), WithError(err))
+		return nil, err
+	}
+	return m, nil
+}
+
+// ReplaceHashWithExpire replaces the whole hash with fields and sets its expire time in one transaction
+func ReplaceHashWithExpire(key string, fields map[string]string, seconds int) error {
+	if len(key) == 0 {
+		return errKeyIsBlank
+	}
+
+	conn := getPool().Get()
+	defer conn.Close()
+	conn.Send("MULTI")
+	conn.Send("DEL", key)
+	conn.Send("HMSET", redis.Args{}.Add(key).AddFlat(fields)...)
+	conn.Send("EXPIRE", key, seconds)
+	if _, err := do(conn, "EXEC"); err != nil {
+		Log.Error("redis: ReplaceHashWithExpire Error", With("key", key), WithError(err))
+		return err
+	}
+	Log.Debug("redis: ReplaceHashWithExpire success", With("key", key))
+	return nil
+}
+
+// DeleteHashFields removes fields from the hash key
+func DeleteHashFields(key string, fields ...string) error {
+	if len(key) == 0 {
+		return errKeyIsBlank
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+
+	conn := getPool().Get()
+	defer conn.Close()
+	if _, err := do(conn, "HDEL", redis.Args{}.Add(key).AddFlat(fields)...); err != nil {
+		Log.Error("redis: HDEL Error", With("key", key), With("fields", fields), WithError(err))
+		return err
+	}
+	return nil
+}
+
+// Rename renames key to newKey atomically, returns false if key does not exist
+func Rename(key, newKey string) (bool, error) {
+	if len(key) == 0 || len(newKey) == 0 {
+		return false, errKeyIsBlank
+	}
+
+	conn := getPool().Get()
+	defer conn.Close()
+	if _, err := conn.Do("RENAME", key, newKey); err != nil {
+		if strings.Contains(err.Error(), "no such key") {
+			return false, nil
+		}
+		Log.Error("redis: RENAME Error", With("key", key), With("newKey", newKey), WithError(err))
+		return false, err
+	}
+	return true, nil
+}
+
+// XAdd appends an entry of field value pairs to stream and returns the entry id,
+// the stream is trimmed to about maxLen entries if maxLen > 0
+func XAdd(stream string, maxLen int64, fieldValues ...string) (string, error) {
+	if len(stream) == 0 {
+		return "", errKeyIsBlank
+	}
+
+	conn := getPool().Get()
+	defer conn.Close()
+	args := redis.Args{}.Add(stream)
+	if maxLen > 0 {
+		args = args.Add("MAXLEN", "~", maxLen)
+	}
+	args = args.Add("*").AddFlat(fieldValues)
+	id, err := redis.String(do(conn, "XADD", args...))
+	if err != nil {
+		Log.Error("redis: XADD Error", With("stream", stream), WithError(err))
+		return "", err
+	}
+	return id, nil
+}
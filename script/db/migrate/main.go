@@ -0,0 +1,21 @@
+// Command migrate creates the database and applies the versioned SQL migrations.
+//
+//	go run ./script/db/migrate -conf conf/app.conf create
+//	go run ./script/db/migrate -conf conf/app.conf -dir migrations up
+//
+// Services with Go migrations should call database.RunMigrateCommand in their own main.
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/yiGmMk/pz-infra-new/database"
+)
+
+func main() {
+	if err := database.RunMigrateCommand(os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,47 @@
+package session
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/astaxie/beego"
+	beegoContext "github.com/astaxie/beego/context"
+)
+
+// BeegoFilter loads the session of the request into its context, it should be inserted at beego.BeforeRouter.
+// The session is saved before the response is written or by BeegoReleaseFilter.
+// Use FromContext(ctx.Request.Context()) to get the session in controllers.
+func BeegoFilter(option *MiddlewareOption) beego.FilterFunc {
+	opt := option.withDefaults()
+	return func(ctx *beegoContext.Context) {
+		sc, err := loadSession(ctx.Request, opt)
+		if err != nil {
+			code := loadSessionErrorCode(err)
+			ctx.Abort(code, http.StatusText(code))
+			return
+		}
+		ctx.Request = ctx.Request.WithContext(context.WithValue(ctx.Request.Context(), sessionContextKey{}, sc))
+		ctx.ResponseWriter.ResponseWriter = &sessionResponseWriter{ResponseWriter: ctx.ResponseWriter.ResponseWriter, session: sc}
+	}
+}
+
+// BeegoReleaseFilter saves the session if it's not saved yet, it should be inserted at beego.FinishRouter.
+func BeegoReleaseFilter() beego.FilterFunc {
+	return func(ctx *beegoContext.Context) {
+		sc, ok := ctx.Request.Context().Value(sessionContextKey{}).(*sessionContext)
+		if !ok {
+			return
+		}
+		w := ctx.ResponseWriter.ResponseWriter
+		if sw, ok := w.(*sessionResponseWriter); ok {
+			w = sw.ResponseWriter
+		}
+		sc.release(w)
+	}
+}
+
+// InsertBeegoFilters inserts BeegoFilter and BeegoReleaseFilter for the pattern
+func InsertBeegoFilters(pattern string, option *MiddlewareOption) {
+	beego.InsertFilter(pattern, beego.BeforeRouter, BeegoFilter(option))
+	beego.InsertFilter(pattern, beego.FinishRouter, BeegoReleaseFilter(), false)
+}
@@ -0,0 +1,333 @@
+package session
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"net/url"
+	"sync"
+
+	. "github.com/yiGmMk/pz-infra-new/logging"
+
+	"github.com/astaxie/beego"
+)
+
+const (
+	COOKIE_HASH_SHA1   = "sha1"
+	COOKIE_HASH_SHA256 = "sha256"
+
+	DEFAULT_COOKIE_SECURITY_NAME = "pzsession"
+	// browsers limit the size of a cookie to 4096 bytes including its name and attributes
+	DEFAULT_COOKIE_MAX_SIZE = 4000
+)
+
+var (
+	// ErrCookieTooLarge is returned (wrapped) by Set if the encoded session exceeds the size limit,
+	// the value is not set.
+	ErrCookieTooLarge = errors.New("session: cookie session exceeds the size limit")
+
+	errCookieProviderNotInit = errors.New("session: cookie session provider is not initialized")
+)
+
+// CookieKey is a pair of keys used to sign and encrypt the session cookie
+type CookieKey struct {
+	HashKey  string `json:"hashKey"`  // key of HMAC
+	BlockKey string `json:"blockKey"` // AES key, 16, 24 or 32 bytes, required
+	HashFunc string `json:"hashFunc"` // sha1(default) or sha256
+}
+
+// CookieSessionConfig is passed to cookieSessionProvider.SessionInit encoded as JSON.
+// AbsoluteTimeout is not supported by the cookie provider.
+type CookieSessionConfig struct {
+	SessionConfig
+	CookieKey
+	// OldKeys are tried in order to decode the cookie if the current keys failed,
+	// sessions are re-encoded with the current keys on release.
+	OldKeys      []CookieKey `json:"oldKeys"`
+	SecurityName string      `json:"securityName"` // name signed into the cookie value
+	CookieName   string      `json:"cookieName"`   // set the session as cookie if not empty
+	MaxSize      int         `json:"maxSize"`      // max length of the encoded session
+	Domain       string      `json:"domain"`
+	Path         string      `json:"path"`
+	Secure       bool        `json:"secure"`
+	HTTPOnly     bool        `json:"httpOnly"`
+}
+
+func getCookieSessionConfig() *CookieSessionConfig {
+	conf := &CookieSessionConfig{
+		SessionConfig: *getSessionConfig(),
+		CookieKey: CookieKey{
+			HashKey:  beego.AppConfig.String("sessionCookieHashKey"),
+			BlockKey: beego.AppConfig.String("sessionCookieBlockKey"),
+			HashFunc: beego.AppConfig.String("sessionCookieHashFunc"),
+		},
+		SecurityName: beego.AppConfig.String("sessionCookieSecurityName"),
+		CookieName:   beego.AppConfig.String("sessionCookieName"),
+		MaxSize:      beego.AppConfig.DefaultInt("sessionCookieMaxSize", DEFAULT_COOKIE_MAX_SIZE),
+		Domain:       beego.AppConfig.String("sessionCookieDomain"),
+		Path:         beego.AppConfig.String("sessionCookiePath"),
+		Secure:       beego.AppConfig.DefaultBool("sessionCookieSecure", false),
+		HTTPOnly:     beego.AppConfig.DefaultBool("sessionCookieHTTPOnly", true),
+	}
+	hashKeys := beego.AppConfig.Strings("sessionCookieOldHashKeys")
+	blockKeys := beego.AppConfig.Strings("sessionCookieOldBlockKeys")
+	hashFuncs := beego.AppConfig.Strings("sessionCookieOldHashFuncs")
+	for i := range hashKeys {
+		key := CookieKey{HashKey: hashKeys[i]}
+		if i < len(blockKeys) {
+			key.BlockKey = blockKeys[i]
+		}
+		if i < len(hashFuncs) {
+			key.HashFunc = hashFuncs[i]
+		}
+		conf.OldKeys = append(conf.OldKeys, key)
+	}
+	return conf
+}
+
+type cookieCodec struct {
+	hashKey  string
+	block    cipher.Block
+	hashFunc func() hash.Hash
+}
+
+func newCookieCodec(key CookieKey) (*cookieCodec, error) {
+	if key.HashKey == "" {
+		return nil, errors.New("session: cookie hash key is empty")
+	}
+	// a random key would lose the sessions after restart and on the other instances
+	if key.BlockKey == "" {
+		return nil, errors.New("session: cookie block key is empty")
+	}
+	block, err := aes.NewCipher([]byte(key.BlockKey))
+	if err != nil {
+		return nil, fmt.Errorf("session: invalid cookie block key: %v", err)
+	}
+	codec := &cookieCodec{hashKey: key.HashKey, block: block}
+	switch key.HashFunc {
+	case "", COOKIE_HASH_SHA1:
+		codec.hashFunc = sha1.New
+	case COOKIE_HASH_SHA256:
+		codec.hashFunc = sha256.New
+	default:
+		return nil, fmt.Errorf("session: unknown cookie hash function %s", key.HashFunc)
+	}
+	return codec, nil
+}
+
+// cookie session store
+type cookieSessionStore struct {
+	sid      string
+	lock     sync.RWMutex
+	values   map[interface{}]interface{}
+	provider *cookieSessionProvider
+}
+
+// set value in cookie session, returns ErrCookieTooLarge if the session is too large to save
+func (cs *cookieSessionStore) Set(key, value interface{}) error {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	old, exists := cs.values[key]
+	cs.values[key] = value
+	if _, err := cs.provider.encode(cs.values); err != nil {
+		if exists {
+			cs.values[key] = old
+		} else {
+			delete(cs.values, key)
+		}
+		return err
+	}
+	return nil
+}
+
+// get value in cookie session
+func (cs *cookieSessionStore) Get(key interface{}) interface{} {
+	cs.lock.RLock()
+	defer cs.lock.RUnlock()
+	if v, ok := cs.values[key]; ok {
+		return v
+	}
+	return nil
+}
+
+// delete value in cookie session
+func (cs *cookieSessionStore) Delete(key interface{}) error {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	delete(cs.values, key)
+	return nil
+}
+
+// clear all values in cookie session
+func (cs *cookieSessionStore) Flush() error {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	cs.values = make(map[interface{}]interface{})
+	return nil
+}
+
+// copy all values of the session
+func (cs *cookieSessionStore) getValues() map[interface{}]interface{} {
+	cs.lock.RLock()
+	defer cs.lock.RUnlock()
+	values := make(map[interface{}]interface{}, len(cs.values))
+	for k, v := range cs.values {
+		values[k] = v
+	}
+	return values
+}
+
+// cookie sessions live in the client only, the id changes on every release so nothing needs to be moved
+func (cs *cookieSessionStore) regenerate(sid string) error {
+	return nil
+}
+
+// get cookie session id, it's the encoded value the session was read from
+func (cs *cookieSessionStore) SessionID() string {
+	return cs.sid
+}
+
+// encode session values to the response header and the cookie if configured
+func (cs *cookieSessionStore) SessionRelease(httpResponseWriter http.ResponseWriter, sessionKey string) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	encoded, err := cs.provider.encode(cs.values)
+	if err != nil {
+		Log.Error("Failed to encode cookie session", WithError(err))
+		return
+	}
+	cs.sid = encoded
+	if httpResponseWriter == nil {
+		return
+	}
+	httpResponseWriter.Header().Set(sessionKey, encoded)
+	conf := cs.provider.config
+	if conf.CookieName != "" {
+		http.SetCookie(httpResponseWriter, &http.Cookie{
+			Name:     conf.CookieName,
+			Value:    url.QueryEscape(encoded),
+			Path:     conf.Path,
+			Domain:   conf.Domain,
+			Secure:   conf.Secure,
+			HttpOnly: conf.HTTPOnly,
+			MaxAge:   conf.IdleTimeout,
+		})
+	}
+}
+
+// cookie session provider, session values are signed and encrypted into the cookie itself
+type cookieSessionProvider struct {
+	config *CookieSessionConfig
+	codecs []*cookieCodec // the first is used to encode, all are tried to decode
+}
+
+// init cookie session with config of CookieSessionConfig in JSON
+func (cp *cookieSessionProvider) SessionInit(config string) error {
+	conf := &CookieSessionConfig{}
+	if config != "" {
+		if err := json.Unmarshal([]byte(config), conf); err != nil {
+			return err
+		}
+	}
+	if conf.IdleTimeout <= 0 {
+		conf.IdleTimeout = DEFAULT_SESSION_IDLE_TIMEOUT
+	}
+	if conf.SecurityName == "" {
+		conf.SecurityName = DEFAULT_COOKIE_SECURITY_NAME
+	}
+	if conf.MaxSize <= 0 {
+		conf.MaxSize = DEFAULT_COOKIE_MAX_SIZE
+	}
+
+	codecs := make([]*cookieCodec, 0, len(conf.OldKeys)+1)
+	for _, key := range append([]CookieKey{conf.CookieKey}, conf.OldKeys...) {
+		codec, err := newCookieCodec(key)
+		if err != nil {
+			return err
+		}
+		codecs = append(codecs, codec)
+	}
+	cp.config = conf
+	cp.codecs = codecs
+	return nil
+}
+
+func (cp *cookieSessionProvider) encode(values map[interface{}]interface{}) (string, error) {
+	if len(cp.codecs) == 0 {
+		return "", errCookieProviderNotInit
+	}
+	codec := cp.codecs[0]
+	encoded, err := encodeCookie(codec.block, codec.hashFunc, codec.hashKey, cp.config.SecurityName, values)
+	if err != nil {
+		return "", err
+	}
+	if len(encoded) > cp.config.MaxSize {
+		return "", fmt.Errorf("%w: %d > %d", ErrCookieTooLarge, len(encoded), cp.config.MaxSize)
+	}
+	return encoded, nil
+}
+
+func (cp *cookieSessionProvider) decode(value string) (map[interface{}]interface{}, error) {
+	if len(cp.codecs) == 0 {
+		return nil, errCookieProviderNotInit
+	}
+	var err error
+	for _, codec := range cp.codecs {
+		var values map[interface{}]interface{}
+		values, err = decodeCookie(codec.block, codec.hashFunc, codec.hashKey, cp.config.SecurityName, value, int64(cp.config.IdleTimeout))
+		if err == nil {
+			return values, nil
+		}
+	}
+	return nil, err
+}
+
+// read cookie session from the encoded value, an empty session is returned if it's invalid or expired
+func (cp *cookieSessionProvider) SessionRead(sid string) (SessionStore, error) {
+	if len(cp.codecs) == 0 {
+		return nil, errCookieProviderNotInit
+	}
+	if unescaped, err := url.QueryUnescape(sid); err == nil {
+		sid = unescaped
+	}
+	values, err := cp.decode(sid)
+	if err != nil {
+		Log.Debug("Failed to decode cookie session, use an empty one", WithError(err))
+		values = make(map[interface{}]interface{})
+	}
+	return &cookieSessionStore{sid: sid, values: values, provider: cp}, nil
+}
+
+func (cp *cookieSessionProvider) SessionGenerate(lifeTime int, sid string) (SessionStore, error) {
+	if len(cp.codecs) == 0 {
+		return nil, errCookieProviderNotInit
+	}
+	return &cookieSessionStore{sid: sid, values: make(map[interface{}]interface{}), provider: cp}, nil
+}
+
+// cookie session always exists
+func (cp *cookieSessionProvider) SessionExist(sid string) bool {
+	return true
+}
+
+// cookie session can't be destroyed on the server side, it expires with IdleTimeout
+func (cp *cookieSessionProvider) SessionDestroy(sid string) error {
+	return nil
+}
+
+// Impelment method, no used.
+func (cp *cookieSessionProvider) SessionGC() {
+	return
+}
+
+// Impelment method, no used.
+func (cp *cookieSessionProvider) SessionAll() int {
+	return 0
+}
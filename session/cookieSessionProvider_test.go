@@ -0,0 +1,100 @@
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	. "github.com/yiGmMk/pz-infra-new/logging"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func initTestLogger() {
+	if Log == nil {
+		Log, _ = (&LogrusProvider{}).New(&LogrusOption{Out: ioutil.Discard})
+	}
+}
+
+func newTestCookieProvider(conf *CookieSessionConfig) (*cookieSessionProvider, error) {
+	config, _ := json.Marshal(conf)
+	cp := &cookieSessionProvider{}
+	return cp, cp.SessionInit(string(config))
+}
+
+func TestCookieSessionProvider(t *testing.T) {
+	initTestLogger()
+	oldKey := CookieKey{HashKey: "old-hash-key", BlockKey: "0123456789abcdef"}
+	newKey := CookieKey{HashKey: "new-hash-key", BlockKey: "fedcba9876543210", HashFunc: COOKIE_HASH_SHA256}
+
+	Convey("test cookie session provider", t, func() {
+		Convey("invalid config", func() {
+			_, err := newTestCookieProvider(&CookieSessionConfig{CookieKey: CookieKey{BlockKey: "0123456789abcdef"}})
+			So(err, ShouldNotBeNil)
+			_, err = newTestCookieProvider(&CookieSessionConfig{CookieKey: CookieKey{HashKey: "key"}})
+			So(err, ShouldNotBeNil)
+			_, err = newTestCookieProvider(&CookieSessionConfig{CookieKey: CookieKey{HashKey: "key", BlockKey: "short"}})
+			So(err, ShouldNotBeNil)
+			_, err = newTestCookieProvider(&CookieSessionConfig{CookieKey: CookieKey{HashKey: "key", BlockKey: "0123456789abcdef", HashFunc: "md5"}})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("encode and decode", func() {
+			cp, err := newTestCookieProvider(&CookieSessionConfig{CookieKey: newKey, CookieName: "sid"})
+			So(err, ShouldBeNil)
+			store, err := cp.SessionGenerate(0, "")
+			So(err, ShouldBeNil)
+			So(store.Set("userId", "u1"), ShouldBeNil)
+
+			w := httptest.NewRecorder()
+			store.SessionRelease(w, "X-Session")
+			encoded := w.Header().Get("X-Session")
+			So(encoded, ShouldNotBeEmpty)
+			So(w.Header().Get("Set-Cookie"), ShouldStartWith, "sid=")
+
+			read, err := cp.SessionRead(encoded)
+			So(err, ShouldBeNil)
+			So(read.Get("userId"), ShouldEqual, "u1")
+		})
+
+		Convey("tampered value results in an empty session", func() {
+			cp, _ := newTestCookieProvider(&CookieSessionConfig{CookieKey: newKey})
+			store, _ := cp.SessionGenerate(0, "")
+			store.Set("userId", "u1")
+			encoded, err := cp.encode(store.(*cookieSessionStore).values)
+			So(err, ShouldBeNil)
+
+			read, err := cp.SessionRead(encoded[:len(encoded)-4] + "AAAA")
+			So(err, ShouldBeNil)
+			So(read.Get("userId"), ShouldBeNil)
+		})
+
+		Convey("old keys are used to decode", func() {
+			oldProvider, _ := newTestCookieProvider(&CookieSessionConfig{CookieKey: oldKey})
+			store, _ := oldProvider.SessionGenerate(0, "")
+			store.Set("userId", "u1")
+			encoded, _ := oldProvider.encode(store.(*cookieSessionStore).values)
+
+			cp, _ := newTestCookieProvider(&CookieSessionConfig{CookieKey: newKey})
+			read, _ := cp.SessionRead(encoded)
+			So(read.Get("userId"), ShouldBeNil)
+
+			cp, _ = newTestCookieProvider(&CookieSessionConfig{CookieKey: newKey, OldKeys: []CookieKey{oldKey}})
+			read, _ = cp.SessionRead(encoded)
+			So(read.Get("userId"), ShouldEqual, "u1")
+		})
+
+		Convey("size limit", func() {
+			cp, _ := newTestCookieProvider(&CookieSessionConfig{CookieKey: newKey, MaxSize: 512})
+			store, _ := cp.SessionGenerate(0, "")
+			So(store.Set("small", "value"), ShouldBeNil)
+			err := store.Set("large", strings.Repeat("x", 1024))
+			So(errors.Is(err, ErrCookieTooLarge), ShouldBeTrue)
+			So(store.Get("large"), ShouldBeNil)
+			So(store.Get("small"), ShouldEqual, "value")
+		})
+	})
+}
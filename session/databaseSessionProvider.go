@@ -0,0 +1,303 @@
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/yiGmMk/pz-infra-new/database"
+	. "github.com/yiGmMk/pz-infra-new/logging"
+
+	"github.com/astaxie/beego"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	DEFAULT_SESSION_TABLE_NAME    = "session"
+	DEFAULT_SESSION_GC_BATCH_SIZE = 1000
+)
+
+// DatabaseSessionConfig is passed to databaseSessionProvider.SessionInit encoded as JSON
+type DatabaseSessionConfig struct {
+	SessionConfig
+	TableName   string `json:"tableName"`
+	GCBatchSize int    `json:"gcBatchSize"` // max rows deleted by one statement in SessionGC
+}
+
+func getDatabaseSessionConfig() *DatabaseSessionConfig {
+	return &DatabaseSessionConfig{
+		SessionConfig: *getSessionConfig(),
+		TableName:     beego.AppConfig.DefaultString("sessionTableName", DEFAULT_SESSION_TABLE_NAME),
+		GCBatchSize:   beego.AppConfig.DefaultInt("sessionGCBatchSize", DEFAULT_SESSION_GC_BATCH_SIZE),
+	}
+}
+
+// sessionRow is a row of the session table
+type sessionRow struct {
+	SessionId string    `gorm:"column:session_id;primaryKey;size:128"`
+	Values    []byte    `gorm:"column:session_values;type:mediumblob"`
+	Lifetime  int       `gorm:"column:lifetime;not null"`
+	CreatedAt time.Time `gorm:"column:created_at;not null"`
+	ExpiresAt time.Time `gorm:"column:expires_at;not null;index"`
+}
+
+// database session store
+type databaseSessionStore struct {
+	sid             string
+	lock            sync.RWMutex
+	values          map[interface{}]interface{}
+	maxlifetime     int //idle expire time in seconds
+	absoluteTimeout int //absolute expire time in seconds since created, 0 means no limit
+	created         time.Time
+	dirty           bool
+	provider        *databaseSessionProvider
+}
+
+// set value in database session
+func (ds *databaseSessionStore) Set(key, value interface{}) error {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	ds.values[key] = value
+	ds.dirty = true
+	return nil
+}
+
+// get value in database session
+func (ds *databaseSessionStore) Get(key interface{}) interface{} {
+	ds.lock.RLock()
+	defer ds.lock.RUnlock()
+	if v, ok := ds.values[key]; ok {
+		return v
+	}
+	return nil
+}
+
+// delete value in database session
+func (ds *databaseSessionStore) Delete(key interface{}) error {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	if _, ok := ds.values[key]; ok {
+		delete(ds.values, key)
+		ds.dirty = true
+	}
+	return nil
+}
+
+// clear all values in database session
+func (ds *databaseSessionStore) Flush() error {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	ds.values = make(map[interface{}]interface{})
+	ds.dirty = true
+	return nil
+}
+
+// copy all values of the session
+func (ds *databaseSessionStore) getValues() map[interface{}]interface{} {
+	ds.lock.RLock()
+	defer ds.lock.RUnlock()
+	values := make(map[interface{}]interface{}, len(ds.values))
+	for k, v := range ds.values {
+		values[k] = v
+	}
+	return values
+}
+
+// update the session id of the database row to sid, a session not saved yet only changes its id
+func (ds *databaseSessionStore) regenerate(sid string) error {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	if err := ds.provider.getDB().Where("session_id = ?", ds.sid).Update("session_id", sid).Error; err != nil {
+		Log.Error("Failed to regenerate session", With("sid", ds.sid), WithError(err))
+		return err
+	}
+	ds.sid = sid
+	return nil
+}
+
+// get database session id
+func (ds *databaseSessionStore) SessionID() string {
+	return ds.sid
+}
+
+// save session values to database if changed, otherwise only refresh its expire time
+func (ds *databaseSessionStore) SessionRelease(httpResponseWriter http.ResponseWriter, sessionKey string) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	now := time.Now()
+	ttl := getSessionTTL(ds.created, ds.maxlifetime, ds.absoluteTimeout, now)
+	if ttl <= 0 {
+		if err := ds.provider.SessionDestroy(ds.sid); err != nil {
+			Log.Error("Failed to delete expired session", With("sid", ds.sid), WithError(err))
+		}
+		return
+	}
+	expiresAt := now.Add(time.Duration(ttl) * time.Second)
+
+	db := ds.provider.getDB()
+	if ds.dirty {
+		b, err := EncodeSession(ds.values)
+		if err != nil {
+			Log.Error("Failed to encode session", With("sid", ds.sid), WithError(err))
+			return
+		}
+		row := &sessionRow{
+			SessionId: ds.sid,
+			Values:    b,
+			Lifetime:  ds.maxlifetime,
+			CreatedAt: ds.created,
+			ExpiresAt: expiresAt,
+		}
+		if err := db.Clauses(clause.OnConflict{UpdateAll: true}).Create(row).Error; err != nil {
+			Log.Error("Failed to save session", With("sid", ds.sid), WithError(err))
+			return
+		}
+		ds.dirty = false
+	} else {
+		if err := db.Where("session_id = ?", ds.sid).Update("expires_at", expiresAt).Error; err != nil {
+			Log.Error("Failed to touch session", With("sid", ds.sid), WithError(err))
+		}
+	}
+
+	if httpResponseWriter != nil {
+		httpResponseWriter.Header().Set(sessionKey, ds.sid)
+	}
+}
+
+// database session provider, based on the gorm DB of the database package
+type databaseSessionProvider struct {
+	config *DatabaseSessionConfig
+}
+
+// init database session with config of DatabaseSessionConfig in JSON,
+// the session table is created if not exists.
+func (dp *databaseSessionProvider) SessionInit(config string) error {
+	conf := &DatabaseSessionConfig{}
+	if config != "" {
+		if err := json.Unmarshal([]byte(config), conf); err != nil {
+			return err
+		}
+	}
+	if conf.IdleTimeout <= 0 {
+		conf.IdleTimeout = DEFAULT_SESSION_IDLE_TIMEOUT
+	}
+	if conf.AbsoluteTimeout < 0 {
+		conf.AbsoluteTimeout = 0
+	}
+	if conf.TableName == "" {
+		conf.TableName = DEFAULT_SESSION_TABLE_NAME
+	}
+	if conf.GCBatchSize <= 0 {
+		conf.GCBatchSize = DEFAULT_SESSION_GC_BATCH_SIZE
+	}
+	dp.config = conf
+	return dp.getDB().AutoMigrate(&sessionRow{})
+}
+
+func (dp *databaseSessionProvider) getDB() *gorm.DB {
+	return database.GetDB().Table(dp.config.TableName)
+}
+
+func (dp *databaseSessionProvider) newStore(sid string, lifeTime int) *databaseSessionStore {
+	if lifeTime <= 0 {
+		lifeTime = dp.config.IdleTimeout
+	}
+	return &databaseSessionStore{
+		sid:             sid,
+		values:          make(map[interface{}]interface{}),
+		maxlifetime:     lifeTime,
+		absoluteTimeout: dp.config.AbsoluteTimeout,
+		created:         time.Now(),
+		provider:        dp,
+	}
+}
+
+// read database session by sid, an empty session is returned if not found or expired
+func (dp *databaseSessionProvider) SessionRead(sid string) (SessionStore, error) {
+	row := &sessionRow{}
+	err := dp.getDB().Where("session_id = ?", sid).Take(row).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return dp.newStore(sid, 0), nil
+	}
+	if err != nil {
+		Log.Error("Failed to read session", With("sid", sid), WithError(err))
+		return nil, err
+	}
+
+	ds := dp.newStore(sid, row.Lifetime)
+	ds.created = row.CreatedAt
+	now := time.Now()
+	if !row.ExpiresAt.After(now) || getSessionTTL(ds.created, ds.maxlifetime, ds.absoluteTimeout, now) <= 0 {
+		if err := dp.SessionDestroy(sid); err != nil {
+			return nil, err
+		}
+		return dp.newStore(sid, row.Lifetime), nil
+	}
+	if len(row.Values) > 0 {
+		if ds.values, ds.dirty, err = DecodeSession(row.Values); err != nil {
+			return nil, err
+		}
+	}
+	return ds, nil
+}
+
+func (dp *databaseSessionProvider) SessionGenerate(lifeTime int, sid string) (SessionStore, error) {
+	ds := dp.newStore(sid, lifeTime)
+	ds.dirty = true
+	return ds, nil
+}
+
+// check database session exist and not expired by sid
+func (dp *databaseSessionProvider) SessionExist(sid string) bool {
+	var count int64
+	if err := dp.getDB().Where("session_id = ? AND expires_at > ?", sid, time.Now()).Count(&count).Error; err != nil {
+		Log.Error("Failed to check session", With("sid", sid), WithError(err))
+		return false
+	}
+	return count > 0
+}
+
+// delete database session by id
+func (dp *databaseSessionProvider) SessionDestroy(sid string) error {
+	return dp.getDB().Where("session_id = ?", sid).Delete(&sessionRow{}).Error
+}
+
+// delete expired sessions in batches of GCBatchSize
+func (dp *databaseSessionProvider) SessionGC() {
+	now := time.Now()
+	total := 0
+	for {
+		var sids []string
+		err := dp.getDB().Where("expires_at <= ?", now).Limit(dp.config.GCBatchSize).Pluck("session_id", &sids).Error
+		if err != nil {
+			Log.Error("Failed to find expired sessions", WithError(err))
+			return
+		}
+		if len(sids) == 0 {
+			break
+		}
+		if err := dp.getDB().Where("session_id IN ?", sids).Delete(&sessionRow{}).Error; err != nil {
+			Log.Error("Failed to delete expired sessions", WithError(err))
+			return
+		}
+		total += len(sids)
+		if len(sids) < dp.config.GCBatchSize {
+			break
+		}
+	}
+	Log.Debug("Session GC finished", With("deleted", total))
+}
+
+// count active sessions
+func (dp *databaseSessionProvider) SessionAll() int {
+	var count int64
+	if err := dp.getDB().Where("expires_at > ?", time.Now()).Count(&count).Error; err != nil {
+		Log.Error("Failed to count sessions", WithError(err))
+		return 0
+	}
+	return int(count)
+}
@@ -0,0 +1,115 @@
+package session
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/yiGmMk/pz-infra-new/tests/base"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func newTestDatabaseProvider(conf *DatabaseSessionConfig) (*databaseSessionProvider, error) {
+	if _, err := base.InitSQLiteDB(""); err != nil {
+		return nil, err
+	}
+	config, _ := json.Marshal(conf)
+	dp := &databaseSessionProvider{}
+	return dp, dp.SessionInit(string(config))
+}
+
+func TestDatabaseSessionProvider(t *testing.T) {
+	initTestLogger()
+
+	Convey("test database session provider", t, func() {
+		dp, err := newTestDatabaseProvider(&DatabaseSessionConfig{
+			SessionConfig: SessionConfig{IdleTimeout: 60},
+			GCBatchSize:   2,
+		})
+		So(err, ShouldBeNil)
+		So(dp.config.TableName, ShouldEqual, DEFAULT_SESSION_TABLE_NAME)
+
+		Convey("read a missing session", func() {
+			store, err := dp.SessionRead("missing")
+			So(err, ShouldBeNil)
+			So(store.SessionID(), ShouldEqual, "missing")
+			So(store.Get("k"), ShouldBeNil)
+			So(dp.SessionExist("missing"), ShouldBeFalse)
+		})
+
+		Convey("release and read a session", func() {
+			store, err := dp.SessionRead("sid")
+			So(err, ShouldBeNil)
+			So(store.Set("name", "tom"), ShouldBeNil)
+			w := httptest.NewRecorder()
+			store.SessionRelease(w, "session")
+			So(w.Header().Get("session"), ShouldEqual, "sid")
+			So(dp.SessionExist("sid"), ShouldBeTrue)
+			So(dp.SessionAll(), ShouldEqual, 1)
+
+			store, err = dp.SessionRead("sid")
+			So(err, ShouldBeNil)
+			So(store.Get("name"), ShouldEqual, "tom")
+
+			So(dp.SessionDestroy("sid"), ShouldBeNil)
+			So(dp.SessionExist("sid"), ShouldBeFalse)
+		})
+
+		Convey("release an unchanged session only refreshes its expire time", func() {
+			store, _ := dp.SessionRead("sid")
+			store.Set("name", "tom")
+			store.SessionRelease(nil, "session")
+			expiresAt := time.Now().Add(time.Second)
+			So(dp.getDB().Where("session_id = ?", "sid").Update("expires_at", expiresAt).Error, ShouldBeNil)
+
+			store, _ = dp.SessionRead("sid")
+			store.SessionRelease(nil, "session")
+			row := &sessionRow{}
+			So(dp.getDB().Where("session_id = ?", "sid").Take(row).Error, ShouldBeNil)
+			So(row.ExpiresAt.After(expiresAt.Add(30*time.Second)), ShouldBeTrue)
+			So(row.Values, ShouldNotBeEmpty)
+		})
+
+		Convey("an expired session is read as empty and deleted", func() {
+			store, _ := dp.SessionRead("sid")
+			store.Set("name", "tom")
+			store.SessionRelease(nil, "session")
+			So(dp.getDB().Where("session_id = ?", "sid").Update("expires_at", time.Now().Add(-time.Second)).Error, ShouldBeNil)
+
+			store, err := dp.SessionRead("sid")
+			So(err, ShouldBeNil)
+			So(store.Get("name"), ShouldBeNil)
+			var count int64
+			dp.getDB().Where("session_id = ?", "sid").Count(&count)
+			So(count, ShouldEqual, 0)
+		})
+
+		Convey("gc deletes the expired sessions in batches", func() {
+			now := time.Now()
+			for i := 0; i < 5; i++ {
+				So(dp.getDB().Create(&sessionRow{
+					SessionId: fmt.Sprintf("expired%d", i),
+					Lifetime:  60,
+					CreatedAt: now.Add(-time.Hour),
+					ExpiresAt: now.Add(-time.Minute),
+				}).Error, ShouldBeNil)
+			}
+			So(dp.getDB().Create(&sessionRow{
+				SessionId: "active",
+				Lifetime:  60,
+				CreatedAt: now,
+				ExpiresAt: now.Add(time.Minute),
+			}).Error, ShouldBeNil)
+			So(dp.SessionAll(), ShouldEqual, 1)
+
+			dp.SessionGC()
+			var sids []string
+			So(dp.getDB().Pluck("session_id", &sids).Error, ShouldBeNil)
+			So(sids, ShouldResemble, []string{"active"})
+			So(dp.SessionAll(), ShouldEqual, 1)
+		})
+	})
+}
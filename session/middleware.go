@@ -0,0 +1,352 @@
+package session
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+
+	. "github.com/yiGmMk/pz-infra-new/logging"
+)
+
+const (
+	DEFAULT_SESSION_HEADER = "X-Session-Id"
+	DEFAULT_SID_LENGTH     = 32
+)
+
+var ErrNoSessionInContext = errors.New("session: no session in context")
+
+// MiddlewareOption is used to set options for Middleware and BeegoFilter
+type MiddlewareOption struct {
+	HeaderName string          // header carrying the sid in request and response, DEFAULT_SESSION_HEADER if empty
+	CookieName string          // cookie carrying the sid if the header is absent, no cookie is used if empty
+	CookiePath string          // path of the sid cookie
+	Secure     bool            // set the sid cookie only over https
+	LifeTime   int             // lifeTime of new sessions in seconds, the provider default if 0
+	SIDLength  int             // bytes of random data of new sid, DEFAULT_SID_LENGTH if 0
+	Provider   SessionProvider // Provider() if nil
+	Binding    *BindingOption  // bind sessions to the client fingerprint, not bound if nil
+}
+
+func (o *MiddlewareOption) withDefaults() *MiddlewareOption {
+	opt := MiddlewareOption{}
+	if o != nil {
+		opt = *o
+	}
+	if opt.HeaderName == "" {
+		opt.HeaderName = DEFAULT_SESSION_HEADER
+	}
+	if opt.SIDLength <= 0 {
+		opt.SIDLength = DEFAULT_SID_LENGTH
+	}
+	if opt.Provider == nil {
+		opt.Provider = Provider()
+	}
+	return &opt
+}
+
+// NewSessionID generates a random session id of length bytes encoded in hex
+func NewSessionID(length int) string {
+	return hex.EncodeToString(generateRandomKey(length))
+}
+
+type sessionContextKey struct{}
+
+// sessionContext is the session of a request
+type sessionContext struct {
+	lock     sync.Mutex
+	store    SessionStore
+	option   *MiddlewareOption
+	released bool
+}
+
+// FromContext returns the session loaded by Middleware or BeegoFilter
+func FromContext(ctx context.Context) (SessionStore, error) {
+	sc, ok := ctx.Value(sessionContextKey{}).(*sessionContext)
+	if !ok {
+		return nil, ErrNoSessionInContext
+	}
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	return sc.store, nil
+}
+
+// RotateSessionID moves the values of the session in ctx to a new session id and destroys the old session.
+// Call it on privilege change, e.g. login, to prevent session fixation. ErrRegenerateNotSupported is returned
+// for stores of other packages, whose values can't be moved, and the session is kept.
+func RotateSessionID(ctx context.Context) (SessionStore, error) {
+	sc, ok := ctx.Value(sessionContextKey{}).(*sessionContext)
+	if !ok {
+		return nil, ErrNoSessionInContext
+	}
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	sid := NewSessionID(sc.option.SIDLength)
+	err := regenerateSession(sc.store, sid)
+	if err == nil {
+		return sc.store, nil
+	}
+	if err != ErrRegenerateNotSupported {
+		Log.Error("Failed to regenerate session", WithError(err))
+		return nil, err
+	}
+
+	// stores without regenerate are copied to a new session, the values of
+	// stores of other packages can't be read, so they are kept as they are
+	values, ok := sessionValues(sc.store)
+	if !ok {
+		return nil, ErrRegenerateNotSupported
+	}
+	provider := sc.option.Provider
+	store, err := provider.SessionGenerate(sc.option.LifeTime, sid)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range values {
+		if err := store.Set(k, v); err != nil {
+			return nil, err
+		}
+	}
+	if err := provider.SessionDestroy(sc.store.SessionID()); err != nil {
+		Log.Error("Failed to destroy rotated session", WithError(err))
+		return nil, err
+	}
+	sc.store = store
+	return store, nil
+}
+
+// lazySessionStore is the session of a request without a known sid. The session is only generated by
+// the provider on the first Set, so requests which don't use the session, e.g. of anonymous users and bots,
+// don't save sessions or get cookies.
+type lazySessionStore struct {
+	lock        sync.Mutex
+	sid         string
+	store       SessionStore // nil until the first Set
+	option      *MiddlewareOption
+	fingerprint *Fingerprint // bound to the session when it's generated, nil if not bound
+}
+
+func newLazySessionStore(option *MiddlewareOption, fp *Fingerprint) *lazySessionStore {
+	return &lazySessionStore{sid: NewSessionID(option.SIDLength), option: option, fingerprint: fp}
+}
+
+// start generates the session if it's not yet, the lock must be held
+func (ls *lazySessionStore) start() (SessionStore, error) {
+	if ls.store != nil {
+		return ls.store, nil
+	}
+	store, err := ls.option.Provider.SessionGenerate(ls.option.LifeTime, ls.sid)
+	if err != nil {
+		Log.Error("Failed to generate session", WithError(err))
+		return nil, err
+	}
+	if ls.fingerprint != nil {
+		if err := BindSession(store, ls.fingerprint); err != nil {
+			return nil, err
+		}
+	}
+	ls.store = store
+	return store, nil
+}
+
+func (ls *lazySessionStore) started() bool {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+	return ls.store != nil
+}
+
+func (ls *lazySessionStore) Set(key, value interface{}) error {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+	store, err := ls.start()
+	if err != nil {
+		return err
+	}
+	return store.Set(key, value)
+}
+
+func (ls *lazySessionStore) Get(key interface{}) interface{} {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+	if ls.store == nil {
+		return nil
+	}
+	return ls.store.Get(key)
+}
+
+func (ls *lazySessionStore) Delete(key interface{}) error {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+	if ls.store == nil {
+		return nil
+	}
+	return ls.store.Delete(key)
+}
+
+func (ls *lazySessionStore) Flush() error {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+	if ls.store == nil {
+		return nil
+	}
+	return ls.store.Flush()
+}
+
+// SessionID returns the sid of the session, which is only saved after the first Set
+func (ls *lazySessionStore) SessionID() string {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+	if ls.store == nil {
+		return ls.sid
+	}
+	return ls.store.SessionID()
+}
+
+// SessionRelease saves the session if it's generated, nothing is written otherwise
+func (ls *lazySessionStore) SessionRelease(w http.ResponseWriter, key string) {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+	if ls.store != nil {
+		ls.store.SessionRelease(w, key)
+	}
+}
+
+// inner returns the session generated, nil if it's not yet
+func (ls *lazySessionStore) inner() SessionStore {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+	return ls.store
+}
+
+// sessionValues returns all values of store, false if store is not of this package and its values can't be read
+func sessionValues(store SessionStore) (map[interface{}]interface{}, bool) {
+	if ls, ok := store.(*lazySessionStore); ok {
+		if store = ls.inner(); store == nil {
+			return map[interface{}]interface{}{}, true
+		}
+	}
+	vs, ok := store.(valuesStore)
+	if !ok {
+		return nil, false
+	}
+	return vs.getValues(), true
+}
+
+func (ls *lazySessionStore) regenerate(sid string) error {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+	if ls.store == nil {
+		ls.sid = sid
+		return nil
+	}
+	return regenerateSession(ls.store, sid)
+}
+
+// loadSession reads the session of the request, or a lazySessionStore if its sid is unknown
+func loadSession(r *http.Request, option *MiddlewareOption) (*sessionContext, error) {
+	sid := r.Header.Get(option.HeaderName)
+	if sid == "" && option.CookieName != "" {
+		if cookie, err := r.Cookie(option.CookieName); err == nil {
+			sid, _ = url.QueryUnescape(cookie.Value)
+		}
+	}
+
+	var fp *Fingerprint
+	if option.Binding != nil {
+		fp = NewFingerprint(r, option.Binding)
+	}
+	// never trust a sid unknown to the provider, it may be chosen by an attacker
+	if sid == "" || !option.Provider.SessionExist(sid) {
+		return &sessionContext{store: newLazySessionStore(option, fp), option: option}, nil
+	}
+	store, err := option.Provider.SessionRead(sid)
+	if err != nil {
+		return nil, err
+	}
+	if fp != nil {
+		if err := VerifySession(store, fp); err != nil {
+			return nil, err
+		}
+		if err := verifyRegisteredClient(store, fp, option.Binding); err != nil {
+			return nil, err
+		}
+	}
+	return &sessionContext{store: store, option: option}, nil
+}
+
+// loadSessionErrorCode returns the http status code to reject the request which failed to load its session
+func loadSessionErrorCode(err error) int {
+	if err == ErrSessionFingerprintMismatch {
+		return http.StatusUnauthorized
+	}
+	Log.Error("Failed to load session", WithError(err))
+	return http.StatusInternalServerError
+}
+
+// release saves the session and writes the sid to the response once, a session never set is not saved
+func (sc *sessionContext) release(w http.ResponseWriter) {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	if sc.released {
+		return
+	}
+	sc.released = true
+	if ls, ok := sc.store.(*lazySessionStore); ok && !ls.started() {
+		return
+	}
+	sc.store.SessionRelease(w, sc.option.HeaderName)
+	if sc.option.CookieName != "" {
+		http.SetCookie(w, &http.Cookie{
+			Name:     sc.option.CookieName,
+			Value:    url.QueryEscape(sc.store.SessionID()),
+			Path:     sc.option.CookiePath,
+			Secure:   sc.option.Secure,
+			HttpOnly: true,
+		})
+	}
+}
+
+// sessionResponseWriter releases the session before the response header is written
+type sessionResponseWriter struct {
+	http.ResponseWriter
+	session *sessionContext
+}
+
+func (w *sessionResponseWriter) WriteHeader(code int) {
+	w.session.release(w.ResponseWriter)
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *sessionResponseWriter) Write(b []byte) (int, error) {
+	w.session.release(w.ResponseWriter)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *sessionResponseWriter) Flush() {
+	w.session.release(w.ResponseWriter)
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Middleware loads the session of the request into its context before calling next,
+// and saves the session after next is done. Use FromContext to get the session in handlers.
+func Middleware(option *MiddlewareOption) func(http.Handler) http.Handler {
+	opt := option.withDefaults()
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			sc, err := loadSession(r, opt)
+			if err != nil {
+				code := loadSessionErrorCode(err)
+				http.Error(w, http.StatusText(code), code)
+				return
+			}
+			sw := &sessionResponseWriter{ResponseWriter: w, session: sc}
+			next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), sessionContextKey{}, sc)))
+			sc.release(w)
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package session
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMiddleware(t *testing.T) {
+	initTestLogger()
+	cp, err := newTestCookieProvider(&CookieSessionConfig{CookieKey: CookieKey{HashKey: "hash-key", BlockKey: "0123456789abcdef"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	middleware := Middleware(&MiddlewareOption{Provider: cp, CookieName: "sid"})
+
+	Convey("test session middleware", t, func() {
+		handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			store, err := FromContext(r.Context())
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if userId := r.URL.Query().Get("login"); userId != "" {
+				store, _ = RotateSessionID(r.Context())
+				store.Set("userId", userId)
+			}
+			if userId, ok := store.Get("userId").(string); ok {
+				w.Write([]byte(userId))
+			}
+		}))
+
+		Convey("no session in context", func() {
+			_, err := FromContext(httptest.NewRequest("GET", "/", nil).Context())
+			So(err, ShouldEqual, ErrNoSessionInContext)
+		})
+
+		Convey("session is saved before the response is written", func() {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", "/?login=u1", nil))
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Body.String(), ShouldEqual, "u1")
+			sid := w.Header().Get(DEFAULT_SESSION_HEADER)
+			So(sid, ShouldNotBeEmpty)
+			So(w.Header().Get("Set-Cookie"), ShouldStartWith, "sid=")
+
+			Convey("session is read from the header", func() {
+				r := httptest.NewRequest("GET", "/", nil)
+				r.Header.Set(DEFAULT_SESSION_HEADER, sid)
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, r)
+				So(w.Body.String(), ShouldEqual, "u1")
+			})
+
+			Convey("session is read from the cookie", func() {
+				r := httptest.NewRequest("GET", "/", nil)
+				r.Header.Set("Cookie", w.Header().Get("Set-Cookie"))
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, r)
+				So(w.Body.String(), ShouldEqual, "u1")
+			})
+		})
+
+		Convey("no session is generated if it's not set", func() {
+			counting := &countingProvider{SessionProvider: cp}
+			handler := Middleware(&MiddlewareOption{Provider: counting, CookieName: "sid"})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				store, _ := FromContext(r.Context())
+				So(store.Get("userId"), ShouldBeNil)
+				So(store.SessionID(), ShouldNotBeEmpty)
+			}))
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+			So(counting.generated, ShouldEqual, 0)
+			So(w.Header().Get(DEFAULT_SESSION_HEADER), ShouldBeEmpty)
+			So(w.Header().Get("Set-Cookie"), ShouldBeEmpty)
+		})
+
+		Convey("session is generated and saved on the first set", func() {
+			counting := &countingProvider{SessionProvider: cp}
+			handler := Middleware(&MiddlewareOption{Provider: counting})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				store, _ := FromContext(r.Context())
+				sid := store.SessionID()
+				So(store.Set("userId", "u1"), ShouldBeNil)
+				So(store.Set("name", "tom"), ShouldBeNil)
+				So(store.SessionID(), ShouldEqual, sid)
+			}))
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+			So(counting.generated, ShouldEqual, 1)
+			So(w.Header().Get(DEFAULT_SESSION_HEADER), ShouldNotBeEmpty)
+		})
+	})
+}
+
+func TestRotateSessionID(t *testing.T) {
+	initTestLogger()
+	cp, err := newTestCookieProvider(&CookieSessionConfig{CookieKey: CookieKey{HashKey: "hash-key", BlockKey: "0123456789abcdef"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Convey("test sessions of other packages are not rotated", t, func() {
+		counting := &countingProvider{SessionProvider: cp}
+		store, err := cp.SessionGenerate(0, "sid")
+		So(err, ShouldBeNil)
+		So(store.Set("userId", "u1"), ShouldBeNil)
+		foreign := &foreignStore{store}
+		sc := &sessionContext{store: foreign, option: (&MiddlewareOption{Provider: counting}).withDefaults()}
+		ctx := context.WithValue(context.Background(), sessionContextKey{}, sc)
+
+		_, err = RotateSessionID(ctx)
+		So(err, ShouldEqual, ErrRegenerateNotSupported)
+		So(counting.generated, ShouldEqual, 0)
+		current, _ := FromContext(ctx)
+		So(current, ShouldEqual, foreign)
+		So(current.Get("userId"), ShouldEqual, "u1")
+	})
+}
+
+// foreignStore is a SessionStore of another package, which can't be regenerated nor read by this package
+type foreignStore struct {
+	SessionStore
+}
+
+// countingProvider counts the sessions generated by the provider
+type countingProvider struct {
+	SessionProvider
+	generated int
+}
+
+func (p *countingProvider) SessionGenerate(lifeTime int, sid string) (SessionStore, error) {
+	p.generated++
+	return p.SessionProvider.SessionGenerate(lifeTime, sid)
+}
@@ -4,18 +4,31 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/yiGmMk/pz-infra-new/log"
 	"github.com/yiGmMk/pz-infra-new/redisUtil"
 )
 
+// fields of the redis hash which stores a session
+const (
+	redisSessionValuesField   = "values"
+	redisSessionLifetimeField = "lifetime"
+	redisSessionCreatedField  = "created"
+)
+
 // redis session store
 type redisSessionStore struct {
-	sid         string
-	lock        sync.RWMutex
-	values      map[interface{}]interface{}
-	maxlifetime int //expire time in seconds
+	sid             string
+	lock            sync.RWMutex
+	values          map[interface{}]interface{}
+	maxlifetime     int       //idle expire time in seconds
+	absoluteTimeout int       //absolute expire time in seconds since created, 0 means no limit
+	created         time.Time //time the session was created
+	dirty           bool      //values changed since read or stored in a legacy serialization
+	legacy          bool      //stored in the old format of two string keys
 }
 
 // set value in redis session
@@ -23,6 +36,7 @@ func (rs *redisSessionStore) Set(key, value interface{}) error {
 	rs.lock.Lock()
 	defer rs.lock.Unlock()
 	rs.values[key] = value
+	rs.dirty = true
 	return nil
 }
 
@@ -41,7 +55,10 @@ func (rs *redisSessionStore) Get(key interface{}) interface{} {
 func (rs *redisSessionStore) Delete(key interface{}) error {
 	rs.lock.Lock()
 	defer rs.lock.Unlock()
-	delete(rs.values, key)
+	if _, ok := rs.values[key]; ok {
+		delete(rs.values, key)
+		rs.dirty = true
+	}
 	return nil
 }
 
@@ -50,6 +67,32 @@ func (rs *redisSessionStore) Flush() error {
 	rs.lock.Lock()
 	defer rs.lock.Unlock()
 	rs.values = make(map[interface{}]interface{})
+	rs.dirty = true
+	return nil
+}
+
+// copy all values of the session
+func (rs *redisSessionStore) getValues() map[interface{}]interface{} {
+	rs.lock.RLock()
+	defer rs.lock.RUnlock()
+	values := make(map[interface{}]interface{}, len(rs.values))
+	for k, v := range rs.values {
+		values[k] = v
+	}
+	return values
+}
+
+// rename the redis session to sid, a session not saved yet only changes its id
+func (rs *redisSessionStore) regenerate(sid string) error {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	if _, err := redisUtil.Rename(rs.sid, sid); err != nil {
+		return err
+	}
+	if rs.legacy {
+		redisUtil.Delete(getSesstionLifeTimeKey(rs.sid))
+	}
+	rs.sid = sid
 	return nil
 }
 
@@ -58,22 +101,46 @@ func (rs *redisSessionStore) SessionID() string {
 	return rs.sid
 }
 
-// save session values to redis
+// ttl returns seconds the session should live from now on
+func (rs *redisSessionStore) ttl(now time.Time) int {
+	return getSessionTTL(rs.created, rs.maxlifetime, rs.absoluteTimeout, now)
+}
+
+// save session values to redis if changed, otherwise only refresh its expire time
 func (rs *redisSessionStore) SessionRelease(httpResponseWriter http.ResponseWriter, sessionKey string) {
 	rs.lock.Lock()
 	defer rs.lock.Unlock()
 
-	b, err := EncodeGob(rs.values)
-	if err != nil {
+	ttl := rs.ttl(time.Now())
+	if ttl <= 0 {
+		if err := redisUtil.Delete(rs.sid); err != nil {
+			log.Error("Delete expired session from redis failed", err.Error())
+		}
 		return
 	}
-	values := string(b)
 
-	if err := redisUtil.SetStringWithExpire(rs.sid, values, rs.maxlifetime); err != nil {
-		log.Error("Set session values to redis failed", err.Error())
-	}
-	if err := redisUtil.SetStringWithExpire(getSesstionLifeTimeKey(rs.sid), strconv.Itoa(rs.maxlifetime), rs.maxlifetime); err != nil {
-		log.Error("Set session values to redis failed", err.Error())
+	if rs.dirty || rs.legacy {
+		b, err := EncodeSession(rs.values)
+		if err != nil {
+			log.Error("Encode session values failed", err.Error())
+			return
+		}
+		fields := map[string]string{
+			redisSessionValuesField:   string(b),
+			redisSessionLifetimeField: strconv.Itoa(rs.maxlifetime),
+			redisSessionCreatedField:  strconv.FormatInt(rs.created.Unix(), 10),
+		}
+		if err := redisUtil.ReplaceHashWithExpire(rs.sid, fields, ttl); err != nil {
+			log.Error("Set session values to redis failed", err.Error())
+			return
+		}
+		if rs.legacy {
+			redisUtil.Delete(getSesstionLifeTimeKey(rs.sid))
+			rs.legacy = false
+		}
+		rs.dirty = false
+	} else {
+		redisUtil.Expire(rs.sid, ttl)
 	}
 
 	if httpResponseWriter != nil {
@@ -83,51 +150,109 @@ func (rs *redisSessionStore) SessionRelease(httpResponseWriter http.ResponseWrit
 
 // redis session provider
 type redisSessionProvider struct {
+	config *SessionConfig
 }
 
-// init redis session
-func (rp *redisSessionProvider) SessionInit(savePath string) error {
+// init redis session with config of SessionConfig in JSON
+func (rp *redisSessionProvider) SessionInit(config string) error {
+	conf, err := parseSessionConfig(config)
+	if err != nil {
+		return err
+	}
+	rp.config = conf
 	return nil
 }
 
+func (rp *redisSessionProvider) getConfig() *SessionConfig {
+	if rp.config == nil {
+		rp.config, _ = parseSessionConfig("")
+	}
+	return rp.config
+}
+
+func (rp *redisSessionProvider) newStore(sid string, lifeTime int) *redisSessionStore {
+	if lifeTime <= 0 {
+		lifeTime = rp.getConfig().IdleTimeout
+	}
+	return &redisSessionStore{
+		sid:             sid,
+		values:          make(map[interface{}]interface{}),
+		maxlifetime:     lifeTime,
+		absoluteTimeout: rp.getConfig().AbsoluteTimeout,
+		created:         time.Now(),
+	}
+}
+
 // read redis session by sid
 func (rp *redisSessionProvider) SessionRead(sid string) (SessionStore, error) {
-	values, err := redisUtil.GetString(sid)
+	fields, err := redisUtil.GetHashStringMap(sid)
 	if err != nil {
+		if strings.HasPrefix(err.Error(), "WRONGTYPE") {
+			return rp.legacySessionRead(sid)
+		}
 		return nil, err
 	}
-	lifeTimeStr, err := redisUtil.GetString(getSesstionLifeTimeKey(sid))
-	if err != nil {
-		log.Warnf("Get lifetime of session %s failed, use 10 minutes by default", sid)
-		lifeTimeStr = strconv.Itoa(60 * 10)
-	}
-	if lifeTimeStr == "" {
-		log.Warnf("Get lifetime of session %s is empty, use 10 minutes by default", sid)
-		lifeTimeStr = strconv.Itoa(60 * 10)
+	if len(fields) == 0 {
+		return rp.newStore(sid, 0), nil
 	}
-	lifeTime, err := strconv.Atoi(lifeTimeStr)
+
+	lifeTime, err := strconv.Atoi(fields[redisSessionLifetimeField])
 	if err != nil {
 		log.Warnf("Get lifetime of session %s failed: %s", sid, err.Error())
 		return nil, err
 	}
+	rs := rp.newStore(sid, lifeTime)
+	if created, err := strconv.ParseInt(fields[redisSessionCreatedField], 10, 64); err == nil {
+		rs.created = time.Unix(created, 0)
+	}
+	if rs.ttl(time.Now()) <= 0 {
+		log.Infof("Session %s reached its absolute timeout", sid)
+		if err := redisUtil.Delete(sid); err != nil {
+			return nil, err
+		}
+		return rp.newStore(sid, lifeTime), nil
+	}
+	if values := fields[redisSessionValuesField]; len(values) > 0 {
+		if rs.values, rs.dirty, err = DecodeSession([]byte(values)); err != nil {
+			return nil, err
+		}
+	}
+	return rs, nil
+}
 
-	var kv map[interface{}]interface{}
-	if len(values) == 0 {
-		kv = make(map[interface{}]interface{})
-	} else {
-		kv, err = DecodeGob([]byte(values))
+// read session stored as the values key and the lifetime key, it's converted on release
+func (rp *redisSessionProvider) legacySessionRead(sid string) (SessionStore, error) {
+	values, err := redisUtil.GetString(sid)
+	if err != nil {
+		return nil, err
+	}
+	lifeTimeStr, err := redisUtil.GetString(getSesstionLifeTimeKey(sid))
+	if err != nil {
+		log.Warnf("Get lifetime of session %s failed, use default", sid)
+		lifeTimeStr = ""
+	}
+	lifeTime := 0
+	if lifeTimeStr != "" {
+		lifeTime, err = strconv.Atoi(lifeTimeStr)
 		if err != nil {
+			log.Warnf("Get lifetime of session %s failed: %s", sid, err.Error())
 			return nil, err
 		}
 	}
 
-	rs := &redisSessionStore{sid: sid, values: kv, maxlifetime: lifeTime}
+	rs := rp.newStore(sid, lifeTime)
+	rs.legacy = true
+	if len(values) > 0 {
+		if rs.values, _, err = DecodeSession([]byte(values)); err != nil {
+			return nil, err
+		}
+	}
 	return rs, nil
 }
 
 func (rp *redisSessionProvider) SessionGenerate(lifeTime int, sid string) (SessionStore, error) {
-	kv := make(map[interface{}]interface{})
-	rs := &redisSessionStore{sid: sid, values: kv, maxlifetime: lifeTime}
+	rs := rp.newStore(sid, lifeTime)
+	rs.dirty = true
 	return rs, nil
 }
 
@@ -138,6 +263,9 @@ func (rp *redisSessionProvider) SessionExist(sid string) bool {
 
 // delete redis session by id
 func (rp *redisSessionProvider) SessionDestroy(sid string) error {
+	if err := redisUtil.Delete(getSesstionLifeTimeKey(sid)); err != nil {
+		return err
+	}
 	return redisUtil.Delete(sid)
 }
 
@@ -0,0 +1,55 @@
+package session
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRedisSessionStore(t *testing.T) {
+	Convey("test redis session store", t, func() {
+		rp := &redisSessionProvider{}
+		So(rp.SessionInit(`{"idleTimeout":60,"absoluteTimeout":3600}`), ShouldBeNil)
+
+		Convey("generated session is dirty", func() {
+			store, err := rp.SessionGenerate(0, "sid")
+			So(err, ShouldBeNil)
+			rs := store.(*redisSessionStore)
+			So(rs.dirty, ShouldBeTrue)
+			So(rs.maxlifetime, ShouldEqual, 60)
+		})
+
+		Convey("only changes mark the session dirty", func() {
+			rs := rp.newStore("sid", 30)
+			So(rs.maxlifetime, ShouldEqual, 30)
+			So(rs.dirty, ShouldBeFalse)
+
+			rs.Get("key")
+			rs.Delete("key")
+			So(rs.dirty, ShouldBeFalse)
+
+			rs.Set("key", "value")
+			So(rs.dirty, ShouldBeTrue)
+		})
+
+		Convey("ttl is cut by absolute timeout", func() {
+			rs := rp.newStore("sid", 60)
+			now := time.Now()
+			So(rs.ttl(now), ShouldEqual, 60)
+
+			rs.created = now.Add(-3600*time.Second + 10*time.Second)
+			So(rs.ttl(now), ShouldEqual, 10)
+
+			rs.created = now.Add(-3601 * time.Second)
+			So(rs.ttl(now), ShouldBeLessThanOrEqualTo, 0)
+		})
+
+		Convey("no absolute timeout", func() {
+			So(rp.SessionInit(`{"idleTimeout":60}`), ShouldBeNil)
+			rs := rp.newStore("sid", 0)
+			rs.created = time.Now().Add(-24 * time.Hour)
+			So(rs.ttl(time.Now()), ShouldEqual, 60)
+		})
+	})
+}
@@ -0,0 +1,193 @@
+package session
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	. "github.com/yiGmMk/pz-infra-new/logging"
+)
+
+// reserved session keys
+const (
+	FINGERPRINT_SESSION_KEY = "_fingerprint"
+	ELEVATED_SESSION_KEY    = "_elevated_until"
+)
+
+const (
+	DEFAULT_IPV4_PREFIX_BITS = 24
+	DEFAULT_IPV6_PREFIX_BITS = 64
+)
+
+// fields of the fingerprint stored in FINGERPRINT_SESSION_KEY
+const (
+	fingerprintUserAgentField = "ua"
+	fingerprintIPField        = "ip"
+	fingerprintClientIdField  = "client"
+)
+
+var (
+	ErrSessionFingerprintMismatch = errors.New("session: fingerprint mismatch")
+	ErrRegenerateNotSupported     = errors.New("session: store does not support regenerate")
+)
+
+// BindingOption is used to bind sessions to the client which created them.
+// A request carrying a session bound to another client is rejected with ErrSessionFingerprintMismatch.
+type BindingOption struct {
+	UserAgent      bool   // bind to the hash of the User-Agent header
+	IP             bool   // bind to the network prefix of the client ip
+	IPv4PrefixBits int    // prefix length of ipv4 addresses, DEFAULT_IPV4_PREFIX_BITS if 0
+	IPv6PrefixBits int    // prefix length of ipv6 addresses, DEFAULT_IPV6_PREFIX_BITS if 0
+	TrustProxy     bool   // read the client ip from X-Forwarded-For or X-Real-IP
+	ClientIdHeader string // bind to the client id in this header, not bound if empty
+	// UserIdKey is the session key of the user id. If set, the client id of the request
+	// must also match the client id the session was registered with in Registry().
+	UserIdKey string
+}
+
+// Fingerprint identifies the client of a session
+type Fingerprint struct {
+	UserAgent string // hex of sha256 of the User-Agent header
+	IPPrefix  string
+	ClientId  string
+}
+
+// NewFingerprint returns the fingerprint of the request with the parts enabled in option
+func NewFingerprint(r *http.Request, option *BindingOption) *Fingerprint {
+	fp := &Fingerprint{}
+	if option == nil {
+		return fp
+	}
+	if option.UserAgent {
+		sum := sha256.Sum256([]byte(r.UserAgent()))
+		fp.UserAgent = hex.EncodeToString(sum[:])
+	}
+	if option.IP {
+		fp.IPPrefix = ipPrefix(clientIP(r, option.TrustProxy), option)
+	}
+	if option.ClientIdHeader != "" {
+		fp.ClientId = r.Header.Get(option.ClientIdHeader)
+	}
+	return fp
+}
+
+func (fp *Fingerprint) toMap() map[string]string {
+	return map[string]string{
+		fingerprintUserAgentField: fp.UserAgent,
+		fingerprintIPField:        fp.IPPrefix,
+		fingerprintClientIdField:  fp.ClientId,
+	}
+}
+
+func clientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+		if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+			return strings.TrimSpace(realIP)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func ipPrefix(addr string, option *BindingOption) string {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return addr
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		bits := option.IPv4PrefixBits
+		if bits <= 0 {
+			bits = DEFAULT_IPV4_PREFIX_BITS
+		}
+		return ip4.Mask(net.CIDRMask(bits, 32)).String()
+	}
+	bits := option.IPv6PrefixBits
+	if bits <= 0 {
+		bits = DEFAULT_IPV6_PREFIX_BITS
+	}
+	return ip.Mask(net.CIDRMask(bits, 128)).String()
+}
+
+// BindSession stores the fingerprint in the session
+func BindSession(store SessionStore, fp *Fingerprint) error {
+	return store.Set(FINGERPRINT_SESSION_KEY, fp.toMap())
+}
+
+// VerifySession checks the fingerprint against the one bound to the session,
+// returns ErrSessionFingerprintMismatch if they differ. A session not bound yet is bound to fp.
+func VerifySession(store SessionStore, fp *Fingerprint) error {
+	bound, ok := store.Get(FINGERPRINT_SESSION_KEY).(map[string]string)
+	if !ok {
+		return BindSession(store, fp)
+	}
+	for k, v := range fp.toMap() {
+		if bound[k] != v {
+			Log.Warn("Session fingerprint mismatch", With("sid", store.SessionID()), With("field", k))
+			return ErrSessionFingerprintMismatch
+		}
+	}
+	return nil
+}
+
+// verifyRegisteredClient checks the client id against the one the session was registered with
+func verifyRegisteredClient(store SessionStore, fp *Fingerprint, option *BindingOption) error {
+	if option.UserIdKey == "" || option.ClientIdHeader == "" {
+		return nil
+	}
+	userId, ok := store.Get(option.UserIdKey).(string)
+	if !ok || userId == "" {
+		return nil
+	}
+	sessions, err := Registry().ListUserSessions(userId)
+	if err != nil {
+		return err
+	}
+	for _, info := range sessions {
+		if info.SessionId == store.SessionID() && info.ClientId != "" && info.ClientId != fp.ClientId {
+			Log.Warn("Session client id mismatch", With("sid", store.SessionID()), With("userId", userId))
+			return ErrSessionFingerprintMismatch
+		}
+	}
+	return nil
+}
+
+// Regenerate moves the session to a new random id atomically, the values are kept.
+// Call it on privilege change, e.g. login, to prevent session fixation.
+func Regenerate(store SessionStore) error {
+	return regenerateSession(store, NewSessionID(DEFAULT_SID_LENGTH))
+}
+
+func regenerateSession(store SessionStore, sid string) error {
+	r, ok := store.(regenerator)
+	if !ok {
+		return ErrRegenerateNotSupported
+	}
+	return r.regenerate(sid)
+}
+
+// MarkElevated marks the session as recently authenticated for d,
+// use it after the user re-enters the password before sensitive operations.
+func MarkElevated(store SessionStore, d time.Duration) error {
+	return store.Set(ELEVATED_SESSION_KEY, time.Now().Add(d).Unix())
+}
+
+// IsElevated checks if the session is marked as elevated and not expired
+func IsElevated(store SessionStore) bool {
+	until, ok := store.Get(ELEVATED_SESSION_KEY).(int64)
+	return ok && time.Now().Unix() < until
+}
+
+// ClearElevated removes the elevated mark of the session
+func ClearElevated(store SessionStore) error {
+	return store.Delete(ELEVATED_SESSION_KEY)
+}
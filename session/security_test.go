@@ -0,0 +1,87 @@
+package session
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSessionBinding(t *testing.T) {
+	initTestLogger()
+	cp, err := newTestCookieProvider(&CookieSessionConfig{CookieKey: CookieKey{HashKey: "hash-key", BlockKey: "0123456789abcdef"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	middleware := Middleware(&MiddlewareOption{Provider: cp, Binding: &BindingOption{UserAgent: true, IP: true}})
+	// sessions are only saved once set
+	handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		store, _ := FromContext(r.Context())
+		store.Set("visited", true)
+	}))
+	newRequest := func(sid, userAgent, remoteAddr string) *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set(DEFAULT_SESSION_HEADER, sid)
+		r.Header.Set("User-Agent", userAgent)
+		r.RemoteAddr = remoteAddr
+		return r
+	}
+
+	Convey("test session binding", t, func() {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, newRequest("", "agent", "10.0.0.1:1234"))
+		sid := w.Header().Get(DEFAULT_SESSION_HEADER)
+		So(sid, ShouldNotBeEmpty)
+
+		Convey("same client in the same network", func() {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, newRequest(sid, "agent", "10.0.0.2:4321"))
+			So(w.Code, ShouldEqual, http.StatusOK)
+		})
+
+		Convey("another user agent", func() {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, newRequest(sid, "other", "10.0.0.1:1234"))
+			So(w.Code, ShouldEqual, http.StatusUnauthorized)
+		})
+
+		Convey("another network", func() {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, newRequest(sid, "agent", "10.0.1.1:1234"))
+			So(w.Code, ShouldEqual, http.StatusUnauthorized)
+		})
+	})
+
+	Convey("test ip prefix", t, func() {
+		So(ipPrefix("192.168.1.100", &BindingOption{}), ShouldEqual, "192.168.1.0")
+		So(ipPrefix("192.168.1.100", &BindingOption{IPv4PrefixBits: 16}), ShouldEqual, "192.168.0.0")
+		So(ipPrefix("2001:db8:1:2:3:4:5:6", &BindingOption{}), ShouldEqual, "2001:db8:1:2::")
+	})
+}
+
+func TestElevatedSession(t *testing.T) {
+	initTestLogger()
+	cp, err := newTestCookieProvider(&CookieSessionConfig{CookieKey: CookieKey{HashKey: "hash-key", BlockKey: "0123456789abcdef"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Convey("test elevated session", t, func() {
+		store, err := cp.SessionGenerate(0, "")
+		So(err, ShouldBeNil)
+		So(IsElevated(store), ShouldBeFalse)
+
+		So(MarkElevated(store, time.Minute), ShouldBeNil)
+		So(IsElevated(store), ShouldBeTrue)
+		So(Regenerate(store), ShouldBeNil)
+		So(IsElevated(store), ShouldBeTrue)
+
+		So(ClearElevated(store), ShouldBeNil)
+		So(IsElevated(store), ShouldBeFalse)
+
+		So(MarkElevated(store, -time.Second), ShouldBeNil)
+		So(IsElevated(store), ShouldBeFalse)
+	})
+}
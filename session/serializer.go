@@ -0,0 +1,469 @@
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+// Session payloads are prefixed by a header of
+//
+//	SERIALIZER_MAGIC | SERIALIZER_VERSION | format of the Serializer
+//
+// SERIALIZER_MAGIC never starts a gob stream, so payloads without it are decoded as legacy gob.
+// SERIALIZER_GOB, the default, writes the legacy gob payloads without the header, so the sessions are
+// readable by the versions before. JSON and msgpack are opt-in, see SetSerializer.
+const (
+	SERIALIZER_MAGIC   byte = 0xF0
+	SERIALIZER_VERSION byte = 1
+
+	SERIALIZER_JSON    = "json"
+	SERIALIZER_MSGPACK = "msgpack"
+	SERIALIZER_GOB     = "gob"
+)
+
+var (
+	ErrUnsupportedSessionKey     = errors.New("session: key must be a string")
+	ErrUnknownSessionFormat      = errors.New("session: unknown payload format")
+	ErrUnsupportedSessionVersion = errors.New("session: unsupported payload version")
+)
+
+// Serializer encodes session values to a payload and decodes it back
+type Serializer interface {
+	// Format identifies the serializer in the payload header, it must be unique
+	Format() byte
+	Marshal(values map[interface{}]interface{}) ([]byte, error)
+	Unmarshal(data []byte) (map[interface{}]interface{}, error)
+}
+
+var (
+	serializersMu sync.RWMutex
+	serializers   = map[string]Serializer{
+		SERIALIZER_JSON:    jsonSerializer{},
+		SERIALIZER_MSGPACK: msgpackSerializer{},
+		SERIALIZER_GOB:     gobSerializer{},
+	}
+	sessionSerializer Serializer = gobSerializer{}
+)
+
+// RegisterSerializer makes a serializer available by name.
+// If RegisterSerializer is called twice with the same name or format, it panics.
+func RegisterSerializer(name string, s Serializer) {
+	serializersMu.Lock()
+	defer serializersMu.Unlock()
+	if s == nil {
+		panic("session: RegisterSerializer serializer is nil")
+	}
+	for n, registered := range serializers {
+		if n == name || registered.Format() == s.Format() {
+			panic("session: RegisterSerializer called twice for serializer " + name)
+		}
+	}
+	serializers[name] = s
+}
+
+// SetSerializer sets the serializer used to encode sessions by name, payloads of all registered
+// serializers are always decodable. Sessions are rewritten with it when they are changed, or read
+// by the redis and database providers. Note that only strings are supported as keys by JSON and msgpack,
+// and values of types not listed by DecodeValue come back as generic JSON values.
+func SetSerializer(name string) error {
+	serializersMu.Lock()
+	defer serializersMu.Unlock()
+	s, ok := serializers[name]
+	if !ok {
+		return fmt.Errorf("session: unknown serializer %s", name)
+	}
+	sessionSerializer = s
+	return nil
+}
+
+func getSerializer(format byte) (Serializer, bool) {
+	serializersMu.RLock()
+	defer serializersMu.RUnlock()
+	for _, s := range serializers {
+		if s.Format() == format {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+// EncodeSession encodes values with the current serializer prefixed by the version header,
+// gob payloads are written without the header as before
+func EncodeSession(values map[interface{}]interface{}) ([]byte, error) {
+	serializersMu.RLock()
+	s := sessionSerializer
+	serializersMu.RUnlock()
+	if _, ok := s.(gobSerializer); ok {
+		return s.Marshal(values)
+	}
+	b, err := s.Marshal(values)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{SERIALIZER_MAGIC, SERIALIZER_VERSION, s.Format()}, b...), nil
+}
+
+// DecodeSession decodes a payload of EncodeSession or a legacy gob payload,
+// legacy is true if the payload should be rewritten with the current serializer.
+func DecodeSession(data []byte) (values map[interface{}]interface{}, legacy bool, err error) {
+	if len(data) == 0 || data[0] != SERIALIZER_MAGIC {
+		values, err = DecodeGob(data)
+		serializersMu.RLock()
+		_, gob := sessionSerializer.(gobSerializer)
+		serializersMu.RUnlock()
+		return values, !gob, err
+	}
+	if len(data) < 3 {
+		return nil, false, ErrUnknownSessionFormat
+	}
+	if data[1] != SERIALIZER_VERSION {
+		return nil, false, ErrUnsupportedSessionVersion
+	}
+	s, ok := getSerializer(data[2])
+	if !ok {
+		return nil, false, ErrUnknownSessionFormat
+	}
+	values, err = s.Unmarshal(data[3:])
+	if err != nil {
+		return nil, false, err
+	}
+	serializersMu.RLock()
+	legacy = s.Format() != sessionSerializer.Format()
+	serializersMu.RUnlock()
+	return values, legacy, nil
+}
+
+// MigrateSession rewrites a payload with the current serializer,
+// migrated is false if the payload is already in the current format.
+func MigrateSession(data []byte) (payload []byte, migrated bool, err error) {
+	values, legacy, err := DecodeSession(data)
+	if err != nil {
+		return nil, false, err
+	}
+	if !legacy {
+		return data, false, nil
+	}
+	payload, err = EncodeSession(values)
+	return payload, err == nil, err
+}
+
+// DecodeValue converts a value read from a session to out, e.g. a struct, by a JSON round trip, so out gets
+// the same value whichever format the session payload is in:
+//   - gob without the header, the values come back as the types set, e.g. the struct itself
+//   - SERIALIZER_MAGIC (0xF0) and SERIALIZER_VERSION followed by the JSON or msgpack encoding, values of
+//     types other than string, bool, int, int64, float64, time.Time, []byte, []string and map[string]string
+//     come back as generic JSON values, i.e. map[string]interface{}, []interface{} and float64 numbers
+//
+// out must be a pointer, as for json.Unmarshal.
+func DecodeValue(value interface{}, out interface{}) error {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, out)
+}
+
+// kinds of typed session values
+const (
+	kindString    = "s"
+	kindBool      = "b"
+	kindInt       = "i"
+	kindInt64     = "i64"
+	kindFloat64   = "f"
+	kindTime      = "t"
+	kindBytes     = "bs"
+	kindStrings   = "ss"
+	kindStringMap = "ms"
+	kindJSON      = "j"
+)
+
+func valueKind(v interface{}) string {
+	switch v.(type) {
+	case string:
+		return kindString
+	case bool:
+		return kindBool
+	case int:
+		return kindInt
+	case int64:
+		return kindInt64
+	case float64:
+		return kindFloat64
+	case time.Time:
+		return kindTime
+	case []byte:
+		return kindBytes
+	case []string:
+		return kindStrings
+	case map[string]string:
+		return kindStringMap
+	default:
+		return kindJSON
+	}
+}
+
+func stringKey(k interface{}) (string, error) {
+	key, ok := k.(string)
+	if !ok {
+		return "", fmt.Errorf("%w: %v(%T)", ErrUnsupportedSessionKey, k, k)
+	}
+	return key, nil
+}
+
+// jsonSerializer encodes values as {"key": {"t": kind, "v": value}}
+type jsonSerializer struct{}
+
+type jsonValue struct {
+	Kind  string          `json:"t"`
+	Value json.RawMessage `json:"v"`
+}
+
+func (jsonSerializer) Format() byte {
+	return 'j'
+}
+
+func (jsonSerializer) Marshal(values map[interface{}]interface{}) ([]byte, error) {
+	m := make(map[string]jsonValue, len(values))
+	for k, v := range values {
+		key, err := stringKey(k)
+		if err != nil {
+			return nil, err
+		}
+		kind := valueKind(v)
+		if kind == kindTime {
+			v = v.(time.Time).Format(time.RFC3339Nano)
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, fmt.Errorf("session: failed to encode %s: %v", key, err)
+		}
+		m[key] = jsonValue{Kind: kind, Value: b}
+	}
+	return json.Marshal(m)
+}
+
+func (jsonSerializer) Unmarshal(data []byte) (map[interface{}]interface{}, error) {
+	var m map[string]jsonValue
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	values := make(map[interface{}]interface{}, len(m))
+	for key, jv := range m {
+		var err error
+		switch jv.Kind {
+		case kindString:
+			var v string
+			err = json.Unmarshal(jv.Value, &v)
+			values[key] = v
+		case kindBool:
+			var v bool
+			err = json.Unmarshal(jv.Value, &v)
+			values[key] = v
+		case kindInt:
+			var v int
+			err = json.Unmarshal(jv.Value, &v)
+			values[key] = v
+		case kindInt64:
+			var v int64
+			err = json.Unmarshal(jv.Value, &v)
+			values[key] = v
+		case kindFloat64:
+			var v float64
+			err = json.Unmarshal(jv.Value, &v)
+			values[key] = v
+		case kindTime:
+			var s string
+			if err = json.Unmarshal(jv.Value, &s); err == nil {
+				values[key], err = time.Parse(time.RFC3339Nano, s)
+			}
+		case kindBytes:
+			var v []byte
+			err = json.Unmarshal(jv.Value, &v)
+			values[key] = v
+		case kindStrings:
+			var v []string
+			err = json.Unmarshal(jv.Value, &v)
+			values[key] = v
+		case kindStringMap:
+			var v map[string]string
+			err = json.Unmarshal(jv.Value, &v)
+			values[key] = v
+		default:
+			var v interface{}
+			err = json.Unmarshal(jv.Value, &v)
+			values[key] = v
+		}
+		if err != nil {
+			return nil, fmt.Errorf("session: failed to decode %s: %v", key, err)
+		}
+	}
+	return values, nil
+}
+
+// msgpackSerializer encodes values as a msgpack map of key to [kind, value]
+type msgpackSerializer struct{}
+
+func (msgpackSerializer) Format() byte {
+	return 'm'
+}
+
+func (msgpackSerializer) Marshal(values map[interface{}]interface{}) ([]byte, error) {
+	b := msgp.AppendMapHeader(nil, uint32(len(values)))
+	for k, v := range values {
+		key, err := stringKey(k)
+		if err != nil {
+			return nil, err
+		}
+		kind := valueKind(v)
+		b = msgp.AppendString(b, key)
+		b = msgp.AppendArrayHeader(b, 2)
+		b = msgp.AppendString(b, kind)
+		switch kind {
+		case kindString:
+			b = msgp.AppendString(b, v.(string))
+		case kindBool:
+			b = msgp.AppendBool(b, v.(bool))
+		case kindInt:
+			b = msgp.AppendInt(b, v.(int))
+		case kindInt64:
+			b = msgp.AppendInt64(b, v.(int64))
+		case kindFloat64:
+			b = msgp.AppendFloat64(b, v.(float64))
+		case kindTime:
+			b = msgp.AppendString(b, v.(time.Time).Format(time.RFC3339Nano))
+		case kindBytes:
+			b = msgp.AppendBytes(b, v.([]byte))
+		case kindStrings:
+			ss := v.([]string)
+			b = msgp.AppendArrayHeader(b, uint32(len(ss)))
+			for _, s := range ss {
+				b = msgp.AppendString(b, s)
+			}
+		case kindStringMap:
+			ms := v.(map[string]string)
+			b = msgp.AppendMapHeader(b, uint32(len(ms)))
+			for mk, mv := range ms {
+				b = msgp.AppendString(b, mk)
+				b = msgp.AppendString(b, mv)
+			}
+		default:
+			js, err := json.Marshal(v)
+			if err != nil {
+				return nil, fmt.Errorf("session: failed to encode %s: %v", key, err)
+			}
+			b = msgp.AppendBytes(b, js)
+		}
+	}
+	return b, nil
+}
+
+func (msgpackSerializer) Unmarshal(data []byte) (map[interface{}]interface{}, error) {
+	n, b, err := msgp.ReadMapHeaderBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[interface{}]interface{}, n)
+	for i := uint32(0); i < n; i++ {
+		var key, kind string
+		if key, b, err = msgp.ReadStringBytes(b); err != nil {
+			return nil, err
+		}
+		var sz uint32
+		if sz, b, err = msgp.ReadArrayHeaderBytes(b); err != nil {
+			return nil, err
+		}
+		if sz != 2 {
+			return nil, fmt.Errorf("session: invalid value of %s", key)
+		}
+		if kind, b, err = msgp.ReadStringBytes(b); err != nil {
+			return nil, err
+		}
+		var v interface{}
+		if v, b, err = readMsgpackValue(kind, b); err != nil {
+			return nil, fmt.Errorf("session: failed to decode %s: %v", key, err)
+		}
+		values[key] = v
+	}
+	return values, nil
+}
+
+func readMsgpackValue(kind string, b []byte) (interface{}, []byte, error) {
+	switch kind {
+	case kindString:
+		return msgp.ReadStringBytes(b)
+	case kindBool:
+		return msgp.ReadBoolBytes(b)
+	case kindInt:
+		return msgp.ReadIntBytes(b)
+	case kindInt64:
+		return msgp.ReadInt64Bytes(b)
+	case kindFloat64:
+		return msgp.ReadFloat64Bytes(b)
+	case kindTime:
+		s, o, err := msgp.ReadStringBytes(b)
+		if err != nil {
+			return nil, o, err
+		}
+		t, err := time.Parse(time.RFC3339Nano, s)
+		return t, o, err
+	case kindBytes:
+		return msgp.ReadBytesBytes(b, nil)
+	case kindStrings:
+		n, o, err := msgp.ReadArrayHeaderBytes(b)
+		if err != nil {
+			return nil, o, err
+		}
+		ss := make([]string, n)
+		for i := range ss {
+			if ss[i], o, err = msgp.ReadStringBytes(o); err != nil {
+				return nil, o, err
+			}
+		}
+		return ss, o, nil
+	case kindStringMap:
+		n, o, err := msgp.ReadMapHeaderBytes(b)
+		if err != nil {
+			return nil, o, err
+		}
+		ms := make(map[string]string, n)
+		for i := uint32(0); i < n; i++ {
+			var mk, mv string
+			if mk, o, err = msgp.ReadStringBytes(o); err != nil {
+				return nil, o, err
+			}
+			if mv, o, err = msgp.ReadStringBytes(o); err != nil {
+				return nil, o, err
+			}
+			ms[mk] = mv
+		}
+		return ms, o, nil
+	default:
+		js, o, err := msgp.ReadBytesBytes(b, nil)
+		if err != nil {
+			return nil, o, err
+		}
+		var v interface{}
+		err = json.Unmarshal(js, &v)
+		return v, o, err
+	}
+}
+
+// gobSerializer is the legacy format, values of unregistered types fail to decode
+type gobSerializer struct{}
+
+func (gobSerializer) Format() byte {
+	return 'g'
+}
+
+func (gobSerializer) Marshal(values map[interface{}]interface{}) ([]byte, error) {
+	return EncodeGob(values)
+}
+
+func (gobSerializer) Unmarshal(data []byte) (map[interface{}]interface{}, error) {
+	return DecodeGob(data)
+}
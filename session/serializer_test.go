@@ -0,0 +1,113 @@
+package session
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type testProfile struct {
+	Name string `json:"name"`
+	Age  int    `json:"age"`
+}
+
+func TestSerializer(t *testing.T) {
+	now := time.Now().Round(time.Millisecond)
+	values := map[interface{}]interface{}{
+		"string":  "value",
+		"bool":    true,
+		"int":     42,
+		"int64":   int64(1) << 40,
+		"float64": 3.14,
+		"time":    now,
+		"bytes":   []byte("raw"),
+		"strings": []string{"a", "b"},
+		"map":     map[string]string{"k": "v"},
+		"profile": testProfile{Name: "tom", Age: 18},
+	}
+
+	for _, name := range []string{SERIALIZER_JSON, SERIALIZER_MSGPACK} {
+		Convey("test serializer "+name, t, func() {
+			So(SetSerializer(name), ShouldBeNil)
+			defer SetSerializer(SERIALIZER_GOB)
+
+			payload, err := EncodeSession(values)
+			So(err, ShouldBeNil)
+			So(payload[0], ShouldEqual, SERIALIZER_MAGIC)
+			So(payload[1], ShouldEqual, SERIALIZER_VERSION)
+
+			decoded, legacy, err := DecodeSession(payload)
+			So(err, ShouldBeNil)
+			So(legacy, ShouldBeFalse)
+			So(decoded["string"], ShouldEqual, "value")
+			So(decoded["bool"], ShouldEqual, true)
+			So(decoded["int"], ShouldEqual, 42)
+			So(decoded["int64"], ShouldEqual, int64(1)<<40)
+			So(decoded["float64"], ShouldEqual, 3.14)
+			So(decoded["time"].(time.Time).Equal(now), ShouldBeTrue)
+			So(decoded["bytes"], ShouldResemble, []byte("raw"))
+			So(decoded["strings"], ShouldResemble, []string{"a", "b"})
+			So(decoded["map"], ShouldResemble, map[string]string{"k": "v"})
+
+			var profile testProfile
+			So(DecodeValue(decoded["profile"], &profile), ShouldBeNil)
+			So(profile, ShouldResemble, testProfile{Name: "tom", Age: 18})
+		})
+	}
+
+	Convey("test default gob serializer", t, func() {
+		values := map[interface{}]interface{}{"userId": "u1", 1: testProfile{Name: "tom", Age: 18}}
+		payload, err := EncodeSession(values)
+		So(err, ShouldBeNil)
+		So(payload[0], ShouldNotEqual, SERIALIZER_MAGIC)
+		legacy, err := DecodeGob(payload)
+		So(err, ShouldBeNil)
+		So(legacy, ShouldResemble, values)
+
+		decoded, migrate, err := DecodeSession(payload)
+		So(err, ShouldBeNil)
+		So(migrate, ShouldBeFalse)
+		So(decoded, ShouldResemble, values)
+	})
+
+	Convey("test serializer errors", t, func() {
+		So(SetSerializer(SERIALIZER_JSON), ShouldBeNil)
+		defer SetSerializer(SERIALIZER_GOB)
+		_, err := EncodeSession(map[interface{}]interface{}{1: "value"})
+		So(errors.Is(err, ErrUnsupportedSessionKey), ShouldBeTrue)
+
+		_, _, err = DecodeSession([]byte{SERIALIZER_MAGIC, SERIALIZER_VERSION + 1, 'j'})
+		So(err, ShouldEqual, ErrUnsupportedSessionVersion)
+
+		_, _, err = DecodeSession([]byte{SERIALIZER_MAGIC, SERIALIZER_VERSION, 'x'})
+		So(err, ShouldEqual, ErrUnknownSessionFormat)
+	})
+
+	Convey("test migrate legacy gob payload", t, func() {
+		So(SetSerializer(SERIALIZER_JSON), ShouldBeNil)
+		defer SetSerializer(SERIALIZER_GOB)
+		old, err := EncodeGob(map[interface{}]interface{}{"userId": "u1", "count": 3})
+		So(err, ShouldBeNil)
+
+		decoded, legacy, err := DecodeSession(old)
+		So(err, ShouldBeNil)
+		So(legacy, ShouldBeTrue)
+		So(decoded["userId"], ShouldEqual, "u1")
+
+		payload, migrated, err := MigrateSession(old)
+		So(err, ShouldBeNil)
+		So(migrated, ShouldBeTrue)
+		So(payload[0], ShouldEqual, SERIALIZER_MAGIC)
+
+		decoded, legacy, err = DecodeSession(payload)
+		So(err, ShouldBeNil)
+		So(legacy, ShouldBeFalse)
+		So(decoded["count"], ShouldEqual, 3)
+
+		_, migrated, err = MigrateSession(payload)
+		So(err, ShouldBeNil)
+		So(migrated, ShouldBeFalse)
+	})
+}
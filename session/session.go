@@ -1,8 +1,10 @@
 package session
 
 import (
+	"encoding/json"
 	"net/http"
 	"sync"
+	"time"
 
 	. "github.com/yiGmMk/pz-infra-new/logging"
 
@@ -19,6 +21,16 @@ type SessionStore interface {
 	Flush() error                                     //delete all data
 }
 
+// valuesStore is implemented by the SessionStores of this package to copy all values of a session
+type valuesStore interface {
+	getValues() map[interface{}]interface{}
+}
+
+// regenerator is implemented by the SessionStores of this package to move a session to a new id atomically
+type regenerator interface {
+	regenerate(sid string) error
+}
+
 // Provider contains global session methods and saved SessionStores.
 // it can operate a SessionStore by its id.
 type SessionProvider interface {
@@ -32,6 +44,56 @@ type SessionProvider interface {
 	SessionGC()
 }
 
+const (
+	DEFAULT_SESSION_IDLE_TIMEOUT = 60 * 10
+)
+
+// SessionConfig is passed to SessionProvider.SessionInit encoded as JSON
+type SessionConfig struct {
+	// IdleTimeout in seconds, the session expires if not accessed within it.
+	// It's used when SessionGenerate is called with a non-positive lifeTime.
+	IdleTimeout int `json:"idleTimeout"`
+	// AbsoluteTimeout in seconds, the session expires after it since created
+	// no matter how often it's accessed. 0 means no limit.
+	AbsoluteTimeout int `json:"absoluteTimeout"`
+}
+
+func getSessionConfig() *SessionConfig {
+	return &SessionConfig{
+		IdleTimeout:     beego.AppConfig.DefaultInt("sessionIdleTimeout", DEFAULT_SESSION_IDLE_TIMEOUT),
+		AbsoluteTimeout: beego.AppConfig.DefaultInt("sessionAbsoluteTimeout", 0),
+	}
+}
+
+func parseSessionConfig(config string) (*SessionConfig, error) {
+	conf := &SessionConfig{}
+	if config != "" {
+		if err := json.Unmarshal([]byte(config), conf); err != nil {
+			return nil, err
+		}
+	}
+	if conf.IdleTimeout <= 0 {
+		conf.IdleTimeout = DEFAULT_SESSION_IDLE_TIMEOUT
+	}
+	if conf.AbsoluteTimeout < 0 {
+		conf.AbsoluteTimeout = 0
+	}
+	return conf, nil
+}
+
+// getSessionTTL returns seconds a session should live from now on,
+// the idle timeout is cut by the absolute timeout.
+func getSessionTTL(created time.Time, idleTimeout, absoluteTimeout int, now time.Time) int {
+	ttl := idleTimeout
+	if absoluteTimeout > 0 {
+		remain := int(created.Add(time.Duration(absoluteTimeout)*time.Second).Sub(now) / time.Second)
+		if remain < ttl {
+			ttl = remain
+		}
+	}
+	return ttl
+}
+
 type session struct {
 	sid    string
 	values map[interface{}]interface{}
@@ -41,15 +103,27 @@ var provider SessionProvider
 var initializer = &sync.Once{}
 
 func initialize() {
+	var conf interface{} = getSessionConfig()
 	providerName := beego.AppConfig.String("sessionProvider")
 	switch providerName {
 	case "redis":
 		provider = new(redisSessionProvider)
-		provider.SessionInit("")
+	case "cookie":
+		provider = new(cookieSessionProvider)
+		conf = getCookieSessionConfig()
+	case "mysql", "database":
+		provider = new(databaseSessionProvider)
+		conf = getDatabaseSessionConfig()
 	default:
 		Log.Info("Missing session provider configuration. Use redis instead")
 		provider = new(redisSessionProvider)
-		provider.SessionInit("")
+	}
+	if err := SetSerializer(beego.AppConfig.DefaultString("sessionSerializer", SERIALIZER_GOB)); err != nil {
+		Log.Error("Failed to set session serializer, use gob instead", WithError(err))
+	}
+	config, _ := json.Marshal(conf)
+	if err := provider.SessionInit(string(config)); err != nil {
+		Log.Error("Failed to init session provider", With("provider", providerName), WithError(err))
 	}
 }
 
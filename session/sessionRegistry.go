@@ -1,14 +1,24 @@
 package session
 
 import (
+	"encoding/json"
+	"sort"
 	"sync"
+	"time"
 
 	. "github.com/yiGmMk/pz-infra-new/logging"
 	"github.com/yiGmMk/pz-infra-new/redisUtil"
+
+	"github.com/astaxie/beego"
+	"github.com/garyburd/redigo/redis"
 )
 
 const (
+	// Deprecated: a single session per user was registered under this prefix,
+	// sessions are registered under SESSION_REGISTRY_LIST_KEY_PREFIX now.
 	SESSION_REGISTRY_KEY_PREFIX = "SESSION_REG_PREFIX_"
+	// hash of session id to SessionInfo in JSON
+	SESSION_REGISTRY_LIST_KEY_PREFIX = "SESSION_REG_LIST_PREFIX_"
 )
 
 // Provider contains global session Registry Method,
@@ -16,8 +26,31 @@ const (
 type SessionRegistry interface {
 	// Registry User Session When Create Session
 	SessionRegistry(userId, clientId, sessionId string, lifeTime int) error
-	// Find Registry User Session
+	// Registry User Session with device info When Create Session,
+	// the oldest sessions are revoked if the user exceeds the max concurrent sessions.
+	RegisterSession(info *SessionInfo, lifeTime int) error
+	// Find the latest Registry User Session
 	GetUserSession(userId string) (sessionId, clientId string, err error)
+	// List all active sessions of the user, the latest first
+	ListUserSessions(userId string) ([]*SessionInfo, error)
+	// Update last seen time of the session and extend its lifetime if lifeTime > 0
+	TouchUserSession(userId, sessionId string, lifeTime int) error
+	// Unregister the session and destroy it
+	RevokeUserSession(userId, sessionId string) error
+	// Unregister all sessions of the user and destroy them
+	RevokeUserSessions(userId string) error
+}
+
+// SessionInfo describes a session of a user on one device
+type SessionInfo struct {
+	UserId     string    `json:"user_id"`
+	ClientId   string    `json:"client_id"`
+	SessionId  string    `json:"session_id"`
+	Device     string    `json:"device"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
 }
 
 var registry SessionRegistry
@@ -26,46 +59,341 @@ var registryOnce = &sync.Once{}
 func Registry() SessionRegistry {
 	registryOnce.Do(func() {
 		if registry == nil {
-			registry = new(redisSessionRegistry)
+			registry = &redisSessionRegistry{
+				maxSessions: beego.AppConfig.DefaultInt("sessionMaxConcurrent", 0),
+			}
 		}
 	})
 	return registry
 }
 
-type registryObject struct {
-	UserId    string `json:"user_id"`
-	ClientId  string `json:"client_id"`
-	SessionId string `json:"session_id"`
-}
-
 type redisSessionRegistry struct {
+	maxSessions int // max concurrent sessions per user, 0 means no limit
 }
 
 // Registry User Session When Create Session
 func (r *redisSessionRegistry) SessionRegistry(userId, clientId, sessionId string, lifeTime int) error {
-	registry := registryObject{
+	return r.RegisterSession(&SessionInfo{
 		UserId:    userId,
 		ClientId:  clientId,
 		SessionId: sessionId,
+	}, lifeTime)
+}
+
+// registryEntry is the value of a session in the registry hash, the times in milliseconds are read by the scripts
+type registryEntry struct {
+	*SessionInfo
+	CreatedAtMs int64 `json:"created_at_ms"`
+	ExpiresAtMs int64 `json:"expires_at_ms"`
+}
+
+func encodeRegistryEntry(info *SessionInfo) (string, error) {
+	bs, err := json.Marshal(&registryEntry{
+		SessionInfo: info,
+		CreatedAtMs: toMillis(info.CreatedAt),
+		ExpiresAtMs: toMillis(info.ExpiresAt),
+	})
+	return string(bs), err
+}
+
+func toMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// registerScript removes the expired sessions, evicts the oldest ones exceeding the max concurrent sessions,
+// and saves the session at once, so concurrent logins can't exceed the limit. Returns the evicted session ids.
+// KEYS[1] is the registry hash, ARGV are the session id, the entry, now and the expire time in ms, and the max sessions.
+var registerScript = redis.NewScript(1, `
+local now = tonumber(ARGV[3])
+local expiresAt = tonumber(ARGV[4])
+local max = tonumber(ARGV[5])
+local values = redis.call("HGETALL", KEYS[1])
+local sessions = {}
+for i = 1, #values, 2 do
+	local sid = values[i]
+	if sid ~= ARGV[1] then
+		local ok, entry = pcall(cjson.decode, values[i + 1])
+		if not ok or type(entry) ~= "table" or (type(entry.expires_at_ms) == "number" and entry.expires_at_ms <= now) then
+			redis.call("HDEL", KEYS[1], sid)
+		else
+			local created = 0
+			if type(entry.created_at_ms) == "number" then
+				created = entry.created_at_ms
+			end
+			table.insert(sessions, {sid = sid, created = created, expires = entry.expires_at_ms})
+		end
+	end
+end
+local evicted = {}
+local first = 1
+if max > 0 and #sessions >= max then
+	table.sort(sessions, function(a, b) return a.created < b.created end)
+	first = #sessions - max + 2
+	for i = 1, first - 1 do
+		redis.call("HDEL", KEYS[1], sessions[i].sid)
+		table.insert(evicted, sessions[i].sid)
+	end
+end
+local keepUntil = expiresAt
+for i = first, #sessions do
+	local expires = sessions[i].expires
+	if type(expires) ~= "number" then
+		-- written without the expire time, keep the key as long as it lives
+		local ttl = redis.call("PTTL", KEYS[1])
+		if ttl > 0 then
+			expires = now + ttl
+		else
+			expires = 0
+		end
+	end
+	if expires > keepUntil then
+		keepUntil = expires
+	end
+end
+redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+redis.call("PEXPIRE", KEYS[1], string.format("%d", math.max(keepUntil - now, 1)))
+return evicted
+`)
+
+// Registry User Session with device info When Create Session
+func (r *redisSessionRegistry) RegisterSession(info *SessionInfo, lifeTime int) error {
+	if err := r.migrateLegacySession(info.UserId); err != nil {
+		return err
+	}
+	now := time.Now()
+	if info.CreatedAt.IsZero() {
+		info.CreatedAt = now
+	}
+	info.LastSeenAt = now
+	info.ExpiresAt = now.Add(time.Duration(lifeTime) * time.Second)
+	entry, err := encodeRegistryEntry(info)
+	if err != nil {
+		return err
 	}
-	return redisUtil.SetObjectWithExpire(r.getRegistryKey(userId), &registry, lifeTime)
+
+	conn := redisUtil.GetPool().Get()
+	evicted, err := redis.Strings(registerScript.Do(conn, r.getRegistryKey(info.UserId),
+		info.SessionId, entry, toMillis(now), toMillis(info.ExpiresAt), r.maxSessions))
+	conn.Close()
+	if err != nil {
+		Log.Error("Failed to Register User Session", With("userId", info.UserId), With("sessionId", info.SessionId), WithError(err))
+		return err
+	}
+	for _, sessionId := range evicted {
+		Log.Info("Evict user session exceeding max concurrent sessions",
+			With("userId", info.UserId), With("sessionId", sessionId), With("max", r.maxSessions))
+		if err := Provider().SessionDestroy(sessionId); err != nil {
+			Log.Error("Failed to Destroy Evicted Session", With("userId", info.UserId), With("sessionId", sessionId), WithError(err))
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateScript moves the legacy session into the registry hash if it's not migrated yet.
+// KEYS[1] is the legacy key, KEYS[2] the registry hash, ARGV are the session id, the entry and its ttl in ms.
+var migrateScript = redis.NewScript(2, `
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+redis.call("HSETNX", KEYS[2], ARGV[1], ARGV[2])
+local ttl = redis.call("PTTL", KEYS[2])
+if ttl ~= -1 and ttl < tonumber(ARGV[3]) then
+	redis.call("PEXPIRE", KEYS[2], ARGV[3])
+end
+redis.call("DEL", KEYS[1])
+return 1
+`)
+
+// migrateLegacySession moves the session registered under SESSION_REGISTRY_KEY_PREFIX before multiple
+// sessions per user were supported into the registry hash, so it's listed and counted until it expires
+func (r *redisSessionRegistry) migrateLegacySession(userId string) error {
+	legacyKey := SESSION_REGISTRY_KEY_PREFIX + userId
+	conn := redisUtil.GetPool().Get()
+	defer conn.Close()
+	fields, err := redis.StringMap(conn.Do("HGETALL", legacyKey))
+	if err != nil {
+		Log.Error("Failed to Read Legacy User Session Registry", With("userId", userId), WithError(err))
+		return err
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	ttl, err := redis.Int64(conn.Do("PTTL", legacyKey))
+	if err != nil {
+		return err
+	}
+	if fields["SessionId"] == "" || ttl <= 0 {
+		_, err := conn.Do("DEL", legacyKey)
+		return err
+	}
+
+	now := time.Now()
+	info := &SessionInfo{
+		UserId:     userId,
+		ClientId:   fields["ClientId"],
+		SessionId:  fields["SessionId"],
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(time.Duration(ttl) * time.Millisecond),
+	}
+	entry, err := encodeRegistryEntry(info)
+	if err != nil {
+		return err
+	}
+	if _, err := migrateScript.Do(conn, legacyKey, r.getRegistryKey(userId), info.SessionId, entry, ttl); err != nil {
+		Log.Error("Failed to Migrate Legacy User Session Registry", With("userId", userId), WithError(err))
+		return err
+	}
+	return nil
 }
 
-// Find Registry User Session
+// Find the latest Registry User Session
 func (r *redisSessionRegistry) GetUserSession(userId string) (string, string, error) {
-	redisKey := r.getRegistryKey(userId)
-	var sessionRegistry registryObject
-	if err := redisUtil.GetObject(redisKey, &sessionRegistry); err != nil {
+	sessions, err := r.ListUserSessions(userId)
+	if err != nil {
 		Log.Error("Failed to Get User Session Registry", With("userId", userId), WithError(err))
 		return "", "", err
 	}
-	if sessionRegistry.SessionId == "" {
+	if len(sessions) == 0 {
 		Log.Debug("No User Session Registry Found", With("userId", userId))
 		return "", "", nil
 	}
-	return sessionRegistry.SessionId, sessionRegistry.ClientId, nil
+	return sessions[0].SessionId, sessions[0].ClientId, nil
+}
+
+// List all active sessions of the user, the latest first. Expired sessions are removed.
+func (r *redisSessionRegistry) ListUserSessions(userId string) ([]*SessionInfo, error) {
+	if err := r.migrateLegacySession(userId); err != nil {
+		return nil, err
+	}
+	redisKey := r.getRegistryKey(userId)
+	values, err := redisUtil.GetHashStringMap(redisKey)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	sessions := make([]*SessionInfo, 0, len(values))
+	var expired []string
+	for sessionId, value := range values {
+		info := &SessionInfo{}
+		if err := json.Unmarshal([]byte(value), info); err != nil {
+			Log.Warn("Invalid User Session Registry", With("userId", userId), With("sessionId", sessionId), WithError(err))
+			expired = append(expired, sessionId)
+			continue
+		}
+		if !info.ExpiresAt.After(now) {
+			expired = append(expired, sessionId)
+			continue
+		}
+		sessions = append(sessions, info)
+	}
+	if len(expired) > 0 {
+		if err := redisUtil.DeleteHashFields(redisKey, expired...); err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].CreatedAt.After(sessions[j].CreatedAt)
+	})
+	return sessions, nil
+}
+
+// touchScript updates the entry of a session only if it's still registered, so a touch racing a revoke or
+// an eviction can't register the session again, and extends the registry key to the expire time of the entry.
+// KEYS[1] is the registry hash, ARGV are the session id, the entry, and the ttl of the entry in ms.
+var touchScript = redis.NewScript(1, `
+if redis.call("HEXISTS", KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+local ttl = redis.call("PTTL", KEYS[1])
+if ttl ~= -1 and ttl < tonumber(ARGV[3]) then
+	redis.call("PEXPIRE", KEYS[1], ARGV[3])
+end
+return 1
+`)
+
+// Update last seen time of the session and extend its lifetime if lifeTime > 0
+func (r *redisSessionRegistry) TouchUserSession(userId, sessionId string, lifeTime int) error {
+	redisKey := r.getRegistryKey(userId)
+	conn := redisUtil.GetPool().Get()
+	defer conn.Close()
+	value, err := redis.String(conn.Do("HGET", redisKey, sessionId))
+	if err == redis.ErrNil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	info := &SessionInfo{}
+	if err := json.Unmarshal([]byte(value), info); err != nil {
+		Log.Warn("Invalid User Session Registry", With("userId", userId), With("sessionId", sessionId), WithError(err))
+		return nil
+	}
+	now := time.Now()
+	if !info.ExpiresAt.After(now) {
+		return nil
+	}
+	info.LastSeenAt = now
+	if lifeTime > 0 {
+		info.ExpiresAt = now.Add(time.Duration(lifeTime) * time.Second)
+	}
+	entry, err := encodeRegistryEntry(info)
+	if err != nil {
+		return err
+	}
+	if _, err := touchScript.Do(conn, redisKey, sessionId, entry, toMillis(info.ExpiresAt)-toMillis(now)); err != nil {
+		Log.Error("Failed to Touch User Session", With("userId", userId), With("sessionId", sessionId), WithError(err))
+		return err
+	}
+	return nil
+}
+
+// Unregister the session and destroy it
+func (r *redisSessionRegistry) RevokeUserSession(userId, sessionId string) error {
+	if err := redisUtil.DeleteHashFields(r.getRegistryKey(userId), sessionId); err != nil {
+		return err
+	}
+	if err := Provider().SessionDestroy(sessionId); err != nil {
+		Log.Error("Failed to Destroy Revoked Session", With("userId", userId), With("sessionId", sessionId), WithError(err))
+		return err
+	}
+	return nil
+}
+
+// revokeScript unregisters all sessions of the user at once and returns their ids,
+// so a session registered concurrently is either revoked here or kept registered.
+// KEYS[1] is the registry hash and KEYS[2] the legacy key.
+var revokeScript = redis.NewScript(2, `
+local sessionIds = redis.call("HKEYS", KEYS[1])
+local legacy = redis.call("HGET", KEYS[2], "SessionId")
+if legacy then
+	table.insert(sessionIds, legacy)
+end
+redis.call("DEL", KEYS[1], KEYS[2])
+return sessionIds
+`)
+
+// Unregister all sessions of the user and destroy them
+func (r *redisSessionRegistry) RevokeUserSessions(userId string) error {
+	conn := redisUtil.GetPool().Get()
+	sessionIds, err := redis.Strings(revokeScript.Do(conn, r.getRegistryKey(userId), SESSION_REGISTRY_KEY_PREFIX+userId))
+	conn.Close()
+	if err != nil {
+		Log.Error("Failed to Revoke User Sessions", With("userId", userId), WithError(err))
+		return err
+	}
+	for _, sessionId := range sessionIds {
+		if err := Provider().SessionDestroy(sessionId); err != nil {
+			Log.Error("Failed to Destroy Revoked Session", With("userId", userId), With("sessionId", sessionId), WithError(err))
+			return err
+		}
+	}
+	return nil
 }
 
 func (r *redisSessionRegistry) getRegistryKey(userId string) string {
-	return SESSION_REGISTRY_KEY_PREFIX + userId
+	return SESSION_REGISTRY_LIST_KEY_PREFIX + userId
 }
@@ -1,10 +1,12 @@
 package session
 
 import (
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/yiGmMk/pz-infra-new/commonUtil"
+	"github.com/yiGmMk/pz-infra-new/redisUtil"
 	"github.com/yiGmMk/pz-infra-new/tests/base"
 
 	. "github.com/smartystreets/goconvey/convey"
@@ -51,5 +53,113 @@ func TestGetSessionRegistry(t *testing.T) {
 			So(sessionId, ShouldBeEmpty)
 			So(clientId, ShouldBeEmpty)
 		})
+
+		Convey("Multiple User sessions", func() {
+			So(testRegistry.RevokeUserSessions(TEST_USER_ID), ShouldBeNil)
+			first := &SessionInfo{UserId: TEST_USER_ID, ClientId: "phone", SessionId: commonUtil.UUID(), Device: "iPhone", IP: "10.0.0.1"}
+			So(testRegistry.RegisterSession(first, 10), ShouldBeNil)
+			time.Sleep(10 * time.Millisecond)
+			second := &SessionInfo{UserId: TEST_USER_ID, ClientId: "web", SessionId: commonUtil.UUID(), Device: "Chrome", IP: "10.0.0.2"}
+			So(testRegistry.RegisterSession(second, 10), ShouldBeNil)
+
+			sessions, err := testRegistry.ListUserSessions(TEST_USER_ID)
+			So(err, ShouldBeNil)
+			So(len(sessions), ShouldEqual, 2)
+			So(sessions[0].SessionId, ShouldEqual, second.SessionId)
+			So(sessions[1].Device, ShouldEqual, "iPhone")
+
+			sessionId, clientId, err := testRegistry.GetUserSession(TEST_USER_ID)
+			So(err, ShouldBeNil)
+			So(sessionId, ShouldEqual, second.SessionId)
+			So(clientId, ShouldEqual, "web")
+
+			So(testRegistry.RevokeUserSession(TEST_USER_ID, second.SessionId), ShouldBeNil)
+			sessions, err = testRegistry.ListUserSessions(TEST_USER_ID)
+			So(err, ShouldBeNil)
+			So(len(sessions), ShouldEqual, 1)
+			So(sessions[0].SessionId, ShouldEqual, first.SessionId)
+
+			So(testRegistry.RevokeUserSessions(TEST_USER_ID), ShouldBeNil)
+			sessions, err = testRegistry.ListUserSessions(TEST_USER_ID)
+			So(err, ShouldBeNil)
+			So(sessions, ShouldBeEmpty)
+		})
+
+		Convey("Max concurrent User sessions", func() {
+			limited := &redisSessionRegistry{maxSessions: 1}
+			So(limited.RevokeUserSessions(TEST_USER_ID), ShouldBeNil)
+			first := &SessionInfo{UserId: TEST_USER_ID, ClientId: "phone", SessionId: commonUtil.UUID()}
+			So(limited.RegisterSession(first, 10), ShouldBeNil)
+			second := &SessionInfo{UserId: TEST_USER_ID, ClientId: "web", SessionId: commonUtil.UUID()}
+			So(limited.RegisterSession(second, 10), ShouldBeNil)
+
+			sessions, err := limited.ListUserSessions(TEST_USER_ID)
+			So(err, ShouldBeNil)
+			So(len(sessions), ShouldEqual, 1)
+			So(sessions[0].SessionId, ShouldEqual, second.SessionId)
+			So(limited.RevokeUserSessions(TEST_USER_ID), ShouldBeNil)
+		})
+
+		Convey("Concurrent User sessions don't exceed the max", func() {
+			limited := &redisSessionRegistry{maxSessions: 2}
+			So(limited.RevokeUserSessions(TEST_USER_ID), ShouldBeNil)
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					limited.RegisterSession(&SessionInfo{UserId: TEST_USER_ID, SessionId: commonUtil.UUID()}, 10)
+				}()
+			}
+			wg.Wait()
+
+			sessions, err := limited.ListUserSessions(TEST_USER_ID)
+			So(err, ShouldBeNil)
+			So(len(sessions), ShouldEqual, 2)
+			So(limited.RevokeUserSessions(TEST_USER_ID), ShouldBeNil)
+		})
+
+		Convey("Touch doesn't register a revoked User session again", func() {
+			So(testRegistry.RevokeUserSessions(TEST_USER_ID), ShouldBeNil)
+			info := &SessionInfo{UserId: TEST_USER_ID, SessionId: commonUtil.UUID()}
+			So(testRegistry.RegisterSession(info, 10), ShouldBeNil)
+			So(testRegistry.TouchUserSession(TEST_USER_ID, info.SessionId, 20), ShouldBeNil)
+			sessions, err := testRegistry.ListUserSessions(TEST_USER_ID)
+			So(err, ShouldBeNil)
+			So(len(sessions), ShouldEqual, 1)
+			So(sessions[0].ExpiresAt.Sub(sessions[0].LastSeenAt), ShouldEqual, 20*time.Second)
+
+			So(testRegistry.RevokeUserSession(TEST_USER_ID, info.SessionId), ShouldBeNil)
+			So(testRegistry.TouchUserSession(TEST_USER_ID, info.SessionId, 20), ShouldBeNil)
+			sessions, err = testRegistry.ListUserSessions(TEST_USER_ID)
+			So(err, ShouldBeNil)
+			So(sessions, ShouldBeEmpty)
+		})
+
+		Convey("Legacy User session is migrated", func() {
+			So(testRegistry.RevokeUserSessions(TEST_USER_ID), ShouldBeNil)
+			legacySessionId := commonUtil.UUID()
+			So(redisUtil.SetObjectWithExpire(SESSION_REGISTRY_KEY_PREFIX+TEST_USER_ID, &struct {
+				UserId    string
+				ClientId  string
+				SessionId string
+			}{TEST_USER_ID, TEST_CLIENT_ID, legacySessionId}, 10), ShouldBeNil)
+
+			sessions, err := testRegistry.ListUserSessions(TEST_USER_ID)
+			So(err, ShouldBeNil)
+			So(len(sessions), ShouldEqual, 1)
+			So(sessions[0].SessionId, ShouldEqual, legacySessionId)
+			So(sessions[0].ClientId, ShouldEqual, TEST_CLIENT_ID)
+			So(redisUtil.Exists(SESSION_REGISTRY_KEY_PREFIX+TEST_USER_ID), ShouldBeFalse)
+
+			limited := &redisSessionRegistry{maxSessions: 1}
+			newSessionId := commonUtil.UUID()
+			So(limited.RegisterSession(&SessionInfo{UserId: TEST_USER_ID, SessionId: newSessionId}, 10), ShouldBeNil)
+			sessions, err = limited.ListUserSessions(TEST_USER_ID)
+			So(err, ShouldBeNil)
+			So(len(sessions), ShouldEqual, 1)
+			So(sessions[0].SessionId, ShouldEqual, newSessionId)
+			So(testRegistry.RevokeUserSessions(TEST_USER_ID), ShouldBeNil)
+		})
 	})
 }
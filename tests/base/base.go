@@ -2,7 +2,6 @@ package base
 
 import (
 	"io/ioutil"
-	"strings"
 
 	"github.com/yiGmMk/pz-infra-new/confUtil"
 	"github.com/yiGmMk/pz-infra-new/database"
@@ -30,7 +29,9 @@ func InitConfigFile(configFileName string) {
 	//dbString := "root:b553e6e21a8ff@tcp(localhost:3306)/pz_base?charset=utf8mb4&parseTime=True"
 	dbString := beego.AppConfig.String("db")
 	log.Debug("DB String is %s", dbString)
-	database.InitDB(dbString, nil)
+	if err := database.InitDB(dbString, nil); err != nil {
+		panic(err)
+	}
 	if Log == nil {
 		InitLogger("testing")
 	}
@@ -47,10 +48,8 @@ func InitDBWithFile(sqlFile string, dbs ...*gorm.DB) {
 	bytes, _ := ioutil.ReadFile(sqlFile)
 
 	db := database.GetNonTransactionDatabases(dbs)
-	sqls := strings.Split(string(bytes), ";")
-	for _, sql := range sqls {
-		err := db.Exec(sql).Error
-		if err != nil && !(strings.Contains(string(err.Error()), "Query was empty")) {
+	for _, sql := range database.SplitSQLStatements(string(bytes)) {
+		if err := db.Exec(sql).Error; err != nil {
 			Log.Error("execute setup sql failed. error is:", WithError(err))
 			panic(err)
 		}
@@ -0,0 +1,121 @@
+package base
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/yiGmMk/pz-infra-new/database"
+	. "github.com/yiGmMk/pz-infra-new/logging"
+
+	"gopkg.in/yaml.v2"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+var (
+	errRollback = errors.New("rollback test transaction")
+	sqliteSeq   int64
+)
+
+// InitSQLiteDB opens an in-memory sqlite database and registers it by name, DEFAULT_DB_NAME if empty,
+// so tests can run without a MySQL server. The database lives as long as the returned DB is not closed.
+// SQL specific to MySQL is not supported by sqlite, keep the tests on it portable.
+func InitSQLiteDB(name string, plugins ...gorm.Plugin) (*gorm.DB, error) {
+	if name == "" {
+		name = database.DEFAULT_DB_NAME
+	}
+	if Log == nil {
+		// the logs go to stderr only, InitLogger would write log files into the directory of the tests
+		if _, err := InitLoggerWithConfig(&LoggingConfig{Component: "testing", Outputs: []OutputConfig{{Type: LOG_OUTPUT_STDERR}}}); err != nil {
+			return nil, err
+		}
+	}
+	// each database has its own memory, shared by the connections of the pool
+	dsn := fmt.Sprintf("file:%s_%d?mode=memory&cache=shared", name, atomic.AddInt64(&sqliteSeq, 1))
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{})
+	if err != nil {
+		Log.Error("Failed to open sqlite db", With("db", name), WithError(err))
+		return nil, err
+	}
+	for _, plugin := range plugins {
+		if err := db.Use(plugin); err != nil {
+			return nil, err
+		}
+	}
+	database.SetNamedDB(name, db)
+	return db, nil
+}
+
+// RunInRollbackTx runs fn in a transaction of the database of name, which is always rolled back,
+// so the data of a test does not leak to the others. Code under test must use the ctx passed to fn,
+// e.g. by database.WithTx or database.GetDBFromContext, to join the transaction, and its
+// database.AfterCommit hooks are dropped. The error of fn is returned.
+func RunInRollbackTx(ctx context.Context, fn database.TxFunc, name ...string) error {
+	option := &database.TxOption{}
+	if len(name) > 0 {
+		option.DBName = name[0]
+	}
+	err := database.WithTx(ctx, func(ctx context.Context, tx *gorm.DB) error {
+		if err := fn(ctx, tx); err != nil {
+			return err
+		}
+		return errRollback
+	}, option)
+	if err == errRollback {
+		return nil
+	}
+	return err
+}
+
+// Fixture is a file of rows of a model, a YAML or JSON list of objects keyed by field or column names,
+// e.g. [{"id": 1, "name": "tom"}]
+type Fixture struct {
+	Model interface{} // pointer to the model, e.g. &User{}
+	File  string      // .yml, .yaml or .json
+}
+
+// LoadFixtures inserts the rows of fixtures in order. Hooks of the models are not called.
+func LoadFixtures(db *gorm.DB, fixtures ...Fixture) error {
+	for _, fixture := range fixtures {
+		rows, err := readFixture(fixture.File)
+		if err != nil {
+			Log.Error("Failed to read fixture", With("file", fixture.File), WithError(err))
+			return err
+		}
+		if len(rows) == 0 {
+			continue
+		}
+		if err := db.Model(fixture.Model).Create(&rows).Error; err != nil {
+			Log.Error("Failed to load fixture", With("file", fixture.File), WithError(err))
+			return err
+		}
+	}
+	return nil
+}
+
+func readFixture(file string) ([]map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var rows []map[string]interface{}
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yml", ".yaml":
+		err = yaml.Unmarshal(data, &rows)
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		// keep large ids exact
+		decoder.UseNumber()
+		err = decoder.Decode(&rows)
+	default:
+		err = fmt.Errorf("unsupported fixture file %s", file)
+	}
+	return rows, err
+}
@@ -0,0 +1,75 @@
+package base
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/yiGmMk/pz-infra-new/database"
+	"github.com/yiGmMk/pz-infra-new/logging"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"gorm.io/gorm"
+)
+
+type harnessUser struct {
+	ID   int64
+	Name string
+}
+
+type harnessOrder struct {
+	ID     int64
+	UserID int64
+	Amount int
+}
+
+func TestHarness(t *testing.T) {
+	logger, err := (&logging.LogrusProvider{}).New(&logging.LogrusOption{Out: ioutil.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logging.Log = logger
+
+	db, err := InitSQLiteDB("harness")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&harnessUser{}, &harnessOrder{}); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	Convey("test fixtures are loaded", t, func() {
+		So(LoadFixtures(db, Fixture{&harnessUser{}, "testdata/users.yml"}, Fixture{&harnessOrder{}, "testdata/orders.json"}), ShouldBeNil)
+		var users []harnessUser
+		So(db.Order("id").Find(&users).Error, ShouldBeNil)
+		So(users, ShouldResemble, []harnessUser{{1, "tom"}, {2, "jerry"}})
+		var order harnessOrder
+		So(db.Take(&order).Error, ShouldBeNil)
+		So(order.ID, ShouldEqual, int64(9007199254740993))
+
+		So(LoadFixtures(db, Fixture{&harnessUser{}, "testdata/users.txt"}), ShouldNotBeNil)
+	})
+
+	Convey("test changes are rolled back", t, func() {
+		So(RunInRollbackTx(ctx, func(ctx context.Context, tx *gorm.DB) error {
+			if err := tx.Create(&harnessUser{ID: 3, Name: "spike"}).Error; err != nil {
+				return err
+			}
+			// nested transactions of the code under test join it
+			return database.WithTx(ctx, func(ctx context.Context, tx *gorm.DB) error {
+				return tx.Where("id = ?", 1).Delete(&harnessUser{}).Error
+			}, &database.TxOption{DBName: "harness"})
+		}, "harness"), ShouldBeNil)
+
+		var count int64
+		So(db.Model(&harnessUser{}).Count(&count).Error, ShouldBeNil)
+		So(count, ShouldEqual, 2)
+
+		err := errors.New("failed")
+		So(RunInRollbackTx(ctx, func(ctx context.Context, tx *gorm.DB) error {
+			return err
+		}, "harness"), ShouldEqual, err)
+	})
+}
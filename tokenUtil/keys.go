@@ -0,0 +1,281 @@
+package tokenUtil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+
+	"github.com/yiGmMk/pz-infra-new/commonUtil"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// supported signing algorithms
+const (
+	ALG_RS256 = "RS256"
+	ALG_ES256 = "ES256"
+	ALG_HS256 = "HS256"
+)
+
+var (
+	errNoSigningKey = errors.New("tokenUtil: no signing key")
+	errKeyNotFound  = errors.New("tokenUtil: key not found")
+)
+
+// Key is a key to sign or verify tokens, identified by its key id
+type Key struct {
+	ID        string
+	Algorithm string
+	signKey   interface{} // nil if the key can only verify tokens
+	verifyKey interface{}
+}
+
+// NewRSAKey returns a RS256 key to sign and verify tokens
+func NewRSAKey(kid string, key *rsa.PrivateKey) *Key {
+	return &Key{ID: kid, Algorithm: ALG_RS256, signKey: key, verifyKey: &key.PublicKey}
+}
+
+// NewECKey returns a ES256 key to sign and verify tokens, the curve must be P-256
+func NewECKey(kid string, key *ecdsa.PrivateKey) *Key {
+	return &Key{ID: kid, Algorithm: ALG_ES256, signKey: key, verifyKey: &key.PublicKey}
+}
+
+// NewHMACKey returns a HS256 key to sign and verify tokens
+func NewHMACKey(kid string, secret []byte) *Key {
+	return &Key{ID: kid, Algorithm: ALG_HS256, signKey: secret, verifyKey: secret}
+}
+
+// NewRSAVerifyKey returns a RS256 key which can only verify tokens
+func NewRSAVerifyKey(kid string, key *rsa.PublicKey) *Key {
+	return &Key{ID: kid, Algorithm: ALG_RS256, verifyKey: key}
+}
+
+// NewECVerifyKey returns a ES256 key which can only verify tokens
+func NewECVerifyKey(kid string, key *ecdsa.PublicKey) *Key {
+	return &Key{ID: kid, Algorithm: ALG_ES256, verifyKey: key}
+}
+
+// LoadRSAKeyFromDisk loads a RS256 key from a PEM encoded private key file, panics on failure
+func LoadRSAKeyFromDisk(kid, location string) *Key {
+	return NewRSAKey(kid, commonUtil.LoadRSAPrivateKeyFromDisk(location))
+}
+
+// LoadRSAVerifyKeyFromDisk loads a RS256 key from a PEM encoded public key file, panics on failure
+func LoadRSAVerifyKeyFromDisk(kid, location string) *Key {
+	return NewRSAVerifyKey(kid, commonUtil.LoadRSAPublicKeyFromDisk(location))
+}
+
+func (k *Key) signingMethod() jwt.SigningMethod {
+	return jwt.GetSigningMethod(k.Algorithm)
+}
+
+// KeySet holds the keys to verify tokens and the key to sign new tokens.
+// To rotate keys, add the new key, make it the signing key,
+// and remove the old key after all tokens signed by it expired.
+type KeySet struct {
+	lock       sync.RWMutex
+	keys       map[string]*Key
+	signingKid string
+}
+
+func NewKeySet(keys ...*Key) (*KeySet, error) {
+	ks := &KeySet{keys: make(map[string]*Key)}
+	for _, key := range keys {
+		if err := ks.AddKey(key); err != nil {
+			return nil, err
+		}
+	}
+	return ks, nil
+}
+
+// AddKey adds a key to the set, the first key able to sign becomes the signing key
+func (ks *KeySet) AddKey(key *Key) error {
+	if key.ID == "" {
+		return errors.New("tokenUtil: key id is empty")
+	}
+	if key.signingMethod() == nil {
+		return fmt.Errorf("tokenUtil: unsupported algorithm %s", key.Algorithm)
+	}
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+	ks.keys[key.ID] = key
+	if ks.signingKid == "" && key.signKey != nil {
+		ks.signingKid = key.ID
+	}
+	return nil
+}
+
+// SetSigningKey makes the key of kid sign new tokens
+func (ks *KeySet) SetSigningKey(kid string) error {
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+	key, ok := ks.keys[kid]
+	if !ok {
+		return errKeyNotFound
+	}
+	if key.signKey == nil {
+		return fmt.Errorf("tokenUtil: key %s can not sign tokens", kid)
+	}
+	ks.signingKid = kid
+	return nil
+}
+
+// RemoveKey removes the key of kid, tokens signed by it can not be verified any more
+func (ks *KeySet) RemoveKey(kid string) {
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+	delete(ks.keys, kid)
+	if ks.signingKid == kid {
+		ks.signingKid = ""
+	}
+}
+
+func (ks *KeySet) signingKey() (*Key, error) {
+	ks.lock.RLock()
+	defer ks.lock.RUnlock()
+	key, ok := ks.keys[ks.signingKid]
+	if !ok {
+		return nil, errNoSigningKey
+	}
+	return key, nil
+}
+
+// keyFunc finds the key by the kid header of the token, the algorithm must match the key
+func (ks *KeySet) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	ks.lock.RLock()
+	key, ok := ks.keys[kid]
+	ks.lock.RUnlock()
+	if !ok {
+		return nil, errKeyNotFound
+	}
+	if token.Method.Alg() != key.Algorithm {
+		return nil, fmt.Errorf("tokenUtil: unexpected algorithm %s", token.Method.Alg())
+	}
+	return key.verifyKey, nil
+}
+
+// JWK is a public key in JSON Web Key format
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKS is a JSON Web Key Set
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public keys of the set to publish for verifiers, HMAC keys are never published
+func (ks *KeySet) JWKS() *JWKS {
+	ks.lock.RLock()
+	defer ks.lock.RUnlock()
+	jwks := &JWKS{Keys: []JWK{}}
+	for _, key := range ks.keys {
+		switch pub := key.verifyKey.(type) {
+		case *rsa.PublicKey:
+			jwks.Keys = append(jwks.Keys, JWK{
+				Kty: "RSA",
+				Kid: key.ID,
+				Use: "sig",
+				Alg: key.Algorithm,
+				N:   encodeBase64(pub.N.Bytes()),
+				E:   encodeBase64(big.NewInt(int64(pub.E)).Bytes()),
+			})
+		case *ecdsa.PublicKey:
+			size := (pub.Curve.Params().BitSize + 7) / 8
+			jwks.Keys = append(jwks.Keys, JWK{
+				Kty: "EC",
+				Kid: key.ID,
+				Use: "sig",
+				Alg: key.Algorithm,
+				Crv: pub.Curve.Params().Name,
+				X:   encodeBase64(padBytes(pub.X.Bytes(), size)),
+				Y:   encodeBase64(padBytes(pub.Y.Bytes(), size)),
+			})
+		}
+	}
+	return jwks
+}
+
+// AddJWKS adds the keys of a JSON Web Key Set to verify tokens, unsupported keys are skipped
+func (ks *KeySet) AddJWKS(data []byte) error {
+	jwks := &JWKS{}
+	if err := json.Unmarshal(data, jwks); err != nil {
+		return err
+	}
+	for _, jwk := range jwks.Keys {
+		key, err := jwk.verifyKey()
+		if err != nil {
+			return err
+		}
+		if key == nil {
+			continue
+		}
+		if err := ks.AddKey(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (jwk *JWK) verifyKey() (*Key, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBase64(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBase64(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		return NewRSAVerifyKey(jwk.Kid, pub), nil
+	case "EC":
+		if jwk.Crv != elliptic.P256().Params().Name {
+			return nil, nil
+		}
+		x, err := decodeBase64(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBase64(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		return NewECVerifyKey(jwk.Kid, pub), nil
+	}
+	return nil, nil
+}
+
+func encodeBase64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeBase64(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(s)
+}
+
+func padBytes(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+	padded := make([]byte, size)
+	copy(padded[size-len(b):], b)
+	return padded
+}
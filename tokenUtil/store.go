@@ -0,0 +1,87 @@
+package tokenUtil
+
+import (
+	"time"
+
+	. "github.com/yiGmMk/pz-infra-new/logging"
+	"github.com/yiGmMk/pz-infra-new/redisUtil"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	// key of a revoked token id
+	TOKEN_REVOKED_KEY_PREFIX = "TOKEN_REVOKED_"
+	// key of the current refresh token id of a token family
+	TOKEN_FAMILY_KEY_PREFIX = "TOKEN_FAMILY_"
+)
+
+// RotateResult is the result of TokenStore.RotateRefreshToken
+type RotateResult int
+
+const (
+	ROTATE_OK        RotateResult = 1  // the refresh token is replaced
+	ROTATE_REUSED    RotateResult = 0  // the refresh token is not the current one of the family
+	ROTATE_NOT_FOUND RotateResult = -1 // the family is revoked or expired
+)
+
+// TokenStore keeps the revocation list and the current refresh token of each token family
+type TokenStore interface {
+	// Revoke adds the token id to the revocation list for ttl
+	Revoke(jti string, ttl time.Duration) error
+	IsRevoked(jti string) (bool, error)
+	// SaveRefreshToken sets jti as the current refresh token of the family
+	SaveRefreshToken(family, jti string, ttl time.Duration) error
+	// RotateRefreshToken replaces the current refresh token of the family from jti to newJti atomically,
+	// returns ROTATE_REUSED if jti is not the current one, ROTATE_NOT_FOUND if the family is revoked or expired
+	RotateRefreshToken(family, jti, newJti string, ttl time.Duration) (RotateResult, error)
+	// RevokeFamily invalidates all refresh tokens of the family
+	RevokeFamily(family string) error
+}
+
+var rotateScript = redis.NewScript(1, `
+local current = redis.call("GET", KEYS[1])
+if not current then
+	return -1
+end
+if current ~= ARGV[1] then
+	return 0
+end
+redis.call("SET", KEYS[1], ARGV[2], "PX", ARGV[3])
+return 1
+`)
+
+type redisTokenStore struct{}
+
+func (s *redisTokenStore) Revoke(jti string, ttl time.Duration) error {
+	seconds := int(ttl / time.Second)
+	if seconds <= 0 {
+		return nil
+	}
+	return redisUtil.SetStringWithExpire(TOKEN_REVOKED_KEY_PREFIX+jti, "1", seconds)
+}
+
+func (s *redisTokenStore) IsRevoked(jti string) (bool, error) {
+	conn := redisUtil.GetPool().Get()
+	defer conn.Close()
+	return redis.Bool(conn.Do("EXISTS", TOKEN_REVOKED_KEY_PREFIX+jti))
+}
+
+func (s *redisTokenStore) SaveRefreshToken(family, jti string, ttl time.Duration) error {
+	return redisUtil.SetStringWithExpire(TOKEN_FAMILY_KEY_PREFIX+family, jti, int(ttl/time.Second))
+}
+
+func (s *redisTokenStore) RotateRefreshToken(family, jti, newJti string, ttl time.Duration) (RotateResult, error) {
+	conn := redisUtil.GetPool().Get()
+	defer conn.Close()
+	result, err := redis.Int(rotateScript.Do(conn, TOKEN_FAMILY_KEY_PREFIX+family, jti, newJti, int64(ttl/time.Millisecond)))
+	if err != nil {
+		Log.Error("Failed to rotate refresh token", With("family", family), WithError(err))
+		return ROTATE_NOT_FOUND, err
+	}
+	return RotateResult(result), nil
+}
+
+func (s *redisTokenStore) RevokeFamily(family string) error {
+	return redisUtil.Delete(TOKEN_FAMILY_KEY_PREFIX + family)
+}
@@ -0,0 +1,255 @@
+package tokenUtil
+
+import (
+	"time"
+
+	. "github.com/yiGmMk/pz-infra-new/errorUtil"
+	. "github.com/yiGmMk/pz-infra-new/logging"
+	"github.com/yiGmMk/pz-infra-new/uuidUtil"
+
+	"github.com/astaxie/beego"
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	TOKEN_TYPE_ACCESS  = "access"
+	TOKEN_TYPE_REFRESH = "refresh"
+
+	DEFAULT_ACCESS_TOKEN_TTL  = 15 * time.Minute
+	DEFAULT_REFRESH_TOKEN_TTL = 30 * 24 * time.Hour
+)
+
+var (
+	ErrAccessTokenTimeout  = NewHErrorCustom(ERROR_CODE_ACCESS_TOKEN_TIMEOUT)
+	ErrAccessTokenInvalid  = NewHErrorCustom(ERROR_CODE_ACCESS_TOKEN_ERROR)
+	ErrAccessTokenRevoked  = NewHErrorCustom(ERROR_CODE_ACCESS_TOKEN_REVOKED)
+	ErrRefreshTokenInvalid = NewHErrorCustom(ERROR_CODE_REFRESH_TOKEN_ERROR)
+	ErrRefreshTokenReused  = NewHErrorCustom(ERROR_CODE_REFRESH_TOKEN_REUSED)
+)
+
+// TokenConfig is used to set the claims and lifetime of issued tokens
+type TokenConfig struct {
+	Issuer          string        // iss of issued tokens, verified if not empty
+	Audience        string        // aud of issued tokens, verified if not empty
+	AccessTokenTTL  time.Duration // DEFAULT_ACCESS_TOKEN_TTL if 0
+	RefreshTokenTTL time.Duration // DEFAULT_REFRESH_TOKEN_TTL if 0
+}
+
+// getTokenConfig reads TokenConfig from app config, the ttl is in seconds
+func getTokenConfig() *TokenConfig {
+	return &TokenConfig{
+		Issuer:          beego.AppConfig.String("tokenIssuer"),
+		Audience:        beego.AppConfig.String("tokenAudience"),
+		AccessTokenTTL:  time.Duration(beego.AppConfig.DefaultInt("accessTokenTTL", 0)) * time.Second,
+		RefreshTokenTTL: time.Duration(beego.AppConfig.DefaultInt("refreshTokenTTL", 0)) * time.Second,
+	}
+}
+
+// Claims of access and refresh tokens, numbers in Extra are decoded as float64
+type Claims struct {
+	jwt.StandardClaims
+	TokenType string                 `json:"typ"`
+	Family    string                 `json:"fam,omitempty"` // refresh tokens rotated from the same login share the family
+	Scope     string                 `json:"scope,omitempty"`
+	Extra     map[string]interface{} `json:"ext,omitempty"`
+}
+
+// TokenPair is returned on login and refresh
+type TokenPair struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"` // seconds the access token expires in
+}
+
+// TokenService issues and verifies tokens signed by the keys of a KeySet
+type TokenService struct {
+	config *TokenConfig
+	keys   *KeySet
+	store  TokenStore
+}
+
+// NewTokenService returns a TokenService, config is read from app config if nil,
+// and the revocation list is stored in redis if store is nil.
+func NewTokenService(config *TokenConfig, keys *KeySet, store TokenStore) *TokenService {
+	if config == nil {
+		config = getTokenConfig()
+	}
+	conf := *config
+	if conf.AccessTokenTTL <= 0 {
+		conf.AccessTokenTTL = DEFAULT_ACCESS_TOKEN_TTL
+	}
+	if conf.RefreshTokenTTL <= 0 {
+		conf.RefreshTokenTTL = DEFAULT_REFRESH_TOKEN_TTL
+	}
+	if store == nil {
+		store = &redisTokenStore{}
+	}
+	return &TokenService{config: &conf, keys: keys, store: store}
+}
+
+// IssueTokenPair issues an access token and a refresh token of a new token family for the subject
+func (s *TokenService) IssueTokenPair(subject, scope string, extra map[string]interface{}) (*TokenPair, error) {
+	family := uuidUtil.GetUUID()
+	refreshId := uuidUtil.GetUUID()
+	pair, err := s.issue(subject, scope, extra, family, refreshId)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.store.SaveRefreshToken(family, refreshId, s.config.RefreshTokenTTL); err != nil {
+		Log.Error("Failed to save refresh token", With("subject", subject), WithError(err))
+		return nil, err
+	}
+	return pair, nil
+}
+
+func (s *TokenService) issue(subject, scope string, extra map[string]interface{}, family, refreshId string) (*TokenPair, error) {
+	now := time.Now()
+	access, err := s.sign(s.newClaims(TOKEN_TYPE_ACCESS, subject, scope, extra, uuidUtil.GetUUID(), "", now, s.config.AccessTokenTTL))
+	if err != nil {
+		return nil, err
+	}
+	refresh, err := s.sign(s.newClaims(TOKEN_TYPE_REFRESH, subject, scope, extra, refreshId, family, now, s.config.RefreshTokenTTL))
+	if err != nil {
+		return nil, err
+	}
+	return &TokenPair{
+		AccessToken:  access,
+		RefreshToken: refresh,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(s.config.AccessTokenTTL / time.Second),
+	}, nil
+}
+
+func (s *TokenService) newClaims(tokenType, subject, scope string, extra map[string]interface{}, jti, family string, now time.Time, ttl time.Duration) *Claims {
+	return &Claims{
+		StandardClaims: jwt.StandardClaims{
+			Id:        jti,
+			Subject:   subject,
+			Issuer:    s.config.Issuer,
+			Audience:  s.config.Audience,
+			IssuedAt:  now.Unix(),
+			NotBefore: now.Unix(),
+			ExpiresAt: now.Add(ttl).Unix(),
+		},
+		TokenType: tokenType,
+		Family:    family,
+		Scope:     scope,
+		Extra:     extra,
+	}
+}
+
+func (s *TokenService) sign(claims *Claims) (string, error) {
+	key, err := s.keys.signingKey()
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(key.signingMethod(), claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.signKey)
+}
+
+// parseClaims verifies the signature and lifetime of the token
+func (s *TokenService) parseClaims(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	parser := &jwt.Parser{ValidMethods: []string{ALG_RS256, ALG_ES256, ALG_HS256}}
+	if _, err := parser.ParseWithClaims(tokenString, claims, s.keys.keyFunc); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// isExpired checks if the only problem of the token is it's expired
+func isExpired(err error) bool {
+	ve, ok := err.(*jwt.ValidationError)
+	return ok && ve.Errors == jwt.ValidationErrorExpired
+}
+
+// parse verifies the signature, lifetime, issuer, audience and type of the token,
+// the returned bool is true if the token is valid but expired
+func (s *TokenService) parse(tokenString, tokenType string) (*Claims, bool, error) {
+	claims, err := s.parseClaims(tokenString)
+	if err != nil {
+		return nil, isExpired(err), err
+	}
+	if claims.TokenType != tokenType {
+		return nil, false, jwt.NewValidationError("unexpected token type", jwt.ValidationErrorClaimsInvalid)
+	}
+	if s.config.Issuer != "" && !claims.VerifyIssuer(s.config.Issuer, true) {
+		return nil, false, jwt.NewValidationError("unexpected issuer", jwt.ValidationErrorIssuer)
+	}
+	if s.config.Audience != "" && !claims.VerifyAudience(s.config.Audience, true) {
+		return nil, false, jwt.NewValidationError("unexpected audience", jwt.ValidationErrorAudience)
+	}
+	return claims, false, nil
+}
+
+// VerifyAccessToken returns the claims of a valid access token, or
+// ErrAccessTokenTimeout if expired, ErrAccessTokenRevoked if revoked, ErrAccessTokenInvalid otherwise
+func (s *TokenService) VerifyAccessToken(tokenString string) (*Claims, error) {
+	claims, expired, err := s.parse(tokenString, TOKEN_TYPE_ACCESS)
+	if expired {
+		return nil, ErrAccessTokenTimeout
+	}
+	if err != nil {
+		Log.Debug("Invalid access token", WithError(err))
+		return nil, ErrAccessTokenInvalid
+	}
+	revoked, err := s.store.IsRevoked(claims.Id)
+	if err != nil {
+		Log.Error("Failed to check token revocation", With("jti", claims.Id), WithError(err))
+		return nil, err
+	}
+	if revoked {
+		return nil, ErrAccessTokenRevoked
+	}
+	return claims, nil
+}
+
+// Refresh issues a new token pair for a refresh token and invalidates the refresh token.
+// If a refresh token is used twice, it may be stolen, so the whole token family is revoked
+// and ErrRefreshTokenReused is returned.
+func (s *TokenService) Refresh(refreshToken string) (*TokenPair, error) {
+	claims, _, err := s.parse(refreshToken, TOKEN_TYPE_REFRESH)
+	if err != nil {
+		Log.Debug("Invalid refresh token", WithError(err))
+		return nil, ErrRefreshTokenInvalid
+	}
+
+	refreshId := uuidUtil.GetUUID()
+	pair, err := s.issue(claims.Subject, claims.Scope, claims.Extra, claims.Family, refreshId)
+	if err != nil {
+		return nil, err
+	}
+	result, err := s.store.RotateRefreshToken(claims.Family, claims.Id, refreshId, s.config.RefreshTokenTTL)
+	if err != nil {
+		return nil, err
+	}
+	switch result {
+	case ROTATE_OK:
+		return pair, nil
+	case ROTATE_REUSED:
+		Log.Warn("Refresh token reused, revoke the token family", With("subject", claims.Subject), With("family", claims.Family))
+		if err := s.store.RevokeFamily(claims.Family); err != nil {
+			return nil, err
+		}
+		return nil, ErrRefreshTokenReused
+	default:
+		return nil, ErrRefreshTokenInvalid
+	}
+}
+
+// Revoke invalidates an access token until it expires, or the token family of a refresh token
+func (s *TokenService) Revoke(tokenString string) error {
+	claims, err := s.parseClaims(tokenString)
+	if err != nil {
+		if isExpired(err) {
+			return nil
+		}
+		return ErrAccessTokenInvalid
+	}
+	if claims.TokenType == TOKEN_TYPE_REFRESH {
+		return s.store.RevokeFamily(claims.Family)
+	}
+	return s.store.Revoke(claims.Id, time.Until(time.Unix(claims.ExpiresAt, 0)))
+}
@@ -0,0 +1,182 @@
+package tokenUtil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yiGmMk/pz-infra-new/logging"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// memoryTokenStore keeps tokens in memory for tests without redis
+type memoryTokenStore struct {
+	lock     sync.Mutex
+	revoked  map[string]bool
+	families map[string]string
+}
+
+func newMemoryTokenStore() *memoryTokenStore {
+	return &memoryTokenStore{revoked: make(map[string]bool), families: make(map[string]string)}
+}
+
+func (s *memoryTokenStore) Revoke(jti string, ttl time.Duration) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.revoked[jti] = true
+	return nil
+}
+
+func (s *memoryTokenStore) IsRevoked(jti string) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.revoked[jti], nil
+}
+
+func (s *memoryTokenStore) SaveRefreshToken(family, jti string, ttl time.Duration) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.families[family] = jti
+	return nil
+}
+
+func (s *memoryTokenStore) RotateRefreshToken(family, jti, newJti string, ttl time.Duration) (RotateResult, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	current, ok := s.families[family]
+	if !ok {
+		return ROTATE_NOT_FOUND, nil
+	}
+	if current != jti {
+		return ROTATE_REUSED, nil
+	}
+	s.families[family] = newJti
+	return ROTATE_OK, nil
+}
+
+func (s *memoryTokenStore) RevokeFamily(family string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.families, family)
+	return nil
+}
+
+func initTestLogger() {
+	logger, err := (&logging.LogrusProvider{}).New(&logging.LogrusOption{Out: ioutil.Discard})
+	if err != nil {
+		panic(err)
+	}
+	logging.Log = logger
+}
+
+func TestTokenService(t *testing.T) {
+	initTestLogger()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &TokenConfig{Issuer: "infra", Audience: "app"}
+
+	for _, key := range []*Key{NewRSAKey("rsa", rsaKey), NewECKey("ec", ecKey), NewHMACKey("hmac", []byte("secret"))} {
+		Convey("test issue and verify "+key.Algorithm, t, func() {
+			keys, err := NewKeySet(key)
+			So(err, ShouldBeNil)
+			service := NewTokenService(config, keys, newMemoryTokenStore())
+
+			pair, err := service.IssueTokenPair("u1", "read", map[string]interface{}{"role": "admin"})
+			So(err, ShouldBeNil)
+			claims, err := service.VerifyAccessToken(pair.AccessToken)
+			So(err, ShouldBeNil)
+			So(claims.Subject, ShouldEqual, "u1")
+			So(claims.Scope, ShouldEqual, "read")
+			So(claims.Extra["role"], ShouldEqual, "admin")
+
+			_, err = service.VerifyAccessToken(pair.RefreshToken)
+			So(err, ShouldEqual, ErrAccessTokenInvalid)
+
+			other := NewTokenService(&TokenConfig{Issuer: "other"}, keys, newMemoryTokenStore())
+			_, err = other.VerifyAccessToken(pair.AccessToken)
+			So(err, ShouldEqual, ErrAccessTokenInvalid)
+		})
+	}
+
+	Convey("test expired token", t, func() {
+		keys, _ := NewKeySet(NewHMACKey("hmac", []byte("secret")))
+		service := NewTokenService(config, keys, newMemoryTokenStore())
+		claims := service.newClaims(TOKEN_TYPE_ACCESS, "u1", "", nil, "jti", "", time.Now().Add(-time.Hour), time.Minute)
+		token, err := service.sign(claims)
+		So(err, ShouldBeNil)
+		_, err = service.VerifyAccessToken(token)
+		So(err, ShouldEqual, ErrAccessTokenTimeout)
+	})
+
+	Convey("test key rotation with jwks", t, func() {
+		keys, _ := NewKeySet(NewRSAKey("old", rsaKey), NewHMACKey("hmac", []byte("secret")))
+		issuer := NewTokenService(config, keys, newMemoryTokenStore())
+		oldPair, err := issuer.IssueTokenPair("u1", "", nil)
+		So(err, ShouldBeNil)
+
+		So(keys.AddKey(NewECKey("new", ecKey)), ShouldBeNil)
+		So(keys.SetSigningKey("new"), ShouldBeNil)
+		newPair, err := issuer.IssueTokenPair("u1", "", nil)
+		So(err, ShouldBeNil)
+
+		data, err := json.Marshal(keys.JWKS())
+		So(err, ShouldBeNil)
+		So(string(data), ShouldNotContainSubstring, "hmac")
+		verifyKeys, _ := NewKeySet()
+		So(verifyKeys.AddJWKS(data), ShouldBeNil)
+		verifier := NewTokenService(config, verifyKeys, newMemoryTokenStore())
+		_, err = verifier.VerifyAccessToken(oldPair.AccessToken)
+		So(err, ShouldBeNil)
+		_, err = verifier.VerifyAccessToken(newPair.AccessToken)
+		So(err, ShouldBeNil)
+		_, err = verifier.IssueTokenPair("u1", "", nil)
+		So(err, ShouldEqual, errNoSigningKey)
+
+		verifyKeys.RemoveKey("old")
+		_, err = verifier.VerifyAccessToken(oldPair.AccessToken)
+		So(err, ShouldEqual, ErrAccessTokenInvalid)
+	})
+
+	Convey("test refresh token rotation", t, func() {
+		keys, _ := NewKeySet(NewHMACKey("hmac", []byte("secret")))
+		service := NewTokenService(config, keys, newMemoryTokenStore())
+		pair, err := service.IssueTokenPair("u1", "read", nil)
+		So(err, ShouldBeNil)
+
+		refreshed, err := service.Refresh(pair.RefreshToken)
+		So(err, ShouldBeNil)
+		claims, err := service.VerifyAccessToken(refreshed.AccessToken)
+		So(err, ShouldBeNil)
+		So(claims.Scope, ShouldEqual, "read")
+
+		Convey("reuse revokes the token family", func() {
+			_, err := service.Refresh(pair.RefreshToken)
+			So(err, ShouldEqual, ErrRefreshTokenReused)
+			_, err = service.Refresh(refreshed.RefreshToken)
+			So(err, ShouldEqual, ErrRefreshTokenInvalid)
+		})
+
+		Convey("revoke tokens", func() {
+			So(service.Revoke(refreshed.AccessToken), ShouldBeNil)
+			_, err := service.VerifyAccessToken(refreshed.AccessToken)
+			So(err, ShouldEqual, ErrAccessTokenRevoked)
+
+			So(service.Revoke(refreshed.RefreshToken), ShouldBeNil)
+			_, err = service.Refresh(refreshed.RefreshToken)
+			So(err, ShouldEqual, ErrRefreshTokenInvalid)
+		})
+	})
+}